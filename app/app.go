@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/hcl/v2"
 
 	"github.com/rboyer/devconsul/app/runner"
 	"github.com/rboyer/devconsul/cachestore"
@@ -24,9 +25,11 @@ const (
 type Core = App
 
 type App struct {
-	logger  hclog.Logger
-	rootDir string
-	timeout time.Duration // check-mesh
+	logger     hclog.Logger
+	rootDir    string
+	configFile string        // relative to rootDir
+	projectDir string        // holds the Dockerfiles and boot scripts
+	timeout    time.Duration // check-mesh
 
 	config   *config.Config
 	topology *infra.Topology
@@ -36,29 +39,109 @@ type App struct {
 	BootInfo // for boot
 }
 
+// Options controls which config file is loaded by New.
+type Options struct {
+	// ConfigFile is the path to the config file. If empty, DefaultConfigFile
+	// in the current directory is used.
+	ConfigFile string
+
+	// Profile overrides the 'active' field in the config file.
+	Profile string
+
+	// Vars sets the values of variable blocks in the config file.
+	Vars map[string]string
+}
+
 func (c *App) SetTimeout(v time.Duration) {
 	c.timeout = v
 }
 
-func New(logger hclog.Logger) (*App, error) {
+// projectPath returns the absolute path of a file that ships with devconsul,
+// like a Dockerfile or boot script.
+func (a *App) projectPath(elem ...string) string {
+	return filepath.Join(append([]string{a.projectDir}, elem...)...)
+}
+
+// projectMarker is one of the files that ship with devconsul, used to
+// recognize the directory holding the rest of them.
+const projectMarker = "Dockerfile-envoy"
+
+// findProjectDir returns the checkout of devconsul holding the Dockerfiles
+// and boot scripts. That is DEVCONSUL_HOME if it is set, and otherwise the
+// current directory or the one holding the executable.
+func findProjectDir() (string, error) {
+	if home := os.Getenv("DEVCONSUL_HOME"); home != "" {
+		dir, err := filepath.Abs(home)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(filepath.Join(dir, projectMarker)); err != nil {
+			return "", fmt.Errorf("DEVCONSUL_HOME is set to %q, which does not contain %s: %w", home, projectMarker, err)
+		}
+		return dir, nil
+	}
+
+	var candidates []string
+	if wd, err := os.Getwd(); err == nil {
+		candidates = append(candidates, wd)
+	}
+	if exe, err := os.Executable(); err == nil {
+		if exe, err := filepath.EvalSymlinks(exe); err == nil {
+			candidates = append(candidates, filepath.Dir(exe))
+		}
+	}
+	for _, dir := range candidates {
+		if _, err := os.Stat(filepath.Join(dir, projectMarker)); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("could not find %s in the current directory or next to the %s binary; run %s from the top of its repository or set DEVCONSUL_HOME to it",
+		projectMarker, ProgramName, ProgramName)
+}
+
+func New(logger hclog.Logger, opts Options) (*App, error) {
 	c := &App{
 		logger: logger,
 	}
 
-	// this needs to run from the same directory as the config.hcl file
-	// for the project
-	var err error
-	c.rootDir, err = os.Getwd()
+	if opts.ConfigFile == "" {
+		opts.ConfigFile = DefaultConfigFile
+	}
+
+	configPath, err := filepath.Abs(opts.ConfigFile)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = os.Stat(filepath.Join(c.rootDir, DefaultConfigFile))
+	_, err = os.Stat(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("Missing required %s file: %v", DefaultConfigFile, err)
+		return nil, fmt.Errorf("Missing required %s file: %v", opts.ConfigFile, err)
+	}
+
+	// The files that ship with devconsul are found in its checkout, while
+	// everything else (cache, terraform state, generated files) lives
+	// alongside the config file.
+	c.projectDir, err = findProjectDir()
+	if err != nil {
+		return nil, err
+	}
+	c.rootDir = filepath.Dir(configPath)
+	c.configFile = filepath.Base(configPath)
+	if err := os.Chdir(c.rootDir); err != nil {
+		return nil, fmt.Errorf("could not change to config directory %q: %w", c.rootDir, err)
 	}
 
-	c.config, err = config.LoadConfig(DefaultConfigFile)
+	c.config, err = config.LoadConfigWithOptions(c.configFile, config.LoadOptions{
+		Active: opts.Profile,
+		Vars:   opts.Vars,
+		Warn: func(diag *hcl.Diagnostic) {
+			if diag.Subject != nil {
+				logger.Warn(diag.Summary, "at", diag.Subject.String())
+			} else {
+				logger.Warn(diag.Summary)
+			}
+		},
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -72,7 +155,7 @@ func New(logger hclog.Logger) (*App, error) {
 		Dir: filepath.Join(c.rootDir, "cache"),
 	}
 
-	c.runner, err = runner.Load(logger, c.config.KubernetesEnabled)
+	c.runner, err = runner.Load(logger, c.config.KubernetesEnabled, runner.Backend(c.config.Backend))
 	if err != nil {
 		return nil, err
 	}
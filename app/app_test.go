@@ -0,0 +1,57 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindProjectDir(t *testing.T) {
+	project := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(project, projectMarker), nil, 0644))
+
+	elsewhere := t.TempDir()
+
+	chdir := func(t *testing.T, dir string) {
+		wd, err := os.Getwd()
+		require.NoError(t, err)
+		require.NoError(t, os.Chdir(dir))
+		t.Cleanup(func() { _ = os.Chdir(wd) })
+	}
+
+	t.Run("current directory", func(t *testing.T) {
+		t.Setenv("DEVCONSUL_HOME", "")
+		chdir(t, project)
+
+		dir, err := findProjectDir()
+		require.NoError(t, err)
+		require.Equal(t, project, dir)
+	})
+
+	t.Run("DEVCONSUL_HOME", func(t *testing.T) {
+		t.Setenv("DEVCONSUL_HOME", project)
+		chdir(t, elsewhere)
+
+		dir, err := findProjectDir()
+		require.NoError(t, err)
+		require.Equal(t, project, dir)
+	})
+
+	t.Run("DEVCONSUL_HOME without the project", func(t *testing.T) {
+		t.Setenv("DEVCONSUL_HOME", elsewhere)
+		chdir(t, project)
+
+		_, err := findProjectDir()
+		require.ErrorContains(t, err, "DEVCONSUL_HOME is set to")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Setenv("DEVCONSUL_HOME", "")
+		chdir(t, elsewhere)
+
+		_, err := findProjectDir()
+		require.ErrorContains(t, err, "could not find Dockerfile-envoy")
+	})
+}
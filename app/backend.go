@@ -0,0 +1,381 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/rboyer/devconsul/app/runner"
+	"github.com/rboyer/devconsul/app/tfgen"
+)
+
+const (
+	ownerLabel = "devconsul=1"
+
+	// hashLabel holds a hash of everything a container was created from, so
+	// that the docker backend can tell when it needs to be replaced.
+	hashLabel = "devconsul.hash"
+)
+
+// apply brings the docker resources in docker.tf up to date using whichever
+// backend is configured.
+func (c *Core) apply() error {
+	if c.runner.Backend() == runner.BackendDocker {
+		return c.dockerApply()
+	}
+	return c.terraformApply()
+}
+
+// teardown removes everything that apply created.
+func (c *Core) teardown() error {
+	if c.runner.Backend() == runner.BackendDocker {
+		return c.dockerDestroy()
+	}
+	return c.terraformDestroy()
+}
+
+// dockerApply reconciles the resources in docker.tf directly against the
+// docker engine. Everything it creates is labeled devconsul=1, and anything
+// with that label which is no longer wanted is removed.
+func (c *Core) dockerApply() error {
+	src, err := os.ReadFile("docker.tf")
+	if err != nil {
+		return err
+	}
+	model, err := tfgen.ParseDockerModel("docker.tf", src)
+	if err != nil {
+		return fmt.Errorf("could not decode docker.tf: %w", err)
+	}
+
+	api, err := c.runner.DockerAPI()
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("Reconciling with the docker engine...")
+
+	// Networks and volumes go first, since containers refer to them.
+	networks, err := api.NetworkList(ownerLabel)
+	if err != nil {
+		return err
+	}
+	haveNetworks := make(map[string]*runner.DockerNetworkSummary)
+	for _, n := range networks {
+		haveNetworks[n.Name] = n
+	}
+	wantNetworks := make(map[string]struct{})
+	for _, n := range model.Networks {
+		wantNetworks[n.Name] = struct{}{}
+		if have, ok := haveNetworks[n.Name]; ok {
+			if have.Subnet() != n.Subnet {
+				return fmt.Errorf("network %q has subnet %s instead of %s, so you'll have to destroy everything first with 'devconsul down'",
+					n.Name, have.Subnet(), n.Subnet)
+			}
+			continue
+		}
+		c.logger.Info("creating network", "name", n.Name, "subnet", n.Subnet)
+		if err := api.NetworkCreate(n.Name, n.Subnet, n.Labels); err != nil {
+			return fmt.Errorf("could not create network %q: %w", n.Name, err)
+		}
+	}
+
+	volumes, err := api.VolumeList(ownerLabel)
+	if err != nil {
+		return err
+	}
+	haveVolumes := make(map[string]struct{})
+	for _, v := range volumes {
+		haveVolumes[v.Name] = struct{}{}
+	}
+	wantVolumes := make(map[string]struct{})
+	for _, v := range model.Volumes {
+		wantVolumes[v.Name] = struct{}{}
+		if _, ok := haveVolumes[v.Name]; ok {
+			continue
+		}
+		c.logger.Info("creating volume", "name", v.Name)
+		if err := api.VolumeCreate(v.Name, v.Labels); err != nil {
+			return fmt.Errorf("could not create volume %q: %w", v.Name, err)
+		}
+	}
+
+	// Like the terraform resources, images are pulled if missing and never
+	// removed.
+	imageIDs := make(map[string]string)
+	for _, img := range model.Images {
+		if _, ok := imageIDs[img.Image]; ok {
+			continue
+		}
+		id, err := api.ImageInspect(img.Image)
+		if runner.IsDockerNotFound(err) {
+			c.logger.Info("pulling image", "image", img.Image)
+			if err := api.ImagePull(img.Image); err != nil {
+				return err
+			}
+			id, err = api.ImageInspect(img.Image)
+		}
+		if err != nil {
+			return fmt.Errorf("could not inspect image %q: %w", img.Image, err)
+		}
+		imageIDs[img.Image] = id
+	}
+
+	containers, err := orderContainers(model.Containers)
+	if err != nil {
+		return err
+	}
+
+	hashes, err := containerHashes(containers, imageIDs)
+	if err != nil {
+		return err
+	}
+
+	existing, err := api.ContainerList(ownerLabel)
+	if err != nil {
+		return err
+	}
+	haveContainers := make(map[string]*runner.DockerContainerSummary)
+	for _, ct := range removalOrder(existing) {
+		name := ct.Name()
+		want, ok := hashes[name]
+		switch {
+		case !ok:
+			c.logger.Info("removing container", "name", name)
+		case ct.Labels[hashLabel] != want:
+			c.logger.Info("replacing container", "name", name)
+		default:
+			haveContainers[name] = ct
+			continue
+		}
+		if err := api.ContainerRemove(ct.ID); err != nil {
+			return fmt.Errorf("could not remove container %q: %w", name, err)
+		}
+	}
+
+	for _, spec := range containers {
+		if have, ok := haveContainers[spec.Name]; ok {
+			if have.State != "running" {
+				c.logger.Info("starting container", "name", spec.Name)
+				if err := api.ContainerStart(have.ID); err != nil {
+					return fmt.Errorf("could not start container %q: %w", spec.Name, err)
+				}
+			}
+			continue
+		}
+
+		c.logger.Info("creating container", "name", spec.Name)
+		if err := createContainer(api, spec, hashes[spec.Name]); err != nil {
+			return fmt.Errorf("could not create container %q: %w", spec.Name, err)
+		}
+	}
+
+	for _, n := range networks {
+		if _, ok := wantNetworks[n.Name]; !ok {
+			c.logger.Info("removing network", "name", n.Name)
+			if err := api.NetworkRemove(n.ID); err != nil {
+				return fmt.Errorf("could not remove network %q: %w", n.Name, err)
+			}
+		}
+	}
+	for _, v := range volumes {
+		if _, ok := wantVolumes[v.Name]; !ok {
+			c.logger.Info("removing volume", "name", v.Name)
+			if err := api.VolumeRemove(v.Name); err != nil {
+				return fmt.Errorf("could not remove volume %q: %w", v.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dockerDestroy removes every container, network, and volume labeled
+// devconsul=1.
+func (c *Core) dockerDestroy() error {
+	api, err := c.runner.DockerAPI()
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("Removing everything labeled " + ownerLabel + "...")
+
+	containers, err := api.ContainerList(ownerLabel)
+	if err != nil {
+		return err
+	}
+	for _, ct := range removalOrder(containers) {
+		c.logger.Info("removing container", "name", ct.Name())
+		if err := api.ContainerRemove(ct.ID); err != nil {
+			return fmt.Errorf("could not remove container %q: %w", ct.Name(), err)
+		}
+	}
+
+	networks, err := api.NetworkList(ownerLabel)
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		c.logger.Info("removing network", "name", n.Name)
+		if err := api.NetworkRemove(n.ID); err != nil {
+			return fmt.Errorf("could not remove network %q: %w", n.Name, err)
+		}
+	}
+
+	volumes, err := api.VolumeList(ownerLabel)
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		c.logger.Info("removing volume", "name", v.Name)
+		if err := api.VolumeRemove(v.Name); err != nil {
+			return fmt.Errorf("could not remove volume %q: %w", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// orderContainers returns the containers that own a network namespace before
+// the containers that join them.
+func orderContainers(specs []*tfgen.DockerContainerSpec) ([]*tfgen.DockerContainerSpec, error) {
+	byName := make(map[string]*tfgen.DockerContainerSpec)
+	for _, spec := range specs {
+		byName[spec.Name] = spec
+	}
+
+	var owners, joiners []*tfgen.DockerContainerSpec
+	for _, spec := range specs {
+		parent := spec.NetworkContainer()
+		if parent == "" {
+			owners = append(owners, spec)
+			continue
+		}
+		if p, ok := byName[parent]; !ok {
+			return nil, fmt.Errorf("container %q joins the network of undefined container %q", spec.Name, parent)
+		} else if p.NetworkContainer() != "" {
+			return nil, fmt.Errorf("container %q joins the network of %q, which joins another container's network itself", spec.Name, parent)
+		}
+		joiners = append(joiners, spec)
+	}
+	return append(owners, joiners...), nil
+}
+
+// removalOrder returns the containers that join another container's network
+// namespace before the ones that own them.
+func removalOrder(containers []*runner.DockerContainerSummary) []*runner.DockerContainerSummary {
+	var joiners, owners []*runner.DockerContainerSummary
+	for _, ct := range containers {
+		if ct.JoinsNetwork() {
+			joiners = append(joiners, ct)
+		} else {
+			owners = append(owners, ct)
+		}
+	}
+	return append(joiners, owners...)
+}
+
+// containerHashes computes the hash of each container, which must be in the
+// order returned by orderContainers. A container is replaced whenever its hash
+// changes. The hash covers the image ID and the hash of any container whose
+// network namespace it shares, since joining a namespace is done by container
+// ID.
+func containerHashes(containers []*tfgen.DockerContainerSpec, imageIDs map[string]string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, spec := range containers {
+		imageID, ok := imageIDs[spec.Image]
+		if !ok {
+			return nil, fmt.Errorf("container %q uses image %q which is not a docker_image resource", spec.Name, spec.Image)
+		}
+		h, err := containerHash(spec, imageID, hashes[spec.NetworkContainer()])
+		if err != nil {
+			return nil, err
+		}
+		hashes[spec.Name] = h
+	}
+	return hashes, nil
+}
+
+func containerHash(spec *tfgen.DockerContainerSpec, imageID, parentHash string) (string, error) {
+	raw, err := json.Marshal(struct {
+		Spec       *tfgen.DockerContainerSpec
+		ImageID    string
+		ParentHash string
+	}{spec, imageID, parentHash})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func createContainer(api *runner.DockerAPI, spec *tfgen.DockerContainerSpec, hash string) error {
+	cfg := &runner.DockerContainerConfig{
+		Image:    spec.Image,
+		Hostname: spec.Hostname,
+		Env:      spec.Env,
+		Cmd:      spec.Command,
+		Labels:   map[string]string{hashLabel: hash},
+		HostConfig: runner.DockerHostConfig{
+			NetworkMode:   spec.NetworkMode,
+			RestartPolicy: runner.DockerRestartPolicy{Name: spec.Restart},
+			DNS:           spec.DNS,
+		},
+	}
+	for k, v := range spec.Labels {
+		cfg.Labels[k] = v
+	}
+
+	for _, m := range spec.Mounts {
+		src := m.HostPath
+		if m.VolumeName != "" {
+			src = m.VolumeName
+		}
+		bind := src + ":" + m.ContainerPath
+		if m.ReadOnly {
+			bind += ":ro"
+		}
+		cfg.HostConfig.Binds = append(cfg.HostConfig.Binds, bind)
+	}
+
+	for _, p := range spec.Ports {
+		port := strconv.Itoa(p.Internal) + "/tcp"
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+			cfg.HostConfig.PortBindings = make(map[string][]runner.DockerPortBinding)
+		}
+		cfg.ExposedPorts[port] = struct{}{}
+		cfg.HostConfig.PortBindings[port] = append(cfg.HostConfig.PortBindings[port],
+			runner.DockerPortBinding{HostPort: strconv.Itoa(p.External)})
+	}
+
+	// The container starts out on its first network rather than the default
+	// bridge, and is attached to the rest before it is started.
+	if len(spec.Networks) > 0 {
+		first := spec.Networks[0]
+		cfg.HostConfig.NetworkMode = first.Network
+		cfg.NetworkingConfig = &runner.DockerNetworkingConfig{
+			EndpointsConfig: map[string]*runner.DockerEndpointConfig{
+				first.Network: {
+					IPAMConfig: &runner.DockerEndpointIPAMConfig{IPv4Address: first.IPv4Address},
+				},
+			},
+		}
+	}
+
+	id, err := api.ContainerCreate(spec.Name, cfg)
+	if err != nil {
+		return err
+	}
+	for i, n := range spec.Networks {
+		if i == 0 {
+			continue
+		}
+		if err := api.NetworkConnect(n.Network, id, n.IPv4Address); err != nil {
+			return err
+		}
+	}
+	return api.ContainerStart(id)
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rboyer/devconsul/app/runner"
+	"github.com/rboyer/devconsul/app/tfgen"
+)
+
+func TestOrderContainers(t *testing.T) {
+	spec := func(name, networkMode string) *tfgen.DockerContainerSpec {
+		return &tfgen.DockerContainerSpec{Name: name, Image: "img", NetworkMode: networkMode}
+	}
+	names := func(specs []*tfgen.DockerContainerSpec) []string {
+		var out []string
+		for _, s := range specs {
+			out = append(out, s.Name)
+		}
+		return out
+	}
+
+	t.Run("owners before joiners", func(t *testing.T) {
+		got, err := orderContainers([]*tfgen.DockerContainerSpec{
+			spec("grafana", "container:prometheus"),
+			spec("dc1-client1-ping", "container:dc1-client1-pod"),
+			spec("dc1-client1-pod", "bridge"),
+			spec("dc1-client1", "container:dc1-client1-pod"),
+			spec("prometheus", "bridge"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"dc1-client1-pod",
+			"prometheus",
+			"grafana",
+			"dc1-client1-ping",
+			"dc1-client1",
+		}, names(got))
+	})
+
+	t.Run("undefined parent", func(t *testing.T) {
+		_, err := orderContainers([]*tfgen.DockerContainerSpec{
+			spec("dc1-client1", "container:dc1-client1-pod"),
+		})
+		require.EqualError(t, err, `container "dc1-client1" joins the network of undefined container "dc1-client1-pod"`)
+	})
+
+	t.Run("nested joins", func(t *testing.T) {
+		_, err := orderContainers([]*tfgen.DockerContainerSpec{
+			spec("dc1-client1-pod", "bridge"),
+			spec("dc1-client1", "container:dc1-client1-pod"),
+			spec("dc1-client1-ping", "container:dc1-client1"),
+		})
+		require.EqualError(t, err, `container "dc1-client1-ping" joins the network of "dc1-client1", which joins another container's network itself`)
+	})
+}
+
+func TestRemovalOrder(t *testing.T) {
+	summary := func(name, networkMode string) *runner.DockerContainerSummary {
+		ct := &runner.DockerContainerSummary{ID: name + "-id", Names: []string{"/" + name}}
+		ct.HostConfig.NetworkMode = networkMode
+		return ct
+	}
+
+	got := removalOrder([]*runner.DockerContainerSummary{
+		summary("dc1-client1-pod", "bridge"),
+		summary("dc1-client1", "container:0123abcd"),
+		summary("prometheus", "devconsul-lan"),
+		summary("grafana", "container:4567cdef"),
+	})
+
+	var names []string
+	for _, ct := range got {
+		names = append(names, ct.Name())
+	}
+	require.Equal(t, []string{
+		"dc1-client1",
+		"grafana",
+		"dc1-client1-pod",
+		"prometheus",
+	}, names)
+}
+
+func TestContainerHashes(t *testing.T) {
+	specs := func() []*tfgen.DockerContainerSpec {
+		return []*tfgen.DockerContainerSpec{
+			{Name: "dc1-client1-pod", Image: "pause", NetworkMode: "bridge"},
+			{Name: "prometheus", Image: "prometheus", NetworkMode: "bridge"},
+			{Name: "dc1-client1", Image: "consul", NetworkMode: "container:dc1-client1-pod"},
+			{Name: "grafana", Image: "grafana", NetworkMode: "container:prometheus"},
+		}
+	}
+	imageIDs := func() map[string]string {
+		return map[string]string{
+			"pause":      "sha256:01",
+			"prometheus": "sha256:02",
+			"consul":     "sha256:03",
+			"grafana":    "sha256:04",
+		}
+	}
+
+	base, err := containerHashes(specs(), imageIDs())
+	require.NoError(t, err)
+	require.Len(t, base, 4)
+
+	t.Run("stable", func(t *testing.T) {
+		again, err := containerHashes(specs(), imageIDs())
+		require.NoError(t, err)
+		require.Equal(t, base, again)
+	})
+
+	// Replacing a pod gives it a new container ID, so everything that joins
+	// its network namespace has to be replaced as well.
+	t.Run("parent spec change propagates to joiners", func(t *testing.T) {
+		changed := specs()
+		changed[0].Hostname = "dc1-client1"
+
+		got, err := containerHashes(changed, imageIDs())
+		require.NoError(t, err)
+		require.NotEqual(t, base["dc1-client1-pod"], got["dc1-client1-pod"])
+		require.NotEqual(t, base["dc1-client1"], got["dc1-client1"])
+		require.Equal(t, base["prometheus"], got["prometheus"])
+		require.Equal(t, base["grafana"], got["grafana"])
+	})
+
+	t.Run("parent image change propagates to joiners", func(t *testing.T) {
+		ids := imageIDs()
+		ids["prometheus"] = "sha256:05"
+
+		got, err := containerHashes(specs(), ids)
+		require.NoError(t, err)
+		require.NotEqual(t, base["prometheus"], got["prometheus"])
+		require.NotEqual(t, base["grafana"], got["grafana"])
+		require.Equal(t, base["dc1-client1-pod"], got["dc1-client1-pod"])
+		require.Equal(t, base["dc1-client1"], got["dc1-client1"])
+	})
+
+	t.Run("joiner change does not affect parent", func(t *testing.T) {
+		ids := imageIDs()
+		ids["consul"] = "sha256:06"
+
+		got, err := containerHashes(specs(), ids)
+		require.NoError(t, err)
+		require.NotEqual(t, base["dc1-client1"], got["dc1-client1"])
+		require.Equal(t, base["dc1-client1-pod"], got["dc1-client1-pod"])
+	})
+
+	t.Run("unknown image", func(t *testing.T) {
+		ids := imageIDs()
+		delete(ids, "grafana")
+
+		_, err := containerHashes(specs(), ids)
+		require.EqualError(t, err, `container "grafana" uses image "grafana" which is not a docker_image resource`)
+	})
+}
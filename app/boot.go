@@ -3,13 +3,16 @@ package app
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	vaultapi "github.com/hashicorp/vault/api"
 
+	"github.com/rboyer/devconsul/app/tfgen"
 	"github.com/rboyer/devconsul/config"
 	"github.com/rboyer/devconsul/consulfunc"
 	"github.com/rboyer/devconsul/infra"
@@ -125,6 +128,9 @@ func (c *Core) runBoot(primaryOnly bool) error {
 		if err := c.peerClusters(); err != nil {
 			return fmt.Errorf("peerClusters: %w", err)
 		}
+		if err := c.waitForPeerings(); err != nil {
+			return fmt.Errorf("waitForPeerings: %w", err)
+		}
 	}
 
 	if c.config.PrometheusEnabled {
@@ -144,56 +150,131 @@ func (c *Core) runBoot(primaryOnly bool) error {
 }
 
 func (c *Core) peerClusters() error {
-	primaryClient := c.clientForCluster(config.PrimaryCluster)
-	pc := primaryClient.Peerings()
-	for _, cluster := range c.topology.Clusters() {
-		if cluster.Name == config.PrimaryCluster {
-			continue // skip
-		}
+	for _, p := range c.topology.Peerings() {
+		var (
+			acceptor = c.clientForCluster(p.Acceptor).Peerings()
+			dialer   = c.clientForCluster(p.Dialer).Peerings()
+		)
 
 		// Check to see if both sides are already peered.
-		var hasPrimaryPeering bool
+		var hasAcceptorPeering bool
 		{
-			found, _, err := pc.Read(context.Background(), "peer-"+cluster.Name, nil)
+			found, _, err := acceptor.Read(context.Background(), infra.PeerName(p.Dialer), nil)
 			if err != nil {
-				return fmt.Errorf("error checking for peering in %q: %w", config.PrimaryCluster, err)
+				return fmt.Errorf("error checking for peering in %q: %w", p.Acceptor, err)
 			}
-			hasPrimaryPeering = found != nil
+			hasAcceptorPeering = found != nil
 		}
 
-		targetClient := c.clientForCluster(cluster.Name)
-		tpc := targetClient.Peerings()
-
-		var hasReversePeering bool
+		var hasDialerPeering bool
 		{
-			found, _, err := tpc.Read(context.Background(), "peer-"+config.PrimaryCluster, nil)
+			found, _, err := dialer.Read(context.Background(), infra.PeerName(p.Acceptor), nil)
 			if err != nil {
-				return fmt.Errorf("error checking for peering in %q: %w", cluster.Name, err)
+				return fmt.Errorf("error checking for peering in %q: %w", p.Dialer, err)
 			}
-			hasReversePeering = found != nil
+			hasDialerPeering = found != nil
 		}
 
-		if hasPrimaryPeering && hasReversePeering {
+		if hasAcceptorPeering && hasDialerPeering {
 			continue
 		}
 
-		resp, _, err := pc.GenerateToken(context.Background(), api.PeeringGenerateTokenRequest{
-			PeerName: "peer-" + cluster.Name,
-		}, nil)
-		if err != nil {
-			return fmt.Errorf("error generating peering token for %q from %q: %w",
-				cluster.Name, config.PrimaryCluster, err)
+		deadline := time.Now().Add(peeringTimeout)
+		for {
+			err := establishPeering(acceptor, dialer, p)
+			if err == nil {
+				break
+			}
+			if !c.topology.PeerThroughMeshGateways() || !isTransientError(err) {
+				return err
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("gave up after %s: %w", peeringTimeout, err)
+			}
+			// The mesh gateways on either side may not be up yet.
+			c.logger.Warn("peering failed; mesh gateways not ready yet",
+				"acceptor", p.Acceptor, "dialer", p.Dialer, "error", err,
+			)
+			time.Sleep(500 * time.Millisecond)
 		}
+	}
+	return nil
+}
 
-		token := resp.PeeringToken
+// peeringTimeout bounds how long 'up' will wait for a peering to be
+// established or to become active.
+const peeringTimeout = 5 * time.Minute
 
-		_, _, err = tpc.Establish(context.Background(), api.PeeringEstablishRequest{
-			PeerName:     "peer-" + config.PrimaryCluster,
-			PeeringToken: token,
-		}, nil)
-		if err != nil {
-			return fmt.Errorf("error establishing peering with token in %q to %q: %w",
-				cluster.Name, config.PrimaryCluster, err)
+// isTransientError returns true for errors from the consul api that are
+// worth retrying, like a refused connection or a 5xx response.
+func isTransientError(err error) bool {
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func establishPeering(acceptor, dialer *api.Peerings, p infra.Peering) error {
+	resp, _, err := acceptor.GenerateToken(context.Background(), api.PeeringGenerateTokenRequest{
+		PeerName: infra.PeerName(p.Dialer),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error generating peering token for %q from %q: %w",
+			p.Dialer, p.Acceptor, err)
+	}
+
+	token := resp.PeeringToken
+
+	_, _, err = dialer.Establish(context.Background(), api.PeeringEstablishRequest{
+		PeerName:     infra.PeerName(p.Acceptor),
+		PeeringToken: token,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error establishing peering with token in %q to %q: %w",
+			p.Dialer, p.Acceptor, err)
+	}
+	return nil
+}
+
+// waitForPeerings blocks until both sides of every peering are active. It
+// fails if a peering ends up in a state it won't recover from, or if it takes
+// longer than peeringTimeout.
+func (c *Core) waitForPeerings() error {
+	for _, p := range c.topology.Peerings() {
+		for _, side := range []struct{ cluster, peer string }{
+			{p.Acceptor, p.Dialer},
+			{p.Dialer, p.Acceptor},
+		} {
+			var (
+				pc     = c.clientForCluster(side.cluster).Peerings()
+				name   = infra.PeerName(side.peer)
+				logger = c.logger.With("cluster", side.cluster, "peer", name)
+				start  = time.Now()
+			)
+			for {
+				found, _, err := pc.Read(context.Background(), name, nil)
+				if err != nil {
+					return fmt.Errorf("error checking for peering in %q: %w", side.cluster, err)
+				}
+				if found != nil && found.State == api.PeeringStateActive {
+					logger.Info("peering is active", "elapsed", time.Since(start))
+					break
+				}
+				state := api.PeeringStateUndefined
+				if found != nil {
+					state = found.State
+				}
+				switch state {
+				case api.PeeringStateFailing, api.PeeringStateTerminated, api.PeeringStateDeleting:
+					return fmt.Errorf("peering %q in %q is %s", name, side.cluster, state)
+				}
+				if time.Since(start) > peeringTimeout {
+					return fmt.Errorf("peering %q in %q is still %s after %s", name, side.cluster, state, peeringTimeout)
+				}
+				logger.Warn("peering is not active yet", "state", state)
+				time.Sleep(500 * time.Millisecond)
+			}
 		}
 	}
 	return nil
@@ -415,6 +496,20 @@ func (c *Core) initPrimaryCluster(cluster string, peered bool) error {
 			return fmt.Errorf("createMeshGatewayToken[%s]: %w", cluster, err)
 		}
 
+		if c.topology.Cluster(cluster).IngressGateways > 0 {
+			err = c.createIngressGatewayToken(cluster, cluster)
+			if err != nil {
+				return fmt.Errorf("createIngressGatewayToken[%s]: %w", cluster, err)
+			}
+		}
+
+		if c.topology.Cluster(cluster).TerminatingGateways > 0 {
+			err = c.createTerminatingGatewayToken(cluster, cluster)
+			if err != nil {
+				return fmt.Errorf("createTerminatingGatewayToken[%s]: %w", cluster, err)
+			}
+		}
+
 		err = c.createAgentTokens(cluster, cluster)
 		if err != nil {
 			return fmt.Errorf("createAgentTokens[%s]: %w", cluster, err)
@@ -495,6 +590,8 @@ func (c *Core) initSecondaryDCs() error {
 		// DC.
 		var (
 			mgwDelay   func() error
+			igwDelay   func() error
+			tgwDelay   func() error
 			agentDelay func() error
 			svcDelay   func() error
 		)
@@ -505,6 +602,20 @@ func (c *Core) initSecondaryDCs() error {
 				return fmt.Errorf("createMeshGatewayToken[%s]: %w", cluster.Name, err)
 			}
 
+			if cluster.IngressGateways > 0 {
+				igwDelay, err = c.createIngressGatewayTokenDelayWrite(config.PrimaryCluster, cluster.Name)
+				if err != nil {
+					return fmt.Errorf("createIngressGatewayToken[%s]: %w", cluster.Name, err)
+				}
+			}
+
+			if cluster.TerminatingGateways > 0 {
+				tgwDelay, err = c.createTerminatingGatewayTokenDelayWrite(config.PrimaryCluster, cluster.Name)
+				if err != nil {
+					return fmt.Errorf("createTerminatingGatewayToken[%s]: %w", cluster.Name, err)
+				}
+			}
+
 			agentDelay, err = c.createAgentTokensDelayWrite(config.PrimaryCluster, cluster.Name)
 			if err != nil {
 				return fmt.Errorf("createAgentTokens[%s]: %w", cluster.Name, err)
@@ -530,6 +641,18 @@ func (c *Core) initSecondaryDCs() error {
 				}
 			}
 
+			if igwDelay != nil {
+				if err = igwDelay(); err != nil {
+					return fmt.Errorf("createIngressGatewayToken.delay[%s]: %w", cluster.Name, err)
+				}
+			}
+
+			if tgwDelay != nil {
+				if err = tgwDelay(); err != nil {
+					return fmt.Errorf("createTerminatingGatewayToken.delay[%s]: %w", cluster.Name, err)
+				}
+			}
+
 			if agentDelay != nil {
 				if err = agentDelay(); err != nil {
 					return fmt.Errorf("createAgentTokens.delay[%s]: %w", cluster.Name, err)
@@ -862,12 +985,39 @@ func (c *Core) createMeshGatewayToken(fromCluster, forCluster string, peered boo
 }
 
 func (c *Core) createMeshGatewayTokenDelayWrite(fromCluster, forCluster string, peered bool) (func() error, error) {
+	// Each partition with its own mesh gateways gets its own token.
+	partitions := []string{"default"}
+	if c.config.EnterpriseEnabled {
+		seen := map[string]struct{}{"default": {}}
+		c.topology.WalkSilent(func(n *infra.Node) {
+			if n.Cluster != forCluster || !n.MeshGateway {
+				return
+			}
+			if _, ok := seen[n.Partition]; !ok {
+				seen[n.Partition] = struct{}{}
+				partitions = append(partitions, n.Partition)
+			}
+		})
+	}
+
+	var funcs []func() error
+	for _, partition := range partitions {
+		f, err := c.createMeshGatewayPartitionTokenDelayWrite(fromCluster, forCluster, partition, peered)
+		if err != nil {
+			return nil, err
+		}
+		funcs = append(funcs, f)
+	}
+	return delayFuncs(funcs), nil
+}
+
+func (c *Core) createMeshGatewayPartitionTokenDelayWrite(fromCluster, forCluster, partition string, peered bool) (func() error, error) {
 	var (
 		client = c.clientForCluster(fromCluster)
-		logger = c.logger.With("cluster", forCluster)
+		logger = c.logger.With("cluster", forCluster, "partition", partition)
 	)
 
-	meshGatewayName := fmt.Sprintf("mesh-gateway--" + forCluster)
+	meshGatewayName := tfgen.MeshGatewayTokenName(forCluster, partition)
 
 	p := &api.ACLPolicy{
 		Name:        meshGatewayName,
@@ -893,9 +1043,12 @@ func (c *Core) createMeshGatewayTokenDelayWrite(fromCluster, forCluster string,
 		`
 		if peered {
 			p.Rules += ` mesh = "write" `
+			if c.topology.PeerThroughMeshGateways() {
+				p.Rules += ` peering = "read" `
+			}
 		}
-		// Wrap with default partition.
-		p.Rules = ` partition "default" { ` + p.Rules + ` } `
+		// Wrap with the gateway's partition.
+		p.Rules = ` partition "` + partition + `" { ` + p.Rules + ` } `
 
 	} else {
 		p.Rules = `
@@ -914,6 +1067,9 @@ func (c *Core) createMeshGatewayTokenDelayWrite(fromCluster, forCluster string,
 			`
 		if peered {
 			p.Rules += ` mesh = "write" `
+			if c.topology.PeerThroughMeshGateways() {
+				p.Rules += ` peering = "read" `
+			}
 		}
 	}
 	p, err := consulfunc.CreateOrUpdatePolicy(client, p, nil)
@@ -938,9 +1094,9 @@ func (c *Core) createMeshGatewayTokenDelayWrite(fromCluster, forCluster string,
 
 	return func() error {
 		// Make sure we wait for it before letting it manifest in the cache store.
-		c.waitForTokenOnServers(forCluster, "mesh-gateway--"+forCluster, token.SecretID)
+		c.waitForTokenOnServers(forCluster, meshGatewayName, token.SecretID)
 
-		if err := c.cache.SaveValue("mesh-gateway--"+forCluster, token.SecretID); err != nil {
+		if err := c.cache.SaveValue(meshGatewayName, token.SecretID); err != nil {
 			return err
 		}
 		logger.Info("mesh-gateway token written to cache", "secretID", token.SecretID)
@@ -948,6 +1104,125 @@ func (c *Core) createMeshGatewayTokenDelayWrite(fromCluster, forCluster string,
 	}, nil
 }
 
+func (c *Core) createIngressGatewayToken(fromCluster, forCluster string) error {
+	delay, err := c.createIngressGatewayTokenDelayWrite(fromCluster, forCluster)
+	if err != nil {
+		return err
+	}
+	return delay()
+}
+
+func (c *Core) createIngressGatewayTokenDelayWrite(fromCluster, forCluster string) (func() error, error) {
+	return c.createLocalGatewayTokenDelayWrite(fromCluster, forCluster, "ingress-gateway", nil)
+}
+
+func (c *Core) createTerminatingGatewayToken(fromCluster, forCluster string) error {
+	delay, err := c.createTerminatingGatewayTokenDelayWrite(fromCluster, forCluster)
+	if err != nil {
+		return err
+	}
+	return delay()
+}
+
+func (c *Core) createTerminatingGatewayTokenDelayWrite(fromCluster, forCluster string) (func() error, error) {
+	// The gateway has to be able to write the services it is linked to.
+	var linked []string
+	for _, svc := range c.topology.ExternalServices(forCluster) {
+		linked = append(linked, svc.ID.Name)
+	}
+	return c.createLocalGatewayTokenDelayWrite(fromCluster, forCluster, "terminating-gateway", linked)
+}
+
+// createLocalGatewayTokenDelayWrite creates the token for the ingress or
+// terminating gateways of a cluster, which register as the service named
+// gatewayName. The gateway may also write the services named by linked.
+func (c *Core) createLocalGatewayTokenDelayWrite(fromCluster, forCluster, gatewayName string, linked []string) (func() error, error) {
+	var (
+		client = c.clientForCluster(fromCluster)
+		logger = c.logger.With("cluster", forCluster)
+	)
+
+	tokenName := gatewayName + "--" + forCluster
+
+	p := &api.ACLPolicy{
+		Name:        tokenName,
+		Description: tokenName,
+	}
+
+	var linkedRules string
+	for _, name := range linked {
+		linkedRules += `
+				service "` + name + `" {
+					policy     = "write"
+				}`
+	}
+
+	if c.config.EnterpriseEnabled {
+		p.Rules = `
+			namespace_prefix "" {
+				service "` + gatewayName + `" {
+					policy     = "write"
+				}` + linkedRules + `
+				service_prefix "" {
+					policy     = "read"
+				}
+				node_prefix "" {
+					policy     = "read"
+				}
+			}
+			agent_prefix "" {
+				policy     = "read"
+			}
+		`
+		// Wrap with default partition.
+		p.Rules = ` partition "default" { ` + p.Rules + ` } `
+
+	} else {
+		p.Rules = `
+			service "` + gatewayName + `" {
+				policy     = "write"
+			}` + linkedRules + `
+			service_prefix "" {
+				policy     = "read"
+			}
+			node_prefix "" {
+				policy     = "read"
+			}
+			agent_prefix "" {
+				policy     = "read"
+			}
+			`
+	}
+	p, err := consulfunc.CreateOrUpdatePolicy(client, p, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create policy: %w", err)
+	}
+
+	token := &api.ACLToken{
+		Description: tokenName,
+		Local:       false,
+		Policies:    []*api.ACLTokenPolicyLink{{ID: p.ID}},
+	}
+
+	token, err = consulfunc.CreateOrUpdateToken(client, token, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create token: %w", err)
+	}
+
+	logger.Info(gatewayName+" token", "secretID", token.SecretID)
+
+	return func() error {
+		// Make sure we wait for it before letting it manifest in the cache store.
+		c.waitForTokenOnServers(forCluster, tokenName, token.SecretID)
+
+		if err := c.cache.SaveValue(tokenName, token.SecretID); err != nil {
+			return err
+		}
+		logger.Info(gatewayName+" token written to cache", "secretID", token.SecretID)
+		return nil
+	}, nil
+}
+
 func (c *Core) injectReplicationToken() error {
 	if c.topology.LinkMode != infra.ClusterLinkModeFederate {
 		return fmt.Errorf("unsupported link_mode=%q here", c.topology.LinkMode)
@@ -1255,49 +1530,49 @@ func (c *Core) createServiceTokensDelayWrite(fromCluster, forCluster string) (fu
 		if n.Cluster != forCluster {
 			return nil // skip
 		}
-		if n.Service == nil {
-			return nil
-		}
-		if _, ok := done[n.Service.ID]; ok {
-			return nil
-		}
+		for _, svc := range n.Services {
+			if _, ok := done[svc.ID]; ok {
+				continue
+			}
 
-		token := &api.ACLToken{
-			Description: "service--" + forCluster + "--" + n.Service.ID.ID(),
-			Local:       false,
-			ServiceIdentities: []*api.ACLServiceIdentity{
-				{
-					ServiceName: n.Service.ID.Name,
+			token := &api.ACLToken{
+				Description: "service--" + forCluster + "--" + svc.ID.ID(),
+				Local:       false,
+				ServiceIdentities: []*api.ACLServiceIdentity{
+					{
+						ServiceName: svc.ID.Name,
+					},
 				},
-			},
-		}
-		if c.config.EnterpriseEnabled {
-			token.Namespace = n.Service.ID.Namespace
-			token.Partition = n.Service.ID.Partition
-		}
+			}
+			if c.config.EnterpriseEnabled {
+				token.Namespace = svc.ID.Namespace
+				token.Partition = svc.ID.Partition
+			}
 
-		token, err := consulfunc.CreateOrUpdateToken(client, token, nil)
-		if err != nil {
-			return err
-		}
+			token, err := consulfunc.CreateOrUpdateToken(client, token, nil)
+			if err != nil {
+				return err
+			}
 
-		logger.Info("service token created",
-			"service", n.Service.ID.Name,
-			"namespace", n.Service.ID.Namespace,
-			"partition", n.Service.ID.Partition,
-			"token", token.SecretID,
-		)
+			logger.Info("service token created",
+				"service", svc.ID.Name,
+				"namespace", svc.ID.Namespace,
+				"partition", svc.ID.Partition,
+				"token", token.SecretID,
+			)
 
-		funcs = append(funcs, func() error {
-			c.waitForTokenOnServers(forCluster, "service--"+forCluster+"--"+n.Service.ID.ID(), token.SecretID)
+			tokenName := "service--" + forCluster + "--" + svc.ID.ID()
+			funcs = append(funcs, func() error {
+				c.waitForTokenOnServers(forCluster, tokenName, token.SecretID)
 
-			if err := c.cache.SaveValue("service--"+forCluster+"--"+n.Service.ID.ID(), token.SecretID); err != nil {
-				return err
-			}
-			return nil
-		})
+				if err := c.cache.SaveValue(tokenName, token.SecretID); err != nil {
+					return err
+				}
+				return nil
+			})
 
-		done[n.Service.ID] = struct{}{}
+			done[svc.ID] = struct{}{}
+		}
 		return nil
 	})
 
@@ -1322,23 +1597,28 @@ func (c *Core) writeCentralConfigs(cluster string) error {
 	ce := client.ConfigEntries()
 
 	// collect upstreams and downstreams
-	dm := make(map[util.Identifier]map[util.Identifier]struct{}) // dest -> src
-	err = c.topology.Walk(func(n *infra.Node) error {
-		if n.Service == nil {
-			return nil
-		}
-		svc := n.Service
-
-		src := svc.ID
-		dst := svc.UpstreamID
-
+	type intentionSource struct {
+		ID   util.Identifier
+		Peer string
+	}
+	dm := make(map[util.Identifier]map[intentionSource]struct{}) // dest -> src
+	addSource := func(dst util.Identifier, src intentionSource) {
 		sm, ok := dm[dst]
 		if !ok {
-			sm = make(map[util.Identifier]struct{})
+			sm = make(map[intentionSource]struct{})
 			dm[dst] = sm
 		}
-
 		sm[src] = struct{}{}
+	}
+	err = c.topology.Walk(func(n *infra.Node) error {
+		for _, svc := range n.Services {
+			for _, up := range svc.Upstreams {
+				if up.Peer != "" && c.topology.LinkWithPeering() {
+					continue // handled below
+				}
+				addSource(up.ID, intentionSource{ID: svc.ID})
+			}
+		}
 
 		return nil
 	})
@@ -1346,6 +1626,13 @@ func (c *Core) writeCentralConfigs(cluster string) error {
 		return err
 	}
 
+	// Anything reached over a peering must be exported to that peer, and
+	// the intentions have to name the peer.
+	peered := c.topology.PeeredUpstreams(cluster)
+	for _, pu := range peered {
+		addSource(pu.Service, intentionSource{ID: pu.Downstream, Peer: pu.Peer})
+	}
+
 	var stockEntries []api.ConfigEntry
 	if c.config.PrometheusEnabled && cluster == config.PrimaryCluster {
 		stockEntries = append(stockEntries, &api.ProxyConfigEntry{
@@ -1359,6 +1646,67 @@ func (c *Core) writeCentralConfigs(cluster string) error {
 		})
 	}
 
+	// All ingress gateways in a cluster share one config entry, so the
+	// listeners of any one of them will do.
+	var ingressListeners []*infra.IngressListener
+	c.topology.WalkSilent(func(n *infra.Node) {
+		if n.Cluster == cluster && n.IngressGateway && ingressListeners == nil {
+			ingressListeners = n.IngressListeners
+		}
+	})
+	if len(ingressListeners) > 0 {
+		// Ingress gateways are only allowed in the default partition (see
+		// infra.CompileTopology), so one entry covers all of them.
+		entry := &api.IngressGatewayConfigEntry{
+			Kind:      api.IngressGateway,
+			Name:      "ingress-gateway",
+			Partition: "default",
+			Namespace: "default",
+		}
+		igw := util.NewIdentifier("ingress-gateway", "", "")
+		for _, l := range ingressListeners {
+			entry.Listeners = append(entry.Listeners, api.IngressListener{
+				Port:     l.Port,
+				Protocol: serviceProtocol(c.config.ConfigEntries[cluster], l.Service),
+				Services: []api.IngressService{{
+					Name:      l.Service.Name,
+					Namespace: l.Service.Namespace,
+					Partition: l.Service.Partition,
+				}},
+			})
+
+			addSource(l.Service, intentionSource{ID: igw})
+		}
+		stockEntries = append(stockEntries, entry)
+	}
+
+	stockEntries = append(stockEntries, exportedServicesEntries(peered)...)
+
+	if c.topology.PeerThroughMeshGateways() {
+		stockEntries = append(stockEntries, &api.MeshConfigEntry{
+			Partition: "default",
+			Peering: &api.PeeringMeshConfig{
+				PeerThroughMeshGateways: true,
+			},
+		})
+	}
+
+	if externals := c.topology.ExternalServices(cluster); len(externals) > 0 && c.topology.Cluster(cluster).TerminatingGateways > 0 {
+		entry := &api.TerminatingGatewayConfigEntry{
+			Kind:      api.TerminatingGateway,
+			Name:      "terminating-gateway",
+			Partition: "default",
+			Namespace: "default",
+		}
+		for _, svc := range externals {
+			entry.Services = append(entry.Services, api.LinkedService{
+				Name:      svc.ID.Name,
+				Namespace: svc.ID.Namespace,
+			})
+		}
+		stockEntries = append(stockEntries, entry)
+	}
+
 	if !c.config.SecurityDisableDefaultIntentions {
 		for dst, sm := range dm {
 			entry := &api.ServiceIntentionsConfigEntry{
@@ -1368,12 +1716,17 @@ func (c *Core) writeCentralConfigs(cluster string) error {
 				Partition: dst.Partition,
 			}
 			for src := range sm {
-				entry.Sources = append(entry.Sources, &api.SourceIntention{
-					Name:      src.Name,
-					Namespace: src.Namespace,
-					Partition: src.Partition,
+				si := &api.SourceIntention{
+					Name:      src.ID.Name,
+					Namespace: src.ID.Namespace,
 					Action:    api.IntentionActionAllow,
-				})
+				}
+				if src.Peer != "" {
+					si.Peer = src.Peer
+				} else {
+					si.Partition = src.ID.Partition
+				}
+				entry.Sources = append(entry.Sources, si)
 			}
 			stockEntries = append(stockEntries, entry)
 		}
@@ -1402,7 +1755,15 @@ func (c *Core) writeCentralConfigs(cluster string) error {
 					ce.Config[k] = v
 				}
 				entries[i] = ce
-			case api.ServiceIntentions:
+			case api.ExportedServices:
+				mergeExportedServices(entry.(*api.ExportedServicesConfigEntry), stockEntry.(*api.ExportedServicesConfigEntry))
+			case api.MeshConfig:
+				ce := entry.(*api.MeshConfigEntry)
+				if ce.Peering == nil {
+					ce.Peering = &api.PeeringMeshConfig{}
+				}
+				ce.Peering.PeerThroughMeshGateways = true
+			case api.ServiceIntentions, api.IngressGateway, api.TerminatingGateway:
 			// we deliberately do not merge these
 			default:
 				return fmt.Errorf("unsupported kind: %q", stockEntry.GetKind())
@@ -1419,20 +1780,7 @@ func (c *Core) writeCentralConfigs(cluster string) error {
 	for _, entry := range entries {
 		// scrub namespace/partition from request for OSS
 		if !c.config.EnterpriseEnabled {
-			switch entry.GetKind() {
-			case api.ProxyDefaults:
-				thisEntry := entry.(*api.ProxyConfigEntry)
-				thisEntry.Namespace = ""
-				thisEntry.Partition = ""
-			case api.ServiceIntentions:
-				thisEntry := entry.(*api.ServiceIntentionsConfigEntry)
-				thisEntry.Namespace = ""
-				thisEntry.Partition = ""
-				for _, src := range thisEntry.Sources {
-					src.Namespace = ""
-					src.Partition = ""
-				}
-			}
+			scrubConfigEntryForOSS(entry)
 		}
 		if _, _, err := ce.Set(entry, nil); err != nil {
 			return err
@@ -1497,40 +1845,184 @@ func (c *Core) writeCentralConfigs(cluster string) error {
 	return nil
 }
 
-func (c *Core) writeServiceRegistrationFiles() error {
-	return c.topology.Walk(func(n *infra.Node) error {
-		if n.Service == nil {
-			return nil
+// exportedServicesEntries builds one exported-services config entry for each
+// partition with services that are reached over a peering.
+func exportedServicesEntries(peered []infra.PeeredUpstream) []api.ConfigEntry {
+	var (
+		out     []api.ConfigEntry
+		byPart  = make(map[string]*api.ExportedServicesConfigEntry)
+		partIdx = make(map[string]map[util.Identifier]int)
+	)
+	for _, pu := range peered {
+		partition := pu.Service.Partition
+		entry, ok := byPart[partition]
+		if !ok {
+			entry = &api.ExportedServicesConfigEntry{
+				Name:      partition,
+				Partition: partition,
+			}
+			byPart[partition] = entry
+			partIdx[partition] = make(map[util.Identifier]int)
+			out = append(out, entry)
 		}
 
-		if !n.IsAgent() {
-			return nil
+		idx, ok := partIdx[partition][pu.Service]
+		if !ok {
+			idx = len(entry.Services)
+			partIdx[partition][pu.Service] = idx
+			entry.Services = append(entry.Services, api.ExportedService{
+				Name:      pu.Service.Name,
+				Namespace: pu.Service.Namespace,
+			})
+		}
+		svc := &entry.Services[idx]
+		if !hasPeerConsumer(svc.Consumers, pu.Peer) {
+			svc.Consumers = append(svc.Consumers, api.ServiceConsumer{Peer: pu.Peer})
+		}
+	}
+	return out
+}
+
+// serviceProtocol returns the protocol that the user's config entries give a
+// service, which anything routing to it (like an ingress listener) has to
+// match. A service-defaults entry wins over the global proxy-defaults entry,
+// and services are "tcp" unless either one says otherwise.
+func serviceProtocol(entries []api.ConfigEntry, id util.Identifier) string {
+	protocol := "tcp"
+	for _, entry := range entries {
+		switch ce := entry.(type) {
+		case *api.ServiceConfigEntry:
+			if ce.Name == id.Name &&
+				util.NamespaceOrDefault(ce.Namespace) == util.NamespaceOrDefault(id.Namespace) &&
+				util.PartitionOrDefault(ce.Partition) == util.PartitionOrDefault(id.Partition) &&
+				ce.Protocol != "" {
+				return ce.Protocol
+			}
+		case *api.ProxyConfigEntry:
+			if ce.Name != api.ProxyConfigGlobal || util.PartitionOrDefault(ce.Partition) != util.PartitionOrDefault(id.Partition) {
+				continue
+			}
+			if p, ok := ce.Config["protocol"].(string); ok && p != "" {
+				protocol = p
+			}
 		}
+	}
+	return protocol
+}
 
-		type templateOpts struct {
-			Service            *infra.Service
-			EnterpriseEnabled  bool
-			LinkWithFederation bool
-			LinkWithPeering    bool
+// mergeExportedServices adds every consumer in stock to the user's entry,
+// keeping whatever the user already exported.
+func mergeExportedServices(user, stock *api.ExportedServicesConfigEntry) {
+	for _, stockSvc := range stock.Services {
+		found := false
+		for i := range user.Services {
+			svc := &user.Services[i]
+			if svc.Name != stockSvc.Name || util.NamespaceOrDefault(svc.Namespace) != util.NamespaceOrDefault(stockSvc.Namespace) {
+				continue
+			}
+			for _, consumer := range stockSvc.Consumers {
+				if !hasPeerConsumer(svc.Consumers, consumer.Peer) {
+					svc.Consumers = append(svc.Consumers, consumer)
+				}
+			}
+			found = true
+			break
 		}
-		opts := templateOpts{
-			Service:            n.Service,
-			EnterpriseEnabled:  c.config.EnterpriseEnabled,
-			LinkWithFederation: c.topology.LinkWithFederation(),
-			LinkWithPeering:    c.topology.LinkWithPeering(),
+		if !found {
+			user.Services = append(user.Services, stockSvc)
 		}
+	}
+}
 
-		var buf bytes.Buffer
-		if err := serviceRegistrationT.Execute(&buf, opts); err != nil {
-			return err
+func hasPeerConsumer(consumers []api.ServiceConsumer, peer string) bool {
+	for _, consumer := range consumers {
+		if consumer.Peer == peer {
+			return true
 		}
-		regHCL := buf.String()
+	}
+	return false
+}
 
-		filename := "servicereg__" + n.Name + "__" + n.Service.ID.Name + ".hcl"
-		if err := c.cache.WriteStringFile(filename, regHCL); err != nil {
-			return err
+// scrubConfigEntryForOSS clears the namespace and partition fields that OSS
+// consul rejects from a config entry.
+func scrubConfigEntryForOSS(entry api.ConfigEntry) {
+	switch entry.GetKind() {
+	case api.ProxyDefaults:
+		thisEntry := entry.(*api.ProxyConfigEntry)
+		thisEntry.Namespace = ""
+		thisEntry.Partition = ""
+	case api.MeshConfig:
+		thisEntry := entry.(*api.MeshConfigEntry)
+		thisEntry.Namespace = ""
+		thisEntry.Partition = ""
+	case api.ExportedServices:
+		thisEntry := entry.(*api.ExportedServicesConfigEntry)
+		thisEntry.Partition = ""
+		for i := range thisEntry.Services {
+			thisEntry.Services[i].Namespace = ""
+		}
+	case api.ServiceIntentions:
+		thisEntry := entry.(*api.ServiceIntentionsConfigEntry)
+		thisEntry.Namespace = ""
+		thisEntry.Partition = ""
+		for _, src := range thisEntry.Sources {
+			src.Namespace = ""
+			src.Partition = ""
+		}
+	case api.TerminatingGateway:
+		thisEntry := entry.(*api.TerminatingGatewayConfigEntry)
+		thisEntry.Namespace = ""
+		thisEntry.Partition = ""
+		for i := range thisEntry.Services {
+			thisEntry.Services[i].Namespace = ""
+		}
+	case api.IngressGateway:
+		thisEntry := entry.(*api.IngressGatewayConfigEntry)
+		thisEntry.Namespace = ""
+		thisEntry.Partition = ""
+		for i := range thisEntry.Listeners {
+			for j := range thisEntry.Listeners[i].Services {
+				thisEntry.Listeners[i].Services[j].Namespace = ""
+				thisEntry.Listeners[i].Services[j].Partition = ""
+			}
+		}
+	}
+}
+
+func (c *Core) writeServiceRegistrationFiles() error {
+	return c.topology.Walk(func(n *infra.Node) error {
+		if !n.IsAgent() {
+			return nil
+		}
+
+		for _, svc := range n.Services {
+			type templateOpts struct {
+				Service            *infra.Service
+				EnterpriseEnabled  bool
+				PrometheusEnabled  bool
+				LinkWithFederation bool
+				LinkWithPeering    bool
+			}
+			opts := templateOpts{
+				Service:            svc,
+				EnterpriseEnabled:  c.config.EnterpriseEnabled,
+				PrometheusEnabled:  c.config.PrometheusEnabled,
+				LinkWithFederation: c.topology.LinkWithFederation(),
+				LinkWithPeering:    c.topology.LinkWithPeering(),
+			}
+
+			var buf bytes.Buffer
+			if err := serviceRegistrationT.Execute(&buf, opts); err != nil {
+				return err
+			}
+			regHCL := buf.String()
+
+			filename := "servicereg__" + n.Name + "__" + svc.ID.Name + ".hcl"
+			if err := c.cache.WriteStringFile(filename, regHCL); err != nil {
+				return err
+			}
+			c.logger.Info("Generated service registration", "filename", filename)
 		}
-		c.logger.Info("Generated service registration", "filename", filename)
 		return nil
 	})
 }
@@ -15,8 +15,12 @@ services = [
     checks = [
       {
         name     = "up"
-        http     = "http://localhost:{{.Service.Port}}/healthz"
+{{- if .Service.HealthCheckPath }}
+        http     = "http://localhost:{{.Service.Port}}{{.Service.HealthCheckPath}}"
         method   = "GET"
+{{- else }}
+        tcp      = "localhost:{{.Service.Port}}"
+{{- end }}
         interval = "5s"
         timeout  = "1s"
       },
@@ -31,22 +35,46 @@ services = [
     connect {
       sidecar_service {
         proxy {
+{{- if .PrometheusEnabled }}
+          config {
+            envoy_prometheus_bind_addr = "0.0.0.0:{{.Service.EnvoyPrometheusPort}}"
+          }
+{{- end }}
           upstreams = [
+{{- range $i, $up := .Service.Upstreams }}
             {
-              destination_name = "{{.Service.UpstreamID.Name}}"
-{{- if .EnterpriseEnabled }}
-              destination_namespace = "{{.Service.UpstreamID.Namespace}}"
-              destination_partition = "{{.Service.UpstreamID.Partition}}"
+{{- if $up.IsPreparedQuery }}
+              destination_type = "prepared_query"
+{{- end }}
+              destination_name = "{{$up.ID.Name}}"
+{{- if and $.EnterpriseEnabled (not $up.IsPreparedQuery) }}
+              destination_namespace = "{{$up.ID.Namespace}}"
+              destination_partition = "{{$up.ID.Partition}}"
+{{- end }}
+              local_bind_port  = {{$up.LocalPort}}
+{{- if $up.Datacenter }}
+              datacenter = "{{$up.Datacenter}}"
 {{- end }}
-              local_bind_port  = {{.Service.UpstreamLocalPort}}
-{{- if .Service.UpstreamDatacenter }}
-              datacenter = "{{.Service.UpstreamDatacenter}}"
+{{- if $up.Peer }}
+              destination_peer = "{{$up.Peer}}"
 {{- end }}
-{{- if .Service.UpstreamPeer }}
-              destination_peer = "{{.Service.UpstreamPeer}}"
+{{- if $up.MeshGatewayMode }}
+              mesh_gateway {
+                mode = "{{$up.MeshGatewayMode}}"
+              }
+{{- end }}
+{{- if $up.Config }}
+              config {
+{{- range $k, $v := $up.Config }}
+                "{{ $k }}" = "{{ $v }}"
+{{- end }}
+              }
+{{- end }}
+{{- if eq $i 0 }}
+{{ $.Service.UpstreamExtraHCL }}
 {{- end }}
-{{ .Service.UpstreamExtraHCL }}
             },
+{{- end }}
           ]
         }
       }
@@ -0,0 +1,268 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rboyer/devconsul/infra"
+	"github.com/rboyer/devconsul/util"
+)
+
+func TestServiceProtocol(t *testing.T) {
+	ping := util.NewIdentifier("ping", "", "")
+
+	type testcase struct {
+		entries []api.ConfigEntry
+		expect  string
+	}
+
+	cases := map[string]testcase{
+		"no entries": {
+			expect: "tcp",
+		},
+		"service-defaults": {
+			entries: []api.ConfigEntry{
+				&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "ping", Protocol: "http"},
+			},
+			expect: "http",
+		},
+		"service-defaults for another service": {
+			entries: []api.ConfigEntry{
+				&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "pong", Protocol: "http"},
+			},
+			expect: "tcp",
+		},
+		"service-defaults in another partition": {
+			entries: []api.ConfigEntry{
+				&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "ping", Partition: "ap1", Protocol: "http"},
+			},
+			expect: "tcp",
+		},
+		"proxy-defaults": {
+			entries: []api.ConfigEntry{
+				&api.ProxyConfigEntry{Kind: api.ProxyDefaults, Name: api.ProxyConfigGlobal, Config: map[string]interface{}{
+					"protocol": "grpc",
+				}},
+			},
+			expect: "grpc",
+		},
+		"service-defaults wins over proxy-defaults": {
+			entries: []api.ConfigEntry{
+				&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "ping", Protocol: "http2"},
+				&api.ProxyConfigEntry{Kind: api.ProxyDefaults, Name: api.ProxyConfigGlobal, Config: map[string]interface{}{
+					"protocol": "http",
+				}},
+			},
+			expect: "http2",
+		},
+		"service-defaults without a protocol": {
+			entries: []api.ConfigEntry{
+				&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "ping"},
+				&api.ProxyConfigEntry{Kind: api.ProxyDefaults, Name: api.ProxyConfigGlobal, Config: map[string]interface{}{
+					"protocol": "http",
+				}},
+			},
+			expect: "http",
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expect, serviceProtocol(tc.entries, ping))
+		})
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	require.True(t, isTransientError(fmt.Errorf("error establishing peering: %w", api.StatusError{Code: 500, Body: "gateway not ready"})))
+	require.True(t, isTransientError(fmt.Errorf("error establishing peering: %w", refused)))
+	require.False(t, isTransientError(fmt.Errorf("error establishing peering: %w", api.StatusError{Code: 403, Body: "Permission denied"})))
+	require.False(t, isTransientError(fmt.Errorf("error establishing peering: %w", api.StatusError{Code: 400, Body: "bad peer name"})))
+}
+
+func TestExportedServicesEntries(t *testing.T) {
+	var (
+		ping      = util.NewIdentifier("ping", "", "")
+		pong      = util.NewIdentifier("pong", "", "")
+		pingAlpha = util.NewIdentifier("ping", "team", "alpha")
+		pingBeta  = util.NewIdentifier("ping", "", "beta")
+	)
+	downstream := util.NewIdentifier("client", "", "")
+
+	type testcase struct {
+		peered []infra.PeeredUpstream
+		expect []api.ConfigEntry
+	}
+
+	cases := map[string]testcase{
+		"none": {},
+		"one service, one peer": {
+			peered: []infra.PeeredUpstream{
+				{Service: ping, Downstream: downstream, Peer: "dc2"},
+			},
+			expect: []api.ConfigEntry{
+				&api.ExportedServicesConfigEntry{
+					Name:      "default",
+					Partition: "default",
+					Services: []api.ExportedService{
+						{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc2"}}},
+					},
+				},
+			},
+		},
+		"multiple peers on one service": {
+			peered: []infra.PeeredUpstream{
+				{Service: ping, Downstream: downstream, Peer: "dc2"},
+				{Service: pong, Downstream: downstream, Peer: "dc2"},
+				{Service: ping, Downstream: downstream, Peer: "dc3"},
+				// a second downstream behind the same peer
+				{Service: ping, Downstream: util.NewIdentifier("other", "", ""), Peer: "dc2"},
+			},
+			expect: []api.ConfigEntry{
+				&api.ExportedServicesConfigEntry{
+					Name:      "default",
+					Partition: "default",
+					Services: []api.ExportedService{
+						{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc2"}, {Peer: "dc3"}}},
+						{Name: "pong", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc2"}}},
+					},
+				},
+			},
+		},
+		"one entry per partition": {
+			peered: []infra.PeeredUpstream{
+				{Service: pingAlpha, Downstream: downstream, Peer: "dc2"},
+				{Service: ping, Downstream: downstream, Peer: "dc2"},
+				{Service: pingBeta, Downstream: downstream, Peer: "dc3"},
+				{Service: pingAlpha, Downstream: downstream, Peer: "dc3"},
+			},
+			expect: []api.ConfigEntry{
+				&api.ExportedServicesConfigEntry{
+					Name:      "alpha",
+					Partition: "alpha",
+					Services: []api.ExportedService{
+						{Name: "ping", Namespace: "team", Consumers: []api.ServiceConsumer{{Peer: "dc2"}, {Peer: "dc3"}}},
+					},
+				},
+				&api.ExportedServicesConfigEntry{
+					Name:      "default",
+					Partition: "default",
+					Services: []api.ExportedService{
+						{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc2"}}},
+					},
+				},
+				&api.ExportedServicesConfigEntry{
+					Name:      "beta",
+					Partition: "beta",
+					Services: []api.ExportedService{
+						{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc3"}}},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expect, exportedServicesEntries(tc.peered))
+		})
+	}
+}
+
+func TestMergeExportedServices(t *testing.T) {
+	stock := func() *api.ExportedServicesConfigEntry {
+		return &api.ExportedServicesConfigEntry{
+			Name:      "default",
+			Partition: "default",
+			Services: []api.ExportedService{
+				{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc2"}, {Peer: "dc3"}}},
+			},
+		}
+	}
+
+	type testcase struct {
+		user   []api.ExportedService
+		expect []api.ExportedService
+	}
+
+	cases := map[string]testcase{
+		"user entry already lists the service": {
+			user: []api.ExportedService{
+				{Name: "ping", Consumers: []api.ServiceConsumer{{Peer: "dc2"}, {Partition: "alpha"}}},
+			},
+			expect: []api.ExportedService{
+				{Name: "ping", Consumers: []api.ServiceConsumer{{Peer: "dc2"}, {Partition: "alpha"}, {Peer: "dc3"}}},
+			},
+		},
+		"user entry already lists every consumer": {
+			user: []api.ExportedService{
+				{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc3"}, {Peer: "dc2"}}},
+			},
+			expect: []api.ExportedService{
+				{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc3"}, {Peer: "dc2"}}},
+			},
+		},
+		"user entry lacks the service": {
+			user: []api.ExportedService{
+				{Name: "pong", Consumers: []api.ServiceConsumer{{Peer: "dc4"}}},
+			},
+			expect: []api.ExportedService{
+				{Name: "pong", Consumers: []api.ServiceConsumer{{Peer: "dc4"}}},
+				{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc2"}, {Peer: "dc3"}}},
+			},
+		},
+		"same name in another namespace": {
+			user: []api.ExportedService{
+				{Name: "ping", Namespace: "team", Consumers: []api.ServiceConsumer{{Peer: "dc2"}}},
+			},
+			expect: []api.ExportedService{
+				{Name: "ping", Namespace: "team", Consumers: []api.ServiceConsumer{{Peer: "dc2"}}},
+				{Name: "ping", Namespace: "default", Consumers: []api.ServiceConsumer{{Peer: "dc2"}, {Peer: "dc3"}}},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			user := &api.ExportedServicesConfigEntry{Name: "default", Services: tc.user}
+			mergeExportedServices(user, stock())
+			require.Equal(t, tc.expect, user.Services)
+		})
+	}
+}
+
+func TestHasPeerConsumer(t *testing.T) {
+	consumers := []api.ServiceConsumer{{Partition: "dc2"}, {Peer: "dc3"}}
+
+	require.True(t, hasPeerConsumer(consumers, "dc3"))
+	// a partition consumer is not a peer, even with the same name
+	require.False(t, hasPeerConsumer(consumers, "dc2"))
+	require.False(t, hasPeerConsumer(nil, "dc3"))
+}
+
+func TestScrubConfigEntryForOSS(t *testing.T) {
+	peered := []infra.PeeredUpstream{
+		{Service: util.NewIdentifier("ping", "", ""), Downstream: util.NewIdentifier("client", "", ""), Peer: "dc2"},
+	}
+	entries := exportedServicesEntries(peered)
+	require.Len(t, entries, 1)
+
+	scrubConfigEntryForOSS(entries[0])
+	require.Equal(t, &api.ExportedServicesConfigEntry{
+		Name: "default",
+		Services: []api.ExportedService{
+			{Name: "ping", Consumers: []api.ServiceConsumer{{Peer: "dc2"}}},
+		},
+	}, entries[0])
+}
@@ -3,6 +3,7 @@ package app
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
@@ -13,7 +14,9 @@ import (
 	"github.com/mitchellh/copystructure"
 )
 
-const VaultAddr = "http://10.0.100.111:8200"
+func (c *Core) vaultAddr() string {
+	return "http://" + net.JoinHostPort(c.topology.VaultIP(), "8200")
+}
 
 func (c *Core) initVault() error {
 	c.vaultCATokens = make(map[string]string)
@@ -34,7 +37,7 @@ func (c *Core) initVault() error {
 	}
 
 	cfg := vaultapi.DefaultConfig()
-	cfg.Address = VaultAddr
+	cfg.Address = c.vaultAddr()
 	// cfg.Logger = c.logger.Named("vault")
 	cfg.HttpClient = cleanhttp.DefaultPooledClient()
 
@@ -285,7 +288,7 @@ func (c *Core) ensureCAUsesVault(cluster string) error {
 	update := &api.CAConfig{
 		Provider: "vault",
 		Config: map[string]any{
-			"Address":             VaultAddr,
+			"Address":             c.vaultAddr(),
 			"Token":               vaultToken,
 			"RootPKIPath":         "connect_root__" + cluster,
 			"IntermediatePKIPath": "connect_inter__" + cluster,
@@ -1,6 +1,11 @@
 package app
 
-import "fmt"
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/rboyer/devconsul/infra"
+)
 
 func (a *App) RunBringUp() error {
 	return a.runBringUp(false)
@@ -43,6 +48,12 @@ func (a *App) runBringUp(primaryOnly bool) error {
 		return err
 	}
 
+	// Record exactly what was deployed for anything that wants to inspect it
+	// later.
+	if err := infra.SaveTopology(filepath.Join(a.cache.Dir, "topology.json"), a.topology); err != nil {
+		return fmt.Errorf("could not save the topology: %w", err)
+	}
+
 	if err := a.runBoot(primaryOnly); err != nil {
 		return err
 	}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -116,10 +117,29 @@ func (a *App) RunDumpLogs() error {
 				n.Name+"-mesh-gateway",
 			)
 		}
-		if n.Service != nil {
+		if n.IngressGateway {
 			containers = append(
 				containers,
-				n.Name+"-"+n.Service.ID.Name+"-sidecar-proxy",
+				n.Name+"-ingress-gateway",
+			)
+		}
+		if n.TerminatingGateway {
+			containers = append(
+				containers,
+				n.Name+"-terminating-gateway",
+			)
+		}
+		for _, svc := range n.ExternalServices {
+			containers = append(
+				containers,
+				n.Name+"-"+svc.ID.Name,
+			)
+		}
+		for _, svc := range n.Services {
+			containers = append(
+				containers,
+				n.Name+"-"+svc.ID.Name,
+				n.Name+"-"+svc.ID.Name+"-sidecar",
 			)
 		}
 
@@ -306,11 +326,10 @@ func (c *Core) RunCheckMesh() error {
 
 		anyFailed := false
 		c.topology.WalkSilent(func(n *infra.Node) {
-			if !n.RunsWorkloads() || n.MeshGateway || n.Service == nil {
+			if !n.RunsWorkloads() || n.MeshGateway || n.IngressGateway || n.TerminatingGateway {
 				return
 			}
 			addr := n.LocalAddress()
-			sid := n.Service.ID.String()
 
 			nodeSuccessMap, ok := successMap[n.Name]
 			if !ok {
@@ -318,30 +337,37 @@ func (c *Core) RunCheckMesh() error {
 				successMap[n.Name] = nodeSuccessMap
 			}
 
-			if _, ok := nodeSuccessMap[sid]; ok {
-				return
-			}
+			for _, svc := range n.Services {
+				if !svc.IsPingPong() || len(svc.Upstreams) == 0 {
+					continue // only the pingpong app knows how to report on its upstream
+				}
+				sid := svc.ID.String()
 
-			logger := c.logger.With(
-				"node", n.Name,
-				"service", sid,
-				"addr", addr,
-			)
+				if _, ok := nodeSuccessMap[sid]; ok {
+					continue
+				}
 
-			// logger.Info("Checking pingpong mesh instance")
+				logger := c.logger.With(
+					"node", n.Name,
+					"service", sid,
+					"addr", addr,
+				)
 
-			status, err := fetchPingHealthz(client, addr)
-			if err != nil {
-				logger.Error("fetching endpoint failed", "error", err)
-				anyFailed = true
-				return
-			}
-			if status == "OK" {
-				logger.Info("last ping", "status", status)
-				nodeSuccessMap[sid] = struct{}{}
-			} else {
-				logger.Error("last ping", "status", status)
-				anyFailed = true
+				// logger.Info("Checking pingpong mesh instance")
+
+				status, err := fetchPingHealthz(client, addr, svc.Port)
+				if err != nil {
+					logger.Error("fetching endpoint failed", "error", err)
+					anyFailed = true
+					continue
+				}
+				if status == "OK" {
+					logger.Info("last ping", "status", status)
+					nodeSuccessMap[sid] = struct{}{}
+				} else {
+					logger.Error("last ping", "status", status)
+					anyFailed = true
+				}
 			}
 		})
 		if !anyFailed {
@@ -377,8 +403,8 @@ type Ping struct {
 	// DurSec int        `json:",omitempty"`
 }
 
-func fetchPingHealthz(client *http.Client, addr string) (string, error) {
-	resp, err := client.Get("http://" + addr + ":8080/pinghealthz")
+func fetchPingHealthz(client *http.Client, addr string, port int) (string, error) {
+	resp, err := client.Get("http://" + addr + ":" + strconv.Itoa(port) + "/pinghealthz")
 	if err != nil {
 		return "", err
 	}
@@ -10,7 +10,7 @@ import (
 func (c *Core) destroy(_ bool) error {
 	c.logger.Info("destroying everything")
 
-	if err := c.terraformDestroy(); err != nil {
+	if err := c.teardown(); err != nil {
 		return err
 	}
 
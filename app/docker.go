@@ -11,6 +11,8 @@ import (
 	"github.com/rboyer/safeio"
 	"golang.org/x/crypto/blake2b"
 
+	"github.com/rboyer/devconsul/app/tfgen"
+	"github.com/rboyer/devconsul/config"
 	"github.com/rboyer/devconsul/infra"
 )
 
@@ -30,16 +32,16 @@ func (a *App) buildDockerImages(force bool) error {
 		if err := addFileToHash(a.runner.GetPathToSelf(), hash); err != nil {
 			return err
 		}
-		if err := addFileToHash(DefaultConfigFile, hash); err != nil {
+		if err := addFileToHash(a.configFile, hash); err != nil {
 			return err
 		}
-		if err := addFileToHash("Dockerfile-envoy", hash); err != nil {
+		if err := addFileToHash(a.projectPath("Dockerfile-envoy"), hash); err != nil {
 			return err
 		}
-		if err := addFileToHash("Dockerfile-cdp", hash); err != nil {
+		if err := addFileToHash(a.projectPath("Dockerfile-cdp"), hash); err != nil {
 			return err
 		}
-		if err := addFileToHash("Dockerfile-tool", hash); err != nil {
+		if err := addFileToHash(a.projectPath("Dockerfile-tool"), hash); err != nil {
 			return err
 		}
 
@@ -49,6 +51,15 @@ func (a *App) buildDockerImages(force bool) error {
 		hash.Write([]byte(a.config.CanaryVersions.Envoy))
 		hash.Write([]byte(a.config.CanaryVersions.ConsulImage))
 		hash.Write([]byte(a.config.CanaryVersions.DataplaneImage))
+		for _, c := range a.config.TopologyClusters {
+			if c.HasVersionOverrides() {
+				v := a.config.ClusterVersions(c.Name)
+				hash.Write([]byte(c.Name))
+				hash.Write([]byte(v.Envoy))
+				hash.Write([]byte(v.ConsulImage))
+				hash.Write([]byte(v.DataplaneImage))
+			}
+		}
 
 		currentHash = fmt.Sprintf("%x", hash.Sum(nil))
 	}
@@ -70,15 +81,21 @@ func (a *App) buildDockerImages(force bool) error {
 		return nil
 	}
 
-	// tag base
-	if err := a.runner.DockerExec([]string{
-		"tag",
-		a.config.Versions.ConsulImage,
-		"local/consul-base:latest",
-	}, nil); err != nil {
+	if err := a.buildVersionedImages(a.config.Versions, ""); err != nil {
 		return err
 	}
 
+	// Clusters that override the global versions get their own images.
+	for _, c := range a.config.TopologyClusters {
+		if !c.HasVersionOverrides() {
+			continue
+		}
+		suffix := tfgen.ClusterImageSuffix(a.config, c.Name)
+		if err := a.buildVersionedImages(a.config.ClusterVersions(c.Name), suffix); err != nil {
+			return err
+		}
+	}
+
 	if a.config.CanaryVersions.ConsulImage != "" {
 		if err := a.runner.DockerExec([]string{
 			"tag",
@@ -89,20 +106,6 @@ func (a *App) buildDockerImages(force bool) error {
 		}
 	}
 
-	// build
-	if err := a.runner.DockerExec([]string{
-		"build",
-		"--build-arg",
-		"CONSUL_IMAGE=local/consul-base:latest",
-		"--build-arg",
-		"ENVOY_VERSION=" + a.config.Versions.Envoy,
-		"-t", "local/consul-envoy",
-		"-f", "Dockerfile-envoy",
-		".",
-	}, nil); err != nil {
-		return err
-	}
-
 	if a.config.CanaryVersions.Envoy != "" {
 		if err := a.runner.DockerExec([]string{
 			"build",
@@ -111,33 +114,21 @@ func (a *App) buildDockerImages(force bool) error {
 			"--build-arg",
 			"ENVOY_VERSION=" + a.config.CanaryVersions.Envoy,
 			"-t", "local/consul-envoy-canary",
-			"-f", "Dockerfile-envoy",
-			".",
+			"-f", a.projectPath("Dockerfile-envoy"),
+			a.projectDir,
 		}, nil); err != nil {
 			return err
 		}
 	}
 
-	// build cdp
-	if err := a.runner.DockerExec([]string{
-		"build",
-		"--build-arg",
-		"DATAPLANE_IMAGE=" + a.config.Versions.DataplaneImage,
-		"-t", "local/consul-dataplane",
-		"-f", "Dockerfile-cdp",
-		".",
-	}, nil); err != nil {
-		return err
-	}
-
 	if a.config.CanaryVersions.DataplaneImage != "" {
 		if err := a.runner.DockerExec([]string{
 			"build",
 			"--build-arg",
 			"DATAPLANE_IMAGE=" + a.config.CanaryVersions.DataplaneImage,
 			"-t", "local/consul-dataplane-canary",
-			"-f", "Dockerfile-cdp",
-			".",
+			"-f", a.projectPath("Dockerfile-cdp"),
+			a.projectDir,
 		}, nil); err != nil {
 			return err
 		}
@@ -145,7 +136,7 @@ func (a *App) buildDockerImages(force bool) error {
 
 	// build tool
 	{
-		_, err := os.Stat("./bin/clustertool")
+		_, err := os.Stat(a.projectPath("bin", "clustertool"))
 		if os.IsNotExist(err) {
 			return fmt.Errorf("clustertool binary not present in bin/ ; please run 'make'")
 		} else if err != nil {
@@ -155,8 +146,8 @@ func (a *App) buildDockerImages(force bool) error {
 		if err := a.runner.DockerExec([]string{
 			"build",
 			"-t", "local/clustertool",
-			"-f", "Dockerfile-tool",
-			"./bin",
+			"-f", a.projectPath("Dockerfile-tool"),
+			a.projectPath("bin"),
 		}, nil); err != nil {
 			return err
 		}
@@ -170,6 +161,48 @@ func (a *App) buildDockerImages(force bool) error {
 	return nil
 }
 
+// buildVersionedImages tags the consul image and builds the envoy and
+// dataplane images for one set of versions. The image names all end with
+// suffix.
+func (a *App) buildVersionedImages(v config.Versions, suffix string) error {
+	// tag base
+	if err := a.runner.DockerExec([]string{
+		"tag",
+		v.ConsulImage,
+		"local/consul-base" + suffix + ":latest",
+	}, nil); err != nil {
+		return err
+	}
+
+	// build
+	if err := a.runner.DockerExec([]string{
+		"build",
+		"--build-arg",
+		"CONSUL_IMAGE=local/consul-base" + suffix + ":latest",
+		"--build-arg",
+		"ENVOY_VERSION=" + v.Envoy,
+		"-t", "local/consul-envoy" + suffix,
+		"-f", a.projectPath("Dockerfile-envoy"),
+		a.projectDir,
+	}, nil); err != nil {
+		return err
+	}
+
+	// build cdp
+	if err := a.runner.DockerExec([]string{
+		"build",
+		"--build-arg",
+		"DATAPLANE_IMAGE=" + v.DataplaneImage,
+		"-t", "local/consul-dataplane" + suffix,
+		"-f", a.projectPath("Dockerfile-cdp"),
+		a.projectDir,
+	}, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (a *App) RunStopDC2() error {
 	return a.runStopDC2()
 }
@@ -186,6 +219,12 @@ func (a *App) runStopDC2() error {
 		if n.MeshGateway {
 			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-mesh-gateway")
 		}
+		if n.IngressGateway {
+			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-ingress-gateway")
+		}
+		if n.TerminatingGateway {
+			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-terminating-gateway")
+		}
 	})
 
 	args := []string{"stop"}
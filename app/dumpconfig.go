@@ -37,15 +37,24 @@ func (c *Core) RunConfigDump() error {
 		if n.MeshGateway {
 			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-mesh-gateway")
 		}
+		if n.IngressGateway {
+			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-ingress-gateway")
+		}
+		if n.TerminatingGateway {
+			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-terminating-gateway")
+		}
 		if n.Kind == infra.NodeKindInfra {
 			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-catalog-sync")
+			for _, s := range n.ExternalServices {
+				containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-"+s.ID.Name)
+			}
 		}
 
-		if n.RunsWorkloads() && n.Service != nil {
-			s := n.Service
-
-			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-"+s.ID.Name)
-			containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-"+s.ID.Name+"-sidecar")
+		if n.RunsWorkloads() {
+			for _, s := range n.Services {
+				containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-"+s.ID.Name)
+				containers[n.Cluster] = append(containers[n.Cluster], n.Name+"-"+s.ID.Name+"-sidecar")
+			}
 		}
 	})
 
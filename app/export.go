@@ -0,0 +1,202 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rboyer/devconsul/app/tfgen"
+	"github.com/rboyer/devconsul/config"
+)
+
+// RunExport writes the environment out so that it can be run without
+// devconsul. The only format so far is "compose", which writes a docker
+// compose file into a directory (default "export", relative to the config
+// file) along with every file from the cache and the project that its
+// containers mount, and what is needed to build the "local/..." images.
+func (a *App) RunExport() error {
+	args := flag.Args()
+	if len(args) == 0 || args[0] != "compose" || len(args) > 2 {
+		return fmt.Errorf("usage: %s export compose [<dir>]", ProgramName)
+	}
+	dir := "export"
+	if len(args) == 2 {
+		dir = args[1]
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if abs == a.rootDir {
+		return errors.New("cannot export into the directory holding the config file")
+	}
+	if abs == a.projectDir {
+		return errors.New("cannot export into the project directory")
+	}
+	if rel, err := filepath.Rel(a.cache.Dir, abs); err == nil && filepath.IsLocal(rel) {
+		return errors.New("cannot export into the cache directory")
+	}
+
+	// The cache has to be populated by 'up' first, since the containers
+	// refer to the secrets in it.
+	if err := checkHasInitRunOnce(); err != nil {
+		return err
+	}
+	if err := a.generateCatalogInfo(false); err != nil {
+		return err
+	}
+
+	res, err := a.dockerResources(false)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := a.exportBuildFiles(filepath.Join(dir, exportBuildDir)); err != nil {
+		return err
+	}
+
+	// ACL tokens, config entries, and peerings are all created through the
+	// API once the containers are up, so compose can't recreate them.
+	warnings := []string{
+		"The config entries, peerings, and other objects that 'devconsul up' creates through the API once the containers start are not recreated.",
+	}
+	if !a.config.SecurityDisableACLs {
+		warnings = append(warnings, "ACLs are enabled, but the ACL tokens that the agents and proxies use are not recreated, so they will fail to authenticate. Set security.disable_acls = true and run 'devconsul up' before exporting.")
+	}
+
+	opts := tfgen.ComposeOptions{
+		HostDirs: []string{a.rootDir, a.projectDir},
+		Builds:   a.composeBuilds(),
+		Warnings: warnings,
+	}
+	filename := filepath.Join(dir, "docker-compose.yml")
+	_, hostPaths, err := tfgen.WriteComposeFile(a.logger, res, opts, filename, 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, hp := range hostPaths {
+		dest := filepath.Join(dir, hp.Path)
+		if err := copyHostPath(hp.Source, dest); err != nil {
+			return fmt.Errorf("could not copy %q: %w", hp.Source, err)
+		}
+		a.logger.Info("exported file", "path", dest)
+	}
+
+	a.logger.Info("exported docker compose file", "path", filename)
+	for _, w := range warnings {
+		a.logger.Warn(w)
+	}
+	return nil
+}
+
+// exportBuildDir holds the files needed to build the "local/..." images,
+// relative to the compose file.
+const exportBuildDir = "build"
+
+// exportBuildFiles copies the files that buildDockerImages uses into dir, so
+// that compose can build the same images.
+func (a *App) exportBuildFiles(dir string) error {
+	if _, err := os.Stat(a.projectPath("bin", "clustertool")); os.IsNotExist(err) {
+		return fmt.Errorf("clustertool binary not present in bin/ ; please run 'make'")
+	} else if err != nil {
+		return err
+	}
+
+	for src, name := range map[string]string{
+		a.projectPath("Dockerfile-envoy"):   "Dockerfile-envoy",
+		a.projectPath("Dockerfile-cdp"):     "Dockerfile-cdp",
+		a.projectPath("Dockerfile-tool"):    "Dockerfile-tool",
+		a.projectPath("bin", "clustertool"): "clustertool",
+	} {
+		if err := copyHostPath(src, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("could not copy %q: %w", src, err)
+		}
+	}
+	a.logger.Info("exported image build files", "path", dir)
+	return nil
+}
+
+// composeBuilds mirrors buildDockerImages, describing how to build each of
+// the "local/..." images from the files written by exportBuildFiles.
+func (a *App) composeBuilds() map[string]*tfgen.ComposeBuild {
+	builds := make(map[string]*tfgen.ComposeBuild)
+	add := func(image, dockerfile string, args map[string]string) {
+		builds["local/"+image+":latest"] = &tfgen.ComposeBuild{
+			Context:    "./" + exportBuildDir,
+			Dockerfile: dockerfile,
+			Args:       args,
+		}
+	}
+	addVersioned := func(v config.Versions, suffix string) {
+		add("consul-envoy"+suffix, "Dockerfile-envoy", map[string]string{
+			"CONSUL_IMAGE":  v.ConsulImage,
+			"ENVOY_VERSION": v.Envoy,
+		})
+		add("consul-dataplane"+suffix, "Dockerfile-cdp", map[string]string{
+			"DATAPLANE_IMAGE": v.DataplaneImage,
+		})
+	}
+
+	addVersioned(a.config.Versions, "")
+	for _, c := range a.config.TopologyClusters {
+		if c.HasVersionOverrides() {
+			addVersioned(a.config.ClusterVersions(c.Name), tfgen.ClusterImageSuffix(a.config, c.Name))
+		}
+	}
+	if v := a.config.CanaryVersions; v.Envoy != "" {
+		add("consul-envoy-canary", "Dockerfile-envoy", map[string]string{
+			"CONSUL_IMAGE":  v.ConsulImage,
+			"ENVOY_VERSION": v.Envoy,
+		})
+	}
+	if v := a.config.CanaryVersions; v.DataplaneImage != "" {
+		add("consul-dataplane-canary", "Dockerfile-cdp", map[string]string{
+			"DATAPLANE_IMAGE": v.DataplaneImage,
+		})
+	}
+	add("clustertool", "Dockerfile-tool", nil)
+
+	return builds
+}
+
+// copyHostPath copies a file or directory to dest, keeping its permissions.
+func copyHostPath(src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			body, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, body, info.Mode().Perm())
+		default:
+			return nil // skip sockets, symlinks, and the like
+		}
+	})
+}
@@ -50,24 +50,41 @@ func (c *Core) runGenerate(primaryOnly bool) error {
 		}
 	}
 
-	return c.terraformApply()
+	return c.apply()
 }
 
 func (c *Core) generateConfigs(primaryOnly bool) error {
-	var networks []tfgen.Resource
-	for _, net := range c.topology.Networks() {
-		networks = append(networks, tfgen.DockerNetwork(net.DockerName(), net.CIDR))
-	}
-
 	// write it to a cache file just so we can detect full-destroy
-	if res, err := tfgen.WriteHCLResourceFile(c.logger, networks, "cache/networks.tf", 0644); err != nil {
+	if res, err := tfgen.WriteHCLResourceFile(c.logger, c.networkResources(), "cache/networks.tf", 0644); err != nil {
 		return err
 	} else if res == tfgen.UpdateResultModified {
 		// You will need to do a full down/up cycle to switch network_shape.
 		return fmt.Errorf("Networking changed significantly, so you'll have to destroy everything first with 'devconsul down'")
 	}
 
+	res, err := c.dockerResources(primaryOnly)
+	if err != nil {
+		return err
+	}
+	res = append([]tfgen.Resource{tfgen.TerraformProvider()}, res...)
+
+	_, err = tfgen.WriteHCLResourceFile(c.logger, res, "docker.tf", 0644)
+	return err
+}
+
+func (c *Core) networkResources() []tfgen.Resource {
+	var networks []tfgen.Resource
+	for _, net := range c.topology.Networks() {
+		networks = append(networks, tfgen.DockerNetwork(net.DockerName(), net.CIDR))
+	}
+	return networks
+}
+
+// dockerResources returns every network, volume, image, and container that
+// makes up the environment.
+func (c *Core) dockerResources(primaryOnly bool) ([]tfgen.Resource, error) {
 	var (
+		networks   = c.networkResources()
 		volumes    []tfgen.Resource
 		images     []tfgen.Resource
 		containers []tfgen.Resource
@@ -101,17 +118,44 @@ func (c *Core) generateConfigs(primaryOnly bool) error {
 		addImage("consul-dataplane-canary", "local/consul-dataplane-canary:latest") //c.config.CanaryVersions.DataplaneImage)
 	}
 
+	for _, cluster := range c.config.TopologyClusters {
+		if !cluster.HasVersionOverrides() {
+			continue
+		}
+		suffix := tfgen.ClusterImageSuffix(c.config, cluster.Name)
+		addImage("consul"+suffix, c.config.ClusterVersions(cluster.Name).ConsulImage)
+		addImage("consul-envoy"+suffix, "local/consul-envoy"+suffix+":latest")
+		addImage("consul-dataplane"+suffix, "local/consul-dataplane"+suffix+":latest")
+	}
+
+	serviceImages := make(map[string]struct{})
 	if err := c.topology.Walk(func(node *infra.Node) error {
 		if node.IsAgent() {
 			addVolume(node.Name)
 		}
 
+		for _, svc := range node.Services {
+			if svc.IsPingPong() {
+				continue
+			}
+			if _, ok := serviceImages[svc.ID.Name]; !ok {
+				serviceImages[svc.ID.Name] = struct{}{}
+				addImage(tfgen.ServiceImageName(svc.ID.Name), svc.Image)
+			}
+		}
+		for _, svc := range node.ExternalServices {
+			if _, ok := serviceImages[svc.ID.Name]; !ok {
+				serviceImages[svc.ID.Name] = struct{}{}
+				addImage(tfgen.ServiceImageName(svc.ID.Name), svc.Image)
+			}
+		}
+
 		// NOTE: primaryOnly implies we still generate empty pods in the remote datacenters
 		populatePodContents := true
 		if primaryOnly {
 			populatePodContents = node.Cluster == config.PrimaryCluster
 		}
-		myContainers, err := tfgen.GenerateNodeContainers(c.config, c.topology, c.cache, node, populatePodContents)
+		myContainers, err := tfgen.GenerateNodeContainers(c.config, c.topology, c.cache, c.projectDir, node, populatePodContents)
 		if err != nil {
 			return err
 		}
@@ -120,7 +164,7 @@ func (c *Core) generateConfigs(primaryOnly bool) error {
 
 		return nil
 	}); err != nil {
-		return err
+		return nil, err
 	}
 
 	if c.config.PrometheusEnabled {
@@ -128,7 +172,7 @@ func (c *Core) generateConfigs(primaryOnly bool) error {
 		addImage("grafana", "grafana/grafana-oss:9.3.2")
 
 		containers = append(containers,
-			tfgen.PrometheusContainer(),
+			tfgen.PrometheusContainer(c.topology),
 			tfgen.GrafanaContainer(),
 		)
 	}
@@ -138,7 +182,7 @@ func (c *Core) generateConfigs(primaryOnly bool) error {
 		addVolume("vault-data")
 
 		containers = append(containers,
-			tfgen.VaultContainer(),
+			tfgen.VaultContainer(c.topology),
 		)
 	}
 
@@ -148,6 +192,5 @@ func (c *Core) generateConfigs(primaryOnly bool) error {
 	res = append(res, images...)
 	res = append(res, containers...)
 
-	_, err := tfgen.WriteHCLResourceFile(c.logger, res, "docker.tf", 0644)
-	return err
+	return res, nil
 }
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+
 	"github.com/rboyer/devconsul/config"
 	"github.com/rboyer/devconsul/infra"
 	"github.com/rboyer/devconsul/structs"
@@ -32,28 +35,19 @@ func (c *Core) generateCatalogInfo(primaryOnly bool) error {
 			if n.Cluster != cluster.Name {
 				return nil
 			}
-			if n.Service == nil {
+			if len(n.ExternalServices) > 0 {
+				defineExternalServices(logger, n, nodes, services, proxies)
 				return nil
 			}
-
-			if n.Kind != infra.NodeKindDataplane {
+			if len(n.Services) == 0 && !n.MeshGateway {
 				return nil
 			}
 
-			if n.Service.UpstreamExtraHCL != "" {
-				panic("cannot do this")
+			if n.Kind != infra.NodeKindDataplane {
+				return nil
 			}
 
-			var (
-				nid      = util.NewIdentifier2(consulNodeName, n.Partition)
-				sidApp   = n.Service.ID
-				sidProxy = util.NewIdentifier(
-					n.Service.ID.Name+"-sidecar-proxy",
-					n.Service.ID.Namespace,
-					n.Service.ID.Partition,
-				)
-			)
-
+			nid := util.NewIdentifier2(consulNodeName, n.Partition)
 			if _, ok := nodes[nid]; !ok {
 				nodes[nid] = &structs.CatalogNode{
 					Node:    consulNodeName,
@@ -64,69 +58,110 @@ func (c *Core) generateCatalogInfo(primaryOnly bool) error {
 				}
 				logger.Info("agentless node defined",
 					"node", consulNodeName,
-					"partition", n.Service.ID.Partition,
+					"partition", n.Partition,
 				)
 
 				services[nid] = make(map[util.Identifier]*structs.CatalogService)
 				proxies[nid] = make(map[util.Identifier]*structs.CatalogProxy)
 			}
 
-			// register app on node
-			services[nid][sidApp] = &structs.CatalogService{
-				Node:      consulNodeName,
-				Partition: n.Partition,
-				//
-				Service:   n.Service.ID.Name,
-				Meta:      n.Service.Meta,
-				Port:      n.Service.Port,
-				Address:   n.LocalAddress(),
-				Namespace: n.Service.ID.Namespace,
-				//
-				CheckID:  n.Service.ID.String(),
-				TCPCheck: n.LocalAddress() + ":" + strconv.Itoa(n.Service.Port),
+			if n.MeshGateway {
+				gw := c.meshGatewayProxy(consulNodeName, n)
+				proxies[nid][gw.ID()] = gw
+
+				logger.Info("agentless mesh gateway defined",
+					"node", consulNodeName,
+					"partition", n.Partition,
+				)
 			}
 
-			logger.Info("agentless service defined",
-				"service", n.Service.ID.Name,
-				"node", consulNodeName,
-				"namespace", n.Service.ID.Namespace,
-				"partition", n.Service.ID.Partition,
-			)
+			for _, svc := range n.Services {
+				if svc.UpstreamExtraHCL != "" {
+					return fmt.Errorf("service %q on node %q uses upstream_extra_hcl, which is not supported on dataplane nodes", svc.ID.Name, n.Name)
+				}
+
+				var (
+					sidApp   = svc.ID
+					sidProxy = util.NewIdentifier(
+						svc.ID.Name+"-sidecar-proxy",
+						svc.ID.Namespace,
+						svc.ID.Partition,
+					)
+				)
 
-			// register proxy for service
-			proxies[nid][sidProxy] = &structs.CatalogProxy{
-				CatalogService: structs.CatalogService{
+				// register app on node
+				app := &structs.CatalogService{
 					Node:      consulNodeName,
 					Partition: n.Partition,
 					//
-					Service:   n.Service.ID.Name + "-sidecar-proxy",
-					Meta:      n.Service.Meta,
-					Port:      20000, // TODO: fake
+					Service:   svc.ID.Name,
+					Meta:      svc.Meta,
+					Port:      svc.Port,
 					Address:   n.LocalAddress(),
-					Namespace: n.Service.ID.Namespace,
+					Namespace: svc.ID.Namespace,
 					//
-					CheckID:  n.Service.ID.String(),
-					TCPCheck: n.LocalAddress() + ":20000",
-				},
-				ProxyDestinationServiceName: n.Service.ID.Name,
-				ProxyLocalServicePort:       n.Service.Port,
-				ProxyUpstreams: []*structs.CatalogProxyUpstream{{
-					DestinationName:      n.Service.UpstreamID.Name,
-					DestinationNamespace: n.Service.UpstreamID.Namespace,
-					DestinationPartition: n.Service.UpstreamID.Partition,
-					DestinationPeer:      n.Service.UpstreamPeer,
-					LocalBindPort:        n.Service.UpstreamLocalPort,
-					Datacenter:           n.Service.UpstreamDatacenter,
-				}},
-			}
+					CheckID: svc.ID.String(),
+				}
+				if svc.HealthCheckPath != "" {
+					app.HTTPCheck = "http://" + n.LocalAddress() + ":" + strconv.Itoa(svc.Port) + svc.HealthCheckPath
+				} else {
+					app.TCPCheck = n.LocalAddress() + ":" + strconv.Itoa(svc.Port)
+				}
+				services[nid][sidApp] = app
+
+				logger.Info("agentless service defined",
+					"service", svc.ID.Name,
+					"node", consulNodeName,
+					"namespace", svc.ID.Namespace,
+					"partition", svc.ID.Partition,
+				)
 
-			logger.Info("agentless proxy defined",
-				"service", n.Service.ID.Name+"-sidecar-proxy",
-				"node", consulNodeName,
-				"namespace", n.Service.ID.Namespace,
-				"namespace", n.Service.ID.Namespace,
-				"partition", n.Service.ID.Partition,
-			)
+				// register proxy for service
+				publicPort := strconv.Itoa(svc.EnvoyPublicListenerPort)
+				proxy := &structs.CatalogProxy{
+					CatalogService: structs.CatalogService{
+						Node:      consulNodeName,
+						Partition: n.Partition,
+						//
+						Service:   svc.ID.Name + "-sidecar-proxy",
+						Meta:      svc.Meta,
+						Port:      svc.EnvoyPublicListenerPort,
+						Address:   n.LocalAddress(),
+						Namespace: svc.ID.Namespace,
+						//
+						CheckID:  svc.ID.String(),
+						TCPCheck: n.LocalAddress() + ":" + publicPort,
+					},
+					ProxyDestinationServiceName: svc.ID.Name,
+					ProxyLocalServicePort:       svc.Port,
+				}
+				for _, up := range svc.Upstreams {
+					proxy.ProxyUpstreams = append(proxy.ProxyUpstreams, &structs.CatalogProxyUpstream{
+						DestinationType:      up.Type,
+						DestinationName:      up.ID.Name,
+						DestinationNamespace: up.ID.Namespace,
+						DestinationPartition: up.ID.Partition,
+						DestinationPeer:      up.Peer,
+						LocalBindPort:        up.LocalPort,
+						Datacenter:           up.Datacenter,
+						MeshGatewayMode:      up.MeshGatewayMode,
+						Config:               up.Config,
+					})
+				}
+				if c.config.PrometheusEnabled {
+					proxy.ProxyConfig = map[string]any{
+						"envoy_prometheus_bind_addr": "0.0.0.0:" + strconv.Itoa(svc.EnvoyPrometheusPort),
+					}
+				}
+				proxies[nid][sidProxy] = proxy
+
+				logger.Info("agentless proxy defined",
+					"service", svc.ID.Name+"-sidecar-proxy",
+					"node", consulNodeName,
+					"namespace", svc.ID.Namespace,
+					"partition", svc.ID.Partition,
+				)
+			}
 
 			return nil
 		})
@@ -163,3 +198,115 @@ func (c *Core) generateCatalogInfo(primaryOnly bool) error {
 
 	return nil
 }
+
+// defineExternalServices registers the external services running in the
+// infra pod on a virtual external node, as if they lived outside of consul
+// entirely. Nothing runs a consul agent there, so catalog-sync keeps their
+// health up to date.
+func defineExternalServices(
+	logger hclog.Logger,
+	n *infra.Node,
+	nodes map[util.Identifier2]*structs.CatalogNode,
+	services map[util.Identifier2]map[util.Identifier]*structs.CatalogService,
+	proxies map[util.Identifier2]map[util.Identifier]*structs.CatalogProxy,
+) {
+	consulNodeName := n.Name + "-external"
+
+	nid := util.NewIdentifier2(consulNodeName, n.Partition)
+	nodes[nid] = &structs.CatalogNode{
+		Node:    consulNodeName,
+		Address: n.LocalAddress(),
+		NodeMeta: map[string]string{
+			"devconsul-virtual": "1",
+			"external-node":     "true",
+			"external-probe":    "false",
+		},
+		Partition: n.Partition,
+	}
+	services[nid] = make(map[util.Identifier]*structs.CatalogService)
+	proxies[nid] = make(map[util.Identifier]*structs.CatalogProxy)
+
+	logger.Info("external node defined",
+		"node", consulNodeName,
+		"partition", n.Partition,
+	)
+
+	for _, svc := range n.ExternalServices {
+		ext := &structs.CatalogService{
+			Node:      consulNodeName,
+			Partition: n.Partition,
+			//
+			Service:   svc.ID.Name,
+			Port:      svc.Port,
+			Address:   n.LocalAddress(),
+			Namespace: svc.ID.Namespace,
+			//
+			CheckID: svc.ID.String(),
+		}
+		if svc.HealthCheckPath != "" {
+			ext.HTTPCheck = "http://" + n.LocalAddress() + ":" + strconv.Itoa(svc.Port) + svc.HealthCheckPath
+		} else {
+			ext.TCPCheck = n.LocalAddress() + ":" + strconv.Itoa(svc.Port)
+		}
+		services[nid][svc.ID] = ext
+
+		logger.Info("external service defined",
+			"service", svc.ID.Name,
+			"node", consulNodeName,
+			"namespace", svc.ID.Namespace,
+			"partition", svc.ID.Partition,
+		)
+	}
+}
+
+// meshGatewayProxy registers the mesh gateway running on an agentless node
+// in the same way that 'consul connect envoy -register' would.
+func (c *Core) meshGatewayProxy(consulNodeName string, n *infra.Node) *structs.CatalogProxy {
+	const port = 8443
+
+	gw := &structs.CatalogProxy{
+		CatalogService: structs.CatalogService{
+			Node:      consulNodeName,
+			Partition: n.Partition,
+			//
+			Service:   "mesh-gateway",
+			Port:      port,
+			Address:   n.LocalAddress(),
+			Namespace: "default",
+			//
+			CheckID:  util.NewIdentifier("mesh-gateway", "", n.Partition).String(),
+			TCPCheck: n.LocalAddress() + ":" + strconv.Itoa(port),
+		},
+		Kind:              string(api.ServiceKindMeshGateway),
+		GatewayWANAddress: n.LocalAddress(),
+		GatewayWANPort:    port,
+	}
+
+	proxyConfig := make(map[string]any)
+
+	switch c.topology.NetworkShape {
+	case infra.NetworkShapeIslands, infra.NetworkShapeDual, infra.NetworkShapeCustom:
+		gw.GatewayWANAddress = n.PublicAddress()
+		if c.topology.LinkWithFederation() {
+			// This is what -expose-servers does.
+			gw.Meta = map[string]string{"consul-wan-federation": "1"}
+		}
+		// Listen on both the LAN and WAN addresses rather than just the
+		// service address, like 'consul connect envoy -register' does when
+		// it is given both.
+		proxyConfig["envoy_gateway_no_default_bind"] = true
+		proxyConfig["envoy_gateway_bind_tagged_addresses"] = true
+	case infra.NetworkShapeFlat:
+		if n.MeshGatewayUseDNSWANAddress {
+			gw.GatewayWANAddress = n.PodName()
+		}
+	}
+
+	if c.config.PrometheusEnabled {
+		proxyConfig["envoy_prometheus_bind_addr"] = "0.0.0.0:9102"
+	}
+	if len(proxyConfig) > 0 {
+		gw.ProxyConfig = proxyConfig
+	}
+	return gw
+}
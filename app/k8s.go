@@ -8,8 +8,6 @@ import (
 
 	"github.com/rboyer/safeio"
 	"golang.org/x/crypto/blake2b"
-
-	"github.com/rboyer/devconsul/config"
 )
 
 func (c *Core) runK8SInit() error {
@@ -33,7 +31,7 @@ func (c *Core) runK8SInit() error {
 		if err := addFileToHash(c.runner.GetPathToSelf(), hash); err != nil {
 			return err
 		}
-		if err := addFileToHash(DefaultConfigFile, hash); err != nil {
+		if err := addFileToHash(c.configFile, hash); err != nil {
 			return err
 		}
 
@@ -92,9 +90,15 @@ func (c *Core) realRunK8SInit() error {
 
 	const saName = "consul-server-auth-method"
 
+	var rbac bytes.Buffer
+	fmt.Fprintf(&rbac, kubeRBACTemplate, saName)
+	for _, svc := range c.config.Services() {
+		fmt.Fprintf(&rbac, kubeServiceAccountTemplate, svc.Name)
+	}
+
 	c.logger.Info(">>> creating RBAC entities", "serviceaccount", saName)
 	_, err = safeio.WriteToFile(
-		bytes.NewBuffer([]byte(fmt.Sprintf(kubeRBACTemplate, saName))),
+		&rbac,
 		"cache/k8s/k8s-rbac-boot.yml",
 		0644,
 	)
@@ -116,11 +120,10 @@ func (c *Core) realRunK8SInit() error {
 	}
 
 	// also get secrets for service accounts in pods
-	if err := c.writeServiceAccountSecret(config.ServicePing, "cache/k8s/service_jwt_token.ping"); err != nil {
-		return err
-	}
-	if err := c.writeServiceAccountSecret(config.ServicePong, "cache/k8s/service_jwt_token.pong"); err != nil {
-		return err
+	for _, svc := range c.config.Services() {
+		if err := c.writeServiceAccountSecret(svc.Name, "cache/k8s/service_jwt_token."+svc.Name); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -255,14 +258,11 @@ apiVersion: v1
 kind: ServiceAccount
 metadata:
   name: %[1]s
----
-apiVersion: v1
-kind: ServiceAccount
-metadata:
-  name: ping
----
+`
+
+const kubeServiceAccountTemplate = `---
 apiVersion: v1
 kind: ServiceAccount
 metadata:
-  name: pong
+  name: %[1]s
 `
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rboyer/safeio"
+
+	"github.com/rboyer/devconsul/config"
+)
+
+// Migrate rewrites the config file described by opts in place so that it no
+// longer uses any deprecated fields, and describes what changed to w.
+func Migrate(w io.Writer, opts Options) error {
+	if opts.ConfigFile == "" {
+		opts.ConfigFile = DefaultConfigFile
+	}
+
+	info, err := os.Stat(opts.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("Missing required %s file: %v", opts.ConfigFile, err)
+	}
+
+	contents, err := os.ReadFile(opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	migrated, changes, err := config.Migrate(opts.ConfigFile, contents)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		_, err := fmt.Fprintf(w, "%s is already up to date.\n", opts.ConfigFile)
+		return err
+	}
+
+	if _, err := safeio.WriteToFile(bytes.NewReader(migrated), opts.ConfigFile, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if _, err := fmt.Fprintf(w, "- %s\n", change); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "Migrated %s.\n", opts.ConfigFile)
+	return err
+}
@@ -0,0 +1,382 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// dockerAPIVersion is the oldest version of the Engine API that has
+// everything the docker backend uses (docker 20.10).
+const dockerAPIVersion = "v1.41"
+
+// DockerAPI is a small client for the parts of the Docker Engine API needed
+// by the docker backend. It talks to the daemon named by DOCKER_HOST, or to
+// the default unix socket.
+type DockerAPI struct {
+	client *http.Client
+	base   string
+}
+
+func newDockerAPI() (*DockerAPI, error) {
+	// Only plaintext connections are supported, so refuse to talk to a daemon
+	// that expects TLS rather than fail in some confusing way.
+	for _, env := range []string{"DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH"} {
+		if os.Getenv(env) != "" {
+			return nil, fmt.Errorf("%s is set, but the docker backend does not support TLS; unset it or use backend = %q", env, BackendTerraform)
+		}
+	}
+
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DOCKER_HOST %q: %w", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		return &DockerAPI{
+			client: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", socket)
+					},
+				},
+			},
+			base: "http://docker/" + dockerAPIVersion,
+		}, nil
+	case "tcp":
+		return &DockerAPI{
+			client: &http.Client{},
+			base:   "http://" + u.Host + "/" + dockerAPIVersion,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DOCKER_HOST %q: only unix:// and tcp:// are supported", host)
+	}
+}
+
+// DockerAPIError is a non-2xx response from the Engine API.
+type DockerAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerAPIError) Error() string {
+	return fmt.Sprintf("docker engine api returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsDockerNotFound returns true if the error is a 404 from the Engine API.
+func IsDockerNotFound(err error) bool {
+	var apiErr *DockerAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func (d *DockerAPI) do(method, path string, query url.Values, in, out any) error {
+	resp, err := d.send(method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (d *DockerAPI) send(method, path string, query url.Values, in any) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	u := d.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the docker engine api: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var msg struct {
+			Message string `json:"message"`
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(raw, &msg); err != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(raw))
+		}
+		return nil, &DockerAPIError{StatusCode: resp.StatusCode, Message: msg.Message}
+	}
+	return resp, nil
+}
+
+func labelFilter(label string) url.Values {
+	filters, _ := json.Marshal(map[string][]string{"label": {label}})
+	return url.Values{"filters": {string(filters)}}
+}
+
+type DockerContainerSummary struct {
+	ID         string `json:"Id"`
+	Names      []string
+	Labels     map[string]string
+	State      string
+	HostConfig struct {
+		NetworkMode string
+	}
+}
+
+// Name returns the name of the container without the leading slash.
+func (c *DockerContainerSummary) Name() string {
+	if len(c.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// JoinsNetwork returns true if the container shares the network namespace of
+// another container.
+func (c *DockerContainerSummary) JoinsNetwork() bool {
+	return strings.HasPrefix(c.HostConfig.NetworkMode, "container:")
+}
+
+// ContainerList returns every container, running or not, with the given
+// label (like "devconsul=1").
+func (d *DockerAPI) ContainerList(label string) ([]*DockerContainerSummary, error) {
+	query := labelFilter(label)
+	query.Set("all", "1")
+
+	var out []*DockerContainerSummary
+	if err := d.do("GET", "/containers/json", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DockerContainerConfig is the body of a container create request.
+type DockerContainerConfig struct {
+	Image            string
+	Hostname         string              `json:",omitempty"`
+	Env              []string            `json:",omitempty"`
+	Cmd              []string            `json:",omitempty"`
+	Labels           map[string]string   `json:",omitempty"`
+	ExposedPorts     map[string]struct{} `json:",omitempty"`
+	HostConfig       DockerHostConfig
+	NetworkingConfig *DockerNetworkingConfig `json:",omitempty"`
+}
+
+type DockerHostConfig struct {
+	NetworkMode   string `json:",omitempty"`
+	RestartPolicy DockerRestartPolicy
+	DNS           []string                       `json:"Dns,omitempty"`
+	Binds         []string                       `json:",omitempty"`
+	PortBindings  map[string][]DockerPortBinding `json:",omitempty"`
+}
+
+type DockerRestartPolicy struct {
+	Name string `json:",omitempty"`
+}
+
+type DockerPortBinding struct {
+	HostPort string
+}
+
+type DockerNetworkingConfig struct {
+	EndpointsConfig map[string]*DockerEndpointConfig
+}
+
+type DockerEndpointConfig struct {
+	IPAMConfig *DockerEndpointIPAMConfig `json:",omitempty"`
+}
+
+type DockerEndpointIPAMConfig struct {
+	IPv4Address string `json:",omitempty"`
+}
+
+// ContainerCreate creates (but does not start) the named container and
+// returns its ID.
+func (d *DockerAPI) ContainerCreate(name string, cfg *DockerContainerConfig) (string, error) {
+	var out struct {
+		ID string `json:"Id"`
+	}
+	if err := d.do("POST", "/containers/create", url.Values{"name": {name}}, cfg, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+func (d *DockerAPI) ContainerStart(id string) error {
+	return d.do("POST", "/containers/"+url.PathEscape(id)+"/start", nil, nil, nil)
+}
+
+// ContainerRemove forcibly removes a container, stopping it first if needed.
+func (d *DockerAPI) ContainerRemove(id string) error {
+	err := d.do("DELETE", "/containers/"+url.PathEscape(id), url.Values{"force": {"1"}}, nil, nil)
+	if IsDockerNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// ImageInspect returns the ID of a local image.
+func (d *DockerAPI) ImageInspect(image string) (string, error) {
+	var out struct {
+		ID string `json:"Id"`
+	}
+	if err := d.do("GET", "/images/"+image+"/json", nil, nil, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// ImagePull pulls an image from its registry and waits for it to finish.
+func (d *DockerAPI) ImagePull(image string) error {
+	query := url.Values{"fromImage": {image}}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		query.Set("fromImage", image[:i])
+		query.Set("tag", image[i+1:])
+	}
+
+	resp, err := d.send("POST", "/images/create", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The progress is streamed back, and failures partway through only show
+	// up as a message in the stream.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("could not pull %q: %s", image, msg.Error)
+		}
+	}
+}
+
+type DockerNetworkSummary struct {
+	ID     string `json:"Id"`
+	Name   string
+	Labels map[string]string
+	IPAM   struct {
+		Config []struct {
+			Subnet string
+		}
+	}
+}
+
+// Subnet returns the first subnet of the network.
+func (n *DockerNetworkSummary) Subnet() string {
+	if len(n.IPAM.Config) == 0 {
+		return ""
+	}
+	return n.IPAM.Config[0].Subnet
+}
+
+func (d *DockerAPI) NetworkList(label string) ([]*DockerNetworkSummary, error) {
+	var out []*DockerNetworkSummary
+	if err := d.do("GET", "/networks", labelFilter(label), nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (d *DockerAPI) NetworkCreate(name, subnet string, labels map[string]string) error {
+	type ipamConfig struct {
+		Subnet string
+	}
+	body := map[string]any{
+		"Name":           name,
+		"CheckDuplicate": true,
+		"Attachable":     true,
+		"Labels":         labels,
+		"IPAM": map[string]any{
+			"Config": []ipamConfig{{Subnet: subnet}},
+		},
+	}
+	return d.do("POST", "/networks/create", nil, body, nil)
+}
+
+// NetworkConnect attaches a container to a network with a fixed address.
+func (d *DockerAPI) NetworkConnect(network, container, ipv4Address string) error {
+	body := map[string]any{
+		"Container": container,
+		"EndpointConfig": &DockerEndpointConfig{
+			IPAMConfig: &DockerEndpointIPAMConfig{IPv4Address: ipv4Address},
+		},
+	}
+	return d.do("POST", "/networks/"+url.PathEscape(network)+"/connect", nil, body, nil)
+}
+
+func (d *DockerAPI) NetworkRemove(id string) error {
+	err := d.do("DELETE", "/networks/"+url.PathEscape(id), nil, nil, nil)
+	if IsDockerNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+type DockerVolumeSummary struct {
+	Name   string
+	Labels map[string]string
+}
+
+func (d *DockerAPI) VolumeList(label string) ([]*DockerVolumeSummary, error) {
+	var out struct {
+		Volumes []*DockerVolumeSummary
+	}
+	if err := d.do("GET", "/volumes", labelFilter(label), nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Volumes, nil
+}
+
+func (d *DockerAPI) VolumeCreate(name string, labels map[string]string) error {
+	body := map[string]any{
+		"Name":   name,
+		"Labels": labels,
+	}
+	return d.do("POST", "/volumes/create", nil, body, nil)
+}
+
+func (d *DockerAPI) VolumeRemove(name string) error {
+	err := d.do("DELETE", "/volumes/"+url.PathEscape(name), nil, nil, nil)
+	if IsDockerNotFound(err) {
+		return nil
+	}
+	return err
+}
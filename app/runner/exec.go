@@ -18,8 +18,17 @@ const (
 	consulFlavorEnterprise = "ent"
 )
 
+// Backend is how the docker resources are brought up and torn down.
+type Backend string
+
+const (
+	BackendTerraform Backend = "terraform"
+	BackendDocker    Backend = "docker" // talk to the docker engine api directly
+)
+
 type Runner struct {
-	logger hclog.Logger
+	logger  hclog.Logger
+	backend Backend
 
 	devconsulBin string // special
 
@@ -30,11 +39,14 @@ type Runner struct {
 	kubectlBin  string // optional
 
 	consulBinFlavor string // oss/ent
+
+	dockerAPI *DockerAPI // only with BackendDocker
 }
 
-func Load(logger hclog.Logger, kubernetesEnabled bool) (*Runner, error) {
+func Load(logger hclog.Logger, kubernetesEnabled bool, backend Backend) (*Runner, error) {
 	r := &Runner{
-		logger: logger,
+		logger:  logger,
+		backend: backend,
 	}
 
 	var err error
@@ -52,7 +64,17 @@ func Load(logger hclog.Logger, kubernetesEnabled bool) (*Runner, error) {
 	lookup := []item{
 		{"consul", &r.consulBin, "run 'make dev' from your consul checkout"},
 		{"docker", &r.dockerBin, ""},
-		{"terraform", &r.tfBin, ""},
+	}
+	switch backend {
+	case BackendTerraform:
+		lookup = append(lookup, item{"terraform", &r.tfBin, ""})
+	case BackendDocker:
+		r.dockerAPI, err = newDockerAPI()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q", backend)
 	}
 	if kubernetesEnabled {
 		lookup = append(lookup,
@@ -112,6 +134,18 @@ func checkIfConsulIsEnterprise(consulBin string) (bool, error) {
 	return strings.HasSuffix(line, "+ent"), nil
 }
 
+func (r *Runner) Backend() Backend {
+	return r.backend
+}
+
+// DockerAPI returns the engine api client used by the docker backend.
+func (r *Runner) DockerAPI() (*DockerAPI, error) {
+	if r.dockerAPI == nil {
+		return nil, fmt.Errorf("the docker engine api is only used with the %q backend, not %q", BackendDocker, r.backend)
+	}
+	return r.dockerAPI, nil
+}
+
 func (r *Runner) DockerExec(args []string, stdout io.Writer) error {
 	return cmdExec("docker", r.dockerBin, args, stdout, "")
 }
@@ -0,0 +1,36 @@
+active = "topology"
+
+config "topology" {
+  consul_image = "consul-dev:latest"
+
+  security {
+    initial_master_token = "root"
+    encryption {
+      tls             = true
+      server_tls_grpc = true
+    }
+  }
+
+  topology {
+    network_shape = "islands"
+    link_mode     = "peer"
+
+    cluster "dc1" {
+      servers       = 1
+      clients       = 2
+      mesh_gateways = 1
+    }
+    cluster "dc2" {
+      servers       = 1
+      clients       = 2
+      mesh_gateways = 1
+    }
+
+    node "dc1-client1" {
+      upstream_peer = "peer-dc2"
+    }
+    node "dc2-client2" {
+      mode = "dataplane"
+    }
+  }
+}
@@ -2,6 +2,7 @@ package tfgen
 
 import (
 	"fmt"
+	"net"
 	"sort"
 	"strconv"
 	"strings"
@@ -56,7 +57,7 @@ func GenerateAgentHCL(
 		if cfg.PrometheusEnabled {
 			b.add("metrics_provider", "prometheus")
 			b.addBlock("metrics_proxy", func() {
-				b.add("base_url", "http://prometheus:9090")
+				b.add("base_url", "http://"+net.JoinHostPort(topology.PrometheusIP(), "9090"))
 			})
 		}
 	})
@@ -147,12 +148,26 @@ func GenerateAgentHCL(
 			}
 		case infra.NetworkShapeDual:
 			useWANIP = true
+		case infra.NetworkShapeCustom:
+			useWANIP = node.HasPublicAddress()
 		case infra.NetworkShapeFlat:
 		default:
 			panic("unknown shape: " + topology.NetworkShape)
 		}
 
-		b.add("bootstrap_expect", len(topology.ServerIPs(node.Cluster)))
+		// Read replicas never vote, so they don't count towards the quorum.
+		b.add("bootstrap_expect", topology.Cluster(node.Cluster).Voters())
+		if node.ReadReplica {
+			b.add("read_replica", true)
+		}
+		if node.Zone != "" {
+			b.addBlock("node_meta", func() {
+				b.add("zone", node.Zone)
+			})
+			b.addBlock("autopilot", func() {
+				b.add("redundancy_zone_tag", "zone")
+			})
+		}
 		b.add("translate_wan_addrs", true)
 		b.addBlock("rpc", func() {
 			b.add("enable_streaming", true)
@@ -231,7 +246,12 @@ func GenerateAgentHCL(
 		}
 	}
 
-	return b.String(), nil
+	// Layer on any raw overrides, most specific last so that it wins.
+	var clusterHCL string
+	if c, ok := cfg.ClusterByName(node.Cluster); ok {
+		clusterHCL = c.AgentExtraHCL
+	}
+	return mergeHCL(b.String(), cfg.AgentExtraHCL, clusterHCL, node.AgentExtraHCL)
 }
 
 type HCLBuilder struct {
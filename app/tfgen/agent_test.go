@@ -0,0 +1,93 @@
+package tfgen
+
+import (
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/rboyer/devconsul/config"
+	"github.com/rboyer/devconsul/infra"
+)
+
+func TestGenerateAgentHCL_ExtraHCL(t *testing.T) {
+	cfg, err := config.LoadConfig("testdata/agent.hcl")
+	require.NoError(t, err)
+	topology, err := infra.CompileTopology(cfg)
+	require.NoError(t, err)
+
+	type testcase struct {
+		node   string
+		expect func(t *testing.T, body *hclsyntax.Body)
+	}
+
+	cases := map[string]testcase{
+		// The server has overrides at every level.
+		"server": {
+			node: "dc1-server1",
+			expect: func(t *testing.T, body *hclsyntax.Body) {
+				requireAttr(t, body, "log_level", cty.StringVal("warn"))
+				requireAttr(t, body, "raft_protocol", cty.NumberIntVal(3))
+				requireAttr(t, body, "server", cty.True)
+
+				limits := requireBlocks(t, body, "limits", 1)[0]
+				requireAttr(t, limits.Body, "rpc_rate", cty.NumberIntVal(10))
+				requireAttr(t, limits.Body, "http_max_conns_per_client", cty.NumberIntVal(100))
+
+				requireBlocks(t, body, "watches", 1)
+				requireBlocks(t, body, "connect", 1)
+			},
+		},
+		// The client only gets the profile and cluster overrides.
+		"client": {
+			node: "dc1-client1",
+			expect: func(t *testing.T, body *hclsyntax.Body) {
+				requireAttr(t, body, "log_level", cty.StringVal("info"))
+				requireAttr(t, body, "raft_protocol", cty.NumberIntVal(3))
+				requireAttr(t, body, "server", cty.False)
+
+				limits := requireBlocks(t, body, "limits", 1)[0]
+				requireAttr(t, limits.Body, "rpc_rate", cty.NumberIntVal(50))
+				requireAttr(t, limits.Body, "http_max_conns_per_client", cty.NumberIntVal(100))
+
+				requireBlocks(t, body, "watches", 0)
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			out, err := GenerateAgentHCL(cfg, topology, topology.Node(tc.node))
+			require.NoError(t, err)
+
+			f, diags := hclsyntax.ParseConfig([]byte(out), "agent.hcl", hcl.InitialPos)
+			require.False(t, diags.HasErrors(), "%v\n%s", diags, out)
+
+			tc.expect(t, f.Body.(*hclsyntax.Body))
+		})
+	}
+}
+
+func requireAttr(t *testing.T, body *hclsyntax.Body, name string, expect cty.Value) {
+	t.Helper()
+	attr, ok := body.Attributes[name]
+	require.True(t, ok, "attribute %q is missing", name)
+	val, diags := attr.Expr.Value(nil)
+	require.False(t, diags.HasErrors(), "%v", diags)
+	require.True(t, expect.RawEquals(val), "%s: expected %#v, got %#v", name, expect, val)
+}
+
+func requireBlocks(t *testing.T, body *hclsyntax.Body, typ string, count int) []*hclsyntax.Block {
+	t.Helper()
+	var out []*hclsyntax.Block
+	for _, block := range body.Blocks {
+		if block.Type == typ {
+			out = append(out, block)
+		}
+	}
+	require.Len(t, out, count, "%s blocks", typ)
+	return out
+}
@@ -0,0 +1,244 @@
+package tfgen
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ComposeProjectName is the project name used in generated compose files.
+const ComposeProjectName = "devconsul"
+
+type composeFile struct {
+	Name     string                     `yaml:"name"`
+	Services map[string]*composeService `yaml:"services"`
+	Networks map[string]*composeNetwork `yaml:"networks,omitempty"`
+	Volumes  map[string]*composeVolume  `yaml:"volumes,omitempty"`
+}
+
+type composeService struct {
+	ContainerName string                        `yaml:"container_name"`
+	Image         string                        `yaml:"image"`
+	Build         *ComposeBuild                 `yaml:"build,omitempty"`
+	Hostname      string                        `yaml:"hostname,omitempty"`
+	Restart       string                        `yaml:"restart,omitempty"`
+	DNS           []string                      `yaml:"dns,omitempty"`
+	Labels        map[string]string             `yaml:"labels,omitempty"`
+	NetworkMode   string                        `yaml:"network_mode,omitempty"`
+	DependsOn     []string                      `yaml:"depends_on,omitempty"`
+	Networks      map[string]*composeAttachment `yaml:"networks,omitempty"`
+	Ports         []string                      `yaml:"ports,omitempty"`
+	Volumes       []*composeMount               `yaml:"volumes,omitempty"`
+	Environment   []string                      `yaml:"environment,omitempty"`
+	Command       []string                      `yaml:"command,omitempty"`
+}
+
+// ComposeBuild tells compose how to build one of the images that devconsul
+// normally builds itself. The paths are relative to the compose file.
+type ComposeBuild struct {
+	Context    string            `yaml:"context"`
+	Dockerfile string            `yaml:"dockerfile"`
+	Args       map[string]string `yaml:"args,omitempty"`
+}
+
+// ComposeOptions control how RenderCompose makes a compose file that can be
+// used from another directory.
+type ComposeOptions struct {
+	// HostDirs are the directories whose files may be shipped alongside the
+	// compose file. Bind mounts of paths below one of them are written
+	// relative to the compose file instead.
+	HostDirs []string
+
+	// Builds are keyed by image. Every "local/..." image has to have one.
+	Builds map[string]*ComposeBuild
+
+	// Warnings are written as comments at the top of the file.
+	Warnings []string
+}
+
+// ComposeHostPath is a bind mounted file or directory that has to be shipped
+// alongside a compose file.
+type ComposeHostPath struct {
+	Source string // the absolute path on this host
+	Path   string // relative to the compose file
+}
+
+type composeAttachment struct {
+	IPv4Address string `yaml:"ipv4_address,omitempty"`
+	Priority    int    `yaml:"priority,omitempty"`
+}
+
+type composeMount struct {
+	Type     string `yaml:"type"`
+	Source   string `yaml:"source"`
+	Target   string `yaml:"target"`
+	ReadOnly bool   `yaml:"read_only,omitempty"`
+}
+
+type composeNetwork struct {
+	Name       string            `yaml:"name"`
+	Attachable bool              `yaml:"attachable"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+	IPAM       struct {
+		Config []composeSubnet `yaml:"config"`
+	} `yaml:"ipam"`
+}
+
+type composeSubnet struct {
+	Subnet string `yaml:"subnet"`
+}
+
+type composeVolume struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// RenderCompose renders the docker objects in the model as a docker compose
+// file. The bind mounts below opts.HostDirs are returned so that they can be
+// shipped alongside it.
+func RenderCompose(model *DockerModel, opts ComposeOptions) ([]byte, []ComposeHostPath, error) {
+	var hostDirs []string
+	for _, dir := range opts.HostDirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		hostDirs = append(hostDirs, abs)
+	}
+
+	out := &composeFile{
+		Name:     ComposeProjectName,
+		Services: make(map[string]*composeService),
+	}
+
+	for _, n := range model.Networks {
+		if out.Networks == nil {
+			out.Networks = make(map[string]*composeNetwork)
+		}
+		cn := &composeNetwork{
+			Name:       n.Name,
+			Attachable: true,
+			Labels:     n.Labels,
+		}
+		cn.IPAM.Config = []composeSubnet{{Subnet: n.Subnet}}
+		out.Networks[n.Name] = cn
+	}
+
+	for _, v := range model.Volumes {
+		if out.Volumes == nil {
+			out.Volumes = make(map[string]*composeVolume)
+		}
+		out.Volumes[v.Name] = &composeVolume{
+			Name:   v.Name,
+			Labels: v.Labels,
+		}
+	}
+
+	var (
+		hostPaths []ComposeHostPath
+		seenPaths = make(map[string]struct{})
+	)
+	for _, c := range model.Containers {
+		build := opts.Builds[c.Image]
+		if build == nil && strings.HasPrefix(c.Image, "local/") {
+			return nil, nil, fmt.Errorf("container %q uses image %q, which devconsul builds itself, but there are no build instructions for it", c.Name, c.Image)
+		}
+
+		svc := &composeService{
+			ContainerName: c.Name,
+			Image:         c.Image,
+			Build:         build,
+			Hostname:      composeEscape(c.Hostname),
+			Restart:       c.Restart,
+			DNS:           c.DNS,
+			Labels:        make(map[string]string, len(c.Labels)),
+		}
+		for k, v := range c.Labels {
+			svc.Labels[k] = composeEscape(v)
+		}
+		for _, e := range c.Env {
+			svc.Environment = append(svc.Environment, composeEscape(e))
+		}
+		for _, arg := range c.Command {
+			svc.Command = append(svc.Command, composeEscape(arg))
+		}
+
+		// Containers joining a pod's network namespace have to wait for the
+		// pod to exist.
+		if parent := c.NetworkContainer(); parent != "" {
+			svc.NetworkMode = c.NetworkMode
+			svc.DependsOn = []string{parent}
+		} else if len(c.Networks) == 0 {
+			svc.NetworkMode = c.NetworkMode
+		}
+
+		// Compose attaches networks in order of descending priority, which
+		// keeps eth0, eth1, and so on in the same order as the resources.
+		for i, n := range c.Networks {
+			if svc.Networks == nil {
+				svc.Networks = make(map[string]*composeAttachment)
+			}
+			svc.Networks[n.Network] = &composeAttachment{
+				IPv4Address: n.IPv4Address,
+				Priority:    len(c.Networks) - i,
+			}
+		}
+
+		for _, p := range c.Ports {
+			svc.Ports = append(svc.Ports, strconv.Itoa(p.External)+":"+strconv.Itoa(p.Internal))
+		}
+
+		for _, m := range c.Mounts {
+			mount := &composeMount{
+				Target:   m.ContainerPath,
+				ReadOnly: m.ReadOnly,
+			}
+			if m.VolumeName != "" {
+				mount.Type = "volume"
+				mount.Source = m.VolumeName
+			} else {
+				mount.Type = "bind"
+				mount.Source = m.HostPath
+				for _, dir := range hostDirs {
+					rel, err := filepath.Rel(dir, m.HostPath)
+					if err != nil || !filepath.IsLocal(rel) {
+						continue
+					}
+					mount.Source = "./" + filepath.ToSlash(rel)
+					if _, ok := seenPaths[rel]; !ok {
+						seenPaths[rel] = struct{}{}
+						hostPaths = append(hostPaths, ComposeHostPath{Source: m.HostPath, Path: rel})
+					}
+					break
+				}
+			}
+			svc.Volumes = append(svc.Volumes, mount)
+		}
+
+		out.Services[c.Name] = svc
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by devconsul. Do not edit.\n")
+	for _, w := range opts.Warnings {
+		buf.WriteString("#\n# WARNING: " + w + "\n")
+	}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(out); err != nil {
+		return nil, nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), hostPaths, nil
+}
+
+// composeEscape keeps compose from interpolating variables in a value.
+func composeEscape(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
@@ -0,0 +1,183 @@
+package tfgen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderCompose(t *testing.T) {
+	labels := map[string]string{"devconsul": "1"}
+
+	model := &DockerModel{
+		Networks: []*DockerNetworkSpec{
+			{Name: "devconsul-dc1", Subnet: "10.0.1.0/24", Labels: labels},
+			{Name: "devconsul-wan", Subnet: "10.1.0.0/16", Labels: labels},
+		},
+		Volumes: []*DockerVolumeSpec{
+			{Name: "dc1-server1", Labels: labels},
+		},
+		Containers: []*DockerContainerSpec{
+			{
+				Name:        "dc1-server1-pod",
+				Image:       "registry.k8s.io/pause:3.3",
+				Hostname:    "dc1-server1-pod",
+				Restart:     "always",
+				NetworkMode: "bridge",
+				Networks: []DockerAttachment{
+					{Network: "devconsul-dc1", IPv4Address: "10.0.1.11"},
+					{Network: "devconsul-wan", IPv4Address: "10.1.1.11"},
+				},
+				Ports: []DockerPort{{Internal: 8500, External: 8500}},
+			},
+			{
+				Name:        "dc1-server1",
+				Image:       "consul:1.15",
+				Restart:     "always",
+				NetworkMode: "container:dc1-server1-pod",
+				Env:         []string{"TOKEN=${file(\"x\")}"},
+				Command:     []string{"agent", "-hcl", "ports { dns = -1 }"},
+				Mounts: []DockerMount{
+					{VolumeName: "dc1-server1", ContainerPath: "/consul/data"},
+					{HostPath: "/work/config/cache", ContainerPath: "/secrets", ReadOnly: true},
+				},
+			},
+			{
+				Name:        "dc1-server1-ping-sidecar",
+				Image:       "local/consul-envoy:latest",
+				Restart:     "on-failure",
+				NetworkMode: "container:dc1-server1-pod",
+				Mounts: []DockerMount{
+					{HostPath: "/work/config/cache", ContainerPath: "/secrets", ReadOnly: true},
+					{HostPath: "/work/src/sidecar-boot.sh", ContainerPath: "/bin/sidecar-boot.sh", ReadOnly: true},
+					{HostPath: "/etc/hosts", ContainerPath: "/etc/hosts", ReadOnly: true},
+				},
+			},
+		},
+	}
+
+	opts := ComposeOptions{
+		HostDirs: []string{"/work/config", "/work/src"},
+		Builds: map[string]*ComposeBuild{
+			"local/consul-envoy:latest": {
+				Context:    "./build",
+				Dockerfile: "Dockerfile-envoy",
+				Args: map[string]string{
+					"CONSUL_IMAGE":  "consul:1.15",
+					"ENVOY_VERSION": "1.25.1",
+				},
+			},
+			"local/clustertool:latest": {
+				Context:    "./build",
+				Dockerfile: "Dockerfile-tool",
+			},
+		},
+		Warnings: []string{"ACLs are enabled."},
+	}
+
+	out, hostPaths, err := RenderCompose(model, opts)
+	require.NoError(t, err)
+
+	require.Equal(t, []ComposeHostPath{
+		{Source: "/work/config/cache", Path: "cache"},
+		{Source: "/work/src/sidecar-boot.sh", Path: "sidecar-boot.sh"},
+	}, hostPaths)
+
+	const expect = `# Generated by devconsul. Do not edit.
+#
+# WARNING: ACLs are enabled.
+name: devconsul
+services:
+  dc1-server1:
+    container_name: dc1-server1
+    image: consul:1.15
+    restart: always
+    network_mode: container:dc1-server1-pod
+    depends_on:
+      - dc1-server1-pod
+    volumes:
+      - type: volume
+        source: dc1-server1
+        target: /consul/data
+      - type: bind
+        source: ./cache
+        target: /secrets
+        read_only: true
+    environment:
+      - TOKEN=$${file("x")}
+    command:
+      - agent
+      - -hcl
+      - ports { dns = -1 }
+  dc1-server1-ping-sidecar:
+    container_name: dc1-server1-ping-sidecar
+    image: local/consul-envoy:latest
+    build:
+      context: ./build
+      dockerfile: Dockerfile-envoy
+      args:
+        CONSUL_IMAGE: consul:1.15
+        ENVOY_VERSION: 1.25.1
+    restart: on-failure
+    network_mode: container:dc1-server1-pod
+    depends_on:
+      - dc1-server1-pod
+    volumes:
+      - type: bind
+        source: ./cache
+        target: /secrets
+        read_only: true
+      - type: bind
+        source: ./sidecar-boot.sh
+        target: /bin/sidecar-boot.sh
+        read_only: true
+      - type: bind
+        source: /etc/hosts
+        target: /etc/hosts
+        read_only: true
+  dc1-server1-pod:
+    container_name: dc1-server1-pod
+    image: registry.k8s.io/pause:3.3
+    hostname: dc1-server1-pod
+    restart: always
+    networks:
+      devconsul-dc1:
+        ipv4_address: 10.0.1.11
+        priority: 2
+      devconsul-wan:
+        ipv4_address: 10.1.1.11
+        priority: 1
+    ports:
+      - 8500:8500
+networks:
+  devconsul-dc1:
+    name: devconsul-dc1
+    attachable: true
+    labels:
+      devconsul: "1"
+    ipam:
+      config:
+        - subnet: 10.0.1.0/24
+  devconsul-wan:
+    name: devconsul-wan
+    attachable: true
+    labels:
+      devconsul: "1"
+    ipam:
+      config:
+        - subnet: 10.1.0.0/16
+volumes:
+  dc1-server1:
+    name: dc1-server1
+    labels:
+      devconsul: "1"
+`
+	require.Equal(t, expect, string(out))
+
+	t.Run("local image without a build", func(t *testing.T) {
+		opts := opts
+		opts.Builds = nil
+		_, _, err := RenderCompose(model, opts)
+		require.EqualError(t, err, `container "dc1-server1-ping-sidecar" uses image "local/consul-envoy:latest", which devconsul builds itself, but there are no build instructions for it`)
+	})
+}
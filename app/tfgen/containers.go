@@ -0,0 +1,127 @@
+package tfgen
+
+import (
+	"github.com/rboyer/devconsul/config"
+	"github.com/rboyer/devconsul/infra"
+)
+
+// PodContainerKind is the job of one of the containers in a node's pod.
+type PodContainerKind string
+
+const (
+	PodContainerPause              PodContainerKind = "pause"
+	PodContainerConsul             PodContainerKind = "consul"
+	PodContainerMeshGateway        PodContainerKind = "mesh-gateway"
+	PodContainerIngressGateway     PodContainerKind = "ingress-gateway"
+	PodContainerTerminatingGateway PodContainerKind = "terminating-gateway"
+	PodContainerService            PodContainerKind = "service"
+	PodContainerSidecar            PodContainerKind = "sidecar" // envoy or consul-dataplane
+	PodContainerCatalogSync        PodContainerKind = "catalog-sync"
+	PodContainerExternalService    PodContainerKind = "external-service"
+)
+
+// PodContainer describes one of the containers that GenerateNodeContainers
+// creates for a node.
+type PodContainer struct {
+	Name          string
+	Kind          PodContainerKind
+	Image         string // the docker image itself
+	ImageResource string // the docker_image resource for Image
+
+	// Service is the position of the service in node.Services (or
+	// node.ExternalServices for external services) for the containers that
+	// belong to one.
+	Service int
+}
+
+// imageRef returns the reference to the image resource used in a
+// docker_container resource.
+func (c *PodContainer) imageRef() string {
+	return "docker_image." + c.ImageResource + ".latest"
+}
+
+// NodeContainers lists the containers that make up the pod for a node, and
+// the image that each one runs. GenerateNodeContainers creates exactly these,
+// in this order. The first one is always the placeholder container that owns
+// the network namespace.
+func NodeContainers(cfg *config.Config, node *infra.Node) []PodContainer {
+	var out []PodContainer
+	add := func(name string, kind PodContainerKind, resource, image string, svc int) {
+		out = append(out, PodContainer{
+			Name:          name,
+			Kind:          kind,
+			Image:         image,
+			ImageResource: resource,
+			Service:       svc,
+		})
+	}
+
+	var (
+		suffix          = ClusterImageSuffix(cfg, node.Cluster)
+		envoy           = "consul-envoy" + suffix
+		dataplane       = "consul-dataplane" + suffix
+		canaryEnvoy     = "consul-envoy-canary"
+		canaryDataplane = "consul-dataplane-canary"
+	)
+
+	// The images that devconsul builds are named after their resources.
+	localImage := func(resource string) string {
+		return "local/" + resource + ":latest"
+	}
+
+	add(node.PodName(), PodContainerPause, "pause", "registry.k8s.io/pause:3.3", 0)
+
+	if node.IsAgent() {
+		add(node.Name, PodContainerConsul, "consul"+suffix, cfg.ClusterVersions(node.Cluster).ConsulImage, 0)
+	}
+
+	if node.RunsWorkloads() {
+		if node.MeshGateway {
+			image := envoy
+			if node.Kind == infra.NodeKindDataplane {
+				image = dataplane
+				if node.Canary {
+					image = canaryDataplane
+				}
+			}
+			add(node.Name+"-mesh-gateway", PodContainerMeshGateway, image, localImage(image), 0)
+		}
+		if node.IngressGateway {
+			add(node.Name+"-ingress-gateway", PodContainerIngressGateway, envoy, localImage(envoy), 0)
+		}
+		if node.TerminatingGateway {
+			add(node.Name+"-terminating-gateway", PodContainerTerminatingGateway, envoy, localImage(envoy), 0)
+		}
+
+		switch node.Kind {
+		case infra.NodeKindClient, infra.NodeKindDataplane:
+			for i, svc := range node.Services {
+				if svc.IsPingPong() {
+					add(node.Name+"-"+svc.ID.Name, PodContainerService, "pingpong", "rboyer/pingpong:latest", i)
+				} else {
+					add(node.Name+"-"+svc.ID.Name, PodContainerService, ServiceImageName(svc.ID.Name), svc.Image, i)
+				}
+
+				sidecar := envoy
+				switch {
+				case node.Kind == infra.NodeKindDataplane && node.Canary:
+					sidecar = canaryDataplane
+				case node.Kind == infra.NodeKindDataplane:
+					sidecar = dataplane
+				case node.Canary:
+					sidecar = canaryEnvoy
+				}
+				add(node.Name+"-"+svc.ID.Name+"-sidecar", PodContainerSidecar, sidecar, localImage(sidecar), i)
+			}
+		}
+	}
+
+	if node.Kind == infra.NodeKindInfra {
+		add(node.Name+"-catalog-sync", PodContainerCatalogSync, "clustertool", localImage("clustertool"), 0)
+		for i, svc := range node.ExternalServices {
+			add(node.Name+"-"+svc.ID.Name, PodContainerExternalService, ServiceImageName(svc.ID.Name), svc.Image, i)
+		}
+	}
+
+	return out
+}
@@ -1,6 +1,16 @@
 package tfgen
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/rboyer/devconsul/config"
+)
+
+// TerraformProvider configures the docker provider. It is written into
+// docker.tf itself so that terraform needs nothing else from the project.
+func TerraformProvider() Resource {
+	return Embed("templates/terraform.tf")
+}
 
 func DockerNetwork(name, cidr string) Resource {
 	return Text(fmt.Sprintf(`
@@ -35,3 +45,15 @@ resource "docker_image" %[1]q {
   keep_locally = true
 }`, name, image))
 }
+
+// ClusterImageSuffix returns the suffix added to the names of the consul,
+// envoy, and dataplane images used by the named cluster. It is empty unless
+// the cluster overrides the global versions.
+func ClusterImageSuffix(cfg *config.Config, cluster string) string {
+	for _, c := range cfg.TopologyClusters {
+		if c.Name == cluster && c.HasVersionOverrides() {
+			return "-" + cluster
+		}
+	}
+	return ""
+}
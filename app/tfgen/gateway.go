@@ -1,24 +1,26 @@
 package tfgen
 
 import (
+	"path/filepath"
 	"text/template"
 
 	"github.com/rboyer/devconsul/config"
 	"github.com/rboyer/devconsul/infra"
+	"github.com/rboyer/devconsul/util"
 )
 
 func GenerateMeshGatewayContainer(
 	config *config.Config,
 	topology *infra.Topology,
+	scriptDir string,
 	podName string,
 	node *infra.Node,
+	image string,
 ) Resource {
-	if !node.MeshGateway {
-		return nil
-	}
-
 	switch node.Kind {
 	case infra.NodeKindClient:
+	case infra.NodeKindDataplane:
+		return generateMeshGatewayDataplaneContainer(config, topology, scriptDir, podName, node, image)
 	default:
 		panic("figure this out: " + node.Kind)
 	}
@@ -26,6 +28,7 @@ func GenerateMeshGatewayContainer(
 	type tfMeshGatewayInfo struct {
 		PodName            string
 		NodeName           string
+		EnvoyImageResource string
 		EnvoyLogLevel      string
 		EnableACLs         bool
 		EnableWAN          bool
@@ -34,14 +37,17 @@ func GenerateMeshGatewayContainer(
 		ExposeServers      bool
 		SidecarBootEnvVars []string
 		Labels             map[string]string
+		BootScript         string
 	}
 
 	mgi := tfMeshGatewayInfo{
-		PodName:       podName,
-		NodeName:      node.Name,
-		EnvoyLogLevel: config.EnvoyLogLevel,
-		EnableACLs:    !config.SecurityDisableACLs,
-		Labels:        map[string]string{
+		PodName:            podName,
+		NodeName:           node.Name,
+		EnvoyImageResource: image,
+		EnvoyLogLevel:      config.EnvoyLogLevel,
+		EnableACLs:         !config.SecurityDisableACLs,
+		BootScript:         filepath.Join(scriptDir, "mesh-gateway-sidecar-boot.sh"),
+		Labels:             map[string]string{
 			//
 		},
 		SidecarBootEnvVars: []string{
@@ -50,37 +56,20 @@ func GenerateMeshGatewayContainer(
 	}
 	node.AddLabels(mgi.Labels)
 
-	if config.SecurityDisableACLs {
-		mgi.SidecarBootEnvVars = append(mgi.SidecarBootEnvVars,
-			"SBOOT_MODE=insecure",
-		)
-	} else {
-		mgi.SidecarBootEnvVars = append(mgi.SidecarBootEnvVars,
-			"SBOOT_MODE=direct",
-			"SBOOT_TOKEN_FILE=/secrets/mesh-gateway--"+node.Cluster+".val",
-		)
-	}
-
-	if config.EnterpriseEnabled && node.Partition != "" {
-		mgi.SidecarBootEnvVars = append(mgi.SidecarBootEnvVars,
-			"SBOOT_PARTITION="+node.Partition)
-	}
-
-	if config.EncryptionTLSAPI {
-		mgi.SidecarBootEnvVars = append(mgi.SidecarBootEnvVars,
-			"SBOOT_AGENT_TLS=1")
-	}
-	if config.EncryptionTLSGRPC {
-		mgi.SidecarBootEnvVars = append(mgi.SidecarBootEnvVars,
-			"SBOOT_AGENT_GRPC_TLS=1")
-	}
+	mgi.SidecarBootEnvVars = gatewayBootEnvVars(config, node, "mesh")
 
 	switch topology.NetworkShape {
 	case infra.NetworkShapeIslands, infra.NetworkShapeDual:
 		mgi.EnableWAN = true
-		mgi.ExposeServers = true
+		mgi.ExposeServers = topology.LinkWithFederation()
 		mgi.LANAddress = `{{ GetInterfaceIP \"eth0\" }}:8443`
 		mgi.WANAddress = `{{ GetInterfaceIP \"eth1\" }}:8443`
+	case infra.NetworkShapeCustom:
+		// The interface order is not fixed with extra networks attached.
+		mgi.EnableWAN = true
+		mgi.ExposeServers = topology.LinkWithFederation()
+		mgi.LANAddress = node.LocalAddress() + ":8443"
+		mgi.WANAddress = node.PublicAddress() + ":8443"
 	case infra.NetworkShapeFlat:
 		mgi.EnableWAN = true
 		mgi.LANAddress = `{{ GetInterfaceIP \"eth0\" }}:8443`
@@ -97,3 +86,151 @@ func GenerateMeshGatewayContainer(
 }
 
 var tfMeshGatewayT = template.Must(template.ParseFS(content, "templates/container-mgw.tf.tmpl"))
+
+// generateMeshGatewayDataplaneContainer runs a mesh gateway on an agentless
+// node. The gateway itself is registered in the catalog by catalog-sync.
+func generateMeshGatewayDataplaneContainer(
+	config *config.Config,
+	topology *infra.Topology,
+	scriptDir string,
+	podName string,
+	node *infra.Node,
+	image string,
+) Resource {
+	type tfMeshGatewayDataplaneInfo struct {
+		PodName                string
+		NodeName               string
+		DataplaneImageResource string
+		EnvVars                []string
+		Labels                 map[string]string
+		BootScript             string
+	}
+
+	mgi := tfMeshGatewayDataplaneInfo{
+		PodName:                podName,
+		NodeName:               node.Name,
+		DataplaneImageResource: image,
+		Labels:                 map[string]string{},
+		BootScript:             filepath.Join(scriptDir, "dataplane-boot.sh"),
+	}
+	node.AddLabels(mgi.Labels)
+
+	env := dataplaneEnv(config, topology, node, "mesh-gateway", util.NewIdentifier("mesh-gateway", "", node.Partition), 19000, 0)
+	if !config.SecurityDisableACLs {
+		env["DP_CREDENTIAL_TYPE"] = "static"
+		env["SBOOT_TOKEN_FILE"] = "/secrets/" + MeshGatewayTokenName(node.Cluster, node.Partition) + ".val"
+	}
+	mgi.EnvVars = renderEnv(env)
+
+	return Eval(tfMeshGatewayDataplaneT, &mgi)
+}
+
+var tfMeshGatewayDataplaneT = template.Must(template.ParseFS(content, "templates/container-mgw-dataplane.tf.tmpl"))
+
+// MeshGatewayTokenName returns the name of the token used by the mesh
+// gateways in one partition of a cluster.
+func MeshGatewayTokenName(cluster, partition string) string {
+	if partition == "" || partition == "default" {
+		return "mesh-gateway--" + cluster
+	}
+	return "mesh-gateway--" + cluster + "--" + partition
+}
+
+func GenerateIngressGatewayContainer(
+	config *config.Config,
+	scriptDir string,
+	podName string,
+	node *infra.Node,
+	image string,
+) Resource {
+	return generateLocalGatewayContainer(config, scriptDir, podName, node, image, "ingress")
+}
+
+func GenerateTerminatingGatewayContainer(
+	config *config.Config,
+	scriptDir string,
+	podName string,
+	node *infra.Node,
+	image string,
+) Resource {
+	return generateLocalGatewayContainer(config, scriptDir, podName, node, image, "terminating")
+}
+
+// generateLocalGatewayContainer runs a gateway that only serves its own
+// cluster, so unlike a mesh gateway it never needs a WAN address.
+func generateLocalGatewayContainer(
+	config *config.Config,
+	scriptDir string,
+	podName string,
+	node *infra.Node,
+	image string,
+	kind string,
+) Resource {
+	type tfGatewayInfo struct {
+		PodName            string
+		NodeName           string
+		Kind               string
+		EnvoyImageResource string
+		EnvoyLogLevel      string
+		LANAddress         string
+		SidecarBootEnvVars []string
+		Labels             map[string]string
+		BootScript         string
+	}
+
+	gi := tfGatewayInfo{
+		PodName:            podName,
+		NodeName:           node.Name,
+		Kind:               kind,
+		EnvoyImageResource: image,
+		EnvoyLogLevel:      config.EnvoyLogLevel,
+		LANAddress:         node.LocalAddress() + ":8443",
+		SidecarBootEnvVars: gatewayBootEnvVars(config, node, kind),
+		Labels:             map[string]string{},
+		BootScript:         filepath.Join(scriptDir, "mesh-gateway-sidecar-boot.sh"),
+	}
+	node.AddLabels(gi.Labels)
+
+	return Eval(tfLocalGatewayT, &gi)
+}
+
+var tfLocalGatewayT = template.Must(template.ParseFS(content, "templates/container-gateway.tf.tmpl"))
+
+// gatewayBootEnvVars configures mesh-gateway-sidecar-boot.sh to launch a
+// gateway of the given kind ("mesh", "ingress", or "terminating") on the
+// node.
+func gatewayBootEnvVars(config *config.Config, node *infra.Node, kind string) []string {
+	env := []string{
+		"SBOOT_GATEWAY=" + kind,
+	}
+
+	if config.SecurityDisableACLs {
+		env = append(env,
+			"SBOOT_MODE=insecure",
+		)
+	} else {
+		tokenName := kind + "-gateway--" + node.Cluster
+		if kind == "mesh" {
+			tokenName = MeshGatewayTokenName(node.Cluster, node.Partition)
+		}
+		env = append(env,
+			"SBOOT_MODE=direct",
+			"SBOOT_TOKEN_FILE=/secrets/"+tokenName+".val",
+		)
+	}
+
+	if config.EnterpriseEnabled && node.Partition != "" {
+		env = append(env,
+			"SBOOT_PARTITION="+node.Partition)
+	}
+
+	if config.EncryptionTLSAPI {
+		env = append(env,
+			"SBOOT_AGENT_TLS=1")
+	}
+	if config.EncryptionTLSGRPC {
+		env = append(env,
+			"SBOOT_AGENT_GRPC_TLS=1")
+	}
+	return env
+}
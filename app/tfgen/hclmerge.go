@@ -0,0 +1,94 @@
+package tfgen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+)
+
+// mergeHCL merges each of the overrides, in order, on top of base and
+// returns the result. Later overrides win when they conflict:
+//
+//   - an attribute replaces any attribute of the same name
+//   - a block is merged recursively into the existing block with the same
+//     type and labels, if there is exactly one
+//   - any other block is appended
+func mergeHCL(base string, overrides ...string) (string, error) {
+	f, diags := hclwrite.ParseConfig([]byte(withTrailingNewline(base)), "generated", hcl.InitialPos)
+	if diags.HasErrors() {
+		return "", fmt.Errorf("could not parse generated config: %w", diags)
+	}
+
+	changed := false
+	for i, src := range overrides {
+		if src == "" {
+			continue
+		}
+		of, diags := hclwrite.ParseConfig([]byte(withTrailingNewline(src)), fmt.Sprintf("override-%d", i), hcl.InitialPos)
+		if diags.HasErrors() {
+			return "", fmt.Errorf("could not parse agent_extra_hcl: %w", diags)
+		}
+		mergeHCLBody(f.Body(), of.Body())
+		changed = true
+	}
+
+	if !changed {
+		return base, nil
+	}
+	return string(hclwrite.Format(f.Bytes())), nil
+}
+
+// withTrailingNewline makes sure src ends with a newline, because hclwrite
+// appends new items directly after the last token of a body.
+func withTrailingNewline(src string) string {
+	if strings.HasSuffix(src, "\n") {
+		return src
+	}
+	return src + "\n"
+}
+
+func mergeHCLBody(dst, src *hclwrite.Body) {
+	for _, name := range attributeNames(src) {
+		dst.SetAttributeRaw(name, src.GetAttribute(name).Expr().BuildTokens(nil))
+	}
+
+	for _, block := range src.Blocks() {
+		var matches []*hclwrite.Block
+		for _, existing := range dst.Blocks() {
+			if existing.Type() == block.Type() && sameLabels(existing.Labels(), block.Labels()) {
+				matches = append(matches, existing)
+			}
+		}
+		if len(matches) == 1 {
+			mergeHCLBody(matches[0].Body(), block.Body())
+			continue
+		}
+		dst.AppendBlock(block)
+	}
+}
+
+// attributeNames returns the names of the attributes in body in a stable
+// order, since hclwrite only exposes them as a map.
+func attributeNames(body *hclwrite.Body) []string {
+	var names []string
+	for name := range body.Attributes() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sameLabels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package tfgen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeHCL(t *testing.T) {
+	const base = `log_level = "trace"
+server    = true
+limits {
+  rpc_rate = 100
+}
+service "ping" {
+  port = 8080
+}
+service "ping" {
+  port = 8081
+}`
+
+	type testcase struct {
+		overrides []string
+		expect    string
+	}
+
+	cases := map[string]testcase{
+		"no overrides": {
+			expect: base,
+		},
+		"empty overrides": {
+			overrides: []string{"", ""},
+			expect:    base,
+		},
+		"most specific attribute wins": {
+			overrides: []string{
+				`log_level = "debug"`,
+				`log_level = "info"`,
+				`log_level = "warn"`,
+			},
+			expect: `log_level = "warn"
+server    = true
+limits {
+  rpc_rate = 100
+}
+service "ping" {
+  port = 8080
+}
+service "ping" {
+  port = 8081
+}
+`,
+		},
+		"new attribute": {
+			overrides: []string{`raft_protocol = 3`},
+			expect: `log_level = "trace"
+server    = true
+limits {
+  rpc_rate = 100
+}
+service "ping" {
+  port = 8080
+}
+service "ping" {
+  port = 8081
+}
+raft_protocol = 3
+`,
+		},
+		"merge into a single block": {
+			overrides: []string{
+				"limits {\n  rpc_rate = 50\n  http_max_conns_per_client = 10\n}",
+				"limits {\n  rpc_rate = 10\n}\n",
+			},
+			expect: `log_level = "trace"
+server    = true
+limits {
+  rpc_rate                  = 10
+  http_max_conns_per_client = 10
+}
+service "ping" {
+  port = 8080
+}
+service "ping" {
+  port = 8081
+}
+`,
+		},
+		"append a block with duplicate labels": {
+			overrides: []string{"service \"ping\" {\n  port = 8082\n}"},
+			expect: `log_level = "trace"
+server    = true
+limits {
+  rpc_rate = 100
+}
+service "ping" {
+  port = 8080
+}
+service "ping" {
+  port = 8081
+}
+service "ping" {
+  port = 8082
+}
+`,
+		},
+		"append a block with different labels": {
+			overrides: []string{"service \"pong\" {\n  port = 9090\n}"},
+			expect: `log_level = "trace"
+server    = true
+limits {
+  rpc_rate = 100
+}
+service "ping" {
+  port = 8080
+}
+service "ping" {
+  port = 8081
+}
+service "pong" {
+  port = 9090
+}
+`,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got, err := mergeHCL(base, tc.overrides...)
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, got)
+		})
+	}
+
+	t.Run("invalid override", func(t *testing.T) {
+		_, err := mergeHCL(base, "limits {")
+		require.ErrorContains(t, err, "could not parse agent_extra_hcl")
+	})
+}
@@ -11,23 +11,22 @@ import (
 )
 
 type catalogSyncInfo struct {
-	PodName   string
-	NodeName  string
-	Args      []string
-	HashValue string
+	PodName       string
+	NodeName      string
+	ImageResource string
+	Args          []string
+	HashValue     string
 }
 
-func GenerateInfraContainers(
+// generateCatalogSyncContainer runs clustertool on an infra node to keep the
+// catalog registrations of the agentless nodes up to date.
+func generateCatalogSyncContainer(
 	config *config.Config,
 	topology *infra.Topology,
 	cache *cachestore.Store,
-	podName string,
 	node *infra.Node,
-) ([]Resource, error) {
-	if node.Kind != infra.NodeKindInfra {
-		return nil, nil
-	}
-
+	image string,
+) (Resource, error) {
 	filename := "catalog_def." + node.Cluster + ".json"
 	hv, err := util.HashFile(cache.GetPathToStringFile(filename))
 	if err != nil {
@@ -35,9 +34,10 @@ func GenerateInfraContainers(
 	}
 
 	info := catalogSyncInfo{
-		PodName:   node.PodName(),
-		NodeName:  node.Name,
-		HashValue: hv,
+		PodName:       node.PodName(),
+		NodeName:      node.Name,
+		ImageResource: image,
+		HashValue:     hv,
 		Args: []string{
 			"-cluster", node.Cluster,
 			"-config-file", "/secrets/" + filename,
@@ -54,9 +54,25 @@ func GenerateInfraContainers(
 		info.Args = append(info.Args, "-token-file", "/secrets/master-token.val")
 	}
 
-	res := Eval(tfCatalogSyncT, &info)
+	return Eval(tfCatalogSyncT, &info), nil
+}
 
-	return []Resource{res}, nil
+// generateExternalServiceContainer runs an external service on an infra
+// node. External services are plain containers without a sidecar.
+func generateExternalServiceContainer(
+	podName string,
+	node *infra.Node,
+	svc *infra.ExternalService,
+	image string,
+) Resource {
+	return Eval(tfServiceAppT, &serviceAppInfo{
+		PodName:       podName,
+		NodeName:      node.Name,
+		ServiceName:   svc.ID.Name,
+		ImageResource: image,
+		Env:           quoteHCLStrings(renderEnv(svc.Env)),
+		Command:       quoteHCLStrings(svc.Command),
+	})
 }
 
 var tfCatalogSyncT = template.Must(template.ParseFS(content, "templates/container-catalog-sync.tf.tmpl"))
@@ -16,11 +16,45 @@ func WriteHCLResourceFile(
 	path string,
 	perm os.FileMode,
 ) (UpdateResult, error) {
+	out, err := renderHCLResources(res)
+	if err != nil {
+		return UpdateResultNone, err
+	}
+	return UpdateFileIfDifferent(logger, out, path, perm)
+}
+
+// WriteComposeFile writes the same resources as WriteHCLResourceFile, but as
+// an equivalent docker compose file. The bind mounts that have to be shipped
+// alongside it are returned, as with RenderCompose.
+func WriteComposeFile(
+	logger hclog.Logger,
+	res []Resource,
+	opts ComposeOptions,
+	path string,
+	perm os.FileMode,
+) (UpdateResult, []ComposeHostPath, error) {
+	hcl, err := renderHCLResources(res)
+	if err != nil {
+		return UpdateResultNone, nil, err
+	}
+	model, err := ParseDockerModel("docker.tf", hcl)
+	if err != nil {
+		return UpdateResultNone, nil, err
+	}
+	out, hostPaths, err := RenderCompose(model, opts)
+	if err != nil {
+		return UpdateResultNone, nil, err
+	}
+	result, err := UpdateFileIfDifferent(logger, out, path, perm)
+	return result, hostPaths, err
+}
+
+func renderHCLResources(res []Resource) ([]byte, error) {
 	var text []string
 	for _, r := range res {
 		val, err := r.Render()
 		if err != nil {
-			return UpdateResultNone, err
+			return nil, err
 		}
 		text = append(text, strings.TrimSpace(val))
 	}
@@ -28,9 +62,7 @@ func WriteHCLResourceFile(
 	body := strings.Join(text, "\n\n")
 
 	// Ensure it looks tidy
-	out := hclwrite.Format(bytes.TrimSpace([]byte(body)))
-
-	return UpdateFileIfDifferent(logger, out, path, perm)
+	return hclwrite.Format(bytes.TrimSpace([]byte(body))), nil
 }
 
 type UpdateResult int
@@ -1,109 +1,104 @@
 package tfgen
 
 import (
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
 	"github.com/rboyer/devconsul/config"
 	"github.com/rboyer/devconsul/infra"
+	"github.com/rboyer/devconsul/util"
 )
 
-type pingpongAppInfo struct {
-	PodName    string
-	NodeName   string
-	PingPong   string // ping or pong
-	MetaString string
+type serviceAppInfo struct {
+	PodName       string
+	NodeName      string
+	ServiceName   string
+	ImageResource string
+	Env           []string // already quoted
+	Command       []string // already quoted
 }
 
-type pingpongSidecarInfo struct {
-	pingpongAppInfo
+type serviceSidecarInfo struct {
+	serviceAppInfo
 	EnvoyImageResource string
 	SidecarBootEnvVars []string
 	UseBuiltinProxy    bool
 	EnvoyLogLevel      string
+	EnvoyAdminPort     int
+	BootScript         string
 }
 
-type pingpongDataplaneInfo struct {
-	pingpongAppInfo
+type serviceDataplaneInfo struct {
+	serviceAppInfo
 	DataplaneImageResource string
 	EnvVars                []string
+	BootScript             string
 }
 
-func GeneratePingPongContainers(
-	config *config.Config,
-	topology *infra.Topology,
+// ServiceImageName returns the name of the docker_image resource used by
+// services that run a custom image.
+func ServiceImageName(serviceName string) string {
+	return "service-" + serviceName
+}
+
+// generateServiceAppContainer runs the application for one of the services
+// on a node.
+func generateServiceAppContainer(
 	podName string,
 	node *infra.Node,
-) []Resource {
-	if node.Service == nil {
-		return nil
-	}
-	svc := node.Service
-
-	switch node.Kind {
-	case infra.NodeKindClient, infra.NodeKindDataplane:
-	default:
-		return nil
-	}
+	svc *infra.Service,
+	image string,
+) Resource {
+	appinfo := newServiceAppInfo(podName, node, svc)
+	appinfo.ImageResource = image
+	return Eval(tfServiceAppT, &appinfo)
+}
 
-	appinfo := pingpongAppInfo{
-		PodName:  podName,
-		NodeName: node.Name,
-		PingPong: svc.ID.Name,
+func newServiceAppInfo(podName string, node *infra.Node, svc *infra.Service) serviceAppInfo {
+	appinfo := serviceAppInfo{
+		PodName:     podName,
+		NodeName:    node.Name,
+		ServiceName: svc.ID.Name,
+		Env:         quoteHCLStrings(renderEnv(svc.Env)),
 	}
-
-	if len(svc.Meta) > 0 {
-		var kvs []struct{ K, V string }
-		for k, v := range svc.Meta {
-			kvs = append(kvs, struct{ K, V string }{k, v})
-		}
-		sort.Slice(kvs, func(i, j int) bool {
-			return kvs[i].K < kvs[j].K
-		})
-		var parts []string
-		for _, kv := range kvs {
-			parts = append(parts, kv.K+"-"+kv.V)
-		}
-		appinfo.MetaString = strings.Join(parts, "--")
-		// ppi.MetaString = strings.Join(parts, "--")
+	if svc.IsPingPong() {
+		appinfo.Command = quoteHCLStrings(pingpongCommand(svc))
+	} else {
+		appinfo.Command = quoteHCLStrings(svc.Command)
 	}
+	return appinfo
+}
 
-	res := make([]Resource, 0, 2)
-	res = append(res, Eval(tfPingPongAppT, &appinfo))
+// generateServiceSidecarContainer runs the proxy for one of the services on
+// a node, which is consul-dataplane on agentless nodes and envoy (or the
+// builtin proxy) otherwise.
+func generateServiceSidecarContainer(
+	config *config.Config,
+	topology *infra.Topology,
+	scriptDir string,
+	podName string,
+	node *infra.Node,
+	idx int, // position of the service on the node
+	image string,
+) Resource {
+	svc := node.Services[idx]
+	appinfo := newServiceAppInfo(podName, node, svc)
 
 	if node.Kind == infra.NodeKindDataplane {
 		if node.UseBuiltinProxy {
 			panic("not possible")
 		}
 
-		dataplaneInfo := pingpongDataplaneInfo{
-			pingpongAppInfo:        appinfo,
-			DataplaneImageResource: "docker_image.consul-dataplane.latest",
-		}
-
-		if node.Canary {
-			dataplaneInfo.DataplaneImageResource = "docker_image.consul-dataplane-canary.latest"
-		}
-
-		env := make(map[string]string)
-		// --- REQUIRED ---
-		env["DP_CONSUL_ADDRESSES"] = topology.ServerIPs(node.Cluster)[0]
-		// env["DP_CONSUL_ADDRESSES"] = "exec=/bin/echo " +
-		// 	strings.Join(topology.ServerIPs(node.Cluster), " ")
-		env["DP_SERVICE_NODE_NAME"] = node.PodName() // TODO(cdp): is this enough?
-		env["DP_PROXY_SERVICE_ID"] = svc.ID.Name + "-sidecar-proxy"
-		// --- enterprise required ---
-		if config.EnterpriseEnabled {
-			env["DP_SERVICE_NAMESPACE"] = svc.ID.Namespace
-			env["DP_SERVICE_PARTITION"] = svc.ID.Partition
+		dataplaneInfo := serviceDataplaneInfo{
+			serviceAppInfo:         appinfo,
+			DataplaneImageResource: image,
+			BootScript:             filepath.Join(scriptDir, "dataplane-boot.sh"),
 		}
 
-		env["DP_LOG_LEVEL"] = config.EnvoyLogLevel
-
-		// envoy
-		env["DP_ENVOY_ADMIN_BIND_ADDRESS"] = "0.0.0.0" // for demo purposes
-		env["DP_ENVOY_ADMIN_BIND_PORT"] = "19000"
+		env := dataplaneEnv(config, topology, node, svc.ID.Name+"-sidecar-proxy", svc.ID, svc.EnvoyAdminPort, idx)
 
 		// acls
 		if config.SecurityDisableACLs {
@@ -118,74 +113,164 @@ func GeneratePingPongContainers(
 			// env["DP_CREDENTIAL_STATIC_TOKEN"] = "<TODO>"
 		}
 
-		if config.EncryptionTLSGRPC {
-			env["SBOOT_AGENT_GRPC_TLS"] = "1"
+		dataplaneInfo.EnvVars = renderEnv(env)
 
-			// The path to a file or directory containing CA certificates used to
-			// verify the server's certificate. Environment variable: DP_CA_CERTS.
-			// env["DP_CA_CERTS"] = "/tls"
-			env["DP_CA_CERTS"] = "/tls/consul-agent-ca.pem"
-			env["DP_CONSUL_GRPC_PORT"] = "8503"
+		return Eval(tfServiceDataplaneT, &dataplaneInfo)
+	}
 
-			env["DP_TLS_SERVER_NAME"] = "server." + node.Cluster + ".consul"
-		} else {
-			env["DP_TLS_INSECURE_SKIP_VERIFY"] = "1"
-			env["DP_CONSUL_GRPC_PORT"] = "8502"
-		}
+	sidecarInfo := serviceSidecarInfo{
+		serviceAppInfo:     appinfo,
+		EnvoyImageResource: image,
+		UseBuiltinProxy:    node.UseBuiltinProxy,
+		EnvoyLogLevel:      config.EnvoyLogLevel,
+		EnvoyAdminPort:     svc.EnvoyAdminPort,
+		BootScript:         filepath.Join(scriptDir, "sidecar-boot.sh"),
+	}
 
-		dataplaneInfo.EnvVars = renderEnv(env)
+	proxyType := "envoy"
+	if node.UseBuiltinProxy {
+		proxyType = "builtin"
+	}
+
+	env := make(map[string]string)
+	env["SBOOT_PROXY_TYPE"] = proxyType
+	env["SBOOT_REGISTER_FILE"] = "/secrets/servicereg__" + node.Name + "__" + svc.ID.Name + ".hcl"
 
-		res = append(res, Eval(tfPingPongDataplaneT, &dataplaneInfo))
+	if config.SecurityDisableACLs {
+		env["SBOOT_MODE"] = "insecure"
+	} else if config.KubernetesEnabled {
+		env["SBOOT_MODE"] = "login"
+		env["SBOOT_BEARER_TOKEN_FILE"] = "/secrets/k8s/service_jwt_token." + svc.ID.Name
+		env["SBOOT_TOKEN_SINK_FILE"] = "/tmp/consul.token"
 	} else {
-		sidecarInfo := pingpongSidecarInfo{
-			pingpongAppInfo:    appinfo,
-			EnvoyImageResource: "docker_image.consul-envoy.latest",
-			UseBuiltinProxy:    node.UseBuiltinProxy,
-			EnvoyLogLevel:      config.EnvoyLogLevel,
-		}
+		env["SBOOT_MODE"] = "direct"
+		env["SBOOT_TOKEN_FILE"] = "/secrets/service--" + node.Cluster + "--" + svc.ID.ID() + ".val"
+	}
 
-		if node.Canary {
-			sidecarInfo.EnvoyImageResource = "docker_image.consul-envoy-canary.latest"
-			// ppi.DataplaneImageResource = "docker_image.consul-dataplane-canary.latest"
-		}
+	if config.EnterpriseEnabled && node.Partition != "" {
+		env["SBOOT_PARTITION"] = node.Partition
+	}
 
-		proxyType := "envoy"
-		if node.UseBuiltinProxy {
-			proxyType = "builtin"
-		}
+	if config.EncryptionTLSAPI {
+		env["SBOOT_AGENT_TLS"] = "1"
+	}
+	if config.EncryptionTLSGRPC {
+		env["SBOOT_AGENT_GRPC_TLS"] = "1"
+	}
 
-		env := make(map[string]string)
-		env["SBOOT_PROXY_TYPE"] = proxyType
-		env["SBOOT_REGISTER_FILE"] = "/secrets/servicereg__" + node.Name + "__" + svc.ID.Name + ".hcl"
+	sidecarInfo.SidecarBootEnvVars = renderEnv(env)
 
-		if config.SecurityDisableACLs {
-			env["SBOOT_MODE"] = "insecure"
-		} else if config.KubernetesEnabled {
-			env["SBOOT_MODE"] = "login"
-			env["SBOOT_BEARER_TOKEN_FILE"] = "/secrets/k8s/service_jwt_token." + svc.ID.Name
-			env["SBOOT_TOKEN_SINK_FILE"] = "/tmp/consul.token"
-		} else {
-			env["SBOOT_MODE"] = "direct"
-			env["SBOOT_TOKEN_FILE"] = "/secrets/service--" + node.Cluster + "--" + svc.ID.ID() + ".val"
-		}
+	return Eval(tfServiceSidecarT, &sidecarInfo)
+}
 
-		if config.EnterpriseEnabled && node.Partition != "" {
-			env["SBOOT_PARTITION"] = node.Partition
-		}
+// dataplaneEnv configures consul-dataplane to run the proxy registered as
+// proxyID on the node, leaving the choice of credentials to the caller. The
+// idx is the position of the proxy within the pod and keeps its listeners
+// from colliding with any others.
+func dataplaneEnv(
+	config *config.Config,
+	topology *infra.Topology,
+	node *infra.Node,
+	proxyID string,
+	id util.Identifier, // namespace and partition of the proxy
+	adminPort int,
+	idx int,
+) map[string]string {
+	env := make(map[string]string)
+	// --- REQUIRED ---
+	env["DP_CONSUL_ADDRESSES"] = topology.ServerIPs(node.Cluster)[0]
+	// env["DP_CONSUL_ADDRESSES"] = "exec=/bin/echo " +
+	// 	strings.Join(topology.ServerIPs(node.Cluster), " ")
+	env["DP_SERVICE_NODE_NAME"] = node.PodName() // TODO(cdp): is this enough?
+	env["DP_PROXY_SERVICE_ID"] = proxyID
+	// --- enterprise required ---
+	if config.EnterpriseEnabled {
+		env["DP_SERVICE_NAMESPACE"] = id.Namespace
+		env["DP_SERVICE_PARTITION"] = id.Partition
+	}
+
+	env["DP_LOG_LEVEL"] = config.EnvoyLogLevel
+
+	// envoy
+	env["DP_ENVOY_ADMIN_BIND_ADDRESS"] = "0.0.0.0" // for demo purposes
+	env["DP_ENVOY_ADMIN_BIND_PORT"] = strconv.Itoa(adminPort)
+
+	// keep the other dataplane listeners from colliding within the pod
+	env["DP_GRACEFUL_PORT"] = strconv.Itoa(20300 + idx)
+	env["DP_TELEMETRY_PROM_MERGE_PORT"] = strconv.Itoa(20100 + idx)
+
+	if config.EncryptionTLSGRPC {
+		env["SBOOT_AGENT_GRPC_TLS"] = "1"
+
+		// The path to a file or directory containing CA certificates used to
+		// verify the server's certificate. Environment variable: DP_CA_CERTS.
+		// env["DP_CA_CERTS"] = "/tls"
+		env["DP_CA_CERTS"] = "/tls/consul-agent-ca.pem"
+		env["DP_CONSUL_GRPC_PORT"] = "8503"
 
-		if config.EncryptionTLSAPI {
-			env["SBOOT_AGENT_TLS"] = "1"
+		env["DP_TLS_SERVER_NAME"] = "server." + node.Cluster + ".consul"
+	} else {
+		env["DP_TLS_INSECURE_SKIP_VERIFY"] = "1"
+		env["DP_CONSUL_GRPC_PORT"] = "8502"
+	}
+	return env
+}
+
+func pingpongCommand(svc *infra.Service) []string {
+	var metaString string
+	if len(svc.Meta) > 0 {
+		var kvs []struct{ K, V string }
+		for k, v := range svc.Meta {
+			kvs = append(kvs, struct{ K, V string }{k, v})
 		}
-		if config.EncryptionTLSGRPC {
-			env["SBOOT_AGENT_GRPC_TLS"] = "1"
+		sort.Slice(kvs, func(i, j int) bool {
+			return kvs[i].K < kvs[j].K
+		})
+		var parts []string
+		for _, kv := range kvs {
+			parts = append(parts, kv.K+"-"+kv.V)
 		}
+		metaString = strings.Join(parts, "--")
+	}
 
-		sidecarInfo.SidecarBootEnvVars = renderEnv(env)
+	cmd := []string{
+		"-bind",
+		"0.0.0.0:" + strconv.Itoa(svc.Port),
+	}
+	if len(svc.Upstreams) > 0 {
+		cmd = append(cmd,
+			"-dial",
+			"127.0.0.1:"+strconv.Itoa(svc.Upstreams[0].LocalPort),
+		)
+	}
+	return append(cmd,
+		"-pong-chaos",
+		"-dialfreq",
+		"250ms",
+		"-name",
+		svc.ID.Name+metaString,
+	)
+}
 
-		res = append(res, Eval(tfPingPongSidecarT, &sidecarInfo))
+// quoteHCLStrings turns each value into a quoted HCL string literal, escaping
+// anything that would otherwise be treated as a template sequence.
+func quoteHCLStrings(vals []string) []string {
+	if len(vals) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(vals))
+	for _, v := range vals {
+		out = append(out, escapeHCLTemplate(strconv.Quote(v)))
 	}
+	return out
+}
 
-	return res
+// escapeHCLTemplate escapes anything in s that would otherwise be treated as
+// a template sequence when embedded in a string or heredoc.
+func escapeHCLTemplate(s string) string {
+	s = strings.ReplaceAll(s, "${", "$${")
+	s = strings.ReplaceAll(s, "%{", "%%{")
+	return s
 }
 
 func renderEnv(m map[string]string) []string {
@@ -197,11 +282,12 @@ func renderEnv(m map[string]string) []string {
 	for k, v := range m {
 		out = append(out, k+"="+v)
 	}
+	sort.Strings(out)
 	return out
 }
 
 // TODO: make chaos opt-in
 // "-pong-chaos",
-var tfPingPongAppT = template.Must(template.ParseFS(content, "templates/container-app.tf.tmpl"))
-var tfPingPongSidecarT = template.Must(template.ParseFS(content, "templates/container-app-sidecar.tf.tmpl"))
-var tfPingPongDataplaneT = template.Must(template.ParseFS(content, "templates/container-app-dataplane.tf.tmpl"))
+var tfServiceAppT = template.Must(template.ParseFS(content, "templates/container-app.tf.tmpl"))
+var tfServiceSidecarT = template.Must(template.ParseFS(content, "templates/container-app-sidecar.tf.tmpl"))
+var tfServiceDataplaneT = template.Must(template.ParseFS(content, "templates/container-app-dataplane.tf.tmpl"))
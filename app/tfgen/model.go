@@ -0,0 +1,314 @@
+package tfgen
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// DockerModel is the set of docker objects described by the resources that
+// are written to docker.tf, decoded so that they can be created without
+// terraform.
+type DockerModel struct {
+	Networks   []*DockerNetworkSpec
+	Volumes    []*DockerVolumeSpec
+	Images     []*DockerImageSpec
+	Containers []*DockerContainerSpec
+}
+
+type DockerNetworkSpec struct {
+	Name   string
+	Subnet string
+	Labels map[string]string
+}
+
+type DockerVolumeSpec struct {
+	Name   string
+	Labels map[string]string
+}
+
+type DockerImageSpec struct {
+	Name  string // resource name
+	Image string
+}
+
+type DockerContainerSpec struct {
+	Name        string
+	Image       string // the image itself, not the terraform resource
+	Hostname    string
+	Restart     string
+	DNS         []string
+	Env         []string
+	Command     []string
+	Labels      map[string]string
+	NetworkMode string // "bridge" or "container:<name>"
+	Networks    []DockerAttachment
+	Ports       []DockerPort
+	Mounts      []DockerMount
+}
+
+// NetworkContainer returns the name of the container whose network namespace
+// this one joins, if any.
+func (c *DockerContainerSpec) NetworkContainer() string {
+	name, _ := strings.CutPrefix(c.NetworkMode, "container:")
+	if name == c.NetworkMode {
+		return ""
+	}
+	return name
+}
+
+type DockerAttachment struct {
+	Network     string
+	IPv4Address string
+}
+
+type DockerPort struct {
+	Internal int
+	External int
+}
+
+// DockerMount is either a bind mount of HostPath or a named volume.
+type DockerMount struct {
+	HostPath      string
+	VolumeName    string
+	ContainerPath string
+	ReadOnly      bool
+}
+
+type rawResource struct {
+	Type string   `hcl:"type,label"`
+	Name string   `hcl:"name,label"`
+	Body hcl.Body `hcl:",remain"`
+}
+
+type rawLabel struct {
+	Label string `hcl:"label"`
+	Value string `hcl:"value"`
+}
+
+type rawDockerNetwork struct {
+	Name       string     `hcl:"name"`
+	Attachable bool       `hcl:"attachable,optional"`
+	Labels     []rawLabel `hcl:"labels,block"`
+	IPAM       []struct {
+		Subnet string `hcl:"subnet"`
+	} `hcl:"ipam_config,block"`
+}
+
+type rawDockerVolume struct {
+	Name   string     `hcl:"name"`
+	Labels []rawLabel `hcl:"labels,block"`
+}
+
+type rawDockerImage struct {
+	Name        string `hcl:"name"`
+	KeepLocally bool   `hcl:"keep_locally,optional"`
+}
+
+type rawDockerContainer struct {
+	Name        string     `hcl:"name"`
+	Image       string     `hcl:"image"`
+	Hostname    string     `hcl:"hostname,optional"`
+	Restart     string     `hcl:"restart,optional"`
+	DNS         []string   `hcl:"dns,optional"`
+	Env         []string   `hcl:"env,optional"`
+	Command     []string   `hcl:"command,optional"`
+	NetworkMode string     `hcl:"network_mode,optional"`
+	Labels      []rawLabel `hcl:"labels,block"`
+	Networks    []struct {
+		Name        string `hcl:"name"`
+		IPv4Address string `hcl:"ipv4_address,optional"`
+	} `hcl:"networks_advanced,block"`
+	Ports []struct {
+		Internal int `hcl:"internal"`
+		External int `hcl:"external"`
+	} `hcl:"ports,block"`
+	Volumes []struct {
+		HostPath      string `hcl:"host_path,optional"`
+		VolumeName    string `hcl:"volume_name,optional"`
+		ContainerPath string `hcl:"container_path"`
+		ReadOnly      bool   `hcl:"read_only,optional"`
+	} `hcl:"volumes,block"`
+}
+
+// ParseDockerModel decodes the resources in a file written by
+// WriteHCLResourceFile. References between resources are resolved the way
+// terraform would, except that images are referred to by name rather than by
+// ID. Relative paths given to abspath() are relative to the file.
+func ParseDockerModel(filename string, src []byte) (*DockerModel, error) {
+	file, diags := hclsyntax.ParseConfig(src, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	var root struct {
+		Resources []*rawResource `hcl:"resource,block"`
+
+		// These only configure terraform itself.
+		Terraform []struct {
+			Body hcl.Body `hcl:",remain"`
+		} `hcl:"terraform,block"`
+		Providers []struct {
+			Name string   `hcl:"name,label"`
+			Body hcl.Body `hcl:",remain"`
+		} `hcl:"provider,block"`
+	}
+	if diags := gohcl.DecodeBody(file.Body, nil, &root); diags.HasErrors() {
+		return nil, diags
+	}
+
+	// Everything can be referred to by its name alone, so collect those first.
+	var (
+		nameSchema = &hcl.BodySchema{Attributes: []hcl.AttributeSchema{{Name: "name", Required: true}}}
+		refs       = map[string]map[string]cty.Value{
+			"docker_network":   {},
+			"docker_volume":    {},
+			"docker_image":     {},
+			"docker_container": {},
+		}
+	)
+	for _, res := range root.Resources {
+		byName, ok := refs[res.Type]
+		if !ok {
+			return nil, fmt.Errorf("%s.%s: unsupported resource type %q", res.Type, res.Name, res.Type)
+		}
+		content, _, diags := res.Body.PartialContent(nameSchema)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		name, diags := content.Attributes["name"].Expr.Value(nil)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		if name.Type() != cty.String || name.IsNull() {
+			return nil, fmt.Errorf("%s.%s: name must be a string", res.Type, res.Name)
+		}
+		byName[res.Name] = cty.ObjectVal(map[string]cty.Value{
+			"name":   name,
+			"id":     name,
+			"latest": name,
+		})
+	}
+
+	ctx := &hcl.EvalContext{
+		Variables: make(map[string]cty.Value),
+		Functions: map[string]function.Function{
+			"abspath": makeAbspathFunc(filepath.Dir(filename)),
+		},
+	}
+	for typ, byName := range refs {
+		ctx.Variables[typ] = cty.ObjectVal(byName)
+	}
+
+	model := &DockerModel{}
+	for _, res := range root.Resources {
+		var diags hcl.Diagnostics
+		switch res.Type {
+		case "docker_network":
+			var raw rawDockerNetwork
+			if diags := gohcl.DecodeBody(res.Body, ctx, &raw); diags.HasErrors() {
+				return nil, diags
+			}
+			if len(raw.IPAM) != 1 {
+				return nil, fmt.Errorf("%s.%s: expected exactly one ipam_config block", res.Type, res.Name)
+			}
+			model.Networks = append(model.Networks, &DockerNetworkSpec{
+				Name:   raw.Name,
+				Subnet: raw.IPAM[0].Subnet,
+				Labels: labelMap(raw.Labels),
+			})
+		case "docker_volume":
+			var raw rawDockerVolume
+			diags = gohcl.DecodeBody(res.Body, ctx, &raw)
+			model.Volumes = append(model.Volumes, &DockerVolumeSpec{
+				Name:   raw.Name,
+				Labels: labelMap(raw.Labels),
+			})
+		case "docker_image":
+			var raw rawDockerImage
+			diags = gohcl.DecodeBody(res.Body, ctx, &raw)
+			model.Images = append(model.Images, &DockerImageSpec{
+				Name:  res.Name,
+				Image: raw.Name,
+			})
+		case "docker_container":
+			var raw rawDockerContainer
+			diags = gohcl.DecodeBody(res.Body, ctx, &raw)
+			model.Containers = append(model.Containers, raw.spec())
+		}
+		if diags.HasErrors() {
+			return nil, diags
+		}
+	}
+
+	return model, nil
+}
+
+func (raw *rawDockerContainer) spec() *DockerContainerSpec {
+	spec := &DockerContainerSpec{
+		Name:        raw.Name,
+		Image:       raw.Image,
+		Hostname:    raw.Hostname,
+		Restart:     raw.Restart,
+		DNS:         raw.DNS,
+		Env:         raw.Env,
+		Command:     raw.Command,
+		Labels:      labelMap(raw.Labels),
+		NetworkMode: raw.NetworkMode,
+	}
+	for _, n := range raw.Networks {
+		spec.Networks = append(spec.Networks, DockerAttachment{
+			Network:     n.Name,
+			IPv4Address: n.IPv4Address,
+		})
+	}
+	for _, p := range raw.Ports {
+		spec.Ports = append(spec.Ports, DockerPort{
+			Internal: p.Internal,
+			External: p.External,
+		})
+	}
+	for _, v := range raw.Volumes {
+		spec.Mounts = append(spec.Mounts, DockerMount{
+			HostPath:      v.HostPath,
+			VolumeName:    v.VolumeName,
+			ContainerPath: v.ContainerPath,
+			ReadOnly:      v.ReadOnly,
+		})
+	}
+	return spec
+}
+
+func labelMap(labels []rawLabel) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.Label] = l.Value
+	}
+	return m
+}
+
+func makeAbspathFunc(baseDir string) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "path", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			path := args[0].AsString()
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(baseDir, path)
+			}
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return cty.NilVal, err
+			}
+			return cty.StringVal(abs), nil
+		},
+	})
+}
@@ -0,0 +1,233 @@
+package tfgen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rboyer/devconsul/cachestore"
+	"github.com/rboyer/devconsul/config"
+	"github.com/rboyer/devconsul/infra"
+)
+
+// renderDockerModel renders the same resources that 'up' writes to docker.tf
+// for a config file, and decodes them with ParseDockerModel.
+func renderDockerModel(t *testing.T, filename, scriptDir string) (*config.Config, *infra.Topology, *DockerModel, string) {
+	t.Helper()
+
+	cfg, err := config.LoadConfig(filename)
+	require.NoError(t, err)
+	topology, err := infra.CompileTopology(cfg)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	cache := &cachestore.Store{Dir: filepath.Join(dir, "cache")}
+	require.NoError(t, os.MkdirAll(cache.Dir, 0755))
+	for _, c := range topology.Clusters() {
+		require.NoError(t, os.WriteFile(cache.GetPathToStringFile("catalog_def."+c.Name+".json"), []byte("{}"), 0644))
+	}
+
+	var (
+		res        = []Resource{TerraformProvider()}
+		containers []Resource
+		images     = make(map[string]struct{})
+	)
+	addImage := func(name, image string) {
+		if _, ok := images[name]; !ok {
+			images[name] = struct{}{}
+			res = append(res, DockerImage(name, image))
+		}
+	}
+	for _, n := range topology.Networks() {
+		res = append(res, DockerNetwork(n.DockerName(), n.CIDR))
+	}
+	require.NoError(t, topology.Walk(func(node *infra.Node) error {
+		if node.IsAgent() {
+			res = append(res, DockerVolume(node.Name))
+		}
+		for _, pc := range NodeContainers(cfg, node) {
+			addImage(pc.ImageResource, pc.Image)
+		}
+		nodeContainers, err := GenerateNodeContainers(cfg, topology, cache, scriptDir, node, true)
+		if err != nil {
+			return err
+		}
+		containers = append(containers, nodeContainers...)
+		return nil
+	}))
+	if cfg.PrometheusEnabled {
+		res = append(res, DockerVolume("prometheus-data"), DockerVolume("grafana-data"))
+		addImage("prometheus", "prom/prometheus:latest")
+		addImage("grafana", "grafana/grafana-oss:9.3.2")
+		containers = append(containers, PrometheusContainer(topology), GrafanaContainer())
+	}
+	if cfg.VaultEnabled {
+		res = append(res, DockerVolume("vault-data"))
+		addImage("vault", cfg.VaultImage)
+		containers = append(containers, VaultContainer(topology))
+	}
+	res = append(res, containers...)
+
+	body, err := renderHCLResources(res)
+	require.NoError(t, err)
+
+	model, err := ParseDockerModel(filepath.Join(dir, "docker.tf"), body)
+	require.NoError(t, err)
+	return cfg, topology, model, dir
+}
+
+func TestParseDockerModel(t *testing.T) {
+	const scriptDir = "/src/devconsul"
+
+	type testcase struct {
+		extra    []string // containers outside of the pods
+		expectFn func(t *testing.T, topology *infra.Topology, model *DockerModel, dir string)
+	}
+
+	cases := map[string]testcase{
+		"dual": {
+			expectFn: func(t *testing.T, topology *infra.Topology, model *DockerModel, dir string) {
+				require.Len(t, model.Networks, 3)
+				require.Equal(t, &DockerNetworkSpec{
+					Name:   "devconsul-wan",
+					Subnet: "10.1.0.0/16",
+					Labels: map[string]string{"devconsul": "1"},
+				}, model.Networks[2])
+
+				// Pods own the network namespace and are on every network
+				// of their node.
+				mgw := findContainer(t, model, "dc1-client5-pod")
+				require.Equal(t, "bridge", mgw.NetworkMode)
+				require.Equal(t, []DockerAttachment{
+					{Network: "devconsul-dc1", IPv4Address: "10.0.1.25"},
+					{Network: "devconsul-wan", IPv4Address: "10.1.1.25"},
+				}, mgw.Networks)
+
+				igw := findContainer(t, model, "dc1-client4-pod")
+				var ports []DockerPort
+				for _, l := range topology.Node("dc1-client4").IngressListeners {
+					ports = append(ports, DockerPort{Internal: l.Port, External: l.HostPort})
+				}
+				require.NotEmpty(t, ports)
+				require.Equal(t, ports, igw.Ports)
+
+				for _, name := range []string{"dc1-client4-ingress-gateway", "dc1-client3-terminating-gateway"} {
+					gw := findContainer(t, model, name)
+					require.Contains(t, gw.Mounts, DockerMount{
+						HostPath:      scriptDir + "/mesh-gateway-sidecar-boot.sh",
+						ContainerPath: "/bin/mesh-gateway-sidecar-boot.sh",
+						ReadOnly:      true,
+					}, name)
+				}
+
+				// Everything else joins its pod.
+				sidecar := findContainer(t, model, "dc1-client1-ping-sidecar")
+				require.Equal(t, "container:dc1-client1-pod", sidecar.NetworkMode)
+				require.Empty(t, sidecar.Networks)
+				require.Equal(t, "local/consul-envoy:latest", sidecar.Image)
+				require.Equal(t, "on-failure", sidecar.Restart)
+				require.Equal(t, "sidecar", sidecar.Labels["devconsul.type"])
+				require.Contains(t, sidecar.Mounts, DockerMount{
+					HostPath:      filepath.Join(dir, "cache"),
+					ContainerPath: "/secrets",
+					ReadOnly:      true,
+				})
+				require.Contains(t, sidecar.Mounts, DockerMount{
+					HostPath:      scriptDir + "/sidecar-boot.sh",
+					ContainerPath: "/bin/sidecar-boot.sh",
+					ReadOnly:      true,
+				})
+
+				dpgw := findContainer(t, model, "dc2-client3-mesh-gateway")
+				require.Equal(t, "local/consul-dataplane:latest", dpgw.Image)
+				require.Contains(t, dpgw.Mounts, DockerMount{
+					HostPath:      scriptDir + "/dataplane-boot.sh",
+					ContainerPath: "/bin/dataplane-boot.sh",
+					ReadOnly:      true,
+				})
+
+				agent := findContainer(t, model, "dc1-server1")
+				require.Equal(t, "consul-dev:latest", agent.Image)
+				require.Contains(t, agent.Mounts, DockerMount{
+					VolumeName:    "dc1-server1",
+					ContainerPath: "/consul/data",
+				})
+			},
+		},
+		"flat": {
+			extra: []string{"prometheus", "grafana", "vault"},
+			expectFn: func(t *testing.T, topology *infra.Topology, model *DockerModel, dir string) {
+				require.Len(t, model.Networks, 1)
+
+				canary := findContainer(t, model, "dc1-client1-ping-sidecar")
+				require.Equal(t, "local/consul-envoy-canary:latest", canary.Image)
+
+				grafana := findContainer(t, model, "grafana")
+				require.Equal(t, "prometheus", grafana.NetworkContainer())
+				require.Equal(t, "grafana/grafana-oss:9.3.2", grafana.Image)
+
+				prometheus := findContainer(t, model, "prometheus")
+				require.Equal(t, []DockerAttachment{
+					{Network: "devconsul-lan", IPv4Address: topology.PrometheusIP()},
+				}, prometheus.Networks)
+				require.Contains(t, prometheus.Mounts, DockerMount{
+					HostPath:      filepath.Join(dir, "cache/prometheus.yml"),
+					ContainerPath: "/etc/prometheus/prometheus.yml",
+					ReadOnly:      true,
+				})
+
+				vault := findContainer(t, model, "vault")
+				require.Equal(t, []DockerAttachment{
+					{Network: "devconsul-lan", IPv4Address: topology.VaultIP()},
+				}, vault.Networks)
+				require.Equal(t, []DockerPort{{Internal: 8200, External: 8200}}, vault.Ports)
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			cfg, topology, model, dir := renderDockerModel(t, filepath.Join("testdata", name+".hcl"), scriptDir)
+
+			// Every container that NodeContainers lists is in the model with
+			// the same image, in the same order.
+			var (
+				expectNames  []string
+				expectImages = make(map[string]string)
+			)
+			topology.WalkSilent(func(node *infra.Node) {
+				for _, pc := range NodeContainers(cfg, node) {
+					expectNames = append(expectNames, pc.Name)
+					expectImages[pc.Name] = pc.Image
+				}
+			})
+			expectNames = append(expectNames, tc.extra...)
+
+			var names []string
+			for _, c := range model.Containers {
+				names = append(names, c.Name)
+				if image, ok := expectImages[c.Name]; ok {
+					require.Equal(t, image, c.Image, c.Name)
+				}
+				require.Equal(t, "1", c.Labels["devconsul"], c.Name)
+			}
+			require.Equal(t, expectNames, names)
+
+			tc.expectFn(t, topology, model, dir)
+		})
+	}
+}
+
+func findContainer(t *testing.T, model *DockerModel, name string) *DockerContainerSpec {
+	t.Helper()
+	for _, c := range model.Containers {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("container %q not found", name)
+	return nil
+}
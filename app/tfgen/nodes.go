@@ -1,6 +1,7 @@
 package tfgen
 
 import (
+	"fmt"
 	"text/template"
 
 	"github.com/rboyer/devconsul/cachestore"
@@ -11,15 +12,19 @@ import (
 type terraformPod struct {
 	PodName               string
 	Node                  *infra.Node
+	ImageResource         string
 	HCL                   string
 	Labels                map[string]string
 	EnterpriseLicensePath string
 }
 
+// GenerateNodeContainers creates the containers listed by NodeContainers for
+// the node. Without podContents only the placeholder container is created.
 func GenerateNodeContainers(
 	cfg *config.Config,
 	topology *infra.Topology,
 	cache *cachestore.Store,
+	scriptDir string, // holds the boot scripts
 	node *infra.Node,
 	podContents bool,
 ) ([]Resource, error) {
@@ -34,40 +39,48 @@ func GenerateNodeContainers(
 	node.AddLabels(pod.Labels)
 
 	var containers []Resource
+	for _, pc := range NodeContainers(cfg, node) {
+		if pc.Kind != PodContainerPause && !podContents {
+			continue
+		}
 
-	// pod placeholder container
-	containers = append(containers, Eval(tfPauseT, &pod))
-
-	if podContents {
-		if node.IsAgent() {
+		var res Resource
+		switch pc.Kind {
+		case PodContainerPause:
+			pause := pod
+			pause.ImageResource = pc.imageRef()
+			res = Eval(tfPauseT, &pause)
+		case PodContainerConsul:
 			podHCL, err := GenerateAgentHCL(cfg, topology, node)
 			if err != nil {
 				return nil, err
 			}
-			pod.HCL = podHCL
-
-			containers = append(containers, Eval(tfConsulT, &pod))
-		}
-
-		if node.RunsWorkloads() {
-			if gwRes := GenerateMeshGatewayContainer(cfg, topology, pod.PodName, pod.Node); gwRes != nil {
-				containers = append(containers, gwRes)
-			}
-
-			if resources := GeneratePingPongContainers(cfg, topology, pod.PodName, pod.Node); len(resources) > 0 {
-				containers = append(containers, resources...)
-			}
-		}
-
-		if node.Kind == infra.NodeKindInfra {
-			resources, err := GenerateInfraContainers(cfg, topology, cache, pod.PodName, pod.Node)
+			agent := pod
+			agent.HCL = escapeHCLTemplate(podHCL)
+			agent.ImageResource = pc.imageRef()
+			res = Eval(tfConsulT, &agent)
+		case PodContainerMeshGateway:
+			res = GenerateMeshGatewayContainer(cfg, topology, scriptDir, pod.PodName, node, pc.imageRef())
+		case PodContainerIngressGateway:
+			res = GenerateIngressGatewayContainer(cfg, scriptDir, pod.PodName, node, pc.imageRef())
+		case PodContainerTerminatingGateway:
+			res = GenerateTerminatingGatewayContainer(cfg, scriptDir, pod.PodName, node, pc.imageRef())
+		case PodContainerService:
+			res = generateServiceAppContainer(pod.PodName, node, node.Services[pc.Service], pc.imageRef())
+		case PodContainerSidecar:
+			res = generateServiceSidecarContainer(cfg, topology, scriptDir, pod.PodName, node, pc.Service, pc.imageRef())
+		case PodContainerCatalogSync:
+			var err error
+			res, err = generateCatalogSyncContainer(cfg, topology, cache, node, pc.imageRef())
 			if err != nil {
 				return nil, err
 			}
-			if len(resources) > 0 {
-				containers = append(containers, resources...)
-			}
+		case PodContainerExternalService:
+			res = generateExternalServiceContainer(pod.PodName, node, node.ExternalServices[pc.Service], pc.imageRef())
+		default:
+			return nil, fmt.Errorf("unknown kind of container %q", pc.Kind)
 		}
+		containers = append(containers, res)
 	}
 
 	return containers, nil
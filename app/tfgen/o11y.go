@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"sort"
+	"strconv"
 	"text/template"
 
 	"github.com/rboyer/devconsul/config"
@@ -20,10 +21,12 @@ func GrafanaPrometheus() *FileResource {
 		Embed("templates/grafana-prometheus.yml"))
 }
 
-func PrometheusContainer() Resource {
-	return Embed("templates/container-prometheus.tf")
+func PrometheusContainer(topology *infra.Topology) Resource {
+	return Eval(tfPrometheusT, struct{ IPAddress string }{topology.PrometheusIP()})
 }
 
+var tfPrometheusT = template.Must(template.ParseFS(content, "templates/container-prometheus.tf.tmpl"))
+
 func GrafanaContainer() Resource {
 	return Embed("templates/container-grafana.tf")
 }
@@ -109,21 +112,55 @@ func GeneratePrometheusConfigFile(cfg *config.Config, topology *infra.Topology)
 						{"role", "mesh-gateway"},
 					},
 				})
-			} else if node.Service != nil {
+			} else if node.IngressGateway {
 				add(&job{
-					Name:        node.Service.ID.Name + "-proxy--" + node.Name,
+					Name:        "ingress-gateway--" + node.Name,
 					MetricsPath: "/metrics",
 					Targets: []string{
 						net.JoinHostPort(node.LocalAddress(), "9102"),
 					},
 					Labels: []kv{
 						{"cluster", node.Cluster},
-						{"namespace", node.Service.ID.Namespace},
-						{"partition", node.Service.ID.Partition},
+						{"namespace", "default"},
+						{"partition", node.Partition},
+						{"segment", node.Segment},
+						{"node", node.Name},
+						{"role", "ingress-gateway"},
+					},
+				})
+			} else if node.TerminatingGateway {
+				add(&job{
+					Name:        "terminating-gateway--" + node.Name,
+					MetricsPath: "/metrics",
+					Targets: []string{
+						net.JoinHostPort(node.LocalAddress(), "9102"),
+					},
+					Labels: []kv{
+						{"cluster", node.Cluster},
+						{"namespace", "default"},
+						{"partition", node.Partition},
+						{"segment", node.Segment},
 						{"node", node.Name},
-						{"role", node.Service.ID.Name + "-proxy"},
+						{"role", "terminating-gateway"},
 					},
 				})
+			} else {
+				for _, svc := range node.Services {
+					add(&job{
+						Name:        svc.ID.Name + "-proxy--" + node.Name,
+						MetricsPath: "/metrics",
+						Targets: []string{
+							net.JoinHostPort(node.LocalAddress(), strconv.Itoa(svc.EnvoyPrometheusPort)),
+						},
+						Labels: []kv{
+							{"cluster", node.Cluster},
+							{"namespace", svc.ID.Namespace},
+							{"partition", svc.ID.Partition},
+							{"node", node.Name},
+							{"role", svc.ID.Name + "-proxy"},
+						},
+					})
+				}
 			}
 		}
 	})
@@ -7,3 +7,7 @@ terraform {
   }
   required_version = ">= 0.13"
 }
+
+provider "docker" {
+  host = "unix:///var/run/docker.sock"
+}
@@ -0,0 +1,41 @@
+active = "agent"
+
+config "agent" {
+  consul_image = "consul-dev:latest"
+
+  agent_extra_hcl = <<EOT
+log_level = "debug"
+raft_protocol = 3
+limits {
+  http_max_conns_per_client = 100
+}
+EOT
+
+  topology {
+    network_shape = "flat"
+
+    cluster "dc1" {
+      servers = 1
+      clients = 1
+
+      agent_extra_hcl = <<EOT
+log_level = "info"
+limits {
+  rpc_rate = 50
+}
+EOT
+    }
+
+    node "dc1-server1" {
+      agent_extra_hcl = <<EOT
+log_level = "warn"
+limits {
+  rpc_rate = 10
+}
+watches {
+  type = "keyprefix"
+}
+EOT
+    }
+  }
+}
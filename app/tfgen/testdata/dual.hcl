@@ -0,0 +1,47 @@
+active = "dual"
+
+config "dual" {
+  consul_image = "consul-dev:latest"
+
+  security {
+    initial_master_token = "root"
+    encryption {
+      tls    = true
+      gossip = true
+    }
+  }
+
+  topology {
+    network_shape = "dual"
+
+    cluster "dc1" {
+      servers              = 1
+      clients              = 2
+      mesh_gateways        = 1
+      ingress_gateways     = 1
+      terminating_gateways = 1
+    }
+    cluster "dc2" {
+      servers       = 1
+      clients       = 2
+      mesh_gateways = 1
+    }
+
+    external_service "legacy" {
+      port        = 9999
+      healthcheck = "/"
+    }
+
+    node "dc1-client1" {
+      upstream {
+        name = "legacy"
+      }
+    }
+    node "dc2-client2" {
+      mode = "dataplane"
+    }
+    node "dc2-client3" {
+      mode = "dataplane"
+    }
+  }
+}
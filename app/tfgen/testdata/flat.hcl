@@ -0,0 +1,32 @@
+active = "flat"
+
+config "flat" {
+  consul_image = "consul-dev:latest"
+
+  security {
+    initial_master_token = "root"
+    vault {
+      enabled = true
+    }
+  }
+
+  monitor {
+    prometheus = true
+  }
+
+  canary_proxies {
+    consul_image  = "consul-dev:canary"
+    envoy_version = "1.24.0"
+    nodes         = ["dc1-client1"]
+  }
+
+  topology {
+    network_shape = "flat"
+
+    cluster "dc1" {
+      servers       = 1
+      clients       = 2
+      mesh_gateways = 1
+    }
+  }
+}
@@ -10,12 +10,15 @@ import (
 //go:embed templates/container-catalog-sync.tf.tmpl
 //go:embed templates/container-consul.tf.tmpl
 //go:embed templates/container-grafana.tf
+//go:embed templates/container-gateway.tf.tmpl
+//go:embed templates/container-mgw-dataplane.tf.tmpl
 //go:embed templates/container-mgw.tf.tmpl
 //go:embed templates/container-pause.tf.tmpl
-//go:embed templates/container-prometheus.tf
-//go:embed templates/container-vault.tf
+//go:embed templates/container-prometheus.tf.tmpl
+//go:embed templates/container-vault.tf.tmpl
 //go:embed templates/grafana.ini
 //go:embed templates/grafana-prometheus.yml
 //go:embed templates/prometheus-config.yml.tmpl
+//go:embed templates/terraform.tf
 //go:embed templates/vault-config.hcl
 var content embed.FS
@@ -1,10 +1,18 @@
 package tfgen
 
+import (
+	"text/template"
+
+	"github.com/rboyer/devconsul/infra"
+)
+
 func VaultConfig() *FileResource {
 	return File("cache/vault-config.hcl",
 		Embed("templates/vault-config.hcl"))
 }
 
-func VaultContainer() Resource {
-	return Embed("templates/container-vault.tf")
+func VaultContainer(topology *infra.Topology) Resource {
+	return Eval(tfVaultT, struct{ IPAddress string }{topology.VaultIP()})
 }
+
+var tfVaultT = template.Must(template.ParseFS(content, "templates/container-vault.tf.tmpl"))
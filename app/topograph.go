@@ -0,0 +1,566 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rboyer/devconsul/app/tfgen"
+	"github.com/rboyer/devconsul/config"
+	"github.com/rboyer/devconsul/infra"
+	"github.com/rboyer/devconsul/util"
+)
+
+// ExportTopology compiles the topology for the config file described by opts
+// without touching anything else, and writes it to w in the requested format:
+//
+//   - dot: a graphviz digraph with one subgraph per cluster
+//   - mermaid: a mermaid flowchart with one subgraph per cluster
+//   - json: the graph itself, for other tools to consume
+//   - table: the container/IP/image table from the README
+func ExportTopology(w io.Writer, opts Options, format string) error {
+	switch format {
+	case "dot", "mermaid", "json", "table":
+	default:
+		return fmt.Errorf("unknown output format %q: must be dot, mermaid, json, or table", format)
+	}
+
+	if opts.ConfigFile == "" {
+		opts.ConfigFile = DefaultConfigFile
+	}
+	configPath, err := filepath.Abs(opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadConfigWithOptions(configPath, config.LoadOptions{
+		Active: opts.Profile,
+		Vars:   opts.Vars,
+	})
+	if err != nil {
+		return err
+	}
+
+	topology, err := infra.CompileTopology(cfg)
+	if err != nil {
+		return err
+	}
+
+	g := buildTopologyGraph(cfg, topology)
+
+	switch format {
+	case "dot":
+		return writeTopologyDOT(w, g)
+	case "mermaid":
+		return writeTopologyMermaid(w, g)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(g)
+	default:
+		return writeTopologyTable(w, g)
+	}
+}
+
+type topoGraph struct {
+	LinkMode     string         `json:"link_mode"`
+	NetworkShape string         `json:"network_shape"`
+	PeeringMode  string         `json:"peering_mode,omitempty"`
+	Networks     []topoNetwork  `json:"networks"`
+	Clusters     []topoCluster  `json:"clusters"`
+	Links        []topoLink     `json:"links"`
+	Upstreams    []topoUpstream `json:"upstreams"`
+}
+
+type topoNetwork struct {
+	Name       string `json:"name"`
+	DockerName string `json:"docker_name"`
+	CIDR       string `json:"cidr"`
+}
+
+type topoCluster struct {
+	Name    string    `json:"name"`
+	Primary bool      `json:"primary,omitempty"`
+	Pods    []topoPod `json:"pods"`
+}
+
+type topoPod struct {
+	Name        string          `json:"name"`
+	Node        string          `json:"node"`
+	Kind        string          `json:"kind"`
+	Partition   string          `json:"partition"`
+	Canary      bool            `json:"canary,omitempty"`
+	ReadReplica bool            `json:"read_replica,omitempty"`
+	Zone        string          `json:"zone,omitempty"`
+	Gateways    []string        `json:"gateways,omitempty"`
+	Addresses   []topoAddress   `json:"addresses"`
+	Containers  []topoContainer `json:"containers"`
+}
+
+type topoAddress struct {
+	Network string `json:"network"`
+	IP      string `json:"ip"`
+	Public  bool   `json:"public,omitempty"`
+}
+
+type topoContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// topoLink joins two clusters together, either with WAN federation (from a
+// secondary to the primary) or with a peering (from the dialer to the
+// acceptor).
+type topoLink struct {
+	Kind string   `json:"kind"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Via  []string `json:"via,omitempty"` // mesh gateway pods on either side
+}
+
+// topoUpstream is traffic from one pod to the pods that run the service it
+// is routed to.
+type topoUpstream struct {
+	From       string   `json:"from"`     // the container sending the traffic
+	FromPod    string   `json:"from_pod"` // the pod it runs in
+	Upstream   string   `json:"upstream"`
+	Peer       string   `json:"peer,omitempty"`
+	Datacenter string   `json:"datacenter,omitempty"`
+	Cluster    string   `json:"cluster"` // where the upstream was found
+	To         []string `json:"to"`      // pods running the upstream
+}
+
+func buildTopologyGraph(cfg *config.Config, topology *infra.Topology) *topoGraph {
+	g := &topoGraph{
+		LinkMode:     string(topology.LinkMode),
+		NetworkShape: string(topology.NetworkShape),
+		PeeringMode:  string(topology.PeeringMode),
+		Networks:     []topoNetwork{},
+		Links:        []topoLink{},
+		Upstreams:    []topoUpstream{},
+	}
+
+	for _, n := range topology.Networks() {
+		g.Networks = append(g.Networks, topoNetwork{
+			Name:       n.Name,
+			DockerName: n.DockerName(),
+			CIDR:       n.CIDR,
+		})
+	}
+
+	for _, c := range topology.Clusters() {
+		tc := topoCluster{
+			Name:    c.Name,
+			Primary: c.Primary,
+			Pods:    []topoPod{},
+		}
+		for _, node := range topology.ClusterNodes(c.Name) {
+			tc.Pods = append(tc.Pods, buildTopologyPod(cfg, node))
+		}
+		g.Clusters = append(g.Clusters, tc)
+	}
+
+	// Only mesh gateways in the default partition carry traffic between
+	// clusters.
+	gatewayPods := func(cluster string) []string {
+		var out []string
+		for _, node := range topology.ClusterNodes(cluster) {
+			if node.MeshGateway && node.Partition == "default" {
+				out = append(out, node.PodName())
+			}
+		}
+		return out
+	}
+
+	switch {
+	case topology.LinkWithFederation():
+		var primary string
+		for _, c := range topology.Clusters() {
+			if c.Primary {
+				primary = c.Name
+			}
+		}
+		for _, c := range topology.Clusters() {
+			if c.Primary {
+				continue
+			}
+			link := topoLink{Kind: "federation", From: c.Name, To: primary}
+			if topology.FederateWithGateways() {
+				link.Via = append(gatewayPods(c.Name), gatewayPods(primary)...)
+			}
+			g.Links = append(g.Links, link)
+		}
+	case topology.LinkWithPeering():
+		for _, p := range topology.Peerings() {
+			link := topoLink{Kind: "peering", From: p.Dialer, To: p.Acceptor}
+			if topology.PeerThroughMeshGateways() {
+				link.Via = append(gatewayPods(p.Dialer), gatewayPods(p.Acceptor)...)
+			}
+			g.Links = append(g.Links, link)
+		}
+	}
+
+	topology.WalkSilent(func(node *infra.Node) {
+		if !node.RunsWorkloads() {
+			return
+		}
+		for _, svc := range node.Services {
+			for _, up := range svc.Upstreams {
+				target := upstreamCluster(topology, node.Cluster, up)
+				g.Upstreams = append(g.Upstreams, topoUpstream{
+					From:       node.Name + "-" + svc.ID.Name,
+					FromPod:    node.PodName(),
+					Upstream:   up.ID.String(),
+					Peer:       up.Peer,
+					Datacenter: up.Datacenter,
+					Cluster:    target,
+					To:         podsRunning(topology, target, up.ID, up.Peer != ""),
+				})
+			}
+		}
+		for _, l := range node.IngressListeners {
+			g.Upstreams = append(g.Upstreams, topoUpstream{
+				From:     node.Name + "-ingress-gateway",
+				FromPod:  node.PodName(),
+				Upstream: l.Service.String(),
+				Cluster:  node.Cluster,
+				To:       podsRunning(topology, node.Cluster, l.Service, false),
+			})
+		}
+		if node.TerminatingGateway {
+			for _, ext := range topology.ExternalServices(node.Cluster) {
+				g.Upstreams = append(g.Upstreams, topoUpstream{
+					From:     node.Name + "-terminating-gateway",
+					FromPod:  node.PodName(),
+					Upstream: ext.ID.String(),
+					Cluster:  node.Cluster,
+					To:       podsRunning(topology, node.Cluster, ext.ID, false),
+				})
+			}
+		}
+	})
+
+	return g
+}
+
+func buildTopologyPod(cfg *config.Config, node *infra.Node) topoPod {
+	pod := topoPod{
+		Name:        node.PodName(),
+		Node:        node.Name,
+		Kind:        string(node.Kind),
+		Partition:   node.Partition,
+		Canary:      node.Canary,
+		ReadReplica: node.ReadReplica,
+		Zone:        node.Zone,
+		Addresses:   []topoAddress{},
+		Containers:  []topoContainer{},
+	}
+	if node.MeshGateway {
+		pod.Gateways = append(pod.Gateways, "mesh")
+	}
+	if node.IngressGateway {
+		pod.Gateways = append(pod.Gateways, "ingress")
+	}
+	if node.TerminatingGateway {
+		pod.Gateways = append(pod.Gateways, "terminating")
+	}
+	for _, a := range node.Addresses {
+		pod.Addresses = append(pod.Addresses, topoAddress{
+			Network: a.Network,
+			IP:      a.IPAddress,
+			Public:  a.Public,
+		})
+	}
+	for _, c := range tfgen.NodeContainers(cfg, node) {
+		pod.Containers = append(pod.Containers, topoContainer{
+			Name:  c.Name,
+			Image: c.Image,
+		})
+	}
+	return pod
+}
+
+// upstreamCluster returns the cluster that an upstream of a service in the
+// local cluster is resolved in.
+func upstreamCluster(topology *infra.Topology, local string, up *infra.Upstream) string {
+	switch {
+	case up.Peer != "":
+		for _, c := range topology.Clusters() {
+			if infra.PeerName(c.Name) == up.Peer {
+				return c.Name
+			}
+		}
+		return local
+	case up.Datacenter != "":
+		return up.Datacenter
+	default:
+		return local
+	}
+}
+
+// podsRunning returns the pods in a cluster that run the named service,
+// including external services. Services imported from a peer are exported
+// from whichever partition they live in, so the partition is ignored then.
+func podsRunning(topology *infra.Topology, cluster string, id util.Identifier, anyPartition bool) []string {
+	matches := func(other util.Identifier) bool {
+		if other.Name != id.Name || other.Namespace != id.Namespace {
+			return false
+		}
+		return anyPartition || other.Partition == id.Partition
+	}
+
+	out := []string{}
+	for _, node := range topology.ClusterNodes(cluster) {
+		found := false
+		for _, svc := range node.Services {
+			if matches(svc.ID) {
+				found = true
+			}
+		}
+		for _, ext := range node.ExternalServices {
+			if matches(ext.ID) {
+				found = true
+			}
+		}
+		if found {
+			out = append(out, node.PodName())
+		}
+	}
+	return out
+}
+
+// describe returns the lines used to label a pod in the graph formats.
+func (p *topoPod) describe() []string {
+	kind := p.Kind
+	if p.ReadReplica {
+		kind += " (read replica)"
+	}
+	if len(p.Gateways) > 0 {
+		kind += " (" + strings.Join(p.Gateways, ", ") + " gateway)"
+	}
+	if p.Canary {
+		kind += " [canary]"
+	}
+	if p.Partition != "" && p.Partition != "default" {
+		kind += " partition=" + p.Partition
+	}
+	if p.Zone != "" {
+		kind += " zone=" + p.Zone
+	}
+
+	lines := []string{p.Name, kind}
+	for _, a := range p.Addresses {
+		lines = append(lines, a.Network+": "+a.IP)
+	}
+	for _, c := range p.Containers[1:] {
+		lines = append(lines, "- "+c.Name)
+	}
+	return lines
+}
+
+func (g *topoGraph) clusterLabel(c *topoCluster) string {
+	// Peered clusters are all primaries, so only call it out when federating.
+	if c.Primary && g.LinkMode == string(infra.ClusterLinkModeFederate) {
+		return c.Name + " (primary)"
+	}
+	return c.Name
+}
+
+func writeTopologyDOT(w io.Writer, g *topoGraph) error {
+	var b strings.Builder
+
+	b.WriteString("digraph devconsul {\n")
+	b.WriteString("  compound=true;\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, fontname=\"monospace\"];\n")
+
+	if len(g.Networks) > 0 {
+		lines := []string{"networks"}
+		for _, n := range g.Networks {
+			lines = append(lines, n.Name+": "+n.CIDR)
+		}
+		fmt.Fprintf(&b, "\n  %s [shape=note, label=%s];\n", dotID("networks"), dotID(strings.Join(lines, "\n")))
+	}
+
+	for i := range g.Clusters {
+		c := &g.Clusters[i]
+		fmt.Fprintf(&b, "\n  subgraph %s {\n", dotID("cluster_"+c.Name))
+		fmt.Fprintf(&b, "    label=%s;\n", dotID(g.clusterLabel(c)))
+		for _, p := range c.Pods {
+			fmt.Fprintf(&b, "    %s [label=%s];\n", dotID(p.Name), dotID(strings.Join(p.describe(), "\n")))
+		}
+		b.WriteString("  }\n")
+	}
+
+	// Links between clusters are drawn between the gateways that carry
+	// them, or between the first server of each cluster clipped to the
+	// cluster boxes.
+	firstPod := make(map[string]string)
+	for _, c := range g.Clusters {
+		for _, p := range c.Pods {
+			if p.Kind == string(infra.NodeKindServer) {
+				firstPod[c.Name] = p.Name
+				break
+			}
+		}
+	}
+	if len(g.Links) > 0 {
+		b.WriteString("\n")
+	}
+	for _, l := range g.Links {
+		if len(l.Via) >= 2 {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s, style=dashed, dir=both];\n",
+				dotID(l.Via[0]), dotID(l.Via[len(l.Via)-1]), dotID(l.Kind))
+			continue
+		}
+		from, to := firstPod[l.From], firstPod[l.To]
+		if from == "" || to == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "  %s -> %s [label=%s, style=dashed, dir=both, ltail=%s, lhead=%s];\n",
+			dotID(from), dotID(to), dotID(l.Kind), dotID("cluster_"+l.From), dotID("cluster_"+l.To))
+	}
+
+	if len(g.Upstreams) > 0 {
+		b.WriteString("\n")
+	}
+	for _, u := range g.Upstreams {
+		for _, to := range u.To {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s];\n", dotID(u.FromPod), dotID(to), dotID(upstreamLabel(u)))
+		}
+	}
+
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotID quotes s for use as a graphviz ID. Newlines become graphviz line
+// breaks.
+func dotID(s string) string {
+	return strconv.Quote(s)
+}
+
+func writeTopologyMermaid(w io.Writer, g *topoGraph) error {
+	var b strings.Builder
+
+	b.WriteString("flowchart LR\n")
+
+	if len(g.Networks) > 0 {
+		b.WriteString("  subgraph networks[\"networks\"]\n")
+		for _, n := range g.Networks {
+			fmt.Fprintf(&b, "    %s[%s]\n", mermaidID("network_"+n.Name), mermaidLabel([]string{n.Name, n.CIDR}))
+		}
+		b.WriteString("  end\n")
+	}
+
+	for i := range g.Clusters {
+		c := &g.Clusters[i]
+		fmt.Fprintf(&b, "  subgraph %s[%s]\n", mermaidID("cluster_"+c.Name), mermaidLabel([]string{g.clusterLabel(c)}))
+		for _, p := range c.Pods {
+			fmt.Fprintf(&b, "    %s[%s]\n", mermaidID(p.Name), mermaidLabel(p.describe()))
+		}
+		b.WriteString("  end\n")
+	}
+
+	// Mermaid can link subgraphs directly, so links only need to use the
+	// gateways when they are involved.
+	for _, l := range g.Links {
+		from, to := mermaidID("cluster_"+l.From), mermaidID("cluster_"+l.To)
+		if len(l.Via) >= 2 {
+			from, to = mermaidID(l.Via[0]), mermaidID(l.Via[len(l.Via)-1])
+		}
+		fmt.Fprintf(&b, "  %s <-. %s .-> %s\n", from, l.Kind, to)
+	}
+
+	for _, u := range g.Upstreams {
+		for _, to := range u.To {
+			fmt.Fprintf(&b, "  %s -- %s --> %s\n", mermaidID(u.FromPod), mermaidLabel([]string{upstreamLabel(u)}), mermaidID(to))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidID turns a name into something mermaid accepts as a node ID.
+func mermaidID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// mermaidLabel joins lines into a quoted mermaid label.
+func mermaidLabel(lines []string) string {
+	return `"` + strings.ReplaceAll(strings.Join(lines, "<br/>"), `"`, "#quot;") + `"`
+}
+
+func upstreamLabel(u topoUpstream) string {
+	id, _ := strings.CutPrefix(u.Upstream, "default/default/")
+	switch {
+	case u.Peer != "":
+		return id + " (" + u.Peer + ")"
+	case u.Datacenter != "":
+		return id + " (" + u.Datacenter + ")"
+	default:
+		return id
+	}
+}
+
+// writeTopologyTable writes one row for each container, grouped by pod. The
+// first row of each pod is the placeholder container, which is the only one
+// with an IP of its own; the rest share it.
+func writeTopologyTable(w io.Writer, g *topoGraph) error {
+	rows := [][3]string{
+		{"Container", "IP", "Image"},
+		{},
+	}
+	for _, c := range g.Clusters {
+		for _, p := range c.Pods {
+			ip := ""
+			for _, a := range p.Addresses {
+				if a.Network == c.Name || a.Network == "lan" {
+					ip = a.IP
+					break
+				}
+			}
+			for i, ctr := range p.Containers {
+				if i == 0 {
+					rows = append(rows, [3]string{ctr.Name, ip, ctr.Image})
+				} else {
+					rows = append(rows, [3]string{ctr.Name, "^^^", ctr.Image})
+				}
+			}
+		}
+	}
+
+	var widths [3]int
+	for _, row := range rows {
+		for i, col := range row {
+			if len(col) > widths[i] {
+				widths[i] = len(col)
+			}
+		}
+	}
+	for i := range widths {
+		rows[1][i] = strings.Repeat("-", widths[i])
+	}
+
+	for _, row := range rows {
+		if _, err := fmt.Fprintf(w, "| %-*s | %-*s | %-*s |\n",
+			widths[0], row[0], widths[1], row[1], widths[2], row[2],
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
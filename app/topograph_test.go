@@ -0,0 +1,54 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rboyer/devconsul/config"
+	"github.com/rboyer/devconsul/infra"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestExportTopology(t *testing.T) {
+	for _, format := range []string{"table", "dot", "mermaid", "json"} {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := ExportTopology(&buf, Options{ConfigFile: filepath.Join("testdata", "topology.hcl")}, format)
+			require.NoError(t, err)
+
+			golden := filepath.Join("testdata", "topology."+format+".golden")
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(golden, buf.Bytes(), 0644))
+			}
+
+			expect, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			require.Equal(t, string(expect), buf.String())
+		})
+	}
+}
+
+func TestExportTopology_JSONRoundTrip(t *testing.T) {
+	filename := filepath.Join("testdata", "topology.hcl")
+
+	var buf bytes.Buffer
+	require.NoError(t, ExportTopology(&buf, Options{ConfigFile: filename}, "json"))
+
+	var got topoGraph
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+
+	cfg, err := config.LoadConfig(filename)
+	require.NoError(t, err)
+	topology, err := infra.CompileTopology(cfg)
+	require.NoError(t, err)
+
+	require.Equal(t, buildTopologyGraph(cfg, topology), &got)
+}
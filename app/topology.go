@@ -10,6 +10,7 @@ const (
 	NetworkShapeIslands = infra.NetworkShapeIslands
 	NetworkShapeDual    = infra.NetworkShapeDual
 	NetworkShapeFlat    = infra.NetworkShapeFlat
+	NetworkShapeCustom  = infra.NetworkShapeCustom
 )
 
 type ClusterLinkMode = infra.ClusterLinkMode
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+
+	"github.com/rboyer/devconsul/config"
+	"github.com/rboyer/devconsul/infra"
+)
+
+// Validate parses, validates, and compiles the topology for the config file
+// described by opts without touching anything else, and writes every problem
+// found to w in the requested format ("text" or "json").
+//
+// It returns false if any errors were found.
+func Validate(w io.Writer, opts Options, format string) (bool, error) {
+	switch format {
+	case "text", "json":
+	default:
+		return false, fmt.Errorf("unknown output format %q: must be text or json", format)
+	}
+
+	if opts.ConfigFile == "" {
+		opts.ConfigFile = DefaultConfigFile
+	}
+	configPath, err := filepath.Abs(opts.ConfigFile)
+	if err != nil {
+		return false, err
+	}
+
+	cfg, problems := config.CheckConfig(configPath, config.LoadOptions{
+		Active: opts.Profile,
+		Vars:   opts.Vars,
+	})
+	diags := problems.Diagnostics
+	if cfg != nil {
+		_, topoProblems := infra.CheckTopology(cfg, problems.Sources)
+		diags = append(diags, topoProblems.Diagnostics...)
+	}
+	diags = dedupeDiagnostics(diags)
+
+	if format == "json" {
+		if err := writeDiagnosticsJSON(w, diags); err != nil {
+			return false, err
+		}
+	} else {
+		if err := writeDiagnosticsText(w, diags); err != nil {
+			return false, err
+		}
+	}
+
+	return !diags.HasErrors(), nil
+}
+
+// dedupeDiagnostics drops any diagnostic that repeats an earlier one, which
+// happens when a problem is noticed both while loading the config and while
+// compiling the topology.
+func dedupeDiagnostics(diags hcl.Diagnostics) hcl.Diagnostics {
+	type key struct {
+		severity hcl.DiagnosticSeverity
+		summary  string
+		subject  string
+	}
+	var (
+		out  hcl.Diagnostics
+		seen = make(map[key]struct{})
+	)
+	for _, diag := range diags {
+		k := key{severity: diag.Severity, summary: diag.Summary}
+		if diag.Subject != nil {
+			k.subject = diag.Subject.String()
+		}
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		out = append(out, diag)
+	}
+	return out
+}
+
+func writeDiagnosticsText(w io.Writer, diags hcl.Diagnostics) error {
+	if len(diags) == 0 {
+		_, err := fmt.Fprintln(w, "The configuration is valid.")
+		return err
+	}
+
+	// The diagnostic writer only needs the raw bytes of each file to show the
+	// offending source lines.
+	files := make(map[string]*hcl.File)
+	for _, diag := range diags {
+		if diag.Subject == nil {
+			continue
+		}
+		name := diag.Subject.Filename
+		if _, ok := files[name]; ok {
+			continue
+		}
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		files[name] = &hcl.File{Bytes: contents}
+	}
+
+	dw := hcl.NewDiagnosticTextWriter(w, files, 78, false)
+	if err := dw.WriteDiagnostics(diags); err != nil {
+		return err
+	}
+
+	var errs, warns int
+	for _, diag := range diags {
+		if diag.Severity == hcl.DiagError {
+			errs++
+		} else {
+			warns++
+		}
+	}
+	_, err := fmt.Fprintf(w, "\n%d error(s), %d warning(s)\n", errs, warns)
+	return err
+}
+
+type jsonDiagnostic struct {
+	Severity string     `json:"severity"`
+	Summary  string     `json:"summary"`
+	Detail   string     `json:"detail,omitempty"`
+	Range    *jsonRange `json:"range,omitempty"`
+}
+
+type jsonRange struct {
+	Filename string  `json:"filename"`
+	Start    jsonPos `json:"start"`
+	End      jsonPos `json:"end"`
+}
+
+type jsonPos struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Byte   int `json:"byte"`
+}
+
+func writeDiagnosticsJSON(w io.Writer, diags hcl.Diagnostics) error {
+	out := struct {
+		Valid       bool             `json:"valid"`
+		ErrorCount  int              `json:"error_count"`
+		WarnCount   int              `json:"warning_count"`
+		Diagnostics []jsonDiagnostic `json:"diagnostics"`
+	}{
+		Valid:       !diags.HasErrors(),
+		Diagnostics: []jsonDiagnostic{},
+	}
+
+	for _, diag := range diags {
+		jd := jsonDiagnostic{
+			Summary: diag.Summary,
+			Detail:  diag.Detail,
+		}
+		if diag.Severity == hcl.DiagError {
+			jd.Severity = "error"
+			out.ErrorCount++
+		} else {
+			jd.Severity = "warning"
+			out.WarnCount++
+		}
+		if rng := diag.Subject; rng != nil {
+			jd.Range = &jsonRange{
+				Filename: rng.Filename,
+				Start:    jsonPos{Line: rng.Start.Line, Column: rng.Start.Column, Byte: rng.Start.Byte},
+				End:      jsonPos{Line: rng.End.Line, Column: rng.End.Column, Byte: rng.End.Byte},
+			}
+		}
+		out.Diagnostics = append(out.Diagnostics, jd)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -36,8 +37,9 @@ type catalogSyncCommand struct {
 	client *api.Client
 
 	// lazy
-	dialer *net.Dialer
-	last   healthResults
+	dialer     *net.Dialer
+	httpClient *http.Client
+	last       healthResults
 
 	cluster        string
 	flagConfig     string
@@ -338,7 +340,7 @@ func (h *healthResults) setResult(nid NodeID, sid ServiceID, value string) {
 
 func (c *catalogSyncCommand) detectAndSyncHealthOnce() {
 	for _, svc := range c.conf.Services {
-		if svc.TCPCheck == "" || svc.CheckID == "" {
+		if (svc.TCPCheck == "" && svc.HTTPCheck == "") || svc.CheckID == "" {
 			continue
 		}
 
@@ -354,7 +356,7 @@ func (c *catalogSyncCommand) detectAndSyncHealthOnce() {
 
 		lastResult := c.last.getResult(nid, sid)
 
-		if err := c.checkTCP(svc.TCPCheck); err != nil {
+		if err := c.checkService(svc); err != nil {
 			if lastResult != api.HealthCritical {
 				logger.Warn("health check status is now failing", "p", lastResult, "n", api.HealthCritical)
 
@@ -388,6 +390,32 @@ func (c *catalogSyncCommand) syncHealth(svc *structs.CatalogService, status stri
 	return err
 }
 
+func (c *catalogSyncCommand) checkService(svc *structs.CatalogService) error {
+	if svc.HTTPCheck != "" {
+		return c.checkHTTP(svc.HTTPCheck)
+	}
+	return c.checkTCP(svc.TCPCheck)
+}
+
+func (c *catalogSyncCommand) checkHTTP(url string) error {
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{
+			Timeout: checkTimeout,
+		}
+	}
+
+	resp, err := c.httpClient.Get(url)
+	if err != nil {
+		return fmt.Errorf("http check failed: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("http check failed: unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (c *catalogSyncCommand) checkTCP(addr string) error {
 	if c.dialer == nil {
 		// Create the socket dialer
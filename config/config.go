@@ -10,12 +10,51 @@ type Versions struct {
 	DataplaneImage string
 }
 
+// Addressing describes how IP addresses are handed out. Each cluster gets the
+// subnet of the supernets matching its index, and nodes are placed in it at
+// fixed offsets by role.
+type Addressing struct {
+	LANSupernet   string
+	WANSupernet   string
+	ClusterPrefix int // size of each cluster's subnet
+
+	// host offsets within each cluster's subnet
+	ServerOffset int // first server
+	ClientOffset int // first client
+	InfraOffset  int
+
+	// SharedSubnet is the index of the /24 in the LAN supernet that holds the
+	// containers shared by all clusters, like prometheus and vault.
+	SharedSubnet     int
+	PrometheusOffset int
+	VaultOffset      int
+}
+
+// DefaultAddressing returns the address plan used when the config does not
+// override any of it.
+func DefaultAddressing() Addressing {
+	return Addressing{
+		LANSupernet:      "10.0.0.0/16",
+		WANSupernet:      "10.1.0.0/16",
+		ClusterPrefix:    24,
+		ServerOffset:     11,
+		ClientOffset:     21,
+		InfraOffset:      100,
+		SharedSubnet:     100,
+		PrometheusOffset: 100,
+		VaultOffset:      111,
+	}
+}
+
 // Config is the runtime configuration struct derived from rawConfig.
 type Config struct {
 	ConfName                         string // name from config.hcl
 	Versions                         Versions
 	CanaryVersions                   Versions
 	CanaryNodes                      []string
+	AgentExtraHCL                    string // merged into every agent config
+	Backend                          string // terraform or docker
+	Addressing                       Addressing
 	EncryptionTLS                    bool
 	EncryptionTLSAPI                 bool
 	EncryptionTLSGRPC                bool
@@ -40,8 +79,13 @@ type Config struct {
 	TopologyNetworkShape             string
 	TopologyLinkMode                 string
 	TopologyNodeMode                 string
+	TopologyPeeringMode              string
+	TopologyPeerings                 [][]string
 	TopologyClusters                 []*Cluster
 	TopologyNodes                    []*Node
+	TopologyServices                 []*Service
+	TopologyExternalServices         []*ExternalService
+	TopologyNetworks                 []*Network
 }
 
 func (c *Config) CanaryInfo() (configured bool, nodes map[string]struct{}) {
@@ -56,6 +100,43 @@ func (c *Config) CanaryInfo() (configured bool, nodes map[string]struct{}) {
 	return configured, nodes
 }
 
+// ClusterByName returns the topology cluster with the given name.
+func (c *Config) ClusterByName(name string) (*Cluster, bool) {
+	for _, cluster := range c.TopologyClusters {
+		if cluster.Name == name {
+			return cluster, true
+		}
+	}
+	return nil, false
+}
+
+// ClusterVersions returns the versions used by the named cluster, which are
+// the global versions unless overridden on the cluster.
+func (c *Config) ClusterVersions(name string) Versions {
+	v := c.Versions
+	if cluster, ok := c.ClusterByName(name); ok {
+		if cluster.ConsulImage != "" {
+			v.ConsulImage = cluster.ConsulImage
+		}
+		if cluster.EnvoyVersion != "" {
+			v.Envoy = cluster.EnvoyVersion
+		}
+		if cluster.DataplaneImage != "" {
+			v.DataplaneImage = cluster.DataplaneImage
+		}
+	}
+	return v
+}
+
+// Services returns the configured workload services, falling back on the
+// default ping/pong pair if none are configured.
+func (c *Config) Services() []*Service {
+	if len(c.TopologyServices) == 0 {
+		return DefaultServices()
+	}
+	return c.TopologyServices
+}
+
 type Partition struct {
 	Name       string   `hcl:"name,label"`
 	Namespaces []string `hcl:"namespaces,optional"`
@@ -73,10 +154,43 @@ func (c *Partition) IsDefault() bool {
 }
 
 type Cluster struct {
-	Name         string `hcl:"name,label"`
-	Servers      int    `hcl:"servers,optional"`
-	Clients      int    `hcl:"clients,optional"`
-	MeshGateways int    `hcl:"mesh_gateways,optional"`
+	Name                string `hcl:"name,label"`
+	Servers             int    `hcl:"servers,optional"`
+	Clients             int    `hcl:"clients,optional"`
+	MeshGateways        int    `hcl:"mesh_gateways,optional"`
+	IngressGateways     int    `hcl:"ingress_gateways,optional"`
+	TerminatingGateways int    `hcl:"terminating_gateways,optional"`
+
+	// ReadReplicas is the number of non-voting servers to run on top of the
+	// voting ones. Enterprise only.
+	ReadReplicas int `hcl:"read_replicas,optional"`
+
+	// RedundancyZones spreads the servers (and read replicas) across the
+	// named autopilot redundancy zones, in order. Enterprise only.
+	RedundancyZones []string `hcl:"redundancy_zones,optional"`
+
+	// Index picks which subnet of the address plan the cluster uses. Zero
+	// means it is taken from a name like "dc2", or assigned automatically.
+	Index int `hcl:"index,optional"`
+
+	// These override the global versions for just this cluster.
+	ConsulImage    string `hcl:"consul_image,optional"`
+	EnvoyVersion   string `hcl:"envoy_version,optional"`
+	DataplaneImage string `hcl:"dataplane_image,optional"`
+
+	// AgentExtraHCL is merged into the config of every agent in this cluster.
+	AgentExtraHCL string `hcl:"agent_extra_hcl,optional"`
+
+	// Attach lists the extra networks that each role in this cluster is
+	// attached to, keyed by role (servers, clients, mesh_gateways,
+	// ingress_gateways, or terminating_gateways).
+	Attach map[string][]string `hcl:"attach,optional"`
+}
+
+// HasVersionOverrides returns true if this cluster does not just use the
+// global versions.
+func (c *Cluster) HasVersionOverrides() bool {
+	return c.ConsulImage != "" || c.EnvoyVersion != "" || c.DataplaneImage != ""
 }
 
 type Node struct {
@@ -89,20 +203,101 @@ type Node struct {
 	UpstreamPartition  string            `hcl:"upstream_partition,optional"`
 	UpstreamPeer       string            `hcl:"upstream_peer,optional"`
 	UpstreamDatacenter string            `hcl:"upstream_datacenter,optional"`
-	UpstreamExtraHCL   string            `hcl:"upstream_extra_hcl,optional"`
+	UpstreamExtraHCL   string            `hcl:"upstream_extra_hcl,optional"` // deprecated: use upstream blocks
+	Upstreams          []*Upstream       `hcl:"upstream,block"`
+	Service            string            `hcl:"service,optional"`
+	Services           []string          `hcl:"services,optional"`
 	ServiceMeta        map[string]string `hcl:"service_meta,optional"` // key -> val
 	ServiceNamespace   string            `hcl:"service_namespace,optional"`
 	UseBuiltinProxy    bool              `hcl:"use_builtin_proxy,optional"`
 	Dead               bool              `hcl:"dead,optional"`
+	AgentExtraHCL      string            `hcl:"agent_extra_hcl,optional"` // merged into this agent's config
+	Attach             []string          `hcl:"attach,optional"`          // extra networks, on top of the role's
 
 	// mesh-gateway settings
 	RetainInPrimaryGatewaysList bool `hcl:"retain_in_primary_gateways_list,optional"`
 	UseDNSWANAddress            bool `hcl:"use_dns_wan_address,optional"`
 }
 
+// Upstream is an extra upstream (or an override of one of the service's own
+// upstreams) for a service running on a node.
+type Upstream struct {
+	Service         string            `hcl:"service,optional"`          // service on the node; empty means the first one
+	DestinationType string            `hcl:"destination_type,optional"` // service or prepared_query
+	Name            string            `hcl:"name"`
+	Namespace       string            `hcl:"namespace,optional"`
+	Partition       string            `hcl:"partition,optional"`
+	Peer            string            `hcl:"peer,optional"`
+	Datacenter      string            `hcl:"datacenter,optional"`
+	LocalPort       int               `hcl:"local_port,optional"` // zero means allocate one
+	MeshGatewayMode string            `hcl:"mesh_gateway_mode,optional"`
+	Config          map[string]string `hcl:"config,optional"`
+}
+
+// ServiceNames returns the services explicitly assigned to this node, if any.
+func (c *Node) ServiceNames() []string {
+	if c.Service != "" {
+		return []string{c.Service}
+	}
+	return c.Services
+}
+
 func (c *Node) Meta() map[string]string {
 	if c.ServiceMeta == nil {
 		return map[string]string{}
 	}
 	return c.ServiceMeta
 }
+
+// Service describes a workload that can be scheduled onto client nodes.
+type Service struct {
+	Name        string            `hcl:"name,label"`
+	Image       string            `hcl:"image,optional"` // empty means the builtin pingpong app
+	Port        int               `hcl:"port,optional"`
+	Upstreams   []string          `hcl:"upstreams,optional"`
+	Env         map[string]string `hcl:"env,optional"`
+	Command     []string          `hcl:"command,optional"`
+	Healthcheck string            `hcl:"healthcheck,optional"` // http path; empty means tcp
+}
+
+// Network is an extra network that nodes can be attached to alongside the
+// networks of the network shape.
+type Network struct {
+	Name string `hcl:"name,label"`
+	CIDR string `hcl:"cidr"`
+	// WAN marks the network as the one that attached nodes use for their
+	// public address, like the "wan" network of the built-in shapes.
+	WAN bool `hcl:"wan,optional"`
+}
+
+// ExternalService describes a plain workload outside of the mesh that is
+// registered in the catalog of one cluster and reached through that cluster's
+// terminating gateways.
+type ExternalService struct {
+	Name        string            `hcl:"name,label"`
+	Cluster     string            `hcl:"cluster,optional"` // empty means the primary cluster
+	Image       string            `hcl:"image,optional"`   // empty means a simple http echo server
+	Port        int               `hcl:"port,optional"`
+	Env         map[string]string `hcl:"env,optional"`
+	Command     []string          `hcl:"command,optional"`
+	Healthcheck string            `hcl:"healthcheck,optional"` // http path; empty means tcp
+}
+
+// DefaultServices returns the ping/pong pair that is used when the
+// configuration does not define any services.
+func DefaultServices() []*Service {
+	return []*Service{
+		{
+			Name:        ServicePing,
+			Port:        8080,
+			Upstreams:   []string{ServicePong},
+			Healthcheck: "/healthz",
+		},
+		{
+			Name:        ServicePong,
+			Port:        8080,
+			Upstreams:   []string{ServicePing},
+			Healthcheck: "/healthz",
+		},
+	}
+}
@@ -0,0 +1,409 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/mitchellh/mapstructure"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// rawConfigEntry is a config entry written natively in HCL:
+//
+//	config_entry {
+//	  kind = "service-resolver"
+//	  name = "pong"
+//	  redirect {
+//	    datacenter = "dc2"
+//	  }
+//	}
+//
+// Attribute and block names are written in snake_case and are translated to
+// the field names used by the consul api. Labeled blocks become map entries
+// keyed by their label, and repeated blocks become lists. The contents of
+// object valued attributes (like config or meta) are passed through as-is.
+type rawConfigEntry struct {
+	Body hcl.Body `hcl:",remain"`
+}
+
+func (e *rawConfigEntry) decode(ctx *hcl.EvalContext) (api.ConfigEntry, error) {
+	body, ok := e.Body.(*hclsyntax.Body)
+	if !ok {
+		return nil, fmt.Errorf("config_entry blocks are only supported in native HCL syntax")
+	}
+
+	raw, src, diags := configEntryBodyToMap(body, ctx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	// This detects the kind and does the same decoding that the JSON form
+	// gets, but silently ignores any unknown fields.
+	entry, err := api.DecodeConfigEntry(raw)
+	if err != nil {
+		return nil, configEntryDecodeDiags(body, src, "Invalid config entry", err)
+	}
+
+	// Decode again strictly so that typos are reported.
+	entryType := reflect.TypeOf(entry).Elem()
+	if _, ok := entryType.FieldByName("Kind"); !ok {
+		delete(raw, "Kind") // implied by the type
+	}
+	normalizeConfigEntryKeys(entryType, raw)
+	normalizeConfigEntryKeys(entryType, src)
+
+	strict := reflect.New(entryType).Interface()
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToTimeHookFunc(time.RFC3339),
+		),
+		Result:           strict,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(raw); err != nil {
+		return nil, configEntryDecodeDiags(body, src, "Invalid "+entry.GetKind()+" config entry", err)
+	}
+
+	return strict.(api.ConfigEntry), nil
+}
+
+// configEntryBodyToMap converts a config entry body into the map that the
+// consul api decodes. The second map has the same shape, but holds the
+// *hclsyntax.Attribute that each value came from, and each block's own
+// *hclsyntax.Block under the "" key, so that decoding errors can be traced
+// back to the config file.
+func configEntryBodyToMap(body *hclsyntax.Body, ctx *hcl.EvalContext) (map[string]any, map[string]any, hcl.Diagnostics) {
+	var (
+		out   = make(map[string]any)
+		src   = make(map[string]any)
+		diags hcl.Diagnostics
+	)
+
+	for name, attr := range body.Attributes {
+		val, moreDiags := attr.Expr.Value(ctx)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() || val.IsNull() {
+			continue
+		}
+
+		enc, err := ctyjson.Marshal(val, val.Type())
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported config entry value",
+				Detail:   err.Error(),
+				Subject:  attr.SrcRange.Ptr(),
+			})
+			continue
+		}
+		var v any
+		if err := json.Unmarshal(enc, &v); err != nil {
+			panic(err) // we just encoded it
+		}
+		out[configEntryKey(name)] = v
+		src[configEntryKey(name)] = attr
+	}
+
+	for _, block := range body.Blocks {
+		key := configEntryKey(block.Type)
+
+		if _, ok := body.Attributes[block.Type]; ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate config entry field",
+				Detail:   fmt.Sprintf("%q is defined as both an attribute and a block", block.Type),
+				Subject:  block.DefRange().Ptr(),
+			})
+			continue
+		}
+
+		v, vsrc, moreDiags := configEntryBodyToMap(block.Body, ctx)
+		diags = append(diags, moreDiags...)
+		vsrc[""] = block
+
+		switch len(block.Labels) {
+		case 0:
+			switch prior := out[key].(type) {
+			case nil:
+				out[key] = v
+				src[key] = vsrc
+			case map[string]any:
+				out[key] = []any{prior, v}
+				src[key] = []any{src[key], vsrc}
+			case []any:
+				out[key] = append(prior, v)
+				src[key] = append(src[key].([]any), vsrc)
+			}
+		case 1:
+			m, ok := out[key].(map[string]any)
+			if !ok {
+				m = make(map[string]any)
+				out[key] = m
+				src[key] = make(map[string]any)
+			}
+			if _, ok := m[block.Labels[0]]; ok {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate config entry block",
+					Detail:   fmt.Sprintf("%s %q is defined more than once", block.Type, block.Labels[0]),
+					Subject:  block.DefRange().Ptr(),
+				})
+				continue
+			}
+			m[block.Labels[0]] = v
+			src[key].(map[string]any)[block.Labels[0]] = vsrc
+		default:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported config entry block",
+				Detail:   fmt.Sprintf("%s blocks may have at most one label", block.Type),
+				Subject:  block.DefRange().Ptr(),
+			})
+		}
+	}
+
+	return out, src, diags
+}
+
+// mapstructureField matches the quoted path of the field (like
+// 'Routes[0].Match') in one of the problems in a mapstructure error.
+var mapstructureField = regexp.MustCompile(`'([^']*)'`)
+
+// configEntryDecodeDiags converts an error from decoding a config entry into
+// diagnostics that point at the attribute or block it is about, named the way
+// it was written in the config file.
+func configEntryDecodeDiags(body *hclsyntax.Body, src map[string]any, summary string, err error) hcl.Diagnostics {
+	var problems []string
+	if merr := (*mapstructure.Error)(nil); errors.As(err, &merr) {
+		problems = merr.Errors
+	} else {
+		problems = []string{err.Error()}
+	}
+	sort.Strings(problems)
+
+	var diags hcl.Diagnostics
+	for _, problem := range problems {
+		diag := &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  summary,
+			Detail:   problem,
+			Subject:  body.SrcRange.Ptr(),
+		}
+
+		loc := mapstructureField.FindStringSubmatchIndex(problem)
+		if loc == nil {
+			diags = append(diags, diag)
+			continue
+		}
+		node := lookupConfigEntrySource(src, problem[loc[2]:loc[3]])
+
+		if keys, ok := strings.CutPrefix(problem[loc[1]:], " has invalid keys: "); ok {
+			parent, _ := node.(map[string]any)
+			for _, key := range strings.Split(keys, ", ") {
+				diag := &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  summary,
+					Detail:   fmt.Sprintf("Unexpected field %q.", key),
+					Subject:  body.SrcRange.Ptr(),
+				}
+				switch n := parent[key].(type) {
+				case *hclsyntax.Attribute:
+					diag.Summary = "Unsupported argument"
+					diag.Detail = fmt.Sprintf("An argument named %q is not expected here.", n.Name)
+					diag.Subject = n.SrcRange.Ptr()
+				case map[string]any, []any:
+					if block := configEntrySourceBlock(n); block != nil {
+						diag.Summary = "Unsupported block type"
+						diag.Detail = fmt.Sprintf("Blocks of type %q are not expected here.", block.Type)
+						diag.Subject = block.DefRange().Ptr()
+					}
+				}
+				diags = append(diags, diag)
+			}
+			continue
+		}
+
+		// Otherwise name the field the way the user wrote it.
+		var name string
+		switch n := node.(type) {
+		case *hclsyntax.Attribute:
+			name = n.Name
+			diag.Subject = n.SrcRange.Ptr()
+		case map[string]any, []any:
+			if block := configEntrySourceBlock(n); block != nil {
+				name = block.Type
+				diag.Subject = block.DefRange().Ptr()
+			}
+		}
+		if name != "" {
+			diag.Detail = problem[:loc[0]] + strconv.Quote(name) + problem[loc[1]:]
+		}
+		diags = append(diags, diag)
+	}
+	return diags
+}
+
+// lookupConfigEntrySource follows a mapstructure field path through the
+// sources from configEntryBodyToMap, and returns the most specific part of
+// it that was found.
+func lookupConfigEntrySource(src map[string]any, path string) any {
+	var node any = src
+	for _, seg := range splitFieldPath(path) {
+		var next any
+		switch n := node.(type) {
+		case map[string]any:
+			if _, single := n[""]; single && seg == "[0]" {
+				next = n // a single block decoded into a list
+			} else if key, ok := strings.CutPrefix(seg, "["); ok {
+				next = n[strings.TrimSuffix(key, "]")]
+			} else {
+				for key, v := range n {
+					if strings.EqualFold(key, seg) {
+						next = v
+						break
+					}
+				}
+			}
+		case []any:
+			if i, err := strconv.Atoi(strings.Trim(seg, "[]")); err == nil && i >= 0 && i < len(n) {
+				next = n[i]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node
+}
+
+// splitFieldPath splits a mapstructure field path like "Routes[0].Match" into
+// "Routes", "[0]", and "Match".
+func splitFieldPath(path string) []string {
+	var out []string
+	for _, part := range strings.Split(path, ".") {
+		for part != "" {
+			i := strings.Index(part[1:], "[")
+			if i < 0 {
+				out = append(out, part)
+				break
+			}
+			out = append(out, part[:i+1])
+			part = part[i+1:]
+		}
+	}
+	return out
+}
+
+// configEntrySourceBlock returns the block for a value from the sources of
+// configEntryBodyToMap, or the first one if the block was repeated or
+// labeled.
+func configEntrySourceBlock(v any) *hclsyntax.Block {
+	var first *hclsyntax.Block
+	switch n := v.(type) {
+	case map[string]any:
+		if block, ok := n[""].(*hclsyntax.Block); ok {
+			return block
+		}
+		for _, elem := range n {
+			block := configEntrySourceBlock(elem)
+			if block != nil && (first == nil || block.Range().Start.Byte < first.Range().Start.Byte) {
+				first = block
+			}
+		}
+	case []any:
+		if len(n) > 0 {
+			first = configEntrySourceBlock(n[0])
+		}
+	}
+	return first
+}
+
+// normalizeConfigEntryKeys renames any keys that match the alias of a field
+// in the destination type (such as peer_name for Peer) to the field name.
+func normalizeConfigEntryKeys(t reflect.Type, v any) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return
+		}
+		renamed := make(map[string]any, len(m))
+		for key, val := range m {
+			f, ok := findConfigEntryField(t, key)
+			if !ok {
+				renamed[key] = val
+				continue
+			}
+			normalizeConfigEntryKeys(f.Type, val)
+			renamed[f.Name] = val
+		}
+		for key := range m {
+			delete(m, key)
+		}
+		for key, val := range renamed {
+			m[key] = val
+		}
+	case reflect.Slice, reflect.Array:
+		switch vv := v.(type) {
+		case []any:
+			for _, elem := range vv {
+				normalizeConfigEntryKeys(t.Elem(), elem)
+			}
+		case map[string]any:
+			normalizeConfigEntryKeys(t.Elem(), vv) // a single block
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]any); ok {
+			for _, elem := range m {
+				normalizeConfigEntryKeys(t.Elem(), elem)
+			}
+		}
+	}
+}
+
+func findConfigEntryField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+		if alias := f.Tag.Get("alias"); alias != "" && strings.EqualFold(configEntryKey(alias), key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// configEntryKey converts snake_case names into the CamelCase used by the
+// consul api structs.
+func configEntryKey(name string) string {
+	parts := strings.Split(name, "_")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -1,9 +1,14 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -13,6 +18,8 @@ func TestParseConfig_EmptyInferDefaults(t *testing.T) {
 
 	require.Equal(t, &Config{
 		ConfName:             "legacy",
+		Addressing:           DefaultAddressing(),
+		Backend:              "terraform",
 		EnvoyLogLevel:        "info",
 		TopologyNetworkShape: "flat",
 		TopologyLinkMode:     "federate",
@@ -24,8 +31,8 @@ func TestParseConfig_EmptyInferDefaults(t *testing.T) {
 		VaultAsMeshCA: make(map[string]struct{}),
 		Versions: Versions{
 			ConsulImage:    "consul-dev:latest",
-			DataplaneImage: "hashicorp/consul-dataplane:1.0.0",
-			Envoy:          "v1.24.0",
+			DataplaneImage: DefaultDataplaneImage,
+			Envoy:          DefaultEnvoyVersion,
 		},
 	}, fc)
 }
@@ -39,6 +46,8 @@ func TestParseConfig_BothFormats(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, &Config{
 			ConfName:             "legacy",
+			Addressing:           DefaultAddressing(),
+			Backend:              "terraform",
 			EnvoyLogLevel:        "info",
 			TopologyNetworkShape: "flat",
 			TopologyLinkMode:     "federate",
@@ -50,7 +59,7 @@ func TestParseConfig_BothFormats(t *testing.T) {
 			VaultAsMeshCA: make(map[string]struct{}),
 			Versions: Versions{
 				ConsulImage:    "consul-dev:latest",
-				DataplaneImage: "hashicorp/consul-dataplane:1.0.0",
+				DataplaneImage: DefaultDataplaneImage,
 				Envoy:          "v1.18.3",
 			},
 		}, fc)
@@ -69,6 +78,8 @@ func TestParseConfig_BothFormats(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, &Config{
 			ConfName:             "beta",
+			Addressing:           DefaultAddressing(),
+			Backend:              "terraform",
 			EnvoyLogLevel:        "info",
 			TopologyNetworkShape: "flat",
 			TopologyLinkMode:     "federate",
@@ -81,7 +92,7 @@ func TestParseConfig_BothFormats(t *testing.T) {
 			Versions: Versions{
 				ConsulImage:    "consul-dev:latest",
 				Envoy:          "v1.18.3",
-				DataplaneImage: "hashicorp/consul-dataplane:1.0.0",
+				DataplaneImage: DefaultDataplaneImage,
 			},
 		}, fc)
 	})
@@ -99,6 +110,8 @@ func TestParseConfig_BothFormats(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, &Config{
 			ConfName:             "alpha",
+			Addressing:           DefaultAddressing(),
+			Backend:              "terraform",
 			EnvoyLogLevel:        "info",
 			TopologyNetworkShape: "flat",
 			TopologyLinkMode:     "federate",
@@ -111,10 +124,35 @@ func TestParseConfig_BothFormats(t *testing.T) {
 			Versions: Versions{
 				ConsulImage:    "consul-dev:latest",
 				Envoy:          "v1.17.3",
-				DataplaneImage: "hashicorp/consul-dataplane:1.0.0",
+				DataplaneImage: DefaultDataplaneImage,
 			},
 		}, fc)
 	})
+	t.Run("active override", func(t *testing.T) {
+		body := `
+		active = "alpha"
+		config "alpha" {
+		  envoy_version = "v1.17.3"
+		}
+		config "beta" {
+		  envoy_version = "v1.18.3"
+		}
+		`
+		fc, err := parseConfigWithOptions("fake.hcl", []byte(body), LoadOptions{Active: "beta"})
+		require.NoError(t, err)
+		require.Equal(t, "beta", fc.ConfName)
+		require.Equal(t, "v1.18.3", fc.Versions.Envoy)
+
+		_, err = parseConfigWithOptions("fake.hcl", []byte(body), LoadOptions{Active: "gamma"})
+		require.Error(t, err)
+	})
+	t.Run("legacy active override", func(t *testing.T) {
+		body := `
+		envoy_version = "v1.18.3"
+		`
+		_, err := parseConfigWithOptions("fake.hcl", []byte(body), LoadOptions{Active: "beta"})
+		require.Error(t, err)
+	})
 }
 
 func TestParseConfig_AllFields(t *testing.T) {
@@ -229,11 +267,13 @@ EOF
 	require.NoError(t, err)
 
 	expected := &Config{
-		ConfName: "legacy",
+		ConfName:   "legacy",
+		Addressing: DefaultAddressing(),
+		Backend:    "terraform",
 		Versions: Versions{
 			ConsulImage:    "my-dev-image:blah",
 			Envoy:          "v1.18.3",
-			DataplaneImage: "hashicorp/consul-dataplane:1.0.0",
+			DataplaneImage: DefaultDataplaneImage,
 		},
 		CanaryVersions: Versions{
 			ConsulImage: "consul:1.9.5",
@@ -319,3 +359,1151 @@ EOF
 	}
 	require.Equal(t, expected, fc)
 }
+
+func TestParseConfig_Services(t *testing.T) {
+	body := `
+		topology {
+			service "web" {
+				upstreams   = ["api"]
+				healthcheck = "/healthz"
+			}
+			service "api" {
+				image   = "example/api:1.0"
+				port    = 9000
+				command = ["serve", "-v"]
+				env = {
+					FOO = "bar"
+				}
+			}
+			node "dc1-client2" {
+				service = "web"
+			}
+		}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(fc))
+
+	expect := []*Service{
+		{
+			Name:        "web",
+			Port:        8080,
+			Upstreams:   []string{"api"},
+			Healthcheck: "/healthz",
+		},
+		{
+			Name:    "api",
+			Image:   "example/api:1.0",
+			Port:    9000,
+			Command: []string{"serve", "-v"},
+			Env:     map[string]string{"FOO": "bar"},
+		},
+	}
+	require.Equal(t, expect, fc.TopologyServices)
+	require.Equal(t, expect, fc.Services())
+	require.Equal(t, "web", fc.TopologyNodes[0].Service)
+}
+
+func TestParseConfig_ServicesInvalid(t *testing.T) {
+	cases := map[string]struct {
+		body      string
+		expectErr string
+	}{
+		"duplicate name": {
+			body: `
+				topology {
+					service "web" {}
+					service "web" {}
+				}`,
+			expectErr: `service "web" is defined more than once`,
+		},
+		"undefined upstream": {
+			body: `
+				topology {
+					service "web" {
+						upstreams = ["api"]
+					}
+				}`,
+			expectErr: `service["web"] has an upstream on an undefined service "api"`,
+		},
+		"command without image": {
+			body: `
+				topology {
+					service "web" {
+						command = ["serve"]
+					}
+				}`,
+			expectErr: `service["web"].command can only be set when service["web"].image is set`,
+		},
+		"undefined node service": {
+			body: `
+				topology {
+					node "dc1-client1" {
+						service = "web"
+					}
+				}`,
+			expectErr: `node["dc1-client1"] is assigned an undefined service "web"`,
+		},
+		"duplicate node service": {
+			body: `
+				topology {
+					node "dc1-client1" {
+						services = ["ping", "ping"]
+					}
+				}`,
+			expectErr: `node["dc1-client1"] is assigned service "ping" more than once`,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			fc, err := parseConfig("fake.hcl", []byte(tc.body))
+			require.NoError(t, err)
+			require.EqualError(t, validateConfig(fc), tc.expectErr)
+		})
+	}
+}
+
+func TestParseConfig_ConfigEntryBlocks(t *testing.T) {
+	body := `
+		cluster_config "dc1" {
+			config_entries = [
+				<<EOF
+{
+	"Kind": "service-defaults",
+	"Name": "ping",
+	"Protocol": "http"
+}
+EOF
+			]
+
+			config_entry {
+				kind = "proxy-defaults"
+				name = "global"
+				config = {
+					protocol                   = "http"
+					envoy_prometheus_bind_addr = "0.0.0.0:9102"
+				}
+				mesh_gateway {
+					mode = "local"
+				}
+			}
+
+			config_entry {
+				kind            = "service-resolver"
+				name            = "pong"
+				connect_timeout = "15s"
+				redirect {
+					datacenter = "dc2"
+				}
+				subsets "v1" {
+					filter = "Service.Meta.version == v1"
+				}
+			}
+
+			config_entry {
+				kind = "service-router"
+				name = "ping"
+				routes {
+					match {
+						http {
+							path_prefix = "/v2"
+						}
+					}
+					destination {
+						service = "pong"
+					}
+				}
+			}
+		}
+
+		cluster_config "dc2" {
+			config_entry {
+				kind = "exported-services"
+				name = "default"
+				services {
+					name = "pong"
+					consumers {
+						peer_name = "peer-dc1"
+					}
+				}
+			}
+		}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+
+	require.Equal(t, map[string][]api.ConfigEntry{
+		"dc1": {
+			&api.ServiceConfigEntry{
+				Kind:     api.ServiceDefaults,
+				Name:     "ping",
+				Protocol: "http",
+			},
+			&api.ProxyConfigEntry{
+				Kind: api.ProxyDefaults,
+				Name: api.ProxyConfigGlobal,
+				Config: map[string]interface{}{
+					"protocol":                   "http",
+					"envoy_prometheus_bind_addr": "0.0.0.0:9102",
+				},
+				MeshGateway: api.MeshGatewayConfig{
+					Mode: api.MeshGatewayModeLocal,
+				},
+			},
+			&api.ServiceResolverConfigEntry{
+				Kind:           api.ServiceResolver,
+				Name:           "pong",
+				ConnectTimeout: 15 * time.Second,
+				Redirect: &api.ServiceResolverRedirect{
+					Datacenter: "dc2",
+				},
+				Subsets: map[string]api.ServiceResolverSubset{
+					"v1": {Filter: "Service.Meta.version == v1"},
+				},
+			},
+			&api.ServiceRouterConfigEntry{
+				Kind: api.ServiceRouter,
+				Name: "ping",
+				Routes: []api.ServiceRoute{{
+					Match: &api.ServiceRouteMatch{
+						HTTP: &api.ServiceRouteHTTPMatch{
+							PathPrefix: "/v2",
+						},
+					},
+					Destination: &api.ServiceRouteDestination{
+						Service: "pong",
+					},
+				}},
+			},
+		},
+		"dc2": {
+			&api.ExportedServicesConfigEntry{
+				Name: "default",
+				Services: []api.ExportedService{{
+					Name: "pong",
+					Consumers: []api.ServiceConsumer{{
+						Peer: "peer-dc1",
+					}},
+				}},
+			},
+		},
+	}, fc.ConfigEntries)
+}
+
+func TestParseConfig_ConfigEntryBlocksInvalid(t *testing.T) {
+	body := `
+		cluster_config "dc1" {
+			config_entry {
+				kind = "service-resolver"
+				name = "pong"
+				redirect {
+					datacentre = "dc2"
+				}
+			}
+		}
+`
+	_, err := parseConfig("fake.hcl", []byte(body))
+	require.EqualError(t, err, `fake.hcl:7,6-24: Unsupported argument; An argument named "datacentre" is not expected here.`)
+
+	type testcase struct {
+		body   string
+		expect []string
+	}
+
+	cases := map[string]testcase{
+		"misspelled block in a list": {
+			body: `
+		cluster_config "dc1" {
+			config_entry {
+				kind = "service-router"
+				name = "ping"
+				routes {
+					match {
+						http {
+							path_prefix = "/v2"
+						}
+					}
+					destinaton {
+						service = "pong"
+					}
+				}
+			}
+		}
+`,
+			expect: []string{`fake.hcl:12,6-16: Unsupported block type; Blocks of type "destinaton" are not expected here.`},
+		},
+		"misspelled attributes in a labeled block": {
+			body: `
+		cluster_config "dc1" {
+			config_entry {
+				kind = "service-resolver"
+				name = "pong"
+				subsets "v1" {
+					fliter = "Service.Meta.version == v1"
+				}
+				subsets "v2" {
+					only_pasing = true
+				}
+			}
+		}
+`,
+			expect: []string{
+				`fake.hcl:7,6-43: Unsupported argument; An argument named "fliter" is not expected here.`,
+				`fake.hcl:10,6-24: Unsupported argument; An argument named "only_pasing" is not expected here.`,
+			},
+		},
+		"wrong type": {
+			body: `
+		cluster_config "dc1" {
+			config_entry {
+				kind = "service-resolver"
+				name = "pong"
+				connect_timeout = "soon"
+			}
+		}
+`,
+			expect: []string{`fake.hcl:6,5-29: Invalid config entry; error decoding "connect_timeout": time: invalid duration "soon"`},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := parseConfig("fake.hcl", []byte(tc.body))
+			var diags hcl.Diagnostics
+			require.ErrorAs(t, err, &diags)
+			require.Len(t, diags, len(tc.expect))
+			for i, expect := range tc.expect {
+				require.Contains(t, hcl.Diagnostics{diags[i]}.Error(), expect)
+			}
+		})
+	}
+}
+
+func TestParseConfig_Extends(t *testing.T) {
+	body := `
+active = "child"
+config "grandparent" {
+  consul_image = "consul:1.15.0"
+  security {
+    disable_acls = true
+    encryption {
+      tls    = true
+      gossip = true
+    }
+  }
+  topology {
+    cluster "dc1" {
+      servers = 3
+      clients = 2
+    }
+  }
+}
+config "parent" {
+  extends = "grandparent"
+  envoy_version = "v1.25.0"
+  security {
+    disable_acls = false
+    initial_master_token = "root"
+  }
+  topology {
+    cluster "dc2" {
+      servers = 1
+      clients = 1
+    }
+    node "dc1-client1" {
+      service_meta = {
+        version = "v1"
+      }
+    }
+  }
+  cluster_config "dc1" {
+    config_entry {
+      kind = "proxy-defaults"
+      name = "global"
+    }
+  }
+}
+config "child" {
+  extends = "parent"
+  topology {
+    cluster "dc1" {
+      clients = 4
+    }
+    node "dc1-client1" {
+      dead = true
+    }
+  }
+  cluster_config "dc1" {
+    config_entry {
+      kind     = "service-defaults"
+      name     = "ping"
+      protocol = "http"
+    }
+  }
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+
+	require.Equal(t, "child", fc.ConfName)
+	require.Equal(t, "consul:1.15.0", fc.Versions.ConsulImage)
+	require.Equal(t, "v1.25.0", fc.Versions.Envoy)
+	require.False(t, fc.SecurityDisableACLs)
+	require.Equal(t, "root", fc.InitialMasterToken)
+	require.True(t, fc.EncryptionTLS)
+	require.True(t, fc.EncryptionGossip)
+	require.Equal(t, []*Cluster{
+		{Name: "dc1", Servers: 3, Clients: 4},
+		{Name: "dc2", Servers: 1, Clients: 1},
+	}, fc.TopologyClusters)
+	require.Equal(t, []*Node{
+		{
+			NodeName:    "dc1-client1",
+			ServiceMeta: map[string]string{"version": "v1"},
+			Dead:        true,
+		},
+	}, fc.TopologyNodes)
+	require.Equal(t, []api.ConfigEntry{
+		&api.ProxyConfigEntry{Kind: api.ProxyDefaults, Name: "global"},
+		&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "ping", Protocol: "http"},
+	}, fc.ConfigEntries["dc1"])
+}
+
+func TestParseConfig_ExtendsInvalid(t *testing.T) {
+	cases := map[string]struct {
+		body   string
+		expect string
+	}{
+		"undefined parent": {
+			body: `
+active = "a"
+config "a" {
+  extends = "nope"
+}
+`,
+			expect: `config "a" extends undefined config "nope"`,
+		},
+		"self": {
+			body: `
+active = "a"
+config "a" {
+  extends = "a"
+}
+`,
+			expect: `config "a" has an extends cycle: a -> a`,
+		},
+		"cycle": {
+			body: `
+active = "a"
+config "a" {
+  extends = "b"
+}
+config "b" {
+  extends = "c"
+}
+config "c" {
+  extends = "a"
+}
+`,
+			expect: `config "a" has an extends cycle: a -> b -> c -> a`,
+		},
+		"legacy": {
+			body: `
+extends = "a"
+`,
+			expect: `extends can only be used inside of a 'config' block`,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := parseConfig("fake.hcl", []byte(tc.body))
+			require.ErrorContains(t, err, tc.expect)
+		})
+	}
+}
+
+func TestParseConfig_Expressions(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile := func(name, contents string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+
+	writeFile("license.txt", "  the-license  \n")
+	writeFile("entry.json.tmpl", `{"Kind":"service-defaults","Name":"${name}","Protocol":"http"}`)
+	writeFile("base.hcl", `
+locals {
+  image_repo = "consul"
+}
+
+config "base" {
+  security {
+    disable_acls = true
+  }
+}
+`)
+
+	t.Setenv("DEVCONSUL_TEST_ENVOY", "v1.25.1")
+
+	body := `
+include = ["base.hcl"]
+
+variable "consul_version" {
+  default = "1.15.0"
+}
+
+locals {
+  image = "${local.image_repo}:${var.consul_version}"
+}
+
+active = "main"
+
+config "main" {
+  extends       = "base"
+  consul_image  = local.image
+  envoy_version = env("DEVCONSUL_TEST_ENVOY")
+
+  enterprise {
+    license_path = trimspace(file("license.txt"))
+  }
+
+  cluster_config "dc1" {
+    config_entries = [
+      templatefile("entry.json.tmpl", { name = "ping" }),
+    ]
+    config_entry {
+      kind     = "service-defaults"
+      name     = upper("pong")
+      protocol = "http"
+    }
+  }
+}
+`
+	pathname := filepath.Join(dir, "config.hcl")
+
+	fc, err := parseConfigWithOptions(pathname, []byte(body), LoadOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "consul:1.15.0", fc.Versions.ConsulImage)
+	require.Equal(t, "v1.25.1", fc.Versions.Envoy)
+	require.Equal(t, "the-license", fc.EnterpriseLicensePath)
+	require.True(t, fc.SecurityDisableACLs)
+	require.Equal(t, []api.ConfigEntry{
+		&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "ping", Protocol: "http"},
+		&api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: "PONG", Protocol: "http"},
+	}, fc.ConfigEntries["dc1"])
+
+	fc, err = parseConfigWithOptions(pathname, []byte(body), LoadOptions{
+		Vars: map[string]string{"consul_version": "1.16.0"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "consul:1.16.0", fc.Versions.ConsulImage)
+
+	_, err = parseConfigWithOptions(pathname, []byte(body), LoadOptions{
+		Vars: map[string]string{"consul_versoin": "1.16.0"},
+	})
+	require.ErrorContains(t, err, "values given for undeclared variables: consul_versoin")
+}
+
+func TestParseConfig_ExpressionsInvalid(t *testing.T) {
+	cases := map[string]struct {
+		body   string
+		expect string
+	}{
+		"unset variable": {
+			body: `
+variable "image" {}
+consul_image = var.image
+`,
+			expect: `variable "image" is not set`,
+		},
+		"local cycle": {
+			body: `
+locals {
+  a = local.b
+  b = local.a
+}
+consul_image = local.a
+`,
+			expect: `locals refer to each other in a cycle: a, b`,
+		},
+		"undefined local": {
+			body: `
+active = "a"
+config "a" {
+  consul_image = local.nope
+}
+`,
+			expect: `Unsupported attribute`,
+		},
+		"missing include": {
+			body: `
+include = ["nope.hcl"]
+`,
+			expect: `could not read included config file`,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := parseConfig("fake.hcl", []byte(tc.body))
+			require.ErrorContains(t, err, tc.expect)
+		})
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	body := `
+active = "a"
+config "base" {
+  security {
+    encryption {
+      tls_grpc = true
+    }
+  }
+}
+config "a" {
+  extends = "base"
+  monitor {
+    prometheus = true
+  }
+  security {
+    disable_acls = true
+  }
+  topology {
+    service "web" {
+      port = 70000
+    }
+  }
+}
+`
+	dir := t.TempDir()
+	pathname := filepath.Join(dir, "config.hcl")
+	require.NoError(t, os.WriteFile(pathname, []byte(body), 0644))
+
+	cfg, problems := CheckConfig(pathname, LoadOptions{})
+	require.NotNil(t, cfg)
+	require.True(t, problems.HasErrors())
+	require.EqualError(t, problems.Err(), "encryption.tls_grpc=true requires encryption.tls=true")
+
+	type found struct {
+		Summary string
+		Line    int
+	}
+	var got []found
+	for _, diag := range problems.Diagnostics {
+		require.NotNil(t, diag.Subject, diag.Summary)
+		require.Equal(t, pathname, diag.Subject.Filename)
+		got = append(got, found{diag.Summary, diag.Subject.Start.Line})
+	}
+	require.Equal(t, []found{
+		{"encryption.tls_grpc=true requires encryption.tls=true", 6},
+		{"prometheus setup is incompatible with insecure consul", 13},
+		{`service["web"].port is out of range: 70000`, 20},
+	}, got)
+
+	t.Run("decode error", func(t *testing.T) {
+		pathname := filepath.Join(dir, "bad.hcl")
+		require.NoError(t, os.WriteFile(pathname, []byte("bogus = 1\n"), 0644))
+
+		cfg, problems := CheckConfig(pathname, LoadOptions{})
+		require.Nil(t, cfg)
+		require.Len(t, problems.Diagnostics, 1)
+		require.Equal(t, "Unsupported argument", problems.Diagnostics[0].Summary)
+		require.Equal(t, 1, problems.Diagnostics[0].Subject.Start.Line)
+	})
+}
+
+func TestParseConfig_DeprecationWarnings(t *testing.T) {
+	body := `
+topology {
+  datacenter "dc1" {
+    servers = 1
+    clients = 1
+  }
+}
+config_entries = [
+  <<EOF
+{"Kind": "proxy-defaults", "Name": "global"}
+EOF
+]
+`
+	var warnings []string
+	fc, err := parseConfigWithOptions("fake.hcl", []byte(body), LoadOptions{
+		Warn: func(diag *hcl.Diagnostic) {
+			warnings = append(warnings, diag.Summary)
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*Cluster{{Name: "dc1", Servers: 1, Clients: 1}}, fc.TopologyClusters)
+	require.Len(t, fc.ConfigEntries["dc1"], 1)
+	require.Equal(t, []string{
+		"config files without any 'config' blocks are deprecated; run 'devconsul config migrate' to upgrade",
+		"topology.datacenter is deprecated in favor of topology.cluster; run 'devconsul config migrate' to upgrade",
+		`config_entries is deprecated in favor of cluster_config "dc1"; run 'devconsul config migrate' to upgrade`,
+	}, warnings)
+}
+
+func TestMigrate(t *testing.T) {
+	t.Run("legacy", func(t *testing.T) {
+		body := `# header
+variable "v" {
+  default = "x"
+}
+
+consul_image = "consul:${var.v}" # trailing
+
+topology {
+  # the primary
+  datacenter "dc1" {
+    servers = 1
+  }
+}
+
+config_entries = [
+  <<EOF
+{"Kind": "proxy-defaults", "Name": "global"}
+EOF
+]
+`
+		out, changes, err := Migrate("fake.hcl", []byte(body))
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			`moved everything into config "default"`,
+			`config "default": renamed topology.datacenter "dc1" to topology.cluster`,
+			`config "default": moved config_entries into cluster_config "dc1"`,
+		}, changes)
+		require.Equal(t, `# header
+variable "v" {
+  default = "x"
+}
+
+active = "default"
+
+config "default" {
+  consul_image = "consul:${var.v}" # trailing
+
+  topology {
+    # the primary
+    cluster "dc1" {
+      servers = 1
+    }
+  }
+
+  cluster_config "dc1" {
+    config_entries = [
+      <<EOF
+{"Kind": "proxy-defaults", "Name": "global"}
+EOF
+    ]
+  }
+}
+`, string(out))
+
+		// The result should load the same way without warnings.
+		var warnings []string
+		fc, err := parseConfigWithOptions("fake.hcl", out, LoadOptions{
+			Warn: func(diag *hcl.Diagnostic) {
+				warnings = append(warnings, diag.Summary)
+			},
+		})
+		require.NoError(t, err)
+		require.Empty(t, warnings)
+		require.Equal(t, "consul:x", fc.Versions.ConsulImage)
+		require.Equal(t, []*Cluster{{Name: "dc1", Servers: 1}}, fc.TopologyClusters)
+		require.Len(t, fc.ConfigEntries["dc1"], 1)
+
+		// Migrating again is a no-op.
+		again, changes, err := Migrate("fake.hcl", out)
+		require.NoError(t, err)
+		require.Empty(t, changes)
+		require.Equal(t, out, again)
+	})
+	t.Run("conflict", func(t *testing.T) {
+		body := `
+active = "a"
+config "a" {
+  config_entries = []
+  cluster_config "dc1" {
+    config_entries = []
+  }
+}
+`
+		_, _, err := Migrate("fake.hcl", []byte(body))
+		require.ErrorContains(t, err, `cannot move config_entries into cluster_config "dc1"`)
+	})
+}
+
+func TestParseConfig_ClusterVersions(t *testing.T) {
+	body := `
+active = "mixed"
+config "mixed" {
+  consul_image  = "consul:1.14.0"
+  envoy_version = "v1.24.0"
+  topology {
+    cluster "dc1" {
+      servers = 1
+      clients = 1
+    }
+    cluster "dc2" {
+      servers       = 1
+      clients       = 1
+      consul_image  = "consul:1.15.0"
+      envoy_version = "v1.25.1"
+    }
+  }
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+
+	require.Equal(t, Versions{
+		ConsulImage:    "consul:1.14.0",
+		Envoy:          "v1.24.0",
+		DataplaneImage: DefaultDataplaneImage,
+	}, fc.ClusterVersions("dc1"))
+	require.Equal(t, Versions{
+		ConsulImage:    "consul:1.15.0",
+		Envoy:          "v1.25.1",
+		DataplaneImage: DefaultDataplaneImage,
+	}, fc.ClusterVersions("dc2"))
+
+	dc1, dc2 := fc.TopologyClusters[0], fc.TopologyClusters[1]
+	require.False(t, dc1.HasVersionOverrides())
+	require.True(t, dc2.HasVersionOverrides())
+}
+
+func TestParseConfig_AgentExtraHCL(t *testing.T) {
+	body := `
+active = "extra"
+config "extra" {
+  agent_extra_hcl = "log_level = \"debug\""
+  topology {
+    cluster "dc1" {
+      servers         = 1
+      clients         = 1
+      agent_extra_hcl = "telemetry { disable_hostname = true }"
+    }
+    node "dc1-client1" {
+      agent_extra_hcl = "ports { grpc = -1 }"
+    }
+  }
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(fc))
+
+	require.Equal(t, `log_level = "debug"`, fc.AgentExtraHCL)
+	dc1, ok := fc.ClusterByName("dc1")
+	require.True(t, ok)
+	require.Equal(t, "telemetry { disable_hostname = true }", dc1.AgentExtraHCL)
+	require.Len(t, fc.TopologyNodes, 1)
+	require.Equal(t, "ports { grpc = -1 }", fc.TopologyNodes[0].AgentExtraHCL)
+
+	t.Run("invalid", func(t *testing.T) {
+		fc, err := parseConfig("fake.hcl", []byte(strings.Replace(body, `"ports { grpc = -1 }"`, `"ports {"`, 1)))
+		require.NoError(t, err)
+		require.ErrorContains(t, validateConfig(fc), "agent_extra_hcl is not valid HCL")
+	})
+}
+
+func TestParseConfig_NodeUpstreams(t *testing.T) {
+	body := `
+active = "upstreams"
+config "upstreams" {
+  topology {
+    cluster "dc1" {
+      servers = 1
+      clients = 1
+    }
+    node "dc1-client1" {
+      upstream {
+        name = "pong"
+        config = {
+          protocol = "grpc"
+        }
+      }
+      upstream {
+        destination_type  = "prepared_query"
+        name              = "pong-query"
+        local_port        = 9191
+        mesh_gateway_mode = "local"
+      }
+    }
+  }
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(fc))
+
+	require.Len(t, fc.TopologyNodes, 1)
+	require.Equal(t, []*Upstream{
+		{
+			DestinationType: UpstreamTypeService,
+			Name:            "pong",
+			Config:          map[string]string{"protocol": "grpc"},
+		},
+		{
+			DestinationType: UpstreamTypePreparedQuery,
+			Name:            "pong-query",
+			LocalPort:       9191,
+			MeshGatewayMode: "local",
+		},
+	}, fc.TopologyNodes[0].Upstreams)
+
+	t.Run("invalid", func(t *testing.T) {
+		fc, err := parseConfig("fake.hcl", []byte(strings.Replace(body, `"local"`, `"sideways"`, 1)))
+		require.NoError(t, err)
+		require.EqualError(t, validateConfig(fc), `node["dc1-client1"] upstream "pong-query": mesh_gateway_mode must be one of none, local, or remote`)
+	})
+}
+
+func TestParseConfig_Addressing(t *testing.T) {
+	body := `
+active = "addr"
+config "addr" {
+  addressing {
+    lan_supernet  = "172.30.0.0/16"
+    wan_supernet  = "172.31.0.0/16"
+    client_offset = 50
+  }
+  topology {
+    cluster "dc1" {
+      servers = 1
+      clients = 1
+    }
+    cluster "us-east" {
+      index   = 7
+      servers = 1
+      clients = 1
+    }
+  }
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(fc))
+
+	expect := DefaultAddressing()
+	expect.LANSupernet = "172.30.0.0/16"
+	expect.WANSupernet = "172.31.0.0/16"
+	expect.ClientOffset = 50
+	require.Equal(t, expect, fc.Addressing)
+
+	east, ok := fc.ClusterByName("us-east")
+	require.True(t, ok)
+	require.Equal(t, 7, east.Index)
+
+	t.Run("overlapping supernets", func(t *testing.T) {
+		fc, err := parseConfig("fake.hcl", []byte(strings.Replace(body, "172.31.0.0/16", "172.30.128.0/17", 1)))
+		require.NoError(t, err)
+		require.EqualError(t, validateConfig(fc), "addressing.lan_supernet and addressing.wan_supernet overlap")
+	})
+}
+
+func TestParseConfig_ExternalServices(t *testing.T) {
+	body := `
+active = "external"
+config "external" {
+  topology {
+    cluster "dc1" {
+      servers              = 1
+      clients              = 1
+      terminating_gateways = 1
+    }
+    service "web" {
+      upstreams = ["legacy"]
+    }
+    external_service "legacy" {
+      port = 9999
+    }
+    external_service "billing" {
+      image = "example/billing:latest"
+      port  = 8000
+    }
+  }
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(fc))
+
+	dc1, ok := fc.ClusterByName("dc1")
+	require.True(t, ok)
+	require.Equal(t, 1, dc1.TerminatingGateways)
+
+	require.Equal(t, []*ExternalService{
+		{
+			Name:    "legacy",
+			Cluster: "dc1",
+			Image:   DefaultExternalServiceImage,
+			Port:    9999,
+			Command: []string{"-listen=:9999", "-text=legacy"},
+		},
+		{
+			Name:    "billing",
+			Cluster: "dc1",
+			Image:   "example/billing:latest",
+			Port:    8000,
+		},
+	}, fc.TopologyExternalServices)
+
+	t.Run("port collision", func(t *testing.T) {
+		fc, err := parseConfig("fake.hcl", []byte(strings.Replace(body, "9999", "8000", 1)))
+		require.NoError(t, err)
+		require.EqualError(t, validateConfig(fc), `external services "legacy" and "billing" in cluster "dc1" are both listening on port 8000`)
+	})
+
+	t.Run("undefined cluster", func(t *testing.T) {
+		fc, err := parseConfig("fake.hcl", []byte(strings.Replace(body, "port = 9999", `port = 9999
+      cluster = "dc9"`, 1)))
+		require.NoError(t, err)
+		require.EqualError(t, validateConfig(fc), `external_service["legacy"] is in an undefined cluster "dc9"`)
+	})
+}
+
+func TestParseConfig_Networks(t *testing.T) {
+	body := `
+active = "dmz"
+config "dmz" {
+  topology {
+    network_shape = "custom"
+
+    network "dmz" {
+      cidr = "192.168.10.0/24"
+    }
+    network "transit" {
+      cidr = "192.168.20.0/24"
+      wan  = true
+    }
+
+    cluster "dc1" {
+      servers       = 1
+      clients       = 1
+      mesh_gateways = 1
+      attach = {
+        servers       = ["dmz"]
+        mesh_gateways = ["dmz", "transit"]
+      }
+    }
+
+    node "dc1-client1" {
+      attach = ["dmz"]
+    }
+  }
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(fc))
+
+	require.Equal(t, []*Network{
+		{Name: "dmz", CIDR: "192.168.10.0/24"},
+		{Name: "transit", CIDR: "192.168.20.0/24", WAN: true},
+	}, fc.TopologyNetworks)
+
+	dc1, ok := fc.ClusterByName("dc1")
+	require.True(t, ok)
+	require.Equal(t, map[string][]string{
+		"servers":       {"dmz"},
+		"mesh_gateways": {"dmz", "transit"},
+	}, dc1.Attach)
+
+	require.Len(t, fc.TopologyNodes, 1)
+	require.Equal(t, []string{"dmz"}, fc.TopologyNodes[0].Attach)
+}
+
+func TestParseConfig_ServerPlacement(t *testing.T) {
+	body := `
+active = "ent"
+config "ent" {
+  enterprise {
+    enabled      = true
+    license_path = "/tmp/foo.hclic"
+  }
+  topology {
+    cluster "dc1" {
+      servers          = 3
+      read_replicas    = 2
+      redundancy_zones = ["zone-a", "zone-b"]
+    }
+  }
+}
+config "oss" {
+  topology {
+    cluster "dc1" {
+      servers          = 3
+      read_replicas    = 1
+      redundancy_zones = ["zone-a", "zone-a"]
+    }
+  }
+}
+config "dupes" {
+  extends = "ent"
+  topology {
+    cluster "dc1" {
+      read_replicas    = -1
+      redundancy_zones = ["zone-a", "", "zone-a"]
+    }
+  }
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(fc))
+
+	dc1, ok := fc.ClusterByName("dc1")
+	require.True(t, ok)
+	require.Equal(t, 2, dc1.ReadReplicas)
+	require.Equal(t, []string{"zone-a", "zone-b"}, dc1.RedundancyZones)
+
+	summaries := func(active string) []string {
+		fc, err := parseConfigWithOptions("fake.hcl", []byte(body), LoadOptions{Active: active})
+		require.NoError(t, err)
+		problems := &Problems{}
+		checkConfig(fc, problems)
+		var out []string
+		for _, diag := range problems.Diagnostics {
+			out = append(out, diag.Summary)
+		}
+		return out
+	}
+
+	require.Equal(t, []string{
+		"dc1: read_replicas cannot be configured when enterprise.enabled=false",
+		"dc1: redundancy_zones cannot be configured when enterprise.enabled=false",
+	}, summaries("oss"))
+
+	require.Equal(t, []string{
+		"dc1: read replicas must be non-negative",
+		"dc1: redundancy_zones cannot contain an empty name",
+		`dc1: redundancy_zones contains a duplicate for "zone-a"`,
+	}, summaries("dupes"))
+}
+
+func TestParseConfig_Backend(t *testing.T) {
+	body := `
+active = "native"
+config "native" {
+  backend = "docker"
+}
+config "bogus" {
+  backend = "compose"
+}
+`
+	fc, err := parseConfig("fake.hcl", []byte(body))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(fc))
+	require.Equal(t, "docker", fc.Backend)
+
+	fc, err = parseConfigWithOptions("fake.hcl", []byte(body), LoadOptions{Active: "bogus"})
+	require.NoError(t, err)
+	require.EqualError(t, validateConfig(fc), `unknown backend "compose"; expected "terraform" or "docker"`)
+}
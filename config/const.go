@@ -6,3 +6,12 @@ const (
 	ServicePing = "ping"
 	ServicePong = "pong"
 )
+
+// DefaultExternalServiceImage is run for external services that do not set
+// their own image.
+const DefaultExternalServiceImage = "hashicorp/http-echo:latest"
+
+const (
+	UpstreamTypeService       = "service"
+	UpstreamTypePreparedQuery = "prepared_query"
+)
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// Path identifies a part of the active configuration by the names of the
+// attributes and blocks (and block labels) leading to it, such as
+// Path{"topology", "node", "dc1-client1", "mode"}.
+type Path []string
+
+func (p Path) key() string {
+	return strings.Join(p, ".")
+}
+
+// SourceMap records where each attribute and block of the active
+// configuration was defined so that problems can be reported against the
+// relevant part of the config file.
+type SourceMap struct {
+	ranges map[string]hcl.Range
+}
+
+// Range returns the source range of the most specific part of path that was
+// explicitly written in the config file, or nil if none of it was.
+func (m *SourceMap) Range(path Path) *hcl.Range {
+	if m == nil {
+		return nil
+	}
+	for i := len(path); i >= 0; i-- {
+		if rng, ok := m.ranges[path[:i].key()]; ok {
+			return rng.Ptr()
+		}
+	}
+	return nil
+}
+
+// newSourceMap indexes the given bodies in order, so that anything defined
+// in a later body replaces the same thing defined in an earlier one.
+func newSourceMap(root *hcl.Range, bodies ...*hclsyntax.Body) *SourceMap {
+	m := &SourceMap{
+		ranges: make(map[string]hcl.Range),
+	}
+	if root != nil {
+		m.ranges[""] = *root
+	}
+	for _, body := range bodies {
+		m.addBody(nil, body)
+	}
+	return m
+}
+
+// sourceAliases are block types that are recorded under a second name
+// because they are renamed during parsing.
+var sourceAliases = map[string]string{
+	"datacenter": "cluster",
+}
+
+func (m *SourceMap) addBody(prefix Path, body *hclsyntax.Body) {
+	for name, attr := range body.Attributes {
+		m.ranges[append(prefix, name).key()] = attr.SrcRange
+	}
+	counts := make(map[string]int)
+	for _, block := range body.Blocks {
+		types := []string{block.Type}
+		if alias, ok := sourceAliases[block.Type]; ok {
+			types = append(types, alias)
+		}
+		for _, typ := range types {
+			typePath := append(append(Path{}, prefix...), typ)
+			if counts[typ] == 0 {
+				// The first block of each type stands in for all of them.
+				m.ranges[typePath.key()] = block.DefRange()
+			}
+
+			path := append(Path{}, typePath...)
+			if len(block.Labels) > 0 {
+				path = append(path, block.Labels...)
+			} else {
+				// Unlabeled repeated blocks are addressed by position.
+				path = append(path, strconv.Itoa(counts[typ]))
+			}
+			counts[typ]++
+			m.ranges[path.key()] = block.DefRange()
+			if len(block.Labels) == 0 {
+				// Single blocks are also addressed without a position.
+				m.addBody(typePath, block.Body)
+			}
+			m.addBody(path, block.Body)
+		}
+	}
+}
+
+// Problems collects every problem found with a configuration, rather than
+// stopping at the first one.
+type Problems struct {
+	// Sources is used to attach source ranges to problems. It may be nil.
+	Sources *SourceMap
+
+	Diagnostics hcl.Diagnostics
+
+	errs []error
+}
+
+// Errorf records a problem with the part of the config identified by at.
+func (p *Problems) Errorf(at Path, format string, args ...interface{}) {
+	p.add(at, fmt.Errorf(format, args...))
+}
+
+// Error records err as a problem with the part of the config identified by
+// at. If err holds hcl diagnostics they are recorded as-is, since they
+// already know where they came from.
+func (p *Problems) Error(at Path, err error) {
+	p.add(at, err)
+}
+
+func (p *Problems) add(at Path, err error) {
+	p.errs = append(p.errs, err)
+
+	var diags hcl.Diagnostics
+	if errors.As(err, &diags) {
+		p.Diagnostics = append(p.Diagnostics, diags...)
+		return
+	}
+	p.Diagnostics = append(p.Diagnostics, &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  err.Error(),
+		Subject:  p.Sources.Range(at),
+	})
+}
+
+// Warnf records something that is not a problem yet, such as the use of a
+// deprecated feature, with the part of the config identified by at.
+func (p *Problems) Warnf(at Path, format string, args ...interface{}) {
+	p.Diagnostics = append(p.Diagnostics, &hcl.Diagnostic{
+		Severity: hcl.DiagWarning,
+		Summary:  fmt.Sprintf(format, args...),
+		Subject:  p.Sources.Range(at),
+	})
+}
+
+// Warnings returns only the warnings that were recorded.
+func (p *Problems) Warnings() hcl.Diagnostics {
+	var out hcl.Diagnostics
+	for _, diag := range p.Diagnostics {
+		if diag.Severity == hcl.DiagWarning {
+			out = append(out, diag)
+		}
+	}
+	return out
+}
+
+// HasErrors returns true if any problems (not counting warnings) were
+// recorded.
+func (p *Problems) HasErrors() bool {
+	return len(p.errs) > 0
+}
+
+// Err returns the first problem recorded, for callers that only care about
+// whether or not the config is usable.
+func (p *Problems) Err() error {
+	if len(p.errs) == 0 {
+		return nil
+	}
+	return p.errs[0]
+}
@@ -0,0 +1,375 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/tryfunc"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+)
+
+// configSource is a config file (and everything it includes) ready to be
+// decoded.
+type configSource struct {
+	// Body is the merged body of every file, minus the variable, locals, and
+	// include declarations which have already been evaluated into Ctx.
+	Body hcl.Body
+	Ctx  *hcl.EvalContext
+
+	// Syntax holds the native syntax body of each file, if it has one.
+	Syntax []*hclsyntax.Body
+}
+
+var configFileSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "include"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "variable", LabelNames: []string{"name"}},
+		{Type: "locals"},
+	},
+}
+
+type rawVariable struct {
+	Name        string    `hcl:"name,label"`
+	Default     cty.Value `hcl:"default,optional"`
+	Description string    `hcl:"description,optional"`
+}
+
+// loadConfigSource parses the named config file along with any files it
+// includes, and evaluates all of the variable and locals blocks.
+//
+// Values in vars override the defaults of the matching variable blocks.
+func loadConfigSource(pathname string, contents []byte, vars map[string]string) (*configSource, error) {
+	baseDir := filepath.Dir(pathname)
+
+	l := &configLoader{
+		parser:  hclparse.NewParser(),
+		baseCtx: &hcl.EvalContext{Functions: configFunctions(baseDir)},
+		seen:    make(map[string]struct{}),
+	}
+	if err := l.load(pathname, contents); err != nil {
+		return nil, err
+	}
+
+	ctx := l.baseCtx.NewChild()
+	ctx.Variables = make(map[string]cty.Value)
+
+	varVals, err := l.evalVariables(vars)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Variables["var"] = cty.ObjectVal(varVals)
+
+	localVals, err := l.evalLocals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Variables["local"] = cty.ObjectVal(localVals)
+
+	return &configSource{
+		Body:   hcl.MergeBodies(l.bodies),
+		Ctx:    ctx,
+		Syntax: l.syntax,
+	}, nil
+}
+
+type configLoader struct {
+	parser  *hclparse.Parser
+	baseCtx *hcl.EvalContext // functions only
+	seen    map[string]struct{}
+
+	bodies    []hcl.Body
+	syntax    []*hclsyntax.Body
+	variables []*hcl.Block
+	locals    []*hcl.Block
+}
+
+func (l *configLoader) load(pathname string, contents []byte) error {
+	abs, err := filepath.Abs(pathname)
+	if err != nil {
+		return err
+	}
+	if _, ok := l.seen[abs]; ok {
+		return fmt.Errorf("config file %q is included more than once", pathname)
+	}
+	l.seen[abs] = struct{}{}
+
+	var (
+		file  *hcl.File
+		diags hcl.Diagnostics
+	)
+	if strings.HasSuffix(pathname, ".json") {
+		file, diags = l.parser.ParseJSON(contents, pathname)
+	} else {
+		file, diags = l.parser.ParseHCL(contents, pathname)
+	}
+	if diags.HasErrors() {
+		return fmt.Errorf("could not parse and decode snippet %q: %w", pathname, diags)
+	}
+
+	content, remain, diags := file.Body.PartialContent(configFileSchema)
+	if diags.HasErrors() {
+		return fmt.Errorf("could not parse and decode snippet %q: %w", pathname, diags)
+	}
+
+	l.bodies = append(l.bodies, remain)
+	if body, ok := file.Body.(*hclsyntax.Body); ok {
+		l.syntax = append(l.syntax, body)
+	}
+
+	for _, block := range content.Blocks {
+		switch block.Type {
+		case "variable":
+			l.variables = append(l.variables, block)
+		case "locals":
+			l.locals = append(l.locals, block)
+		}
+	}
+
+	attr, ok := content.Attributes["include"]
+	if !ok {
+		return nil
+	}
+
+	var includes []string
+	if diags := gohcl.DecodeExpression(attr.Expr, l.baseCtx, &includes); diags.HasErrors() {
+		return fmt.Errorf("could not parse and decode snippet %q: %w", pathname, diags)
+	}
+	for _, inc := range includes {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(pathname), inc)
+		}
+		contents, err := os.ReadFile(inc)
+		if err != nil {
+			return fmt.Errorf("could not read included config file: %w", err)
+		}
+		if err := l.load(inc, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *configLoader) evalVariables(overrides map[string]string) (map[string]cty.Value, error) {
+	out := make(map[string]cty.Value)
+	for _, block := range l.variables {
+		var v rawVariable
+		if diags := gohcl.DecodeBody(block.Body, l.baseCtx, &v); diags.HasErrors() {
+			return nil, fmt.Errorf("%s: invalid variable: %w", block.DefRange, diags)
+		}
+		v.Name = block.Labels[0]
+
+		if _, ok := out[v.Name]; ok {
+			return nil, fmt.Errorf("%s: variable %q is defined more than once", block.DefRange, v.Name)
+		}
+
+		if val, ok := overrides[v.Name]; ok {
+			out[v.Name] = cty.StringVal(val)
+		} else if !v.Default.IsNull() {
+			out[v.Name] = v.Default
+		} else {
+			return nil, fmt.Errorf("variable %q is not set; use -var %s=<value> or give it a default", v.Name, v.Name)
+		}
+	}
+
+	var unknown []string
+	for name := range overrides {
+		if _, ok := out[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("values given for undeclared variables: %s", strings.Join(unknown, ", "))
+	}
+
+	return out, nil
+}
+
+// evalLocals evaluates all locals in dependency order, since they are allowed
+// to refer to each other.
+func (l *configLoader) evalLocals(ctx *hcl.EvalContext) (map[string]cty.Value, error) {
+	pending := make(map[string]*hcl.Attribute)
+	for _, block := range l.locals {
+		attrs, diags := block.Body.JustAttributes()
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("invalid locals block: %w", diags)
+		}
+		for name, attr := range attrs {
+			if _, ok := pending[name]; ok {
+				return nil, fmt.Errorf("%s: local %q is defined more than once", attr.NameRange, name)
+			}
+			pending[name] = attr
+		}
+	}
+
+	out := make(map[string]cty.Value)
+	ctx.Variables["local"] = cty.EmptyObjectVal
+	for len(pending) > 0 {
+		progress := false
+		for name, attr := range pending {
+			if dependsOnPendingLocal(attr.Expr, pending) {
+				continue
+			}
+			val, diags := attr.Expr.Value(ctx)
+			if diags.HasErrors() {
+				return nil, fmt.Errorf("invalid local %q: %w", name, diags)
+			}
+			out[name] = val
+			ctx.Variables["local"] = cty.ObjectVal(out)
+			delete(pending, name)
+			progress = true
+		}
+
+		if !progress {
+			var names []string
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("locals refer to each other in a cycle: %s", strings.Join(names, ", "))
+		}
+	}
+	return out, nil
+}
+
+func dependsOnPendingLocal(expr hcl.Expression, pending map[string]*hcl.Attribute) bool {
+	for _, trav := range expr.Variables() {
+		if trav.RootName() != "local" || len(trav) < 2 {
+			continue
+		}
+		if attr, ok := trav[1].(hcl.TraverseAttr); ok {
+			if _, ok := pending[attr.Name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configFunctions returns the functions available in config files. Relative
+// paths given to file functions are relative to baseDir.
+func configFunctions(baseDir string) map[string]function.Function {
+	funcs := map[string]function.Function{
+		"abs":        stdlib.AbsoluteFunc,
+		"can":        tryfunc.CanFunc,
+		"coalesce":   stdlib.CoalesceFunc,
+		"concat":     stdlib.ConcatFunc,
+		"contains":   stdlib.ContainsFunc,
+		"csvdecode":  stdlib.CSVDecodeFunc,
+		"distinct":   stdlib.DistinctFunc,
+		"element":    stdlib.ElementFunc,
+		"flatten":    stdlib.FlattenFunc,
+		"format":     stdlib.FormatFunc,
+		"formatlist": stdlib.FormatListFunc,
+		"indent":     stdlib.IndentFunc,
+		"join":       stdlib.JoinFunc,
+		"jsondecode": stdlib.JSONDecodeFunc,
+		"jsonencode": stdlib.JSONEncodeFunc,
+		"keys":       stdlib.KeysFunc,
+		"length":     stdlib.LengthFunc,
+		"lookup":     stdlib.LookupFunc,
+		"lower":      stdlib.LowerFunc,
+		"max":        stdlib.MaxFunc,
+		"merge":      stdlib.MergeFunc,
+		"min":        stdlib.MinFunc,
+		"range":      stdlib.RangeFunc,
+		"regex":      stdlib.RegexFunc,
+		"replace":    stdlib.ReplaceFunc,
+		"split":      stdlib.SplitFunc,
+		"substr":     stdlib.SubstrFunc,
+		"title":      stdlib.TitleFunc,
+		"tonumber":   stdlib.MakeToFunc(cty.Number),
+		"tostring":   stdlib.MakeToFunc(cty.String),
+		"trimspace":  stdlib.TrimSpaceFunc,
+		"try":        tryfunc.TryFunc,
+		"upper":      stdlib.UpperFunc,
+		"values":     stdlib.ValuesFunc,
+		"zipmap":     stdlib.ZipmapFunc,
+
+		"env":  envFunc,
+		"file": makeFileFunc(baseDir),
+	}
+	funcs["templatefile"] = makeTemplateFileFunc(baseDir, funcs)
+	return funcs
+}
+
+var envFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "name", Type: cty.String},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return cty.StringVal(os.Getenv(args[0].AsString())), nil
+	},
+})
+
+func makeFileFunc(baseDir string) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "path", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			contents, err := readConfigRelativeFile(baseDir, args[0].AsString())
+			if err != nil {
+				return cty.NilVal, err
+			}
+			return cty.StringVal(string(contents)), nil
+		},
+	})
+}
+
+func makeTemplateFileFunc(baseDir string, funcs map[string]function.Function) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "path", Type: cty.String},
+			{Name: "vars", Type: cty.DynamicPseudoType},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			pathname := args[0].AsString()
+			contents, err := readConfigRelativeFile(baseDir, pathname)
+			if err != nil {
+				return cty.NilVal, err
+			}
+
+			vars := args[1]
+			if !vars.Type().IsObjectType() && !vars.Type().IsMapType() {
+				return cty.NilVal, function.NewArgErrorf(1, "vars must be an object or map")
+			}
+
+			expr, diags := hclsyntax.ParseTemplate(contents, pathname, hcl.InitialPos)
+			if diags.HasErrors() {
+				return cty.NilVal, diags
+			}
+
+			ctx := &hcl.EvalContext{
+				Variables: vars.AsValueMap(),
+				Functions: funcs,
+			}
+			val, diags := expr.Value(ctx)
+			if diags.HasErrors() {
+				return cty.NilVal, diags
+			}
+			return val, nil
+		},
+	})
+}
+
+func readConfigRelativeFile(baseDir, pathname string) ([]byte, error) {
+	if !filepath.IsAbs(pathname) {
+		pathname = filepath.Join(baseDir, pathname)
+	}
+	return os.ReadFile(pathname)
+}
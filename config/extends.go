@@ -0,0 +1,200 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// resolveExtends returns the named configuration with everything it
+// inherits (via 'extends') merged into it.
+//
+// A child is merged on top of its parent field by field:
+//
+//   - attributes set in the child replace the parent's value entirely; this
+//     includes list and map valued attributes like 'services' or 'env'
+//   - single blocks (like 'security') are merged recursively
+//   - labeled blocks (like 'cluster', 'node', 'service', 'partition', and
+//     'cluster_config') are matched up by label; a match is merged
+//     recursively and anything new is appended after the parent's entries
+//   - unlabeled repeated blocks (like 'config_entry') are appended after the
+//     parent's entries
+//
+// Nothing inherited can be removed by a child.
+func resolveExtends(
+	envelope *rawConfigEnvelope,
+	bodies map[string]*hclsyntax.Body,
+	name string,
+	seen []string,
+) (*rawConfig, error) {
+	for _, prior := range seen {
+		if prior == name {
+			return nil, fmt.Errorf("config %q has an extends cycle: %s",
+				seen[0], strings.Join(append(seen, name), " -> "))
+		}
+	}
+	seen = append(seen, name)
+
+	var child *rawConfig
+	for _, cfg := range envelope.Config {
+		if cfg.Name == name {
+			child = cfg
+			break
+		}
+	}
+	if child == nil {
+		if len(seen) == 1 {
+			return nil, fmt.Errorf("active configuration %q is not defined", name)
+		}
+		return nil, fmt.Errorf("config %q extends undefined config %q", seen[len(seen)-2], name)
+	}
+
+	if child.Extends == "" {
+		return child, nil
+	}
+
+	parent, err := resolveExtends(envelope, bodies, child.Extends, seen)
+	if err != nil {
+		return nil, err
+	}
+
+	body, ok := bodies[name]
+	if !ok {
+		return nil, fmt.Errorf("config %q: extends is only supported in native HCL syntax", name)
+	}
+
+	merged := mergeBlock(reflect.ValueOf(parent).Elem(), reflect.ValueOf(child).Elem(), body)
+	return merged.Addr().Interface().(*rawConfig), nil
+}
+
+// configBlockBodies returns the syntax of each top level 'config' block so
+// that it is possible to tell which fields were actually set in each.
+func configBlockBodies(files []*hclsyntax.Body) map[string]*hclsyntax.Body {
+	out := make(map[string]*hclsyntax.Body)
+	for _, body := range files {
+		for _, block := range body.Blocks {
+			if block.Type == "config" && len(block.Labels) == 1 {
+				out[block.Labels[0]] = block.Body
+			}
+		}
+	}
+	return out
+}
+
+// mergeBlock returns a copy of parent with the fields set in child (according
+// to its syntax in body) merged on top. Both must be struct values decoded via
+// gohcl struct tags.
+func mergeBlock(parent, child reflect.Value, body *hclsyntax.Body) reflect.Value {
+	out := reflect.New(parent.Type()).Elem()
+	out.Set(parent)
+
+	t := parent.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, kind, ok := hclFieldTag(t.Field(i))
+		if !ok {
+			continue
+		}
+		field := out.Field(i)
+		childField := child.Field(i)
+
+		switch kind {
+		case "label":
+			field.Set(childField)
+		case "attr", "optional":
+			if _, ok := body.Attributes[name]; ok {
+				field.Set(childField)
+			}
+		case "block":
+			blocks := blocksOfType(body, name)
+			if len(blocks) == 0 {
+				continue
+			}
+			switch field.Kind() {
+			case reflect.Pointer:
+				if field.IsNil() {
+					field.Set(childField)
+				} else {
+					merged := mergeBlock(field.Elem(), childField.Elem(), blocks[0].Body)
+					field.Set(merged.Addr())
+				}
+			case reflect.Slice:
+				field.Set(mergeBlockList(field, childField, blocks))
+			default:
+				field.Set(childField)
+			}
+		default:
+			field.Set(childField)
+		}
+	}
+	return out
+}
+
+// mergeBlockList merges a list of repeated blocks. Labeled blocks are matched
+// up by label and merged, while unlabeled blocks are simply appended.
+func mergeBlockList(parent, child reflect.Value, blocks []*hclsyntax.Block) reflect.Value {
+	out := reflect.MakeSlice(parent.Type(), 0, parent.Len()+child.Len())
+	out = reflect.AppendSlice(out, parent)
+
+	labelIdx := -1
+	if elemType := parent.Type().Elem(); elemType.Kind() == reflect.Pointer && elemType.Elem().Kind() == reflect.Struct {
+		labelIdx = hclLabelField(elemType.Elem())
+	}
+
+	for i := 0; i < child.Len(); i++ {
+		elem := child.Index(i)
+		if labelIdx < 0 || i >= len(blocks) {
+			out = reflect.Append(out, elem)
+			continue
+		}
+
+		label := elem.Elem().Field(labelIdx).Interface()
+		matched := false
+		for j := 0; j < out.Len(); j++ {
+			existing := out.Index(j)
+			if existing.Elem().Field(labelIdx).Interface() != label {
+				continue
+			}
+			merged := mergeBlock(existing.Elem(), elem.Elem(), blocks[i].Body)
+			existing.Set(merged.Addr())
+			matched = true
+			break
+		}
+		if !matched {
+			out = reflect.Append(out, elem)
+		}
+	}
+	return out
+}
+
+func blocksOfType(body *hclsyntax.Body, typeName string) []*hclsyntax.Block {
+	var out []*hclsyntax.Block
+	for _, block := range body.Blocks {
+		if block.Type == typeName {
+			out = append(out, block)
+		}
+	}
+	return out
+}
+
+func hclLabelField(t reflect.Type) int {
+	for i := 0; i < t.NumField(); i++ {
+		if _, kind, ok := hclFieldTag(t.Field(i)); ok && kind == "label" {
+			return i
+		}
+	}
+	return -1
+}
+
+func hclFieldTag(f reflect.StructField) (name, kind string, ok bool) {
+	tag, ok := f.Tag.Lookup("hcl")
+	if !ok {
+		return "", "", false
+	}
+	name, kind, _ = strings.Cut(tag, ",")
+	if kind == "" {
+		kind = "attr"
+	}
+	return name, kind, true
+}
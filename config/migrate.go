@@ -0,0 +1,169 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+)
+
+// Migrate rewrites the contents of a config file so that it no longer uses
+// any deprecated constructs, preserving comments and formatting where
+// possible. It returns the new contents along with a description of each
+// change that was made. If nothing needed to change the original contents are
+// returned with no changes listed.
+//
+// The following are migrated:
+//
+//   - files without any 'config' blocks are wrapped in 'config "default"'
+//     with a matching 'active' attribute
+//   - topology.datacenter blocks are renamed to topology.cluster
+//   - config_entries lists are moved into a cluster_config block for the
+//     primary cluster
+//
+// Included files are not migrated.
+func Migrate(pathname string, contents []byte) ([]byte, []string, error) {
+	f, diags := hclwrite.ParseConfig(contents, pathname, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, nil, fmt.Errorf("could not parse %q: %w", pathname, diags)
+	}
+
+	var changes []string
+
+	if isLegacyFile(f.Body()) {
+		wrapped, err := wrapLegacyFile(pathname, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		f = wrapped
+		changes = append(changes, `moved everything into config "default"`)
+	}
+
+	for _, block := range f.Body().Blocks() {
+		if block.Type() != "config" || len(block.Labels()) != 1 {
+			continue
+		}
+		more, err := migrateConfigBlock(block)
+		if err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, more...)
+	}
+
+	if len(changes) == 0 {
+		return contents, nil, nil
+	}
+	tokens := collapseBlankLines(f.BuildTokens(nil))
+	return hclwrite.Format(tokens.Bytes()), changes, nil
+}
+
+// collapseBlankLines removes any runs of more than one blank line, which are
+// left behind when things are moved around.
+func collapseBlankLines(tokens hclwrite.Tokens) hclwrite.Tokens {
+	var (
+		out      = make(hclwrite.Tokens, 0, len(tokens))
+		newlines = 0
+	)
+	for _, tok := range tokens {
+		switch {
+		case tok.Type == hclsyntax.TokenNewline:
+			newlines++
+			if newlines > 2 {
+				continue
+			}
+		case tok.Type == hclsyntax.TokenComment && bytes.HasSuffix(tok.Bytes, []byte("\n")):
+			newlines = 1 // line comments include their newline
+		default:
+			newlines = 0
+		}
+		out = append(out, tok)
+	}
+	return out
+}
+
+// isLegacyFile returns true if the file has no 'config' blocks, and so is
+// entirely made up of a single configuration.
+func isLegacyFile(body *hclwrite.Body) bool {
+	if body.GetAttribute("active") != nil {
+		return false
+	}
+	for _, block := range body.Blocks() {
+		if block.Type() == "config" {
+			return false
+		}
+	}
+	return true
+}
+
+// wrapLegacyFile moves the contents of a file into a 'config "default"'
+// block, leaving the declarations that only make sense at the top level
+// behind.
+func wrapLegacyFile(pathname string, f *hclwrite.File) (*hclwrite.File, error) {
+	body := f.Body()
+
+	var top bytes.Buffer
+	if attr := body.GetAttribute("include"); attr != nil {
+		top.Write(attr.BuildTokens(nil).Bytes())
+		body.RemoveAttribute("include")
+	}
+	for _, block := range body.Blocks() {
+		for _, schema := range configFileSchema.Blocks {
+			if block.Type() == schema.Type {
+				top.Write(block.BuildTokens(nil).Bytes())
+				body.RemoveBlock(block)
+				break
+			}
+		}
+	}
+	if top.Len() > 0 {
+		top.WriteString("\n")
+	}
+
+	top.WriteString("active = \"default\"\n\nconfig \"default\" {\n")
+	top.Write(bytes.TrimSpace(f.Bytes()))
+	top.WriteString("\n}\n")
+
+	out, diags := hclwrite.ParseConfig(top.Bytes(), pathname, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("could not wrap %q in a config block: %w", pathname, diags)
+	}
+	return out, nil
+}
+
+func migrateConfigBlock(block *hclwrite.Block) ([]string, error) {
+	var (
+		name    = block.Labels()[0]
+		body    = block.Body()
+		changes []string
+	)
+
+	for _, topology := range body.Blocks() {
+		if topology.Type() != "topology" {
+			continue
+		}
+		for _, dc := range topology.Body().Blocks() {
+			if dc.Type() != "datacenter" || len(dc.Labels()) != 1 {
+				continue
+			}
+			dc.SetType("cluster")
+			changes = append(changes, fmt.Sprintf("config %q: renamed topology.datacenter %q to topology.cluster", name, dc.Labels()[0]))
+		}
+	}
+
+	if attr := body.GetAttribute("config_entries"); attr != nil {
+		cc := body.FirstMatchingBlock("cluster_config", []string{PrimaryCluster})
+		if cc == nil {
+			body.AppendNewline()
+			cc = body.AppendNewBlock("cluster_config", []string{PrimaryCluster})
+		} else if cc.Body().GetAttribute("config_entries") != nil {
+			return nil, fmt.Errorf("config %q: cannot move config_entries into cluster_config %q because it already has config_entries", name, PrimaryCluster)
+		}
+		cc.Body().AppendUnstructuredTokens(attr.BuildTokens(nil))
+		body.RemoveAttribute("config_entries")
+		changes = append(changes, fmt.Sprintf("config %q: moved config_entries into cluster_config %q", name, PrimaryCluster))
+	}
+
+	return changes, nil
+}
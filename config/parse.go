@@ -2,21 +2,46 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 )
 
+// LoadOptions tweaks how a config file is interpreted.
+type LoadOptions struct {
+	// Active overrides the 'active' field in the config file.
+	Active string
+
+	// Vars sets the values of variable blocks in the config file, overriding
+	// their defaults.
+	Vars map[string]string
+
+	// Warn, if set, is called with each warning about the config file, such
+	// as the use of deprecated fields.
+	Warn func(*hcl.Diagnostic)
+}
+
 // LoadConfig loads up the default config file (config.hcl), parses it, and
 // does some light validation.
 func LoadConfig(pathname string) (*Config, error) {
+	return LoadConfigWithOptions(pathname, LoadOptions{})
+}
+
+// LoadConfigWithOptions is like LoadConfig but allows for overriding some
+// details of the config file.
+func LoadConfigWithOptions(pathname string, opts LoadOptions) (*Config, error) {
 	contents, err := os.ReadFile(pathname)
 	if err != nil {
 		return nil, err
 	}
 
-	cfg, err := parseConfig(pathname, contents)
+	cfg, err := parseConfigWithOptions(pathname, contents, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -28,11 +53,60 @@ func LoadConfig(pathname string) (*Config, error) {
 	return cfg, nil
 }
 
+// CheckConfig loads the config file the same way as LoadConfigWithOptions,
+// but rather than stopping at the first problem it keeps going and returns
+// everything it finds. The returned config is nil if the file could not be
+// decoded at all.
+func CheckConfig(pathname string, opts LoadOptions) (*Config, *Problems) {
+	problems := &Problems{}
+
+	contents, err := os.ReadFile(pathname)
+	if err != nil {
+		problems.Error(nil, err)
+		return nil, problems
+	}
+
+	cfg := parseConfigProblems(pathname, contents, opts, problems)
+	if cfg == nil {
+		return nil, problems
+	}
+
+	checkConfig(cfg, problems)
+
+	return cfg, problems
+}
+
 func parseConfig(pathname string, contents []byte) (*Config, error) {
+	return parseConfigWithOptions(pathname, contents, LoadOptions{})
+}
+
+func parseConfigWithOptions(pathname string, contents []byte, opts LoadOptions) (*Config, error) {
+	problems := &Problems{}
+	cfg := parseConfigProblems(pathname, contents, opts, problems)
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+	if opts.Warn != nil {
+		for _, diag := range problems.Warnings() {
+			opts.Warn(diag)
+		}
+	}
+	return cfg, nil
+}
+
+// parseConfigProblems records any problems found in problems. It only
+// returns nil if the file could not be decoded at all.
+func parseConfigProblems(pathname string, contents []byte, opts LoadOptions, problems *Problems) *Config {
 	// Extract the actively selected configuration.
-	uc, err := decodeConfig(pathname, contents)
+	uc, evalCtx, sources, err := decodeConfig(pathname, contents, opts)
 	if err != nil {
-		return nil, err
+		problems.Error(nil, err)
+		return nil
+	}
+	problems.Sources = sources
+
+	if uc.legacy {
+		problems.Warnf(nil, "config files without any 'config' blocks are deprecated; run 'devconsul config migrate' to upgrade")
 	}
 
 	uc.removeNilFields()
@@ -46,6 +120,9 @@ func parseConfig(pathname string, contents []byte) (*Config, error) {
 	if uc.DataplaneImage == "" {
 		uc.DataplaneImage = DefaultDataplaneImage
 	}
+	if uc.Backend == "" {
+		uc.Backend = "terraform"
+	}
 	if uc.Envoy.LogLevel == "" {
 		uc.Envoy.LogLevel = "info"
 	}
@@ -61,7 +138,7 @@ func parseConfig(pathname string, contents []byte) (*Config, error) {
 
 	if !uc.Security.DisableACLs {
 		if uc.Topology.LinkMode == "peer" && uc.Security.InitialMasterToken == "" {
-			return nil, fmt.Errorf("with link_mode=peer you need to provide the initial master token if acls are enabled")
+			problems.Errorf(Path{"security", "initial_master_token"}, "with link_mode=peer you need to provide the initial master token if acls are enabled")
 		}
 	}
 
@@ -75,26 +152,64 @@ func parseConfig(pathname string, contents []byte) (*Config, error) {
 
 	if len(uc.Topology.DeprecatedDatacenter) > 0 {
 		if len(uc.Topology.Cluster) > 0 {
-			return nil, fmt.Errorf("both datacenter and cluster configured")
+			problems.Errorf(Path{"topology", "datacenter"}, "both datacenter and cluster configured")
+		} else {
+			problems.Warnf(Path{"topology", "datacenter"}, "topology.datacenter is deprecated in favor of topology.cluster; run 'devconsul config migrate' to upgrade")
+			uc.Topology.Cluster = uc.Topology.DeprecatedDatacenter
 		}
-		uc.Topology.Cluster = uc.Topology.DeprecatedDatacenter
 		uc.Topology.DeprecatedDatacenter = nil
 	}
 
 	if len(uc.DeprecatedRawConfigEntries) > 0 {
 		if len(uc.Clusters) > 0 {
-			return nil, fmt.Errorf("both config_entries and cluster are configured")
+			problems.Errorf(Path{"config_entries"}, "both config_entries and cluster are configured")
+		} else {
+			problems.Warnf(Path{"config_entries"}, "config_entries is deprecated in favor of cluster_config %q; run 'devconsul config migrate' to upgrade", PrimaryCluster)
+			uc.Clusters = []*rawClusterConfig{{
+				Name:             PrimaryCluster,
+				RawConfigEntries: uc.DeprecatedRawConfigEntries,
+			}}
 		}
-		uc.Clusters = []*rawClusterConfig{{
-			Name:             PrimaryCluster,
-			RawConfigEntries: uc.DeprecatedRawConfigEntries,
-		}}
 		uc.DeprecatedRawConfigEntries = nil
 	}
 
 	for _, node := range uc.Topology.Nodes {
 		if node.UpstreamDatacenter != "" && node.UpstreamPeer != "" {
-			return nil, fmt.Errorf("both upstream_datacenter and upstream_peer configured")
+			problems.Errorf(Path{"topology", "node", node.NodeName, "upstream_peer"}, "both upstream_datacenter and upstream_peer configured")
+		}
+		if node.Service != "" && len(node.Services) > 0 {
+			problems.Errorf(Path{"topology", "node", node.NodeName, "services"}, "node[%q]: both service and services configured", node.NodeName)
+		}
+		if node.UpstreamExtraHCL != "" {
+			problems.Warnf(Path{"topology", "node", node.NodeName, "upstream_extra_hcl"}, "node[%q]: upstream_extra_hcl is deprecated in favor of upstream blocks", node.NodeName)
+		}
+		for _, up := range node.Upstreams {
+			if up.DestinationType == "" {
+				up.DestinationType = UpstreamTypeService
+			}
+		}
+	}
+
+	for _, svc := range uc.Topology.Services {
+		if svc.Port == 0 {
+			svc.Port = 8080
+		}
+	}
+	for _, svc := range uc.Topology.ExternalServices {
+		if svc.Cluster == "" {
+			svc.Cluster = PrimaryCluster
+		}
+		if svc.Port == 0 {
+			svc.Port = 8080
+		}
+		if svc.Image == "" {
+			svc.Image = DefaultExternalServiceImage
+			if len(svc.Command) == 0 {
+				svc.Command = []string{
+					"-listen=:" + strconv.Itoa(svc.Port),
+					"-text=" + svc.Name,
+				}
+			}
 		}
 	}
 
@@ -113,7 +228,10 @@ func parseConfig(pathname string, contents []byte) (*Config, error) {
 			Envoy:          uc.EnvoyVersion,
 			DataplaneImage: uc.DataplaneImage,
 		},
-		CanaryNodes: uc.CanaryProxies.Nodes,
+		CanaryNodes:   uc.CanaryProxies.Nodes,
+		AgentExtraHCL: uc.AgentExtraHCL,
+		Backend:       uc.Backend,
+		Addressing:    uc.Addressing.addressing(),
 		CanaryVersions: Versions{
 			ConsulImage:    uc.CanaryProxies.ConsulImage,
 			Envoy:          uc.CanaryProxies.EnvoyVersion,
@@ -139,8 +257,13 @@ func parseConfig(pathname string, contents []byte) (*Config, error) {
 		TopologyNetworkShape:             uc.Topology.NetworkShape,
 		TopologyLinkMode:                 uc.Topology.LinkMode,
 		TopologyNodeMode:                 uc.Topology.NodeMode,
+		TopologyPeeringMode:              uc.Topology.PeeringMode,
+		TopologyPeerings:                 uc.Topology.Peerings,
 		TopologyClusters:                 uc.Topology.Cluster,
 		TopologyNodes:                    uc.Topology.Nodes,
+		TopologyServices:                 uc.Topology.Services,
+		TopologyExternalServices:         uc.Topology.ExternalServices,
+		TopologyNetworks:                 uc.Topology.Networks,
 		ConfigEntries:                    make(map[string][]api.ConfigEntry),
 	}
 
@@ -160,46 +283,116 @@ func parseConfig(pathname string, contents []byte) (*Config, error) {
 		for i, raw := range cluster.RawConfigEntries {
 			entry, err := api.DecodeConfigEntryFromJSON([]byte(raw))
 			if err != nil {
-				return nil, fmt.Errorf("invalid config entry [%d]: %v", i, err)
+				problems.Errorf(Path{"cluster_config", cluster.Name, "config_entries"}, "invalid config entry [%d]: %v", i, err)
+				continue
+			}
+			configEntries = append(configEntries, entry)
+		}
+		for i, raw := range cluster.ConfigEntries {
+			entry, err := raw.decode(evalCtx)
+			if err != nil {
+				problems.Error(Path{"cluster_config", cluster.Name, "config_entry", strconv.Itoa(i)}, err)
+				continue
 			}
 			configEntries = append(configEntries, entry)
 		}
 		cfg.ConfigEntries[cluster.Name] = configEntries
 	}
 
-	return cfg, nil
+	return cfg
 }
 
-// Extract the actively selected configuration.
-func decodeConfig(pathname string, contents []byte) (*rawConfig, error) {
+// Extract the actively selected configuration. If active is not empty it
+// takes precedence over the 'active' field in the file.
+func decodeConfig(pathname string, contents []byte, opts LoadOptions) (*rawConfig, *hcl.EvalContext, *SourceMap, error) {
+	src, err := loadConfigSource(pathname, contents, opts.Vars)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	// check legacy first
 	{
 		var raw rawConfig
-		err := decodeHCL(&raw, pathname, string(contents))
+		err := decodeHCL(&raw, pathname, src)
 		if err == nil {
+			if raw.Extends != "" {
+				return nil, nil, nil, fmt.Errorf("extends can only be used inside of a 'config' block")
+			}
+			if opts.Active != "" {
+				return nil, nil, nil, fmt.Errorf("cannot select configuration %q from a file without any 'config' blocks", opts.Active)
+			}
 			raw.Name = "legacy"
-			return &raw, nil
+			raw.legacy = true
+			start := &hcl.Range{Filename: pathname, Start: hcl.InitialPos, End: hcl.InitialPos}
+			return &raw, src.Ctx, newSourceMap(start, src.Syntax...), nil
 		}
 	}
 
 	// assume non legacy
 	var envelope rawConfigEnvelope
-	err := decodeHCL(&envelope, pathname, string(contents))
+	err = decodeHCL(&envelope, pathname, src)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	if opts.Active != "" {
+		envelope.Active = opts.Active
 	}
 	if envelope.Active == "" {
-		return nil, fmt.Errorf("missing required field 'active'")
+		return nil, nil, nil, fmt.Errorf("missing required field 'active'")
 	}
 
 	got, ok := envelope.GetActive()
 	if !ok {
-		return nil, fmt.Errorf("active configuration %q is not defined", envelope.Active)
+		return nil, nil, nil, fmt.Errorf("active configuration %q is not defined", envelope.Active)
+	}
+	if got.Extends != "" {
+		got, err = resolveExtends(&envelope, configBlockBodies(src.Syntax), envelope.Active, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 	}
-	return got, nil
+	return got, src.Ctx, configSourceMap(&envelope, src), nil
 }
 
-func decodeHCL(out interface{}, name, config string) (xerr error) {
+// configSourceMap indexes the active config block along with every block it
+// extends, with the active block taking precedence.
+func configSourceMap(envelope *rawConfigEnvelope, src *configSource) *SourceMap {
+	blocks := make(map[string]*hclsyntax.Block)
+	for _, body := range src.Syntax {
+		for _, block := range body.Blocks {
+			if block.Type == "config" && len(block.Labels) == 1 {
+				blocks[block.Labels[0]] = block
+			}
+		}
+	}
+
+	active, ok := blocks[envelope.Active]
+	if !ok {
+		return newSourceMap(nil)
+	}
+
+	// resolveExtends has already rejected cycles and missing parents.
+	var bodies []*hclsyntax.Body
+	for name := envelope.Active; name != ""; {
+		block, ok := blocks[name]
+		if !ok {
+			break
+		}
+		bodies = append([]*hclsyntax.Body{block.Body}, bodies...)
+
+		name = ""
+		for _, cfg := range envelope.Config {
+			if cfg.Name == block.Labels[0] {
+				name = cfg.Extends
+				break
+			}
+		}
+	}
+
+	return newSourceMap(active.DefRange().Ptr(), bodies...)
+}
+
+func decodeHCL(out interface{}, name string, src *configSource) (xerr error) {
 	defer func() {
 		if r := recover(); r != nil {
 			panic(fmt.Sprintf(
@@ -207,21 +400,29 @@ func decodeHCL(out interface{}, name, config string) (xerr error) {
 			))
 		}
 	}()
-	err := hclsimple.Decode(
-		name,
-		[]byte(config),
-		nil,
-		out,
-	)
-	if err != nil {
-		return fmt.Errorf("could not parse and decode snippet %q: %v", name, err)
+	diags := gohcl.DecodeBody(src.Body, src.Ctx, out)
+	if diags.HasErrors() {
+		return fmt.Errorf("could not parse and decode snippet %q: %w", name, diags)
 	}
 	return nil
 }
 
 func validateConfig(cfg *Config) error {
+	problems := &Problems{}
+	checkConfig(cfg, problems)
+	return problems.Err()
+}
+
+// checkConfig records every problem with cfg in problems.
+func checkConfig(cfg *Config, problems *Problems) {
+	switch cfg.Backend {
+	case "terraform", "docker":
+	default:
+		problems.Errorf(Path{"backend"}, "unknown backend %q; expected \"terraform\" or \"docker\"", cfg.Backend)
+	}
+
 	if cfg.EnterpriseEnabled && cfg.KubernetesEnabled {
-		return fmt.Errorf("kubernetes and enterprise are not compatible in this tool")
+		problems.Errorf(Path{"kubernetes", "enabled"}, "kubernetes and enterprise are not compatible in this tool")
 	}
 
 	if !cfg.EnterpriseEnabled && cfg.EnterpriseLicensePath != "" {
@@ -229,41 +430,43 @@ func validateConfig(cfg *Config) error {
 	}
 
 	if cfg.EnterpriseEnabled && cfg.EnterpriseLicensePath == "" {
-		return fmt.Errorf("enterprise.license_path is required when enterprise.enabled=true")
+		problems.Errorf(Path{"enterprise", "license_path"}, "enterprise.license_path is required when enterprise.enabled=true")
 	}
 
 	if !cfg.EnterpriseEnabled && len(cfg.EnterpriseSegments) > 0 {
-		return fmt.Errorf("enterprise.segments cannot be configured when enterprise.enabled=false")
+		problems.Errorf(Path{"enterprise", "segments"}, "enterprise.segments cannot be configured when enterprise.enabled=false")
 	}
 
 	if !cfg.EnterpriseEnabled && len(cfg.EnterprisePartitions) > 0 {
-		return fmt.Errorf("enterprise.partitions cannot be configured when enterprise.enabled=false")
+		problems.Errorf(Path{"enterprise", "partition"}, "enterprise.partitions cannot be configured when enterprise.enabled=false")
 	}
 
 	for _, node := range cfg.TopologyNodes {
+		at := Path{"topology", "node", node.NodeName}
 		if cfg.EnterpriseEnabled {
 			if node.Segment != "" {
 				if _, ok := cfg.EnterpriseSegments[node.Segment]; !ok {
-					return fmt.Errorf("node assigned to non existent segment %q", node.Segment)
+					problems.Errorf(append(at, "segment"), "node assigned to non existent segment %q", node.Segment)
 				}
 			}
 		} else {
 			if node.Segment != "" {
-				return fmt.Errorf("nodes cannot be assigned network segments when enterprise.enabled=false")
+				problems.Errorf(append(at, "segment"), "nodes cannot be assigned network segments when enterprise.enabled=false")
 			}
 			if node.Partition != "" {
-				return fmt.Errorf("nodes cannot be assigned partitions when enterprise.enabled=false")
+				problems.Errorf(append(at, "partition"), "nodes cannot be assigned partitions when enterprise.enabled=false")
 			}
 			if node.UpstreamPartition != "" {
-				return fmt.Errorf("upstreams cannot be assigned partitions when enterprise.enabled=false")
+				problems.Errorf(append(at, "upstream_partition"), "upstreams cannot be assigned partitions when enterprise.enabled=false")
 			}
 			if node.ServiceNamespace != "" {
-				return fmt.Errorf("namespaces cannot be configured on services when enterprise.enabled=false")
+				problems.Errorf(append(at, "service_namespace"), "namespaces cannot be configured on services when enterprise.enabled=false")
 			}
 			if node.UpstreamNamespace != "" {
-				return fmt.Errorf("upstreams cannot be assigned namespaces when enterprise.enabled=false")
+				problems.Errorf(append(at, "upstream_namespace"), "upstreams cannot be assigned namespaces when enterprise.enabled=false")
 			}
 		}
+		checkNodeUpstreams(cfg, node, problems)
 	}
 
 	hasSecondaryDatacenter := false
@@ -277,34 +480,38 @@ func validateConfig(cfg *Config) error {
 
 	if cfg.TopologyLinkMode == "peer" {
 		if !cfg.EncryptionTLS {
-			return fmt.Errorf("peering requires servers to do TLS on gRPC: encryption.tls should be enabled")
-		}
-		if !cfg.EncryptionTLSGRPC && !cfg.EncryptionServerTLSGRPC {
-			return fmt.Errorf("peering requires servers to do TLS on gRPC: encryption.tls_grpc or encryption.server_tls_grpc should be enabled")
+			problems.Errorf(Path{"security", "encryption", "tls"}, "peering requires servers to do TLS on gRPC: encryption.tls should be enabled")
+		} else if !cfg.EncryptionTLSGRPC && !cfg.EncryptionServerTLSGRPC {
+			problems.Errorf(Path{"security", "encryption", "tls_grpc"}, "peering requires servers to do TLS on gRPC: encryption.tls_grpc or encryption.server_tls_grpc should be enabled")
 		}
 	}
 
 	if len(cfg.EnterprisePartitions) > 0 {
 		if hasSecondaryDatacenter {
-			return fmt.Errorf("enterprise.partitions and topology.datacenter are mutually exclusive")
+			problems.Errorf(Path{"enterprise", "partition"}, "enterprise.partitions and topology.datacenter are mutually exclusive")
 		}
 		seen := make(map[string]struct{})
 		for _, ap := range cfg.EnterprisePartitions {
+			at := Path{"enterprise", "partition", ap.Name}
 			if ap.Name == "" {
-				return fmt.Errorf("enterprise.partitions must refer to the default partition as %q", "default")
+				problems.Errorf(at, "enterprise.partitions must refer to the default partition as %q", "default")
+				continue
 			}
 			if _, ok := seen[ap.Name]; ok {
-				return fmt.Errorf("enterprise.partitions contains a duplicate for %q", ap.Name)
+				problems.Errorf(at, "enterprise.partitions contains a duplicate for %q", ap.Name)
+				continue
 			}
 			seen[ap.Name] = struct{}{}
 
 			seenNS := make(map[string]struct{})
 			for _, ns := range ap.Namespaces {
 				if ns == "" {
-					return fmt.Errorf("enterprise.partitions[%q].namespaces must refer to the default namespace as %q", ap.Name, "default")
+					problems.Errorf(append(at, "namespaces"), "enterprise.partitions[%q].namespaces must refer to the default namespace as %q", ap.Name, "default")
+					continue
 				}
 				if _, ok := seenNS[ns]; ok {
-					return fmt.Errorf("enterprise.partitions[%q].namespaces contains a duplicate for %q", ap.Name, ns)
+					problems.Errorf(append(at, "namespaces"), "enterprise.partitions[%q].namespaces contains a duplicate for %q", ap.Name, ns)
+					continue
 				}
 				seenNS[ns] = struct{}{}
 			}
@@ -312,25 +519,303 @@ func validateConfig(cfg *Config) error {
 	}
 
 	if cfg.EncryptionTLSAPI && !cfg.EncryptionTLS {
-		return fmt.Errorf("encryption.tls_api=true requires encryption.tls=true")
+		problems.Errorf(Path{"security", "encryption", "tls_api"}, "encryption.tls_api=true requires encryption.tls=true")
 	}
 	if cfg.EncryptionTLSGRPC && !cfg.EncryptionTLS {
-		return fmt.Errorf("encryption.tls_grpc=true requires encryption.tls=true")
+		problems.Errorf(Path{"security", "encryption", "tls_grpc"}, "encryption.tls_grpc=true requires encryption.tls=true")
 	}
 
 	if cfg.CanaryVersions.ConsulImage == "" && cfg.CanaryVersions.Envoy != "" {
-		return fmt.Errorf("canary_proxies.consul_image must be set if canary_proxies.envoy_verison is set")
+		problems.Errorf(Path{"canary_proxies", "envoy_version"}, "canary_proxies.consul_image must be set if canary_proxies.envoy_verison is set")
 	}
 	if cfg.CanaryVersions.ConsulImage == "" && cfg.CanaryVersions.DataplaneImage != "" {
-		return fmt.Errorf("canary_proxies.consul_image must be set if canary_proxies.dataplane_version is set")
+		problems.Errorf(Path{"canary_proxies", "dataplane_image"}, "canary_proxies.consul_image must be set if canary_proxies.dataplane_version is set")
 	}
 	if cfg.CanaryVersions.ConsulImage != "" && cfg.CanaryVersions.Envoy == "" && cfg.CanaryVersions.DataplaneImage == "" {
-		return fmt.Errorf("canary_proxies.envoy_image and/or canary_proxies.dataplane_version must be set if canary_proxies.consul_image is set")
+		problems.Errorf(Path{"canary_proxies", "consul_image"}, "canary_proxies.envoy_image and/or canary_proxies.dataplane_version must be set if canary_proxies.consul_image is set")
 	}
 
 	if cfg.PrometheusEnabled && cfg.SecurityDisableACLs {
-		return fmt.Errorf("prometheus setup is incompatible with insecure consul")
+		problems.Errorf(Path{"monitor", "prometheus"}, "prometheus setup is incompatible with insecure consul")
 	}
 
-	return nil
+	checkAddressing(cfg.Addressing, problems)
+
+	checkAgentExtraHCL(Path{"agent_extra_hcl"}, cfg.AgentExtraHCL, problems)
+	for _, c := range cfg.TopologyClusters {
+		if c.Index < 0 {
+			problems.Errorf(Path{"topology", "cluster", c.Name, "index"}, "%s: index must not be negative: %d", c.Name, c.Index)
+		}
+		checkServerPlacement(cfg, c, problems)
+		checkAgentExtraHCL(Path{"topology", "cluster", c.Name, "agent_extra_hcl"}, c.AgentExtraHCL, problems)
+	}
+	for _, node := range cfg.TopologyNodes {
+		checkAgentExtraHCL(Path{"topology", "node", node.NodeName, "agent_extra_hcl"}, node.AgentExtraHCL, problems)
+	}
+
+	checkServices(cfg, problems)
+}
+
+// checkServerPlacement validates the read replicas and redundancy zones of a
+// cluster, which are both enterprise features.
+func checkServerPlacement(cfg *Config, c *Cluster, problems *Problems) {
+	at := Path{"topology", "cluster", c.Name}
+
+	if c.ReadReplicas < 0 {
+		problems.Errorf(append(at, "read_replicas"), "%s: read replicas must be non-negative", c.Name)
+	} else if c.ReadReplicas > 0 && !cfg.EnterpriseEnabled {
+		problems.Errorf(append(at, "read_replicas"), "%s: read_replicas cannot be configured when enterprise.enabled=false", c.Name)
+	}
+
+	if len(c.RedundancyZones) == 0 {
+		return
+	}
+	if !cfg.EnterpriseEnabled {
+		problems.Errorf(append(at, "redundancy_zones"), "%s: redundancy_zones cannot be configured when enterprise.enabled=false", c.Name)
+		return
+	}
+	seen := make(map[string]struct{})
+	for _, zone := range c.RedundancyZones {
+		if zone == "" {
+			problems.Errorf(append(at, "redundancy_zones"), "%s: redundancy_zones cannot contain an empty name", c.Name)
+			continue
+		}
+		if _, ok := seen[zone]; ok {
+			problems.Errorf(append(at, "redundancy_zones"), "%s: redundancy_zones contains a duplicate for %q", c.Name, zone)
+			continue
+		}
+		seen[zone] = struct{}{}
+	}
+}
+
+// checkAddressing validates the parts of the address plan that do not depend
+// on the shape of the topology. Overlaps between roles are checked when the
+// topology is compiled.
+func checkAddressing(a Addressing, problems *Problems) {
+	at := Path{"addressing"}
+	for _, sn := range []struct {
+		name, cidr string
+	}{
+		{"lan_supernet", a.LANSupernet},
+		{"wan_supernet", a.WANSupernet},
+	} {
+		prefix, err := netip.ParsePrefix(sn.cidr)
+		switch {
+		case err != nil:
+			problems.Errorf(append(at, sn.name), "addressing.%s is not a valid CIDR: %v", sn.name, err)
+		case !prefix.Addr().Is4():
+			problems.Errorf(append(at, sn.name), "addressing.%s must be an IPv4 CIDR", sn.name)
+		case prefix.Bits() > 24:
+			problems.Errorf(append(at, sn.name), "addressing.%s must be at least a /24", sn.name)
+		case prefix.Masked() != prefix:
+			problems.Errorf(append(at, sn.name), "addressing.%s has host bits set; did you mean %s?", sn.name, prefix.Masked())
+		}
+	}
+	lan, lanErr := netip.ParsePrefix(a.LANSupernet)
+	wan, wanErr := netip.ParsePrefix(a.WANSupernet)
+	if lanErr == nil && wanErr == nil {
+		if lan.Overlaps(wan) {
+			problems.Errorf(append(at, "wan_supernet"), "addressing.lan_supernet and addressing.wan_supernet overlap")
+		}
+		if a.ClusterPrefix < lan.Bits() || a.ClusterPrefix < wan.Bits() || a.ClusterPrefix > 28 {
+			problems.Errorf(append(at, "cluster_prefix"), "addressing.cluster_prefix must be between the supernet prefix lengths and 28: %d", a.ClusterPrefix)
+		}
+	}
+
+	// The cluster offsets are relative to the cluster subnet, while the shared
+	// containers always live in a /24.
+	maxClusterOffset := 254
+	if a.ClusterPrefix > 0 && a.ClusterPrefix <= 28 {
+		maxClusterOffset = 1<<(32-a.ClusterPrefix) - 2
+	}
+	for _, off := range []struct {
+		name     string
+		val, max int
+	}{
+		{"server_offset", a.ServerOffset, maxClusterOffset},
+		{"client_offset", a.ClientOffset, maxClusterOffset},
+		{"infra_offset", a.InfraOffset, maxClusterOffset},
+		{"prometheus_offset", a.PrometheusOffset, 254},
+		{"vault_offset", a.VaultOffset, 254},
+	} {
+		if off.val < 1 || off.val > off.max {
+			problems.Errorf(append(at, off.name), "addressing.%s must be between 1 and %d: %d", off.name, off.max, off.val)
+		}
+	}
+	if a.PrometheusOffset == a.VaultOffset {
+		problems.Errorf(append(at, "vault_offset"), "addressing.prometheus_offset and addressing.vault_offset must differ")
+	}
+	if a.SharedSubnet < 0 {
+		problems.Errorf(append(at, "shared_subnet"), "addressing.shared_subnet must not be negative: %d", a.SharedSubnet)
+	}
+}
+
+// checkNodeUpstreams validates the upstream blocks on a single node. Whether
+// they refer to services that actually run on the node is checked when the
+// topology is compiled.
+func checkNodeUpstreams(cfg *Config, node *Node, problems *Problems) {
+	for i, up := range node.Upstreams {
+		at := Path{"topology", "node", node.NodeName, "upstream", strconv.Itoa(i)}
+		switch up.DestinationType {
+		case UpstreamTypeService:
+		case UpstreamTypePreparedQuery:
+			if up.Peer != "" {
+				problems.Errorf(append(at, "peer"), "node[%q] upstream %q: prepared query upstreams cannot target a peer", node.NodeName, up.Name)
+			}
+		default:
+			problems.Errorf(append(at, "destination_type"), "node[%q] upstream %q: unknown destination_type %q", node.NodeName, up.Name, up.DestinationType)
+		}
+		if up.Name == "" {
+			problems.Errorf(append(at, "name"), "node[%q] has an upstream without a name", node.NodeName)
+		}
+		if up.Peer != "" && up.Datacenter != "" {
+			problems.Errorf(append(at, "peer"), "node[%q] upstream %q: both datacenter and peer configured", node.NodeName, up.Name)
+		}
+		if up.LocalPort < 0 || up.LocalPort > 65535 {
+			problems.Errorf(append(at, "local_port"), "node[%q] upstream %q: local_port is out of range: %d", node.NodeName, up.Name, up.LocalPort)
+		}
+		switch up.MeshGatewayMode {
+		case "", "none", "local", "remote":
+		default:
+			problems.Errorf(append(at, "mesh_gateway_mode"), "node[%q] upstream %q: mesh_gateway_mode must be one of none, local, or remote", node.NodeName, up.Name)
+		}
+		if !cfg.EnterpriseEnabled {
+			if up.Partition != "" {
+				problems.Errorf(append(at, "partition"), "upstreams cannot be assigned partitions when enterprise.enabled=false")
+			}
+			if up.Namespace != "" {
+				problems.Errorf(append(at, "namespace"), "upstreams cannot be assigned namespaces when enterprise.enabled=false")
+			}
+		}
+	}
+}
+
+// checkAgentExtraHCL makes sure that a snippet of agent config is at least
+// syntactically valid, since it is otherwise only parsed much later when
+// generating the agent configs.
+func checkAgentExtraHCL(at Path, src string, problems *Problems) {
+	if src == "" {
+		return
+	}
+	if _, diags := hclsyntax.ParseConfig([]byte(src), "agent_extra_hcl", hcl.InitialPos); diags.HasErrors() {
+		problems.Errorf(at, "agent_extra_hcl is not valid HCL: %v", diags)
+	}
+}
+
+func isServiceName(cfg *Config, name string) bool {
+	for _, svc := range cfg.Services() {
+		if svc.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func checkServices(cfg *Config, problems *Problems) {
+	services := make(map[string]*Service)
+	for _, svc := range cfg.TopologyServices {
+		at := Path{"topology", "service", svc.Name}
+		if svc.Name == "" {
+			problems.Errorf(at, "service name cannot be empty")
+			continue
+		}
+		if _, ok := services[svc.Name]; ok {
+			problems.Errorf(at, "service %q is defined more than once", svc.Name)
+			continue
+		}
+		if svc.Port <= 0 || svc.Port > 65535 {
+			problems.Errorf(append(at, "port"), "service[%q].port is out of range: %d", svc.Name, svc.Port)
+		}
+		if svc.Image == "" && len(svc.Command) > 0 {
+			problems.Errorf(append(at, "command"), "service[%q].command can only be set when service[%q].image is set", svc.Name, svc.Name)
+		}
+		if svc.Healthcheck != "" && !strings.HasPrefix(svc.Healthcheck, "/") {
+			problems.Errorf(append(at, "healthcheck"), "service[%q].healthcheck must be an http path starting with '/'", svc.Name)
+		}
+		services[svc.Name] = svc
+	}
+
+	external := make(map[string]*ExternalService)
+	externalPorts := make(map[string]map[int]string) // cluster -> port -> name
+	for _, svc := range cfg.TopologyExternalServices {
+		at := Path{"topology", "external_service", svc.Name}
+		if svc.Name == "" {
+			problems.Errorf(at, "external service name cannot be empty")
+			continue
+		}
+		if isServiceName(cfg, svc.Name) {
+			problems.Errorf(at, "external service %q has the same name as a service", svc.Name)
+			continue
+		}
+		if _, ok := external[svc.Name]; ok {
+			problems.Errorf(at, "external service %q is defined more than once", svc.Name)
+			continue
+		}
+		external[svc.Name] = svc
+
+		cluster, ok := cfg.ClusterByName(svc.Cluster)
+		if !ok {
+			problems.Errorf(append(at, "cluster"), "external_service[%q] is in an undefined cluster %q", svc.Name, svc.Cluster)
+		} else if cluster.TerminatingGateways <= 0 {
+			problems.Warnf(at, "external_service[%q] cannot be reached from the mesh because cluster %q has no terminating gateways", svc.Name, svc.Cluster)
+		}
+		if svc.Port <= 0 || svc.Port > 65535 {
+			problems.Errorf(append(at, "port"), "external_service[%q].port is out of range: %d", svc.Name, svc.Port)
+		} else {
+			// They all share the infra pod of the cluster.
+			if externalPorts[svc.Cluster] == nil {
+				externalPorts[svc.Cluster] = make(map[int]string)
+			}
+			if other, ok := externalPorts[svc.Cluster][svc.Port]; ok {
+				problems.Errorf(append(at, "port"), "external services %q and %q in cluster %q are both listening on port %d", other, svc.Name, svc.Cluster, svc.Port)
+			}
+			externalPorts[svc.Cluster][svc.Port] = svc.Name
+		}
+		if svc.Healthcheck != "" && !strings.HasPrefix(svc.Healthcheck, "/") {
+			problems.Errorf(append(at, "healthcheck"), "external_service[%q].healthcheck must be an http path starting with '/'", svc.Name)
+		}
+	}
+
+	for _, svc := range cfg.TopologyServices {
+		at := Path{"topology", "service", svc.Name, "upstreams"}
+		seen := make(map[string]struct{})
+		for _, up := range svc.Upstreams {
+			_, isExternal := external[up]
+			if _, ok := services[up]; !ok && !isExternal {
+				problems.Errorf(at, "service[%q] has an upstream on an undefined service %q", svc.Name, up)
+				continue
+			}
+			if _, ok := seen[up]; ok {
+				problems.Errorf(at, "service[%q] lists upstream %q more than once", svc.Name, up)
+				continue
+			}
+			seen[up] = struct{}{}
+		}
+	}
+
+	for _, node := range cfg.TopologyNodes {
+		at := Path{"topology", "node", node.NodeName, "services"}
+		if node.Service != "" {
+			at[len(at)-1] = "service"
+		}
+		seen := make(map[string]struct{})
+		for _, name := range node.ServiceNames() {
+			found := false
+			for _, svc := range cfg.Services() {
+				if svc.Name == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				problems.Errorf(at, "node[%q] is assigned an undefined service %q", node.NodeName, name)
+				continue
+			}
+			if _, ok := seen[name]; ok {
+				problems.Errorf(at, "node[%q] is assigned service %q more than once", node.NodeName, name)
+				continue
+			}
+			seen[name] = struct{}{}
+		}
+	}
 }
@@ -18,24 +18,31 @@ func (e *rawConfigEnvelope) GetActive() (*rawConfig, bool) {
 // provided config file. It is what the file is initially decoded into.
 type rawConfig struct {
 	Name           string                  `hcl:"name,label"`
+	Extends        string                  `hcl:"extends,optional"` // name of another config block to inherit from
 	ConsulImage    string                  `hcl:"consul_image,optional"`
 	EnvoyVersion   string                  `hcl:"envoy_version,optional"`
 	DataplaneImage string                  `hcl:"dataplane_image,optional"`
+	AgentExtraHCL  string                  `hcl:"agent_extra_hcl,optional"`
+	Backend        string                  `hcl:"backend,optional"`
 	CanaryProxies  *rawConfigCanaryProxies `hcl:"canary_proxies,block"`
 	Security       *rawConfigSecurity      `hcl:"security,block"`
 	Kubernetes     *rawConfigK8S           `hcl:"kubernetes,block"`
 	Envoy          *rawConfigEnvoy         `hcl:"envoy,block"`
 	Monitor        *rawConfigMonitor       `hcl:"monitor,block"`
 	Enterprise     *rawConfigEnterprise    `hcl:"enterprise,block"`
+	Addressing     *rawConfigAddressing    `hcl:"addressing,block"`
 	Topology       *rawTopology            `hcl:"topology,block"`
 	Clusters       []*rawClusterConfig     `hcl:"cluster_config,block"`
 
 	DeprecatedRawConfigEntries []string `hcl:"config_entries,optional"`
+
+	legacy bool // decoded from a file without any 'config' blocks
 }
 
 type rawClusterConfig struct {
-	Name             string   `hcl:"name,label"`
-	RawConfigEntries []string `hcl:"config_entries,optional"`
+	Name             string            `hcl:"name,label"`
+	RawConfigEntries []string          `hcl:"config_entries,optional"`
+	ConfigEntries    []*rawConfigEntry `hcl:"config_entry,block"`
 }
 
 func (uc *rawConfig) removeNilFields() {
@@ -60,6 +67,9 @@ func (uc *rawConfig) removeNilFields() {
 	if uc.Monitor == nil {
 		uc.Monitor = &rawConfigMonitor{}
 	}
+	if uc.Addressing == nil {
+		uc.Addressing = &rawConfigAddressing{}
+	}
 	if uc.Topology == nil {
 		uc.Topology = &rawTopology{}
 	}
@@ -72,6 +82,43 @@ type rawConfigMonitor struct {
 	Prometheus bool `hcl:"prometheus,optional"`
 }
 
+type rawConfigAddressing struct {
+	LANSupernet      string `hcl:"lan_supernet,optional"`
+	WANSupernet      string `hcl:"wan_supernet,optional"`
+	ClusterPrefix    int    `hcl:"cluster_prefix,optional"`
+	ServerOffset     int    `hcl:"server_offset,optional"`
+	ClientOffset     int    `hcl:"client_offset,optional"`
+	InfraOffset      int    `hcl:"infra_offset,optional"`
+	SharedSubnet     int    `hcl:"shared_subnet,optional"`
+	PrometheusOffset int    `hcl:"prometheus_offset,optional"`
+	VaultOffset      int    `hcl:"vault_offset,optional"`
+}
+
+// addressing returns the address plan with anything left unset defaulted.
+func (a *rawConfigAddressing) addressing() Addressing {
+	out := DefaultAddressing()
+	setString := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	setInt := func(dst *int, v int) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	setString(&out.LANSupernet, a.LANSupernet)
+	setString(&out.WANSupernet, a.WANSupernet)
+	setInt(&out.ClusterPrefix, a.ClusterPrefix)
+	setInt(&out.ServerOffset, a.ServerOffset)
+	setInt(&out.ClientOffset, a.ClientOffset)
+	setInt(&out.InfraOffset, a.InfraOffset)
+	setInt(&out.SharedSubnet, a.SharedSubnet)
+	setInt(&out.PrometheusOffset, a.PrometheusOffset)
+	setInt(&out.VaultOffset, a.VaultOffset)
+	return out
+}
+
 type rawConfigEnvoy struct {
 	LogLevel string `hcl:"log_level,optional"`
 }
@@ -117,11 +164,16 @@ type rawConfigEnterprise struct {
 }
 
 type rawTopology struct {
-	NetworkShape string     `hcl:"network_shape,optional"`
-	LinkMode     string     `hcl:"link_mode,optional"`
-	NodeMode     string     `hcl:"node_mode,optional"`
-	Cluster      []*Cluster `hcl:"cluster,block"`
-	Nodes        []*Node    `hcl:"node,block"`
+	NetworkShape     string             `hcl:"network_shape,optional"`
+	LinkMode         string             `hcl:"link_mode,optional"`
+	NodeMode         string             `hcl:"node_mode,optional"`
+	PeeringMode      string             `hcl:"peering_mode,optional"`
+	Peerings         [][]string         `hcl:"peerings,optional"`
+	Cluster          []*Cluster         `hcl:"cluster,block"`
+	Nodes            []*Node            `hcl:"node,block"`
+	Services         []*Service         `hcl:"service,block"`
+	ExternalServices []*ExternalService `hcl:"external_service,block"`
+	Networks         []*Network         `hcl:"network,block"`
 
 	DeprecatedDatacenter []*Cluster `hcl:"datacenter,block"`
 }
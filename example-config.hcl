@@ -2,7 +2,8 @@ active = "simple"
 # active = "mesh-gateways"
 # active = "wan-federation-via-mesh-gateways"
 
-config "simple" {
+# Settings shared by the other configs below via 'extends'.
+config "base" {
   consul_image = "consul-dev:latest"
   # consul_image = "consul:1.6.1"
 
@@ -23,6 +24,10 @@ config "simple" {
     # log_level = "info"
     log_level = "debug"
   }
+}
+
+config "simple" {
+  extends = "base"
 
   topology {
     cluster "dc1" {
@@ -41,51 +46,7 @@ config "simple" {
 }
 
 config "mesh-gateways" {
-  consul_image = "consul-dev:latest"
-
-  security {
-    initial_master_token = "root"
-    encryption {
-      tls    = true
-      gossip = true
-    }
-  }
-
-  kubernetes {
-    enabled = false
-  }
-
-  envoy {
-    # log_level = "trace"
-    # log_level = "info"
-    log_level = "debug"
-  }
-
-  config_entries = [
-    <<EOF
-{
-  "Kind": "service-resolver",
-  "Name": "pong",
-  "Redirect": {
-      "Datacenter": "dc2"
-  }
-}
-EOF
-    ,
-    <<EOF
-{
-  "Kind": "proxy-defaults",
-  "Name": "global",
-  "Config": {
-      "protocol" : "http"
-  },
-  "MeshGateway": {
-      "Mode": "local"
-  }
-}
-EOF
-    ,
-  ]
+  extends = "base"
 
   topology {
     cluster "dc1" {
@@ -155,39 +116,43 @@ EOF
       }
     }
   }
+
+  cluster_config "dc1" {
+    config_entries = [
+      <<EOF
+{
+  "Kind": "service-resolver",
+  "Name": "pong",
+  "Redirect": {
+      "Datacenter": "dc2"
+  }
+}
+EOF
+      ,
+      <<EOF
+{
+  "Kind": "proxy-defaults",
+  "Name": "global",
+  "Config": {
+      "protocol" : "http"
+  },
+  "MeshGateway": {
+      "Mode": "local"
+  }
+}
+EOF
+      ,
+    ]
+  }
 }
 
 config "wan-federation-via-mesh-gateways" {
-  consul_image = "consul-dev:latest"
-
-  security {
-    initial_master_token = "root"
-    encryption {
-      tls    = true
-      gossip = true
-    }
-  }
+  extends = "base"
 
   envoy {
     log_level = "info"
   }
 
-  config_entries = [
-    <<EOF
-  {
-    "Kind": "proxy-defaults",
-    "Name": "global",
-    "Config": {
-        "protocol": "http"
-    },
-    "MeshGateway": {
-        "Mode": "local"
-    }
-  }
-  EOF
-    ,
-  ]
-
   topology {
     network_shape = "islands"
     # network_shape = "dual"
@@ -206,4 +171,22 @@ config "wan-federation-via-mesh-gateways" {
       mesh_gateways = 1
     }
   }
+
+  cluster_config "dc1" {
+    config_entries = [
+      <<EOF
+  {
+    "Kind": "proxy-defaults",
+    "Name": "global",
+    "Config": {
+        "protocol": "http"
+    },
+    "MeshGateway": {
+        "Mode": "local"
+    }
+  }
+  EOF
+      ,
+    ]
+  }
 }
@@ -61,47 +61,41 @@ config "simple-peering" {
   }
 
   cluster_config "dc1" {
-    config_entries = [
-      <<EOF
-{
-  "Kind": "exported-services",
-  "Name": "default",
-  "Services": [
-    {
-      "Name": "ping",
-      "Consumers": [ { "PeerName": "peer-dc2" } ]
-    },
-    {
-      "Name": "pong",
-      "Consumers": [ { "PeerName": "peer-dc2" } ]
+    config_entry {
+      kind = "exported-services"
+      name = "default"
+      services {
+        name = "ping"
+        consumers {
+          peer_name = "peer-dc2"
+        }
+      }
+      services {
+        name = "pong"
+        consumers {
+          peer_name = "peer-dc2"
+        }
+      }
     }
-  ]
-}
-  EOF
-      ,
-    ]
   }
 
   cluster_config "dc2" {
-    config_entries = [
-      <<EOF
-{
-  "Kind": "exported-services",
-  "Name": "default",
-  "Services": [
-    {
-      "Name": "ping",
-      "Consumers": [ { "PeerName": "peer-dc1" } ]
-    },
-    {
-      "Name": "pong",
-      "Consumers": [ { "PeerName": "peer-dc1" } ]
+    config_entry {
+      kind = "exported-services"
+      name = "default"
+      services {
+        name = "ping"
+        consumers {
+          peer_name = "peer-dc1"
+        }
+      }
+      services {
+        name = "pong"
+        consumers {
+          peer_name = "peer-dc1"
+        }
+      }
     }
-  ]
-}
-  EOF
-      ,
-    ]
   }
 }
 
@@ -0,0 +1,158 @@
+package infra
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/rboyer/devconsul/config"
+)
+
+// addressPlan is the compiled form of config.Addressing.
+type addressPlan struct {
+	config.Addressing
+
+	lan    netip.Prefix
+	wan    netip.Prefix
+	shared netip.Prefix // the /24 holding the containers shared by all clusters
+}
+
+func compileAddressPlan(a config.Addressing, problems *config.Problems) *addressPlan {
+	if a == (config.Addressing{}) {
+		a = config.DefaultAddressing() // yay zero value!
+	}
+	plan := &addressPlan{Addressing: a}
+
+	var err error
+	if plan.lan, err = netip.ParsePrefix(a.LANSupernet); err != nil {
+		problems.Errorf(config.Path{"addressing", "lan_supernet"}, "addressing.lan_supernet is not a valid CIDR: %v", err)
+		return plan
+	}
+	if plan.wan, err = netip.ParsePrefix(a.WANSupernet); err != nil {
+		problems.Errorf(config.Path{"addressing", "wan_supernet"}, "addressing.wan_supernet is not a valid CIDR: %v", err)
+		return plan
+	}
+
+	var ok bool
+	if plan.shared, ok = nthSubnet(plan.lan, 24, a.SharedSubnet); !ok {
+		problems.Errorf(config.Path{"addressing", "shared_subnet"}, "addressing.shared_subnet %d does not fit in %s", a.SharedSubnet, plan.lan)
+	}
+	return plan
+}
+
+// clusterSubnets returns the LAN and WAN subnets for the cluster with the
+// given index.
+func (p *addressPlan) clusterSubnets(index int) (lan, wan netip.Prefix, ok bool) {
+	lan, lanOK := nthSubnet(p.lan, p.ClusterPrefix, index)
+	wan, wanOK := nthSubnet(p.wan, p.ClusterPrefix, index)
+	return lan, wan, lanOK && wanOK
+}
+
+// nthSubnet returns the n-th subnet of the given size in the supernet, or
+// false if there is no such subnet.
+func nthSubnet(supernet netip.Prefix, bits, n int) (netip.Prefix, bool) {
+	if !supernet.Addr().Is4() || bits < supernet.Bits() || bits > 32 {
+		return netip.Prefix{}, false
+	}
+	if n < 0 || n >= 1<<(bits-supernet.Bits()) {
+		return netip.Prefix{}, false
+	}
+	a4 := supernet.Masked().Addr().As4()
+	v := binary.BigEndian.Uint32(a4[:]) + uint32(n)<<(32-bits)
+	binary.BigEndian.PutUint32(a4[:], v)
+	return netip.PrefixFrom(netip.AddrFrom4(a4), bits), true
+}
+
+// hostIP returns the address at the given offset into the subnet.
+func hostIP(subnet netip.Prefix, offset int) string {
+	a4 := subnet.Addr().As4()
+	v := binary.BigEndian.Uint32(a4[:]) + uint32(offset)
+	binary.BigEndian.PutUint32(a4[:], v)
+	return netip.AddrFrom4(a4).String()
+}
+
+// checkCluster makes sure that every node in the cluster gets a distinct
+// address within its subnet.
+func (p *addressPlan) checkCluster(c *Cluster, at config.Path, problems *config.Problems) {
+	type hostRange struct {
+		role        string
+		first, last int
+	}
+	var (
+		maxOffset = 1<<(32-p.ClusterPrefix) - 2
+		ranges    = []hostRange{
+			{"servers", p.ServerOffset, p.ServerOffset + c.Servers - 1},
+			{"clients", p.ClientOffset, p.ClientOffset + c.Clients - 1},
+			{"infra", p.InfraOffset, p.InfraOffset},
+		}
+	)
+	for i, a := range ranges {
+		if a.last > maxOffset {
+			problems.Errorf(at, "%s: %s do not fit in a /%d starting at offset %d", c.Name, a.role, p.ClusterPrefix, a.first)
+			continue
+		}
+		for _, b := range ranges[i+1:] {
+			if a.first <= b.last && b.first <= a.last {
+				problems.Errorf(at, "%s: addresses for %s and %s overlap", c.Name, a.role, b.role)
+			}
+		}
+	}
+}
+
+var legacyClusterNamePatt = regexp.MustCompile(`^dc([0-9]+)$`)
+
+// assignClusterIndexes works out which subnet each cluster uses. An explicit
+// index wins, then the number in names like "dc2", and anything else gets the
+// lowest free index (in name order, so that the config can be reordered
+// without moving things around).
+func (p *addressPlan) assignClusterIndexes(clusters []*config.Cluster, problems *config.Problems) map[string]int {
+	var (
+		out     = make(map[string]int)
+		used    = make(map[int]string)
+		pending []string
+	)
+	for _, c := range clusters {
+		at := config.Path{"topology", "cluster", c.Name}
+
+		idx := c.Index
+		if idx == 0 {
+			m := legacyClusterNamePatt.FindStringSubmatch(c.Name)
+			if m == nil {
+				pending = append(pending, c.Name)
+				continue
+			}
+			var err error
+			if idx, err = strconv.Atoi(m[1]); err != nil {
+				problems.Errorf(at, "%s: not a valid cluster name", c.Name)
+				continue
+			}
+		} else {
+			at = append(at, "index")
+		}
+
+		if other, ok := used[idx]; ok {
+			problems.Errorf(at, "%s: index %d is already used by cluster %s", c.Name, idx, other)
+			continue
+		}
+		used[idx] = c.Name
+		out[c.Name] = idx
+	}
+
+	sort.Strings(pending)
+	next := 1
+	for _, name := range pending {
+		for {
+			_, taken := used[next]
+			lan, _, ok := p.clusterSubnets(next)
+			if !taken && (!ok || !lan.Overlaps(p.shared)) {
+				break
+			}
+			next++
+		}
+		used[next] = name
+		out[name] = next
+	}
+	return out
+}
@@ -2,7 +2,7 @@ package infra
 
 import (
 	"errors"
-	"fmt"
+	"net/netip"
 	"regexp"
 	"sort"
 	"strconv"
@@ -13,21 +13,53 @@ import (
 
 // CompileTopology creates a Topology based on the provided configuration.
 func CompileTopology(cfg *config.Config) (*Topology, error) {
+	topology, problems := CheckTopology(cfg, nil)
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+	return topology, nil
+}
+
+// CheckTopology is like CompileTopology, but rather than stopping at the first
+// problem it returns as many as it can find. Problems are attributed to the
+// relevant part of the config file using sources, which may be nil. The
+// returned topology is nil if any problems were found.
+func CheckTopology(cfg *config.Config, sources *config.SourceMap) (*Topology, *config.Problems) {
+	problems := &config.Problems{Sources: sources}
+	topology := compileTopology(cfg, problems)
+	if problems.HasErrors() {
+		return nil, problems
+	}
+	return topology, problems
+}
+
+// Cluster names end up in container names, hostnames, and datacenter names,
+// so they need to be safe in all of them. Network names end up in the names
+// of docker networks, so the same goes for them.
+var clusterNamePatt = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+func compileTopology(cfg *config.Config, problems *config.Problems) *Topology {
 	var (
-		topology         = &Topology{}
-		needsAllNetworks = false
+		topology             = &Topology{}
+		needsClusterNetworks = false
+		needsWANNetwork      = false
 	)
 	switch cfg.TopologyNetworkShape {
 	case "islands":
 		topology.NetworkShape = NetworkShapeIslands
-		needsAllNetworks = true
+		needsClusterNetworks = true
+		needsWANNetwork = true
 	case "dual":
 		topology.NetworkShape = NetworkShapeDual
-		needsAllNetworks = true
+		needsClusterNetworks = true
+		needsWANNetwork = true
+	case "custom":
+		topology.NetworkShape = NetworkShapeCustom
+		needsClusterNetworks = true
 	case "flat", "":
 		topology.NetworkShape = NetworkShapeFlat
 	default:
-		return nil, fmt.Errorf("unknown network_shape: %s", cfg.TopologyNetworkShape)
+		problems.Errorf(config.Path{"topology", "network_shape"}, "unknown network_shape: %s", cfg.TopologyNetworkShape)
 	}
 
 	switch cfg.TopologyNodeMode {
@@ -36,14 +68,14 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 	case string(NodeModeDataplane):
 		topology.NodeMode = NodeModeDataplane
 	default:
-		return nil, fmt.Errorf("unknown node_mode: %s", cfg.TopologyNodeMode)
+		problems.Errorf(config.Path{"topology", "node_mode"}, "unknown node_mode: %s", cfg.TopologyNodeMode)
 	}
 
 	for _, n := range cfg.TopologyNodes {
 		switch n.Mode {
 		case string(NodeModeAgent), string(NodeModeDataplane), "":
 		default:
-			return nil, fmt.Errorf("unknown node[%q].mode: %s", n.NodeName, n.Mode)
+			problems.Errorf(config.Path{"topology", "node", n.NodeName, "mode"}, "unknown node[%q].mode: %s", n.NodeName, n.Mode)
 		}
 	}
 
@@ -54,19 +86,34 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 	case string(ClusterLinkModeFederate):
 		topology.LinkMode = ClusterLinkModeFederate
 	default:
-		return nil, fmt.Errorf("unknown link_mode: %s", cfg.TopologyLinkMode)
+		problems.Errorf(config.Path{"topology", "link_mode"}, "unknown link_mode: %s", cfg.TopologyLinkMode)
+	}
+
+	if topology.LinkMode == ClusterLinkModePeer {
+		switch cfg.TopologyPeeringMode {
+		case string(PeeringModeHub), "":
+			topology.PeeringMode = PeeringModeHub
+		case string(PeeringModeMesh):
+			topology.PeeringMode = PeeringModeMesh
+		case string(PeeringModeExplicit):
+			topology.PeeringMode = PeeringModeExplicit
+		default:
+			problems.Errorf(config.Path{"topology", "peering_mode"}, "unknown peering_mode: %s", cfg.TopologyPeeringMode)
+		}
+	} else if cfg.TopologyPeeringMode != "" || len(cfg.TopologyPeerings) > 0 {
+		problems.Errorf(config.Path{"topology", "peering_mode"}, "peering_mode and peerings require link_mode=%q", ClusterLinkModePeer)
 	}
 
-	if topology.NetworkShape != NetworkShapeFlat && topology.LinkMode == ClusterLinkModePeer {
-		return nil, fmt.Errorf("network_shape=%q is incompatible with link_mode=%q", topology.NetworkShape, topology.LinkMode)
+	if problems.HasErrors() {
+		return nil // everything else depends on the above
 	}
 
 	if topology.NetworkShape == NetworkShapeIslands && !cfg.EncryptionTLS {
-		return nil, fmt.Errorf("network_shape=%q requires TLS to be enabled to function", topology.NetworkShape)
+		problems.Errorf(config.Path{"topology", "network_shape"}, "network_shape=%q requires TLS to be enabled to function", topology.NetworkShape)
 	}
 
 	if cfg.PrometheusEnabled && topology.NetworkShape != NetworkShapeFlat {
-		return nil, fmt.Errorf("enabling prometheus currently requires network_shape=flat")
+		problems.Errorf(config.Path{"monitor", "prometheus"}, "enabling prometheus currently requires network_shape=flat")
 	}
 
 	canaryConfigured, canaryNodes := cfg.CanaryInfo()
@@ -89,23 +136,52 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 		return nil
 	}
 
-	if needsAllNetworks {
+	plan := compileAddressPlan(cfg.Addressing, problems)
+	if problems.HasErrors() {
+		return nil // nothing can be addressed
+	}
+	clusterIndexes := plan.assignClusterIndexes(cfg.TopologyClusters, problems)
+
+	if needsWANNetwork {
 		topology.AddNetwork(&Network{
 			Name: "wan",
-			CIDR: "10.1.0.0/16",
+			CIDR: plan.wan.String(),
 		})
-	} else {
+	}
+	if !needsClusterNetworks {
 		topology.AddNetwork(&Network{
 			Name: "lan",
-			CIDR: "10.0.0.0/16",
+			CIDR: plan.lan.String(),
+		})
+	}
+	userNetworks := compileUserNetworks(cfg, plan, topology, problems)
+
+	topology.prometheusIP = hostIP(plan.shared, plan.PrometheusOffset)
+	topology.vaultIP = hostIP(plan.shared, plan.VaultOffset)
+
+	services := cfg.Services()
+	servicesByName := make(map[string]*config.Service)
+	for _, svc := range services {
+		servicesByName[svc.Name] = svc
+	}
+
+	externalServices := make(map[string][]*ExternalService) // cluster -> services
+	for _, svc := range cfg.TopologyExternalServices {
+		externalServices[svc.Cluster] = append(externalServices[svc.Cluster], &ExternalService{
+			ID:              util.NewIdentifier(svc.Name, "", ""),
+			Image:           svc.Image,
+			Command:         svc.Command,
+			Env:             svc.Env,
+			Port:            svc.Port,
+			HealthCheckPath: svc.Healthcheck,
 		})
 	}
 
-	forCluster := func(clusterName, baseIP, wanBaseIP string, servers, clients, meshGateways int) error {
+	forCluster := func(clusterName string, subnet, wanSubnet netip.Prefix, servers, clients, meshGateways, ingressGateways, terminatingGateways, readReplicas int, zones []string) {
 		for idx := 1; idx <= servers; idx++ {
 			id := strconv.Itoa(idx)
-			ip := baseIP + "." + strconv.Itoa(10+idx)
-			wanIP := wanBaseIP + "." + strconv.Itoa(10+idx)
+			ip := hostIP(subnet, plan.ServerOffset+idx-1)
+			wanIP := hostIP(wanSubnet, plan.ServerOffset+idx-1)
 
 			node := &Node{
 				Cluster:   clusterName,
@@ -119,11 +195,17 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 					},
 				},
 				Index: idx - 1,
+				// The read replicas come after all of the voters.
+				ReadReplica: idx > servers-readReplicas,
+			}
+			if len(zones) > 0 {
+				node.Zone = zones[(idx-1)%len(zones)]
 			}
 
 			if c := getNode(node.Name); c != nil {
-				if c.Mode != string(NodeModeAgent) {
-					return fmt.Errorf("a consul server cannot be agentless")
+				node.AgentExtraHCL = c.AgentExtraHCL
+				if c.Mode == string(NodeModeDataplane) {
+					problems.Errorf(config.Path{"topology", "node", node.Name, "mode"}, "a consul server cannot be agentless")
 				}
 			}
 
@@ -141,15 +223,13 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 					IPAddress: wanIP,
 				})
 			case NetworkShapeFlat:
-			default:
-				return fmt.Errorf("unknown shape: %s", topology.NetworkShape)
 			}
 			topology.AddNode(node)
 		}
 
 		{ // add special pod
 			const idx = 100
-			ip := baseIP + ".100"
+			ip := hostIP(subnet, plan.InfraOffset)
 
 			nodeName := clusterName + "-infra1"
 			node := &Node{
@@ -161,18 +241,27 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 					Network:   topology.NetworkShape.GetNetworkName(clusterName),
 					IPAddress: ip,
 				}},
-				Index: idx - 1,
+				Index:            idx - 1,
+				ExternalServices: externalServices[clusterName],
 			}
 			topology.AddNode(node)
 		}
 
-		numServiceClients := clients - meshGateways
+		// The gateways are the last clients: first the terminating gateways,
+		// then the ingress gateways, and then the mesh gateways.
+		var (
+			numServiceClients   = clients - meshGateways - ingressGateways - terminatingGateways
+			firstIngressGateway = numServiceClients + terminatingGateways + 1
+			firstMeshGateway    = firstIngressGateway + ingressGateways
+		)
 		for idx := 1; idx <= clients; idx++ {
-			isGatewayClient := (idx > numServiceClients)
+			isTerminatingGatewayClient := (idx > numServiceClients && idx < firstIngressGateway)
+			isIngressGatewayClient := (idx >= firstIngressGateway && idx < firstMeshGateway)
+			isGatewayClient := (idx >= firstMeshGateway)
 
 			id := strconv.Itoa(idx)
-			ip := baseIP + "." + strconv.Itoa(20+idx)
-			wanIP := wanBaseIP + "." + strconv.Itoa(20+idx)
+			ip := hostIP(subnet, plan.ClientOffset+idx-1)
+			wanIP := hostIP(wanSubnet, plan.ClientOffset+idx-1)
 
 			nodeName := clusterName + "-client" + id
 			node := &Node{
@@ -192,6 +281,7 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 			if c := getNode(nodeName); c != nil {
 				nodeConfig = *c
 			}
+			at := config.Path{"topology", "node", nodeName}
 
 			if topology.NodeMode == NodeModeDataplane {
 				node.Kind = NodeKindDataplane
@@ -219,17 +309,43 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 			}
 
 			node.Segment = nodeConfig.Segment
+			node.AgentExtraHCL = nodeConfig.AgentExtraHCL
 
-			if isGatewayClient {
-				node.MeshGateway = true
+			if node.Kind == NodeKindDataplane && nodeConfig.UpstreamExtraHCL != "" {
+				problems.Errorf(append(at, "upstream_extra_hcl"), "node[%q]: upstream_extra_hcl cannot be used on dataplane nodes; use upstream blocks instead", nodeName)
+			}
 
+			if isTerminatingGatewayClient || isIngressGatewayClient {
+				kind := "ingress"
+				if isTerminatingGatewayClient {
+					kind = "terminating"
+					node.TerminatingGateway = true
+				} else {
+					node.IngressGateway = true
+				}
+
+				if node.Kind != NodeKindClient {
+					problems.Errorf(at, "node[%q]: %s gateways must run with a consul agent", nodeName, kind)
+				}
+				if len(nodeConfig.Upstreams) > 0 {
+					problems.Errorf(append(at, "upstream"), "node[%q]: upstream blocks cannot be used on %s gateways", nodeName, kind)
+				}
 				if node.Partition != "default" {
-					return fmt.Errorf("mesh gateways can only be deployed in the default partition")
+					problems.Errorf(append(at, "partition"), "%s gateways can only be deployed in the default partition", kind)
+				}
+				if nodeConfig.UseDNSWANAddress {
+					problems.Errorf(append(at, "use_dns_wan_address"), "use_dns_wan_address only applies to mesh gateways")
+				}
+			} else if isGatewayClient {
+				node.MeshGateway = true
+
+				if len(nodeConfig.Upstreams) > 0 {
+					problems.Errorf(append(at, "upstream"), "node[%q]: upstream blocks cannot be used on mesh gateways", nodeName)
 				}
 
 				if nodeConfig.UseDNSWANAddress {
 					if topology.NetworkShape != NetworkShapeFlat {
-						return fmt.Errorf("use_dns_wan_address only applies to flat networking models")
+						problems.Errorf(append(at, "use_dns_wan_address"), "use_dns_wan_address only applies to flat networking models")
 					}
 					node.MeshGatewayUseDNSWANAddress = nodeConfig.UseDNSWANAddress
 				}
@@ -241,41 +357,20 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 						IPAddress: wanIP,
 					})
 				case NetworkShapeFlat:
-				default:
-					return fmt.Errorf("unknown shape: %s", topology.NetworkShape)
 				}
 			} else {
 				if nodeConfig.UseDNSWANAddress {
-					return fmt.Errorf("use_dns_wan_address only applies to mesh gateways")
+					problems.Errorf(append(at, "use_dns_wan_address"), "use_dns_wan_address only applies to mesh gateways")
 				}
 				if nodeConfig.UseBuiltinProxy {
 					node.UseBuiltinProxy = true
 				}
-				svc := Service{
-					Port:              8080,
-					UpstreamLocalPort: 9090,
-					UpstreamExtraHCL:  nodeConfig.UpstreamExtraHCL,
-					Meta:              nodeConfig.Meta(),
-				}
-				if idx%2 == 1 {
-					svc.ID = util.NewIdentifier(config.ServicePing, nodeConfig.ServiceNamespace, node.Partition)
-					svc.UpstreamID = util.NewIdentifier(config.ServicePong, nodeConfig.UpstreamNamespace, nodeConfig.UpstreamPartition)
-				} else {
-					svc.ID = util.NewIdentifier(config.ServicePong, nodeConfig.ServiceNamespace, node.Partition)
-					svc.UpstreamID = util.NewIdentifier(config.ServicePing, nodeConfig.UpstreamNamespace, nodeConfig.UpstreamPartition)
+				names := nodeConfig.ServiceNames()
+				if len(names) == 0 {
+					names = []string{services[(idx-1)%len(services)].Name}
 				}
 
-				if nodeConfig.UpstreamName != "" {
-					svc.UpstreamID.Name = nodeConfig.UpstreamName
-				}
-				if nodeConfig.UpstreamPeer != "" {
-					svc.UpstreamPeer = nodeConfig.UpstreamPeer
-				}
-				if nodeConfig.UpstreamDatacenter != "" {
-					svc.UpstreamDatacenter = nodeConfig.UpstreamDatacenter
-				}
-
-				node.Service = &svc
+				node.Services = compileNodeServices(nodeName, &nodeConfig, node.Partition, names, servicesByName, problems)
 			}
 
 			if canaryConfigured {
@@ -292,50 +387,65 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 			}
 			topology.AddNode(node)
 		}
-
-		return nil
 	}
 
 	if c := getCluster(config.PrimaryCluster); c == nil {
-		return nil, fmt.Errorf("primary cluster %q is missing from config", config.PrimaryCluster)
+		problems.Errorf(config.Path{"topology", "cluster"}, "primary cluster %q is missing from config", config.PrimaryCluster)
 	}
 
-	clusterNamePatt := regexp.MustCompile(`^dc([0-9]+)$`)
-
 	for _, c := range cfg.TopologyClusters {
+		at := config.Path{"topology", "cluster", c.Name}
 		if c.MeshGateways < 0 {
-			return nil, fmt.Errorf("%s: mesh gateways must be non-negative", c.Name)
+			problems.Errorf(append(at, "mesh_gateways"), "%s: mesh gateways must be non-negative", c.Name)
+			continue
+		}
+		if c.IngressGateways < 0 {
+			problems.Errorf(append(at, "ingress_gateways"), "%s: ingress gateways must be non-negative", c.Name)
+			continue
+		}
+		if c.TerminatingGateways < 0 {
+			problems.Errorf(append(at, "terminating_gateways"), "%s: terminating gateways must be non-negative", c.Name)
+			continue
 		}
-		c.Clients += c.MeshGateways // the gateways are just fancy clients
+		c.Clients += c.MeshGateways + c.IngressGateways + c.TerminatingGateways // the gateways are just fancy clients
 
 		if c.Servers <= 0 {
-			return nil, fmt.Errorf("%s: must always have at least one server", c.Name)
+			problems.Errorf(append(at, "servers"), "%s: must always have at least one server", c.Name)
 		}
 		if c.Clients <= 0 {
-			return nil, fmt.Errorf("%s: must always have at least one client", c.Name)
-		}
-		if c.Clients > 50 {
-			return nil, fmt.Errorf("%s: must always have no more than 50 clients", c.Name)
+			problems.Errorf(append(at, "clients"), "%s: must always have at least one client", c.Name)
 		}
 
-		m := clusterNamePatt.FindStringSubmatch(c.Name)
-		if m == nil {
-			return nil, fmt.Errorf("%s: not a valid cluster name", c.Name)
+		if !clusterNamePatt.MatchString(c.Name) {
+			problems.Errorf(at, "%s: not a valid cluster name; use lowercase letters, digits, and dashes", c.Name)
+			continue
+		}
+		if c.Name == "canary" {
+			problems.Errorf(at, "%s: not a valid cluster name; it is reserved for canary images", c.Name)
+			continue
 		}
-		i, err := strconv.Atoi(m[1])
-		if err != nil {
-			return nil, fmt.Errorf("%s: not a valid cluster name", c.Name)
+		i, ok := clusterIndexes[c.Name]
+		if !ok {
+			continue // already reported
 		}
 
 		thisCluster := &Cluster{
-			Name:         c.Name,
-			Index:        i,
-			Servers:      c.Servers,
-			Clients:      c.Clients,
-			MeshGateways: c.MeshGateways,
-			BaseIP:       fmt.Sprintf("10.0.%d", i),
-			WANBaseIP:    fmt.Sprintf("10.1.%d", i),
+			Name:                c.Name,
+			Index:               i,
+			Servers:             c.Servers + c.ReadReplicas, // read replicas are just servers that don't vote
+			Clients:             c.Clients,
+			MeshGateways:        c.MeshGateways,
+			IngressGateways:     c.IngressGateways,
+			TerminatingGateways: c.TerminatingGateways,
+			ReadReplicas:        c.ReadReplicas,
 		}
+
+		if thisCluster.Subnet, thisCluster.WANSubnet, ok = plan.clusterSubnets(i); !ok {
+			problems.Errorf(at, "%s: index %d does not fit in the addressing supernets", c.Name, i)
+		} else if thisCluster.Subnet.Overlaps(plan.shared) {
+			problems.Errorf(at, "%s: index %d collides with addressing.shared_subnet %d", c.Name, i, plan.SharedSubnet)
+		}
+		plan.checkCluster(thisCluster, at, problems)
 		if cfg.TopologyLinkMode == string(ClusterLinkModePeer) {
 			thisCluster.Primary = true
 		} else if c.Name == config.PrimaryCluster {
@@ -343,10 +453,10 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 		}
 		topology.clusters = append(topology.clusters, thisCluster)
 
-		if needsAllNetworks {
+		if needsClusterNetworks {
 			topology.AddNetwork(&Network{
 				Name: thisCluster.Name,
-				CIDR: thisCluster.BaseIP + ".0/24",
+				CIDR: thisCluster.Subnet.String(),
 			})
 		}
 	}
@@ -354,32 +464,377 @@ func CompileTopology(cfg *config.Config) (*Topology, error) {
 		return topology.clusters[i].Name < topology.clusters[j].Name
 	})
 
+	if topology.LinkMode == ClusterLinkModePeer {
+		topology.peerings = compilePeerings(topology, cfg.TopologyPeerings, problems)
+	}
+
+	if problems.HasErrors() {
+		return nil // the nodes cannot be laid out
+	}
+
 	for _, cluster := range topology.clusters {
-		err := forCluster(cluster.Name, cluster.BaseIP, cluster.WANBaseIP, cluster.Servers, cluster.Clients, cluster.MeshGateways)
-		if err != nil {
-			return nil, err
+		var zones []string
+		if c, ok := cfg.ClusterByName(cluster.Name); ok {
+			zones = c.RedundancyZones
 		}
+		forCluster(cluster.Name, cluster.Subnet, cluster.WANSubnet, cluster.Servers, cluster.Clients, cluster.MeshGateways, cluster.IngressGateways, cluster.TerminatingGateways, cluster.ReadReplicas, zones)
 	}
 
-	if err := checkForErrors(topology); err != nil {
-		return nil, err
+	attached := attachUserNetworks(cfg, topology, userNetworks, problems)
+	if attached && topology.NetworkShape == NetworkShapeCustom {
+		checkCustomShape(cfg, topology, problems)
 	}
 
-	return topology, nil
+	assignIngressListeners(topology)
+
+	if err := checkForErrors(topology, servicesByName); err != nil {
+		problems.Error(nil, err)
+	}
+	if topology.LinkMode == ClusterLinkModePeer {
+		checkPeeredUpstreams(topology, problems)
+	}
+	if topology.PeerThroughMeshGateways() {
+		checkPeeringGateways(topology, problems)
+	}
+
+	return topology
 }
 
-func checkForErrors(topology *Topology) error {
-	return topology.Walk(func(node *Node) error {
-		if node.Service == nil {
-			return nil
+// compilePeerings works out which pairs of clusters are peered for the
+// topology's peering mode. The clusters must already be sorted by name.
+func compilePeerings(topology *Topology, explicit [][]string, problems *config.Problems) []Peering {
+	at := config.Path{"topology", "peerings"}
+
+	if topology.PeeringMode != PeeringModeExplicit && len(explicit) > 0 {
+		problems.Errorf(at, "peerings can only be set when peering_mode=%q", PeeringModeExplicit)
+	}
+
+	var out []Peering
+	switch topology.PeeringMode {
+	case PeeringModeHub:
+		for _, c := range topology.clusters {
+			if c.Name != config.PrimaryCluster {
+				out = append(out, Peering{Acceptor: config.PrimaryCluster, Dialer: c.Name})
+			}
+		}
+	case PeeringModeMesh:
+		for i, a := range topology.clusters {
+			for _, b := range topology.clusters[i+1:] {
+				out = append(out, Peering{Acceptor: a.Name, Dialer: b.Name})
+			}
 		}
-		svc := node.Service
+	case PeeringModeExplicit:
+		if len(explicit) == 0 {
+			problems.Errorf(at, "peering_mode=%q requires at least one pair of clusters in peerings", PeeringModeExplicit)
+		}
+		clusters := make(map[string]struct{})
+		for _, c := range topology.clusters {
+			clusters[c.Name] = struct{}{}
+		}
+		seen := make(map[[2]string]struct{})
+		for _, pair := range explicit {
+			if len(pair) != 2 {
+				problems.Errorf(at, "peerings must be pairs of cluster names: %q", pair)
+				continue
+			}
+			p := Peering{Acceptor: pair[0], Dialer: pair[1]}
+			if p.Acceptor == p.Dialer {
+				problems.Errorf(at, "cluster %q cannot be peered with itself", p.Acceptor)
+				continue
+			}
+			known := true
+			for _, name := range pair {
+				if _, ok := clusters[name]; !ok {
+					problems.Errorf(at, "peerings refers to an undefined cluster %q", name)
+					known = false
+				}
+			}
+			if !known {
+				continue
+			}
+			key := [2]string{p.Acceptor, p.Dialer}
+			if key[0] > key[1] {
+				key[0], key[1] = key[1], key[0]
+			}
+			if _, ok := seen[key]; ok {
+				problems.Errorf(at, "clusters %q and %q are peered more than once", p.Acceptor, p.Dialer)
+				continue
+			}
+			seen[key] = struct{}{}
+			out = append(out, p)
+		}
+	}
+	return out
+}
 
-		switch svc.ID.Name {
-		case config.ServicePing, config.ServicePong:
-			return nil
-		default:
-			return errors.New("unexpected service: " + svc.ID.Name)
+// checkPeeringGateways makes sure that every peered cluster has a mesh
+// gateway in the default partition, since that is the only way for the
+// servers to reach each other in the non-flat shapes.
+func checkPeeringGateways(topology *Topology, problems *config.Problems) {
+	hasGateway := make(map[string]bool)
+	topology.WalkSilent(func(n *Node) {
+		if n.MeshGateway && n.Partition == "default" {
+			hasGateway[n.Cluster] = true
+		}
+	})
+	for _, c := range topology.Clusters() {
+		if len(topology.PeeredWith(c.Name)) > 0 && !hasGateway[c.Name] {
+			problems.Errorf(config.Path{"topology", "cluster", c.Name, "mesh_gateways"}, "%s: peering with network_shape=%q requires a mesh gateway in the default partition", c.Name, topology.NetworkShape)
 		}
+	}
+}
+
+// checkPeeredUpstreams makes sure that every upstream on a peer refers to a
+// cluster that the node's cluster is actually peered with.
+func checkPeeredUpstreams(topology *Topology, problems *config.Problems) {
+	topology.WalkSilent(func(node *Node) {
+		for _, svc := range node.Services {
+			for _, up := range svc.Upstreams {
+				if up.Peer == "" {
+					continue
+				}
+				ok := false
+				for _, other := range topology.PeeredWith(node.Cluster) {
+					if up.Peer == PeerName(other) {
+						ok = true
+						break
+					}
+				}
+				if !ok {
+					problems.Errorf(config.Path{"topology", "node", node.Name}, "node[%q] has an upstream %q on peer %q but cluster %q has no such peer", node.Name, up.ID.Name, up.Peer, node.Cluster)
+				}
+			}
+		}
+	})
+}
+
+// assignIngressListeners gives every ingress gateway a listener for each
+// service running in its cluster. The listener ports are the same on every
+// gateway, but each one is published on its own host port.
+func assignIngressListeners(topology *Topology) {
+	var (
+		services = make(map[string][]util.Identifier) // cluster -> services
+		seen     = make(map[string]map[util.Identifier]struct{})
+	)
+	topology.WalkSilent(func(n *Node) {
+		for _, svc := range n.Services {
+			if svc.ID.Namespace != "default" || svc.ID.Partition != "default" {
+				continue // the gateways live in the default namespace and partition
+			}
+			if seen[n.Cluster] == nil {
+				seen[n.Cluster] = make(map[util.Identifier]struct{})
+			}
+			if _, ok := seen[n.Cluster][svc.ID]; ok {
+				continue
+			}
+			seen[n.Cluster][svc.ID] = struct{}{}
+			services[n.Cluster] = append(services[n.Cluster], svc.ID)
+		}
+	})
+	for _, ids := range services {
+		sort.Slice(ids, func(i, j int) bool {
+			return ids[i].Name < ids[j].Name
+		})
+	}
+
+	nextHostPort := 21000
+	topology.WalkSilent(func(n *Node) {
+		if !n.IngressGateway {
+			return
+		}
+		for i, id := range services[n.Cluster] {
+			n.IngressListeners = append(n.IngressListeners, &IngressListener{
+				Service:  id,
+				Port:     8080 + i,
+				HostPort: nextHostPort,
+			})
+			nextHostPort++
+		}
+	})
+}
+
+// compileNodeServices builds the services that run on a single client node.
+// Each service gets its own sidecar, so the sidecar ports and the upstream
+// local bind ports are offset to avoid colliding within the shared pod.
+func compileNodeServices(
+	nodeName string,
+	nodeConfig *config.Node,
+	partition string,
+	names []string,
+	defs map[string]*config.Service,
+	problems *config.Problems,
+) []*Service {
+	var (
+		out       []*Service
+		seenNames = make(map[string]struct{})
+		seenPorts = make(map[int]string)
+	)
+	at := config.Path{"topology", "node", nodeName, "services"}
+	if nodeConfig.Service != "" {
+		at[len(at)-1] = "service"
+	}
+	for i, up := range nodeConfig.Upstreams {
+		if up.Service == "" {
+			continue
+		}
+		found := false
+		for _, name := range names {
+			if name == up.Service {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems.Errorf(config.Path{"topology", "node", nodeName, "upstream", strconv.Itoa(i), "service"},
+				"node[%q] upstream %q is for service %q which does not run on the node", nodeName, up.Name, up.Service)
+		}
+	}
+	for i, name := range names {
+		def, ok := defs[name]
+		if !ok {
+			problems.Errorf(at, "node[%q] is assigned an undefined service %q", nodeName, name)
+			continue
+		}
+		if _, ok := seenNames[name]; ok {
+			problems.Errorf(at, "node[%q] is assigned service %q more than once", nodeName, name)
+			continue
+		}
+		seenNames[name] = struct{}{}
+		if other, ok := seenPorts[def.Port]; ok {
+			problems.Errorf(at, "node[%q] has services %q and %q both listening on port %d", nodeName, other, name, def.Port)
+			continue
+		}
+		seenPorts[def.Port] = name
+
+		svc := &Service{
+			ID:                      util.NewIdentifier(def.Name, nodeConfig.ServiceNamespace, partition),
+			Image:                   def.Image,
+			Command:                 def.Command,
+			Env:                     def.Env,
+			Port:                    def.Port,
+			HealthCheckPath:         def.Healthcheck,
+			EnvoyAdminPort:          19000 + i,
+			EnvoyPublicListenerPort: 20000 + i,
+			EnvoyPrometheusPort:     9102 + i,
+			Meta:                    nodeConfig.Meta(),
+		}
+		for _, upName := range def.Upstreams {
+			svc.Upstreams = append(svc.Upstreams, &Upstream{
+				ID: util.NewIdentifier(upName, nodeConfig.UpstreamNamespace, nodeConfig.UpstreamPartition),
+			})
+		}
+
+		// The node-level upstream overrides only apply to the first upstream
+		// of the first service.
+		if i == 0 {
+			svc.UpstreamExtraHCL = nodeConfig.UpstreamExtraHCL
+
+			if len(svc.Upstreams) == 0 {
+				if nodeConfig.UpstreamName != "" {
+					svc.Upstreams = append(svc.Upstreams, &Upstream{
+						ID: util.NewIdentifier(nodeConfig.UpstreamName, nodeConfig.UpstreamNamespace, nodeConfig.UpstreamPartition),
+					})
+				} else if nodeConfig.UpstreamPeer != "" || nodeConfig.UpstreamDatacenter != "" || nodeConfig.UpstreamExtraHCL != "" {
+					problems.Errorf(config.Path{"topology", "node", nodeName}, "node[%q] configures an upstream but service %q has no upstreams", nodeName, def.Name)
+				}
+			}
+			if len(svc.Upstreams) > 0 {
+				up := svc.Upstreams[0]
+				if nodeConfig.UpstreamName != "" {
+					up.ID.Name = nodeConfig.UpstreamName
+				}
+				if nodeConfig.UpstreamPeer != "" {
+					up.Peer = nodeConfig.UpstreamPeer
+				}
+				if nodeConfig.UpstreamDatacenter != "" {
+					up.Datacenter = nodeConfig.UpstreamDatacenter
+				}
+			}
+		}
+
+		for _, upConfig := range nodeConfig.Upstreams {
+			if upConfig.Service == name || (upConfig.Service == "" && i == 0) {
+				addNodeUpstream(svc, nodeConfig, upConfig)
+			}
+		}
+
+		out = append(out, svc)
+	}
+
+	// Explicit local ports are honored first, then the rest are handed out
+	// in order around them.
+	usedPorts := make(map[int]struct{})
+	for _, svc := range out {
+		for _, up := range svc.Upstreams {
+			if up.LocalPort == 0 {
+				continue
+			}
+			if _, ok := usedPorts[up.LocalPort]; ok {
+				problems.Errorf(config.Path{"topology", "node", nodeName, "upstream"}, "node[%q] has more than one upstream on local port %d", nodeName, up.LocalPort)
+			}
+			usedPorts[up.LocalPort] = struct{}{}
+		}
+	}
+	nextUpstream := 9090
+	for _, svc := range out {
+		for _, up := range svc.Upstreams {
+			if up.LocalPort != 0 {
+				continue
+			}
+			for {
+				if _, ok := usedPorts[nextUpstream]; !ok {
+					break
+				}
+				nextUpstream++
+			}
+			up.LocalPort = nextUpstream
+			usedPorts[nextUpstream] = struct{}{}
+		}
+	}
+	return out
+}
+
+// addNodeUpstream adds an upstream block from the node config to svc. If the
+// service already has an upstream on the same destination it is replaced
+// instead.
+func addNodeUpstream(svc *Service, nodeConfig *config.Node, upConfig *config.Upstream) {
+	namespace := upConfig.Namespace
+	if namespace == "" {
+		namespace = nodeConfig.UpstreamNamespace
+	}
+	partition := upConfig.Partition
+	if partition == "" {
+		partition = nodeConfig.UpstreamPartition
+	}
+
+	up := &Upstream{
+		ID:              util.NewIdentifier(upConfig.Name, namespace, partition),
+		Peer:            upConfig.Peer,
+		Datacenter:      upConfig.Datacenter,
+		LocalPort:       upConfig.LocalPort,
+		MeshGatewayMode: upConfig.MeshGatewayMode,
+		Config:          upConfig.Config,
+	}
+	if upConfig.DestinationType == config.UpstreamTypePreparedQuery {
+		up.Type = config.UpstreamTypePreparedQuery
+	}
+
+	for i, existing := range svc.Upstreams {
+		if existing.Type == up.Type && existing.ID.Name == up.ID.Name {
+			svc.Upstreams[i] = up
+			return
+		}
+	}
+	svc.Upstreams = append(svc.Upstreams, up)
+}
+
+func checkForErrors(topology *Topology, services map[string]*config.Service) error {
+	return topology.Walk(func(node *Node) error {
+		for _, svc := range node.Services {
+			if _, ok := services[svc.ID.Name]; !ok {
+				return errors.New("unexpected service: " + svc.ID.Name)
+			}
+		}
+		return nil
 	})
 }
@@ -1,6 +1,10 @@
 package infra
 
 import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -32,6 +36,13 @@ func TestCompileTopology(t *testing.T) {
 			require.NoError(t, err)
 			require.NotNil(t, topo)
 			tc.expectFn(t, topo)
+
+			// Every compiled topology should survive a trip through JSON.
+			data, err := json.Marshal(topo)
+			require.NoError(t, err)
+			var decoded Topology
+			require.NoError(t, json.Unmarshal(data, &decoded))
+			require.Equal(t, topo, &decoded)
 		}
 	}
 
@@ -88,8 +99,8 @@ func TestCompileTopology(t *testing.T) {
 							Index:     1,
 							Servers:   1,
 							Clients:   2,
-							BaseIP:    "10.0.1",
-							WANBaseIP: "10.1.1",
+							Subnet:    netip.MustParsePrefix("10.0.1.0/24"),
+							WANSubnet: netip.MustParsePrefix("10.1.1.0/24"),
 						},
 					},
 					nm: map[string]*Node{
@@ -132,13 +143,19 @@ func TestCompileTopology(t *testing.T) {
 									IPAddress: "10.0.1.21",
 								},
 							},
-							Service: &Service{
-								ID:                util.NewIdentifier("ping", "", ""),
-								Port:              8080,
-								UpstreamID:        util.NewIdentifier("pong", "", ""),
-								UpstreamLocalPort: 9090,
-								Meta:              map[string]string{},
-							},
+							Services: []*Service{{
+								ID:              util.NewIdentifier("ping", "", ""),
+								Port:            8080,
+								HealthCheckPath: "/healthz",
+								Upstreams: []*Upstream{{
+									ID:        util.NewIdentifier("pong", "", ""),
+									LocalPort: 9090,
+								}},
+								Meta:                    map[string]string{},
+								EnvoyAdminPort:          19000,
+								EnvoyPublicListenerPort: 20000,
+								EnvoyPrometheusPort:     9102,
+							}},
 						},
 						"dc1-client2": {
 							Kind:      NodeKindDataplane,
@@ -152,16 +169,24 @@ func TestCompileTopology(t *testing.T) {
 									IPAddress: "10.0.1.22",
 								},
 							},
-							Service: &Service{
-								ID:                util.NewIdentifier("pong", "", ""),
-								Port:              8080,
-								UpstreamID:        util.NewIdentifier("ping", "", ""),
-								UpstreamLocalPort: 9090,
-								Meta:              map[string]string{},
-							},
+							Services: []*Service{{
+								ID:              util.NewIdentifier("pong", "", ""),
+								Port:            8080,
+								HealthCheckPath: "/healthz",
+								Upstreams: []*Upstream{{
+									ID:        util.NewIdentifier("ping", "", ""),
+									LocalPort: 9090,
+								}},
+								Meta:                    map[string]string{},
+								EnvoyAdminPort:          19000,
+								EnvoyPublicListenerPort: 20000,
+								EnvoyPrometheusPort:     9102,
+							}},
 						},
 					},
 					additionalPrimaryGateways: []string(nil),
+					prometheusIP:              "10.0.100.100",
+					vaultIP:                   "10.0.100.111",
 				}
 				require.Equal(t, expect, topo)
 
@@ -253,8 +278,8 @@ func TestCompileTopology(t *testing.T) {
 							Servers:      3,
 							Clients:      3,
 							MeshGateways: 1,
-							BaseIP:       "10.0.1",
-							WANBaseIP:    "10.1.1",
+							Subnet:       netip.MustParsePrefix("10.0.1.0/24"),
+							WANSubnet:    netip.MustParsePrefix("10.1.1.0/24"),
 						},
 						{
 							Name:         "dc2",
@@ -263,8 +288,8 @@ func TestCompileTopology(t *testing.T) {
 							Servers:      3,
 							Clients:      3,
 							MeshGateways: 1,
-							BaseIP:       "10.0.2",
-							WANBaseIP:    "10.1.2",
+							Subnet:       netip.MustParsePrefix("10.0.2.0/24"),
+							WANSubnet:    netip.MustParsePrefix("10.1.2.0/24"),
 						},
 					},
 					nm: map[string]*Node{
@@ -333,16 +358,22 @@ func TestCompileTopology(t *testing.T) {
 									IPAddress: "10.0.1.21",
 								},
 							},
-							Service: &Service{
-								ID:                util.NewIdentifier("ping", "", ""),
-								Port:              8080,
-								UpstreamID:        util.NewIdentifier("pong", "", ""),
-								UpstreamLocalPort: 9090,
+							Services: []*Service{{
+								ID:              util.NewIdentifier("ping", "", ""),
+								Port:            8080,
+								HealthCheckPath: "/healthz",
+								Upstreams: []*Upstream{{
+									ID:        util.NewIdentifier("pong", "", ""),
+									LocalPort: 9090,
+								}},
 								Meta: map[string]string{
 									"foo": "bar",
 									"RAB": "OOF",
 								},
-							},
+								EnvoyAdminPort:          19000,
+								EnvoyPublicListenerPort: 20000,
+								EnvoyPrometheusPort:     9102,
+							}},
 						},
 						"dc1-client2": {
 							Index:     1,
@@ -356,13 +387,19 @@ func TestCompileTopology(t *testing.T) {
 									IPAddress: "10.0.1.22",
 								},
 							},
-							Service: &Service{
-								ID:                util.NewIdentifier("pong", "", ""),
-								Port:              8080,
-								UpstreamID:        util.NewIdentifier("ping", "", ""),
-								UpstreamLocalPort: 9090,
-								Meta:              map[string]string{},
-							},
+							Services: []*Service{{
+								ID:              util.NewIdentifier("pong", "", ""),
+								Port:            8080,
+								HealthCheckPath: "/healthz",
+								Upstreams: []*Upstream{{
+									ID:        util.NewIdentifier("ping", "", ""),
+									LocalPort: 9090,
+								}},
+								Meta:                    map[string]string{},
+								EnvoyAdminPort:          19000,
+								EnvoyPublicListenerPort: 20000,
+								EnvoyPrometheusPort:     9102,
+							}},
 						},
 						"dc1-client3": {
 							Index:     2,
@@ -459,13 +496,19 @@ func TestCompileTopology(t *testing.T) {
 									IPAddress: "10.0.2.21",
 								},
 							},
-							Service: &Service{
-								ID:                util.NewIdentifier("ping", "", ""),
-								Port:              8080,
-								UpstreamID:        util.NewIdentifier("pong", "", ""),
-								UpstreamLocalPort: 9090,
-								Meta:              map[string]string{},
-							},
+							Services: []*Service{{
+								ID:              util.NewIdentifier("ping", "", ""),
+								Port:            8080,
+								HealthCheckPath: "/healthz",
+								Upstreams: []*Upstream{{
+									ID:        util.NewIdentifier("pong", "", ""),
+									LocalPort: 9090,
+								}},
+								Meta:                    map[string]string{},
+								EnvoyAdminPort:          19000,
+								EnvoyPublicListenerPort: 20000,
+								EnvoyPrometheusPort:     9102,
+							}},
 						},
 						"dc2-client2": {
 							Index:     1,
@@ -479,17 +522,23 @@ func TestCompileTopology(t *testing.T) {
 									IPAddress: "10.0.2.22",
 								},
 							},
-							Service: &Service{
-								ID:                 util.NewIdentifier("pong", "", ""),
-								Port:               8080,
-								UpstreamID:         util.NewIdentifier("blah", "", "also-fake"),
-								UpstreamDatacenter: "fake",
-								UpstreamExtraHCL:   "// not real",
-								UpstreamLocalPort:  9090,
+							Services: []*Service{{
+								ID:              util.NewIdentifier("pong", "", ""),
+								Port:            8080,
+								HealthCheckPath: "/healthz",
+								Upstreams: []*Upstream{{
+									ID:         util.NewIdentifier("blah", "", "also-fake"),
+									Datacenter: "fake",
+									LocalPort:  9090,
+								}},
+								UpstreamExtraHCL: "// not real",
 								Meta: map[string]string{
 									"AAA": "BBB",
 								},
-							},
+								EnvoyAdminPort:          19000,
+								EnvoyPublicListenerPort: 20000,
+								EnvoyPrometheusPort:     9102,
+							}},
 							UseBuiltinProxy: true,
 							Canary:          true,
 						},
@@ -513,6 +562,8 @@ func TestCompileTopology(t *testing.T) {
 						},
 					},
 					additionalPrimaryGateways: []string(nil),
+					prometheusIP:              "10.0.100.100",
+					vaultIP:                   "10.0.100.111",
 				}
 				require.Equal(t, expect, topo)
 
@@ -537,6 +588,704 @@ func TestCompileTopology(t *testing.T) {
 				require.Equal(t, "dc2-client2", node2.Name)
 			},
 		},
+		"custom-services": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{
+						Name:    "dc1",
+						Servers: 1,
+						Clients: 3,
+					},
+				},
+				TopologyServices: []*config.Service{
+					{
+						Name:        "web",
+						Port:        8080,
+						Upstreams:   []string{"api", "db"},
+						Healthcheck: "/healthz",
+					},
+					{
+						Name:    "api",
+						Image:   "example/api:1.0",
+						Port:    9000,
+						Env:     map[string]string{"FOO": "bar"},
+						Command: []string{"serve"},
+					},
+					{
+						Name:  "db",
+						Image: "example/db:1.0",
+						Port:  5432,
+					},
+				},
+				TopologyNodes: []*config.Node{
+					{
+						NodeName:     "dc1-client3",
+						Services:     []string{"web", "api"},
+						UpstreamPeer: "peer1",
+					},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				require.Equal(t, []*Service{{
+					ID:              util.NewIdentifier("web", "", ""),
+					Port:            8080,
+					HealthCheckPath: "/healthz",
+					Upstreams: []*Upstream{
+						{
+							ID:        util.NewIdentifier("api", "", ""),
+							LocalPort: 9090,
+						},
+						{
+							ID:        util.NewIdentifier("db", "", ""),
+							LocalPort: 9091,
+						},
+					},
+					Meta:                    map[string]string{},
+					EnvoyAdminPort:          19000,
+					EnvoyPublicListenerPort: 20000,
+					EnvoyPrometheusPort:     9102,
+				}}, topo.Node("dc1-client1").Services)
+
+				require.Equal(t, []*Service{{
+					ID:                      util.NewIdentifier("api", "", ""),
+					Image:                   "example/api:1.0",
+					Command:                 []string{"serve"},
+					Env:                     map[string]string{"FOO": "bar"},
+					Port:                    9000,
+					Meta:                    map[string]string{},
+					EnvoyAdminPort:          19000,
+					EnvoyPublicListenerPort: 20000,
+					EnvoyPrometheusPort:     9102,
+				}}, topo.Node("dc1-client2").Services)
+
+				svcs := topo.Node("dc1-client3").Services
+				require.Len(t, svcs, 2)
+
+				web := svcs[0]
+				require.Equal(t, "web", web.ID.Name)
+				require.Len(t, web.Upstreams, 2)
+				require.Equal(t, "peer1", web.Upstreams[0].Peer)
+				require.Equal(t, 9090, web.Upstreams[0].LocalPort)
+				require.Empty(t, web.Upstreams[1].Peer)
+				require.Equal(t, 9091, web.Upstreams[1].LocalPort)
+				require.Equal(t, 19000, web.EnvoyAdminPort)
+
+				api := svcs[1]
+				require.Equal(t, "api", api.ID.Name)
+				require.Empty(t, api.Upstreams)
+				require.Equal(t, 19001, api.EnvoyAdminPort)
+				require.Equal(t, 20001, api.EnvoyPublicListenerPort)
+				require.Equal(t, 9103, api.EnvoyPrometheusPort)
+			},
+		},
+		"undefined-node-service": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{
+						Name:    "dc1",
+						Servers: 1,
+						Clients: 1,
+					},
+				},
+				TopologyNodes: []*config.Node{
+					{
+						NodeName: "dc1-client1",
+						Service:  "web",
+					},
+				},
+			},
+			expectExactErr: `node["dc1-client1"] is assigned an undefined service "web"`,
+		},
+		"node-service-port-collision": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{
+						Name:    "dc1",
+						Servers: 1,
+						Clients: 1,
+					},
+				},
+				TopologyNodes: []*config.Node{
+					{
+						NodeName: "dc1-client1",
+						Services: []string{"ping", "pong"},
+					},
+				},
+			},
+			expectExactErr: `node["dc1-client1"] has services "ping" and "pong" both listening on port 8080`,
+		},
+		"custom-addressing": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				Addressing: config.Addressing{
+					LANSupernet:      "172.30.0.0/16",
+					WANSupernet:      "172.31.0.0/16",
+					ClusterPrefix:    24,
+					ServerOffset:     5,
+					ClientOffset:     50,
+					InfraOffset:      200,
+					SharedSubnet:     250,
+					PrometheusOffset: 10,
+					VaultOffset:      11,
+				},
+				TopologyClusters: []*config.Cluster{
+					{
+						Name:    "dc1",
+						Servers: 2,
+						Clients: 1,
+					},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				require.Equal(t, []*Network{{Name: "lan", CIDR: "172.30.0.0/16"}}, topo.Networks())
+				require.Equal(t, []string{"172.30.1.5", "172.30.1.6"}, topo.ServerIPs("dc1"))
+				require.Equal(t, "172.30.1.50", topo.Node("dc1-client1").LocalAddress())
+				require.Equal(t, "172.30.1.200", topo.Node("dc1-infra1").LocalAddress())
+				require.Equal(t, "172.30.250.10", topo.PrometheusIP())
+				require.Equal(t, "172.30.250.11", topo.VaultIP())
+			},
+		},
+		"addressing-overlap": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				Addressing: func() config.Addressing {
+					a := config.DefaultAddressing()
+					a.ClientOffset = 12
+					return a
+				}(),
+				TopologyClusters: []*config.Cluster{
+					{
+						Name:    "dc1",
+						Servers: 3,
+						Clients: 1,
+					},
+				},
+			},
+			expectExactErr: "dc1: addresses for servers and clients overlap",
+		},
+		"named-clusters": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "peer",
+				TopologyNodeMode:     "agent",
+				Addressing: func() config.Addressing {
+					a := config.DefaultAddressing()
+					a.ClusterPrefix = 22
+					a.InfraOffset = 1000
+					return a
+				}(),
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1},
+					{Name: "us-west", Servers: 1, Clients: 1},
+					{Name: "us-east", Servers: 1, Clients: 200},
+					{Name: "eu", Servers: 1, Clients: 1, Index: 3},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				subnets := make(map[string]string)
+				for _, c := range topo.Clusters() {
+					subnets[c.Name] = c.Subnet.String()
+				}
+				require.Equal(t, map[string]string{
+					"dc1":     "10.0.4.0/22",
+					"eu":      "10.0.12.0/22",
+					"us-east": "10.0.8.0/22",
+					"us-west": "10.0.16.0/22",
+				}, subnets)
+
+				require.Equal(t, "10.0.8.220", topo.Node("us-east-client200").LocalAddress())
+				require.Equal(t, "10.0.11.232", topo.Node("us-east-infra1").LocalAddress())
+			},
+		},
+		"duplicate-cluster-index": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "peer",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1},
+					{Name: "west", Servers: 1, Clients: 1, Index: 1},
+				},
+			},
+			expectExactErr: "west: index 1 is already used by cluster dc1",
+		},
+		"node-upstream-blocks": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{
+						Name:    "dc1",
+						Servers: 1,
+						Clients: 1,
+					},
+				},
+				TopologyNodes: []*config.Node{
+					{
+						NodeName: "dc1-client1",
+						Services: []string{"ping"},
+						Upstreams: []*config.Upstream{
+							{
+								DestinationType: config.UpstreamTypePreparedQuery,
+								Name:            "pong-query",
+								LocalPort:       9090,
+							},
+							{
+								DestinationType: config.UpstreamTypeService,
+								Name:            "pong",
+								MeshGatewayMode: "local",
+								Config:          map[string]string{"protocol": "grpc"},
+							},
+						},
+					},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				svcs := topo.Node("dc1-client1").Services
+				require.Len(t, svcs, 1)
+				require.Equal(t, []*Upstream{
+					{
+						ID:              util.NewIdentifier("pong", "", ""),
+						LocalPort:       9091,
+						MeshGatewayMode: "local",
+						Config:          map[string]string{"protocol": "grpc"},
+					},
+					{
+						ID:        util.NewIdentifier("pong-query", "", ""),
+						Type:      config.UpstreamTypePreparedQuery,
+						LocalPort: 9090,
+					},
+				}, svcs[0].Upstreams)
+			},
+		},
+		"node-upstream-unknown-service": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{
+						Name:    "dc1",
+						Servers: 1,
+						Clients: 1,
+					},
+				},
+				TopologyNodes: []*config.Node{
+					{
+						NodeName: "dc1-client1",
+						Upstreams: []*config.Upstream{
+							{
+								Service:         "pong",
+								DestinationType: config.UpstreamTypeService,
+								Name:            "ping",
+							},
+						},
+					},
+				},
+			},
+			expectExactErr: `node["dc1-client1"] upstream "ping" is for service "pong" which does not run on the node`,
+		},
+		"dataplane-upstream-extra-hcl": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "dataplane",
+				TopologyClusters: []*config.Cluster{
+					{
+						Name:    "dc1",
+						Servers: 1,
+						Clients: 1,
+					},
+				},
+				TopologyNodes: []*config.Node{
+					{
+						NodeName:         "dc1-client1",
+						UpstreamExtraHCL: "// not real",
+					},
+				},
+			},
+			expectExactErr: `node["dc1-client1"]: upstream_extra_hcl cannot be used on dataplane nodes; use upstream blocks instead`,
+		},
+		"ingress-gateways": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 2, IngressGateways: 2},
+					{Name: "dc2", Servers: 1, Clients: 2, IngressGateways: 1},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				require.Equal(t, 4, topo.Cluster("dc1").Clients)
+
+				var gateways []string
+				topo.WalkSilent(func(n *Node) {
+					if n.IngressGateway {
+						gateways = append(gateways, n.Name)
+						require.Empty(t, n.Services)
+					}
+				})
+				require.Equal(t, []string{"dc1-client3", "dc1-client4", "dc2-client3"}, gateways)
+
+				ping := util.NewIdentifier("ping", "", "")
+				pong := util.NewIdentifier("pong", "", "")
+				require.Equal(t, []*IngressListener{
+					{Service: ping, Port: 8080, HostPort: 21000},
+					{Service: pong, Port: 8081, HostPort: 21001},
+				}, topo.Node("dc1-client3").IngressListeners)
+				require.Equal(t, []*IngressListener{
+					{Service: ping, Port: 8080, HostPort: 21002},
+					{Service: pong, Port: 8081, HostPort: 21003},
+				}, topo.Node("dc1-client4").IngressListeners)
+				require.Equal(t, []*IngressListener{
+					{Service: ping, Port: 8080, HostPort: 21004},
+					{Service: pong, Port: 8081, HostPort: 21005},
+				}, topo.Node("dc2-client3").IngressListeners)
+			},
+		},
+		"partitioned-ingress-gateway": {
+			cfg: &config.Config{
+				EnterpriseEnabled:    true,
+				EnterprisePartitions: []*config.Partition{{Name: "ap1"}},
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1, IngressGateways: 1},
+				},
+				TopologyNodes: []*config.Node{
+					{NodeName: "dc1-client2", Partition: "ap1"},
+				},
+			},
+			expectExactErr: `ingress gateways can only be deployed in the default partition`,
+		},
+		"terminating-gateways": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 2, TerminatingGateways: 1, IngressGateways: 1, MeshGateways: 1},
+				},
+				TopologyExternalServices: []*config.ExternalService{
+					{Name: "legacy", Cluster: "dc1", Image: "example/legacy", Port: 9999, Healthcheck: "/"},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				require.True(t, topo.Node("dc1-client3").TerminatingGateway)
+				require.True(t, topo.Node("dc1-client4").IngressGateway)
+				require.True(t, topo.Node("dc1-client5").MeshGateway)
+
+				legacy := &ExternalService{
+					ID:              util.NewIdentifier("legacy", "", ""),
+					Image:           "example/legacy",
+					Port:            9999,
+					HealthCheckPath: "/",
+				}
+				require.Equal(t, []*ExternalService{legacy}, topo.Node("dc1-infra1").ExternalServices)
+				require.Equal(t, []*ExternalService{legacy}, topo.ExternalServices("dc1"))
+			},
+		},
+		"partitioned-dataplane-mesh-gateways": {
+			cfg: &config.Config{
+				EnterpriseEnabled:    true,
+				EnterprisePartitions: []*config.Partition{{Name: "ap1"}},
+				TopologyNetworkShape: "dual",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 2, MeshGateways: 2},
+				},
+				TopologyNodes: []*config.Node{
+					{NodeName: "dc1-client3", Mode: "dataplane"},
+					{NodeName: "dc1-client4", Partition: "ap1"},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				gw1 := topo.Node("dc1-client3")
+				require.True(t, gw1.MeshGateway)
+				require.Equal(t, NodeKindDataplane, gw1.Kind)
+				require.Equal(t, "default", gw1.Partition)
+
+				gw2 := topo.Node("dc1-client4")
+				require.True(t, gw2.MeshGateway)
+				require.Equal(t, NodeKindClient, gw2.Kind)
+				require.Equal(t, "ap1", gw2.Partition)
+
+				// Only the default partition takes part in federation.
+				require.Equal(t, []string{"10.1.1.23:8443"}, topo.GatewayAddrs("dc1"))
+			},
+		},
+		"ingress-gateway-upstreams": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 2, IngressGateways: 1},
+				},
+				TopologyNodes: []*config.Node{
+					{
+						NodeName: "dc1-client3",
+						Upstreams: []*config.Upstream{
+							{DestinationType: config.UpstreamTypeService, Name: "ping"},
+						},
+					},
+				},
+			},
+			expectExactErr: `node["dc1-client3"]: upstream blocks cannot be used on ingress gateways`,
+		},
+		"peering-hub": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "peer",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1},
+					{Name: "dc2", Servers: 1, Clients: 1},
+					{Name: "dc3", Servers: 1, Clients: 1},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				require.Equal(t, PeeringModeHub, topo.PeeringMode)
+				require.Equal(t, []Peering{
+					{Acceptor: "dc1", Dialer: "dc2"},
+					{Acceptor: "dc1", Dialer: "dc3"},
+				}, topo.Peerings())
+				require.Equal(t, []string{"dc1"}, topo.PeeredWith("dc3"))
+				require.False(t, topo.ArePeered("dc2", "dc3"))
+			},
+		},
+		"read-replicas-and-zones": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 3, ReadReplicas: 2, Clients: 1, RedundancyZones: []string{"zone-a", "zone-b"}},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				dc1 := topo.Cluster("dc1")
+				require.Equal(t, 5, dc1.Servers)
+				require.Equal(t, 2, dc1.ReadReplicas)
+				require.Equal(t, 3, dc1.Voters())
+				require.Len(t, topo.ServerIPs("dc1"), 5)
+
+				type server struct {
+					replica bool
+					zone    string
+					ip      string
+				}
+				var got []server
+				for _, n := range topo.Nodes() {
+					if n.IsServer() {
+						got = append(got, server{n.ReadReplica, n.Zone, n.LocalAddress()})
+					} else {
+						require.False(t, n.ReadReplica)
+						require.Empty(t, n.Zone)
+					}
+				}
+				require.Equal(t, []server{
+					{false, "zone-a", "10.0.1.11"},
+					{false, "zone-b", "10.0.1.12"},
+					{false, "zone-a", "10.0.1.13"},
+					{true, "zone-b", "10.0.1.14"},
+					{true, "zone-a", "10.0.1.15"},
+				}, got)
+			},
+		},
+		"peering-mesh": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "peer",
+				TopologyPeeringMode:  "mesh",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1},
+					{Name: "dc2", Servers: 1, Clients: 1},
+					{Name: "dc3", Servers: 1, Clients: 1},
+				},
+				TopologyNodes: []*config.Node{
+					{NodeName: "dc2-client1", UpstreamPeer: "peer-dc3"},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				require.Equal(t, []Peering{
+					{Acceptor: "dc1", Dialer: "dc2"},
+					{Acceptor: "dc1", Dialer: "dc3"},
+					{Acceptor: "dc2", Dialer: "dc3"},
+				}, topo.Peerings())
+				require.Equal(t, []string{"dc1", "dc2"}, topo.PeeredWith("dc3"))
+				require.True(t, topo.ArePeered("dc3", "dc2"))
+
+				require.Equal(t, []PeeredUpstream{{
+					Service:    util.NewIdentifier("pong", "", ""),
+					Downstream: util.NewIdentifier("ping", "", ""),
+					Peer:       "peer-dc2",
+				}}, topo.PeeredUpstreams("dc3"))
+				require.Empty(t, topo.PeeredUpstreams("dc1"))
+				require.Empty(t, topo.PeeredUpstreams("dc2"))
+			},
+		},
+		"peering-explicit": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "peer",
+				TopologyPeeringMode:  "explicit",
+				TopologyPeerings:     [][]string{{"dc3", "dc2"}},
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1},
+					{Name: "dc2", Servers: 1, Clients: 1},
+					{Name: "dc3", Servers: 1, Clients: 1},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				require.Equal(t, []Peering{
+					{Acceptor: "dc3", Dialer: "dc2"},
+				}, topo.Peerings())
+				require.Empty(t, topo.PeeredWith("dc1"))
+				require.Equal(t, []string{"dc3"}, topo.PeeredWith("dc2"))
+			},
+		},
+		"peering-upstream-not-peered": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "peer",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1},
+					{Name: "dc2", Servers: 1, Clients: 1},
+					{Name: "dc3", Servers: 1, Clients: 1},
+				},
+				TopologyNodes: []*config.Node{
+					{NodeName: "dc2-client1", UpstreamPeer: "peer-dc3"},
+				},
+			},
+			expectExactErr: `node["dc2-client1"] has an upstream "pong" on peer "peer-dc3" but cluster "dc2" has no such peer`,
+		},
+		"peering-islands": {
+			cfg: &config.Config{
+				EncryptionTLS:        true,
+				TopologyNetworkShape: "islands",
+				TopologyLinkMode:     "peer",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1, MeshGateways: 1},
+					{Name: "dc2", Servers: 1, Clients: 1, MeshGateways: 1},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				require.True(t, topo.PeerThroughMeshGateways())
+				require.Equal(t, []string{"10.1.1.22:8443"}, topo.GatewayAddrs("dc1"))
+				require.Equal(t, []string{"10.1.2.22:8443"}, topo.GatewayAddrs("dc2"))
+			},
+		},
+		"peering-islands-without-gateways": {
+			cfg: &config.Config{
+				EncryptionTLS:        true,
+				TopologyNetworkShape: "islands",
+				TopologyLinkMode:     "peer",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1, MeshGateways: 1},
+					{Name: "dc2", Servers: 1, Clients: 1},
+				},
+			},
+			expectExactErr: `dc2: peering with network_shape="islands" requires a mesh gateway in the default partition`,
+		},
+		"custom-networks": {
+			cfg: &config.Config{
+				EncryptionTLS:        true,
+				TopologyNetworkShape: "custom",
+				TopologyLinkMode:     "federate",
+				TopologyNodeMode:     "agent",
+				TopologyNetworks: []*config.Network{
+					{Name: "dmz", CIDR: "192.168.10.0/24"},
+					{Name: "transit", CIDR: "192.168.20.0/24", WAN: true},
+				},
+				TopologyClusters: []*config.Cluster{
+					{
+						Name: "dc1", Servers: 1, Clients: 1, MeshGateways: 1,
+						Attach: map[string][]string{
+							"servers":       {"dmz"},
+							"mesh_gateways": {"dmz", "transit"},
+						},
+					},
+					{
+						Name: "dc2", Servers: 1, Clients: 1, MeshGateways: 1,
+						Attach: map[string][]string{
+							"mesh_gateways": {"transit"},
+						},
+					},
+				},
+				TopologyNodes: []*config.Node{
+					{NodeName: "dc1-client1", Attach: []string{"dmz"}},
+				},
+			},
+			expectFn: func(t *testing.T, topo *Topology) {
+				var networks []string
+				for _, n := range topo.Networks() {
+					networks = append(networks, n.Name+"="+n.CIDR)
+				}
+				require.Equal(t, []string{
+					"dc1=10.0.1.0/24",
+					"dc2=10.0.2.0/24",
+					"dmz=192.168.10.0/24",
+					"transit=192.168.20.0/24",
+				}, networks)
+
+				require.Equal(t, []Address{
+					{Network: "dc1", IPAddress: "10.0.1.21"},
+					{Network: "dmz", IPAddress: "192.168.10.11"},
+				}, topo.Node("dc1-client1").Addresses)
+				require.Equal(t, []Address{
+					{Network: "dc1", IPAddress: "10.0.1.22"},
+					{Network: "dmz", IPAddress: "192.168.10.12"},
+					{Network: "transit", IPAddress: "192.168.20.10", Public: true},
+				}, topo.Node("dc1-client2").Addresses)
+				require.Equal(t, []Address{
+					{Network: "dc1", IPAddress: "10.0.1.11"},
+					{Network: "dmz", IPAddress: "192.168.10.10"},
+				}, topo.Node("dc1-server1").Addresses)
+				require.Equal(t, []Address{
+					{Network: "dc2", IPAddress: "10.0.2.22"},
+					{Network: "transit", IPAddress: "192.168.20.11", Public: true},
+				}, topo.Node("dc2-client2").Addresses)
+
+				require.True(t, topo.FederateWithGateways())
+				require.False(t, topo.Node("dc1-server1").HasPublicAddress())
+				require.Equal(t, []string{"192.168.20.10:8443"}, topo.GatewayAddrs("dc1"))
+			},
+		},
+		"peering-mode-without-peering": {
+			cfg: &config.Config{
+				TopologyNetworkShape: "flat",
+				TopologyLinkMode:     "federate",
+				TopologyPeeringMode:  "mesh",
+				TopologyNodeMode:     "agent",
+				TopologyClusters: []*config.Cluster{
+					{Name: "dc1", Servers: 1, Clients: 1},
+				},
+			},
+			expectExactErr: `peering_mode and peerings require link_mode="peer"`,
+		},
 	}
 
 	for name, tc := range cases {
@@ -546,3 +1295,160 @@ func TestCompileTopology(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckTopology(t *testing.T) {
+	cfg := &config.Config{
+		TopologyNetworkShape: "flat",
+		TopologyLinkMode:     "federate",
+		TopologyNodeMode:     "agent",
+		TopologyClusters: []*config.Cluster{
+			{Name: "dc1", Servers: 0, Clients: 1},
+			{Name: "dc2", Servers: 1, Clients: 90},
+			{Name: "East", Servers: 1, Clients: 1},
+		},
+	}
+
+	topo, problems := CheckTopology(cfg, nil)
+	require.Nil(t, topo)
+
+	var got []string
+	for _, diag := range problems.Diagnostics {
+		got = append(got, diag.Summary)
+	}
+	require.Equal(t, []string{
+		"dc1: must always have at least one server",
+		"dc2: addresses for clients and infra overlap",
+		"East: not a valid cluster name; use lowercase letters, digits, and dashes",
+	}, got)
+}
+
+func TestCheckTopology_UserNetworks(t *testing.T) {
+	summaries := func(cfg *config.Config) []string {
+		topo, problems := CheckTopology(cfg, nil)
+		require.Nil(t, topo)
+
+		var got []string
+		for _, diag := range problems.Diagnostics {
+			got = append(got, diag.Summary)
+		}
+		return got
+	}
+
+	require.Equal(t, []string{
+		`network["wan"]: name is already used by a built-in network`,
+		`network["inner"].cidr 192.168.10.128/25 overlaps network["dmz"]`,
+		`network["lan2"].cidr 10.0.50.0/24 overlaps the addressing supernets`,
+	}, summaries(&config.Config{
+		TopologyNetworkShape: "flat",
+		TopologyLinkMode:     "federate",
+		TopologyNodeMode:     "agent",
+		TopologyNetworks: []*config.Network{
+			{Name: "dmz", CIDR: "192.168.10.0/24"},
+			{Name: "wan", CIDR: "192.168.20.0/24"},
+			{Name: "inner", CIDR: "192.168.10.128/25"},
+			{Name: "lan2", CIDR: "10.0.50.0/24"},
+		},
+		TopologyClusters: []*config.Cluster{
+			{Name: "dc1", Servers: 1, Clients: 1},
+		},
+	}))
+
+	require.Equal(t, []string{
+		`dc1: unknown role "proxies" in attach`,
+		`attach refers to an undefined network "nowhere"`,
+	}, summaries(&config.Config{
+		EncryptionTLS:        true,
+		TopologyNetworkShape: "custom",
+		TopologyLinkMode:     "federate",
+		TopologyNodeMode:     "agent",
+		TopologyNetworks: []*config.Network{
+			{Name: "dmz", CIDR: "192.168.10.0/24"},
+		},
+		TopologyClusters: []*config.Cluster{
+			{
+				Name: "dc1", Servers: 1, Clients: 1,
+				Attach: map[string][]string{
+					"servers": {"dmz"},
+					"proxies": {"dmz"},
+				},
+			},
+		},
+		TopologyNodes: []*config.Node{
+			{NodeName: "dc1-client1", Attach: []string{"nowhere"}},
+		},
+	}))
+
+	require.Equal(t, []string{
+		`node["dc1-client2"]: mesh gateways must be attached to a wan network with network_shape="custom"`,
+	}, summaries(&config.Config{
+		EncryptionTLS:        true,
+		TopologyNetworkShape: "custom",
+		TopologyLinkMode:     "federate",
+		TopologyNodeMode:     "agent",
+		TopologyClusters: []*config.Cluster{
+			{Name: "dc1", Servers: 1, Clients: 1, MeshGateways: 1},
+		},
+	}))
+}
+
+func TestCheckTopology_ExplicitPeerings(t *testing.T) {
+	cfg := &config.Config{
+		TopologyNetworkShape: "flat",
+		TopologyLinkMode:     "peer",
+		TopologyPeeringMode:  "explicit",
+		TopologyPeerings: [][]string{
+			{"dc1", "dc2"},
+			{"dc2", "dc1"},
+			{"dc1"},
+			{"dc2", "dc2"},
+			{"dc1", "dc9"},
+		},
+		TopologyNodeMode: "agent",
+		TopologyClusters: []*config.Cluster{
+			{Name: "dc1", Servers: 1, Clients: 1},
+			{Name: "dc2", Servers: 1, Clients: 1},
+		},
+	}
+
+	topo, problems := CheckTopology(cfg, nil)
+	require.Nil(t, topo)
+
+	var got []string
+	for _, diag := range problems.Diagnostics {
+		got = append(got, diag.Summary)
+	}
+	require.Equal(t, []string{
+		`clusters "dc2" and "dc1" are peered more than once`,
+		`peerings must be pairs of cluster names: ["dc1"]`,
+		`cluster "dc2" cannot be peered with itself`,
+		`peerings refers to an undefined cluster "dc9"`,
+	}, got)
+}
+
+func TestLoadTopology(t *testing.T) {
+	cfg := &config.Config{
+		TopologyNetworkShape: "flat",
+		TopologyLinkMode:     "peer",
+		TopologyNodeMode:     "agent",
+		TopologyClusters: []*config.Cluster{
+			{Name: "dc1", Servers: 1, Clients: 2},
+			{Name: "dc2", Servers: 1, Clients: 2},
+		},
+	}
+	topo, err := CompileTopology(cfg)
+	require.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "topology.json")
+	require.NoError(t, SaveTopology(filename, topo))
+
+	loaded, err := LoadTopology(filename)
+	require.NoError(t, err)
+	require.Equal(t, topo, loaded)
+	require.Equal(t, []Peering{{Acceptor: "dc1", Dialer: "dc2"}}, loaded.Peerings())
+	require.Equal(t, "10.0.2.11", loaded.LeaderIP("dc2", false))
+
+	// A newer schema can't be read.
+	require.NoError(t, os.WriteFile(filename, []byte(`{"version": 2}`), 0644))
+	_, err = LoadTopology(filename)
+	require.ErrorContains(t, err, "unsupported topology schema version 2: expected 1")
+}
@@ -0,0 +1,192 @@
+package infra
+
+import (
+	"net/netip"
+	"sort"
+
+	"github.com/rboyer/devconsul/config"
+)
+
+// firstAttachOffset is the host offset of the first address handed out on a
+// user-defined network. Anything below it is left for docker.
+const firstAttachOffset = 10
+
+// attachRoles are the keys allowed in a cluster's attach map.
+var attachRoles = map[string]struct{}{
+	"servers":              {},
+	"clients":              {},
+	"mesh_gateways":        {},
+	"ingress_gateways":     {},
+	"terminating_gateways": {},
+}
+
+// userNetwork is the compiled form of config.Network.
+type userNetwork struct {
+	*config.Network
+
+	prefix netip.Prefix
+	next   int // next host offset to hand out
+}
+
+// compileUserNetworks validates the user-defined networks and adds them to
+// the topology.
+func compileUserNetworks(cfg *config.Config, plan *addressPlan, topology *Topology, problems *config.Problems) map[string]*userNetwork {
+	reserved := map[string]struct{}{
+		"lan": {},
+		"wan": {},
+	}
+	for _, c := range cfg.TopologyClusters {
+		reserved[c.Name] = struct{}{}
+	}
+
+	out := make(map[string]*userNetwork)
+	var compiled []*userNetwork
+	for _, n := range cfg.TopologyNetworks {
+		at := config.Path{"topology", "network", n.Name}
+
+		if !clusterNamePatt.MatchString(n.Name) {
+			problems.Errorf(at, "network[%q]: not a valid network name; use lowercase letters, digits, and dashes", n.Name)
+			continue
+		}
+		if _, ok := reserved[n.Name]; ok {
+			problems.Errorf(at, "network[%q]: name is already used by a built-in network", n.Name)
+			continue
+		}
+		if _, ok := out[n.Name]; ok {
+			problems.Errorf(at, "network[%q] is defined more than once", n.Name)
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(n.CIDR)
+		if err != nil {
+			problems.Errorf(append(at, "cidr"), "network[%q].cidr is not a valid CIDR: %v", n.Name, err)
+			continue
+		}
+		prefix = prefix.Masked()
+		if !prefix.Addr().Is4() {
+			problems.Errorf(append(at, "cidr"), "network[%q].cidr must be an IPv4 CIDR", n.Name)
+			continue
+		}
+		if prefix.Overlaps(plan.lan) || prefix.Overlaps(plan.wan) {
+			problems.Errorf(append(at, "cidr"), "network[%q].cidr %s overlaps the addressing supernets", n.Name, prefix)
+			continue
+		}
+		overlaps := false
+		for _, other := range compiled {
+			if prefix.Overlaps(other.prefix) {
+				problems.Errorf(append(at, "cidr"), "network[%q].cidr %s overlaps network[%q]", n.Name, prefix, other.Name)
+				overlaps = true
+			}
+		}
+		if overlaps {
+			continue
+		}
+
+		un := &userNetwork{
+			Network: n,
+			prefix:  prefix,
+			next:    firstAttachOffset,
+		}
+		out[n.Name] = un
+		compiled = append(compiled, un)
+
+		topology.AddNetwork(&Network{
+			Name: n.Name,
+			CIDR: prefix.String(),
+		})
+	}
+	return out
+}
+
+// attachUserNetworks gives every node an address on each user-defined network
+// that its role (or the node itself) is attached to. Addresses are handed out
+// in the order that the nodes are walked. It returns false if the attachments
+// could not be worked out.
+func attachUserNetworks(cfg *config.Config, topology *Topology, networks map[string]*userNetwork, problems *config.Problems) bool {
+	valid := true
+	checkNames := func(at config.Path, names []string) {
+		for _, name := range names {
+			if _, ok := networks[name]; !ok {
+				problems.Errorf(at, "attach refers to an undefined network %q", name)
+				valid = false
+			}
+		}
+	}
+
+	roleAttach := make(map[string]map[string][]string) // cluster -> role -> networks
+	for _, c := range cfg.TopologyClusters {
+		at := config.Path{"topology", "cluster", c.Name, "attach"}
+		roles := make([]string, 0, len(c.Attach))
+		for role := range c.Attach {
+			roles = append(roles, role)
+		}
+		sort.Strings(roles)
+		for _, role := range roles {
+			if _, ok := attachRoles[role]; !ok {
+				problems.Errorf(at, "%s: unknown role %q in attach", c.Name, role)
+				valid = false
+				continue
+			}
+			checkNames(at, c.Attach[role])
+		}
+		roleAttach[c.Name] = c.Attach
+	}
+	nodeAttach := make(map[string][]string)
+	for _, n := range cfg.TopologyNodes {
+		checkNames(config.Path{"topology", "node", n.NodeName, "attach"}, n.Attach)
+		nodeAttach[n.NodeName] = n.Attach
+	}
+	if !valid {
+		return false
+	}
+
+	topology.WalkSilent(func(node *Node) {
+		at := config.Path{"topology", "node", node.Name, "attach"}
+
+		var (
+			names  = append(append([]string{}, roleAttach[node.Cluster][node.Role()]...), nodeAttach[node.Name]...)
+			seen   = make(map[string]struct{})
+			hasWAN = node.HasPublicAddress()
+		)
+		for _, name := range names {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+
+			un := networks[name]
+			if un.next > 1<<(32-un.prefix.Bits())-2 {
+				problems.Errorf(at, "network[%q] has run out of addresses for node[%q]", name, node.Name)
+				continue
+			}
+			if un.WAN {
+				if hasWAN {
+					problems.Errorf(at, "node[%q] can only have one public address, but is attached to wan network %q as well", node.Name, name)
+					continue
+				}
+				hasWAN = true
+			}
+			node.Addresses = append(node.Addresses, Address{
+				Network:   name,
+				IPAddress: hostIP(un.prefix, un.next),
+				Public:    un.WAN,
+			})
+			un.next++
+		}
+	})
+	return true
+}
+
+// checkCustomShape makes sure that the nodes that need to be reachable from
+// other clusters are attached to a wan network.
+func checkCustomShape(cfg *config.Config, topology *Topology, problems *config.Problems) {
+	topology.WalkSilent(func(node *Node) {
+		if node.MeshGateway && !node.HasPublicAddress() {
+			problems.Errorf(config.Path{"topology", "node", node.Name, "attach"}, "node[%q]: mesh gateways must be attached to a wan network with network_shape=%q", node.Name, topology.NetworkShape)
+		}
+	})
+
+	if topology.LinkWithFederation() && topology.FederateWithGateways() && !cfg.EncryptionTLS {
+		problems.Errorf(config.Path{"topology", "network_shape"}, "network_shape=%q without a wan network for every server requires TLS to be enabled to federate through mesh gateways", topology.NetworkShape)
+	}
+}
@@ -1,8 +1,10 @@
 package infra
 
 import (
+	"net/netip"
 	"sort"
 
+	"github.com/rboyer/devconsul/config"
 	"github.com/rboyer/devconsul/util"
 )
 
@@ -21,11 +23,16 @@ const (
 	// NetworkShapeFlat describes a flat network where every agent has a single
 	// ip address and they all are routable.
 	NetworkShapeFlat = NetworkShape("flat")
+
+	// NetworkShapeCustom describes isolated clusters, like islands, where
+	// anything else is reached only over user-defined networks that the nodes
+	// are explicitly attached to.
+	NetworkShapeCustom = NetworkShape("custom")
 )
 
 func (s NetworkShape) GetNetworkName(dc string) string {
 	switch s {
-	case NetworkShapeIslands, NetworkShapeDual:
+	case NetworkShapeIslands, NetworkShapeDual, NetworkShapeCustom:
 		return dc
 	case NetworkShapeFlat:
 		return "lan"
@@ -41,6 +48,29 @@ const (
 	ClusterLinkModeFederate = ClusterLinkMode("federate")
 )
 
+// PeeringMode picks which clusters are peered with each other when the
+// clusters are linked with peering.
+type PeeringMode string
+
+const (
+	PeeringModeHub      = PeeringMode("hub")      // the primary with everything else
+	PeeringModeMesh     = PeeringMode("mesh")     // everything with everything else
+	PeeringModeExplicit = PeeringMode("explicit") // just the configured pairs
+)
+
+// Peering is a link between two clusters. The peering token is generated in
+// the Acceptor and used to establish the peering from the Dialer.
+type Peering struct {
+	Acceptor string
+	Dialer   string
+}
+
+// PeerName is the name that other clusters use for their peering with the
+// named cluster.
+func PeerName(cluster string) string {
+	return "peer-" + cluster
+}
+
 type NodeMode string
 
 const (
@@ -52,20 +82,81 @@ type Topology struct {
 	NetworkShape NetworkShape
 	LinkMode     ClusterLinkMode
 	NodeMode     NodeMode
+	PeeringMode  PeeringMode // only set when LinkMode is peer
 
 	networks map[string]*Network
 	clusters []*Cluster
+	peerings []Peering
 
 	nm map[string]*Node
 
 	additionalPrimaryGateways []string
+
+	prometheusIP string
+	vaultIP      string
 }
 
-func (t *Topology) FederateWithGateways() bool { return t.NetworkShape == NetworkShapeIslands }
+// PrometheusIP is the address of the shared prometheus container.
+func (t *Topology) PrometheusIP() string { return t.prometheusIP }
+
+// VaultIP is the address of the shared vault container.
+func (t *Topology) VaultIP() string { return t.vaultIP }
+
+func (t *Topology) FederateWithGateways() bool {
+	switch t.NetworkShape {
+	case NetworkShapeIslands:
+		return true
+	case NetworkShapeCustom:
+		// Servers can only federate directly if they can all reach each other.
+		for _, name := range t.sortedNodeKind(NodeKindServer) {
+			if !t.Node(name).HasPublicAddress() {
+				return true
+			}
+		}
+	}
+	return false
+}
 
 func (t *Topology) LinkWithFederation() bool { return t.LinkMode == ClusterLinkModeFederate }
 func (t *Topology) LinkWithPeering() bool    { return t.LinkMode == ClusterLinkModePeer }
 
+// PeerThroughMeshGateways returns true if the servers of peered clusters can
+// only reach each other through their mesh gateways.
+func (t *Topology) PeerThroughMeshGateways() bool {
+	return t.LinkWithPeering() && t.NetworkShape != NetworkShapeFlat
+}
+
+// Peerings returns every pair of peered clusters.
+func (t *Topology) Peerings() []Peering {
+	return t.peerings
+}
+
+// PeeredWith returns the names of the clusters that the named cluster is
+// peered with, in order.
+func (t *Topology) PeeredWith(cluster string) []string {
+	var out []string
+	for _, p := range t.peerings {
+		switch cluster {
+		case p.Acceptor:
+			out = append(out, p.Dialer)
+		case p.Dialer:
+			out = append(out, p.Acceptor)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ArePeered returns true if the two clusters are peered with each other.
+func (t *Topology) ArePeered(a, b string) bool {
+	for _, p := range t.peerings {
+		if (p.Acceptor == a && p.Dialer == b) || (p.Acceptor == b && p.Dialer == a) {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *Topology) LeaderIP(cluster string, wan bool) string {
 	for _, name := range t.sortedNodeKind(NodeKindServer) {
 		n := t.Node(name)
@@ -119,12 +210,15 @@ func (t *Topology) ServerIPs(cluster string) []string {
 	return out
 }
 
+// GatewayAddrs returns the addresses of the mesh gateways that can be used
+// for WAN federation with the cluster, which are only the ones in the default
+// partition.
 func (t *Topology) GatewayAddrs(cluster string) []string {
 	var out []string
 	t.WalkSilent(func(n *Node) {
 		switch n.Kind {
 		case NodeKindClient, NodeKindDataplane:
-			if n.Cluster == cluster && n.MeshGateway {
+			if n.Cluster == cluster && n.MeshGateway && n.Partition == "default" {
 				out = append(out, n.PublicAddress()+":8443")
 			}
 		}
@@ -217,6 +311,62 @@ func (t *Topology) AddNetwork(n *Network) {
 	t.networks[n.Name] = n
 }
 
+// ExternalServices returns the external services registered in the named
+// cluster.
+func (t *Topology) ExternalServices(cluster string) []*ExternalService {
+	var out []*ExternalService
+	t.WalkSilent(func(n *Node) {
+		if n.Cluster == cluster {
+			out = append(out, n.ExternalServices...)
+		}
+	})
+	return out
+}
+
+// PeeredUpstream is an upstream on a service in one cluster that targets a
+// service in a peered cluster.
+type PeeredUpstream struct {
+	Service    util.Identifier // in the exporting cluster
+	Downstream util.Identifier // in the importing cluster
+	Peer       string          // what the exporting cluster calls the importing one
+}
+
+// PeeredUpstreams returns every upstream elsewhere in the topology that
+// targets a service in the named cluster over a peering, and so needs the
+// service exported to the peer.
+func (t *Topology) PeeredUpstreams(cluster string) []PeeredUpstream {
+	if !t.LinkWithPeering() {
+		return nil
+	}
+	var (
+		out  []PeeredUpstream
+		seen = make(map[PeeredUpstream]struct{})
+	)
+	t.WalkSilent(func(n *Node) {
+		if n.Cluster == cluster {
+			return
+		}
+		for _, svc := range n.Services {
+			for _, up := range svc.Upstreams {
+				if up.Peer != PeerName(cluster) {
+					continue
+				}
+				pu := PeeredUpstream{
+					Service:    up.ID,
+					Downstream: svc.ID,
+					Peer:       PeerName(n.Cluster),
+				}
+				if _, ok := seen[pu]; ok {
+					continue
+				}
+				seen[pu] = struct{}{}
+				out = append(out, pu)
+			}
+		}
+	})
+	return out
+}
+
 func (t *Topology) AddNode(node *Node) {
 	if node.Kind == "" {
 		panic("missing node kind")
@@ -235,13 +385,22 @@ type Cluster struct {
 	Name    string
 	Primary bool
 
-	Index        int
-	Servers      int
-	Clients      int
-	MeshGateways int
+	Index               int
+	Servers             int // including read replicas
+	Clients             int
+	MeshGateways        int
+	IngressGateways     int
+	TerminatingGateways int
+	ReadReplicas        int
+
+	Subnet    netip.Prefix
+	WANSubnet netip.Prefix
+}
 
-	BaseIP    string
-	WANBaseIP string
+// Voters returns the number of servers in the cluster that are not read
+// replicas.
+func (c *Cluster) Voters() int {
+	return c.Servers - c.ReadReplicas
 }
 
 type Network struct {
@@ -264,19 +423,67 @@ const (
 )
 
 type Node struct {
-	Kind            NodeKind
-	Cluster         string
-	Name            string
-	Segment         string // may be empty
-	Partition       string // will be not empty
-	Addresses       []Address
-	Service         *Service
-	MeshGateway     bool
-	UseBuiltinProxy bool
-	Index           int
-	Canary          bool
+	Kind               NodeKind
+	Cluster            string
+	Name               string
+	Segment            string // may be empty
+	Partition          string // will be not empty
+	Addresses          []Address
+	Services           []*Service
+	MeshGateway        bool
+	IngressGateway     bool
+	TerminatingGateway bool
+	UseBuiltinProxy    bool
+	Index              int
+	Canary             bool
+	AgentExtraHCL      string // merged into the generated agent config
+	// server only
+	ReadReplica bool
+	Zone        string // autopilot redundancy zone; may be empty
 	// mesh-gateway only
 	MeshGatewayUseDNSWANAddress bool
+	// ingress-gateway only
+	IngressListeners []*IngressListener
+	// infra only
+	ExternalServices []*ExternalService
+}
+
+// ExternalService is a plain workload outside of the mesh. It runs in the
+// infra pod of its cluster and is registered in the catalog on a virtual
+// external node so that terminating gateways can route to it.
+type ExternalService struct {
+	ID              util.Identifier
+	Image           string
+	Command         []string
+	Env             map[string]string
+	Port            int
+	HealthCheckPath string // empty means tcp
+}
+
+// IngressListener is a port on an ingress gateway that routes to a single
+// service in the mesh.
+type IngressListener struct {
+	Service  util.Identifier
+	Port     int // inside the pod
+	HostPort int // published on the docker host
+}
+
+// Role returns the key used for this kind of node in a cluster's attach map,
+// or an empty string for nodes that cannot be attached by role.
+func (n *Node) Role() string {
+	switch {
+	case n.IsServer():
+		return "servers"
+	case n.MeshGateway:
+		return "mesh_gateways"
+	case n.IngressGateway:
+		return "ingress_gateways"
+	case n.TerminatingGateway:
+		return "terminating_gateways"
+	case n.Kind == NodeKindClient || n.Kind == NodeKindDataplane:
+		return "clients"
+	}
+	return ""
 }
 
 func (n *Node) PodName() string  { return n.Name + "-pod" }
@@ -322,16 +529,27 @@ func (n *Node) LocalAddress() string {
 
 func (n *Node) PublicAddress() string {
 	for _, a := range n.Addresses {
-		if a.Network == "wan" {
+		if a.Network == "wan" || a.Public {
 			return a.IPAddress
 		}
 	}
 	panic("node has no public address")
 }
 
+// HasPublicAddress returns true if PublicAddress will not panic.
+func (n *Node) HasPublicAddress() bool {
+	for _, a := range n.Addresses {
+		if a.Network == "wan" || a.Public {
+			return true
+		}
+	}
+	return false
+}
+
 type Address struct {
 	Network   string
 	IPAddress string
+	Public    bool // on a user-defined wan network
 }
 
 type Service struct {
@@ -339,11 +557,38 @@ type Service struct {
 	// Name               string
 	// Namespace          string // will not be empty
 	// Partition          string // will be not empty
-	Port               int
-	UpstreamID         util.Identifier
-	UpstreamPeer       string
-	UpstreamDatacenter string
-	UpstreamLocalPort  int
-	UpstreamExtraHCL   string
-	Meta               map[string]string
+	Image            string // empty means the builtin pingpong app
+	Command          []string
+	Env              map[string]string
+	Port             int
+	HealthCheckPath  string // empty means a tcp check
+	Upstreams        []*Upstream
+	UpstreamExtraHCL string
+	Meta             map[string]string
+
+	// sidecar ports; offset by the position of the service on the node
+	EnvoyAdminPort          int
+	EnvoyPublicListenerPort int
+	EnvoyPrometheusPort     int
+}
+
+// IsPingPong returns true if the service runs the builtin pingpong app.
+func (s *Service) IsPingPong() bool {
+	return s.Image == ""
+}
+
+type Upstream struct {
+	ID              util.Identifier
+	Type            string // empty means a service, otherwise prepared_query
+	Peer            string
+	Datacenter      string
+	LocalPort       int
+	MeshGatewayMode string
+	Config          map[string]string
+}
+
+// IsPreparedQuery returns true if the upstream targets a prepared query
+// rather than a service.
+func (u *Upstream) IsPreparedQuery() bool {
+	return u.Type == config.UpstreamTypePreparedQuery
 }
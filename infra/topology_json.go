@@ -0,0 +1,451 @@
+package infra
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"github.com/rboyer/safeio"
+
+	"github.com/rboyer/devconsul/util"
+)
+
+// TopologySchemaVersion is the version of the JSON form of a Topology. It is
+// bumped whenever a change would break existing readers.
+const TopologySchemaVersion = 1
+
+// The json* types below are the JSON schema for a Topology. They are kept
+// separate from the types used everywhere else so that those can change
+// freely without changing the schema.
+
+type jsonTopology struct {
+	Version      int    `json:"version"`
+	NetworkShape string `json:"network_shape"`
+	LinkMode     string `json:"link_mode"`
+	NodeMode     string `json:"node_mode"`
+	PeeringMode  string `json:"peering_mode,omitempty"`
+
+	Networks []jsonNetwork `json:"networks"`
+	Clusters []jsonCluster `json:"clusters"`
+	Peerings []jsonPeering `json:"peerings,omitempty"`
+	Nodes    []jsonNode    `json:"nodes"`
+
+	AdditionalPrimaryGateways []string `json:"additional_primary_gateways,omitempty"`
+
+	PrometheusIP string `json:"prometheus_ip,omitempty"`
+	VaultIP      string `json:"vault_ip,omitempty"`
+}
+
+type jsonNetwork struct {
+	Name string `json:"name"`
+	CIDR string `json:"cidr"`
+}
+
+type jsonCluster struct {
+	Name                string `json:"name"`
+	Primary             bool   `json:"primary,omitempty"`
+	Index               int    `json:"index"`
+	Servers             int    `json:"servers"`
+	Clients             int    `json:"clients"`
+	MeshGateways        int    `json:"mesh_gateways"`
+	IngressGateways     int    `json:"ingress_gateways"`
+	TerminatingGateways int    `json:"terminating_gateways"`
+	ReadReplicas        int    `json:"read_replicas,omitempty"`
+	Subnet              string `json:"subnet,omitempty"`
+	WANSubnet           string `json:"wan_subnet,omitempty"`
+}
+
+type jsonPeering struct {
+	Acceptor string `json:"acceptor"`
+	Dialer   string `json:"dialer"`
+}
+
+type jsonNode struct {
+	Kind               string `json:"kind"`
+	Cluster            string `json:"cluster"`
+	Name               string `json:"name"`
+	Segment            string `json:"segment,omitempty"`
+	Partition          string `json:"partition"`
+	Index              int    `json:"index"`
+	Canary             bool   `json:"canary,omitempty"`
+	MeshGateway        bool   `json:"mesh_gateway,omitempty"`
+	IngressGateway     bool   `json:"ingress_gateway,omitempty"`
+	TerminatingGateway bool   `json:"terminating_gateway,omitempty"`
+	UseBuiltinProxy    bool   `json:"use_builtin_proxy,omitempty"`
+	AgentExtraHCL      string `json:"agent_extra_hcl,omitempty"`
+	ReadReplica        bool   `json:"read_replica,omitempty"`
+	Zone               string `json:"zone,omitempty"`
+
+	MeshGatewayUseDNSWANAddress bool `json:"mesh_gateway_use_dns_wan_address,omitempty"`
+
+	Addresses        []jsonAddress         `json:"addresses"`
+	Services         []jsonService         `json:"services,omitempty"`
+	IngressListeners []jsonIngressListener `json:"ingress_listeners,omitempty"`
+	ExternalServices []jsonExternalService `json:"external_services,omitempty"`
+}
+
+type jsonAddress struct {
+	Network   string `json:"network"`
+	IPAddress string `json:"ip"`
+	Public    bool   `json:"public,omitempty"`
+}
+
+type jsonIdentifier struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Partition string `json:"partition,omitempty"`
+}
+
+type jsonService struct {
+	ID               jsonIdentifier    `json:"id"`
+	Image            string            `json:"image,omitempty"`
+	Command          []string          `json:"command,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+	Port             int               `json:"port"`
+	HealthCheckPath  string            `json:"health_check_path,omitempty"`
+	Upstreams        []jsonUpstream    `json:"upstreams,omitempty"`
+	UpstreamExtraHCL string            `json:"upstream_extra_hcl,omitempty"`
+	Meta             map[string]string `json:"meta,omitempty"`
+
+	EnvoyAdminPort          int `json:"envoy_admin_port"`
+	EnvoyPublicListenerPort int `json:"envoy_public_listener_port"`
+	EnvoyPrometheusPort     int `json:"envoy_prometheus_port"`
+}
+
+type jsonUpstream struct {
+	ID              jsonIdentifier    `json:"id"`
+	Type            string            `json:"type,omitempty"`
+	Peer            string            `json:"peer,omitempty"`
+	Datacenter      string            `json:"datacenter,omitempty"`
+	LocalPort       int               `json:"local_port"`
+	MeshGatewayMode string            `json:"mesh_gateway_mode,omitempty"`
+	Config          map[string]string `json:"config,omitempty"`
+}
+
+type jsonIngressListener struct {
+	Service  jsonIdentifier `json:"service"`
+	Port     int            `json:"port"`
+	HostPort int            `json:"host_port,omitempty"`
+}
+
+type jsonExternalService struct {
+	ID              jsonIdentifier    `json:"id"`
+	Image           string            `json:"image"`
+	Command         []string          `json:"command,omitempty"`
+	Env             map[string]string `json:"env,omitempty"`
+	Port            int               `json:"port"`
+	HealthCheckPath string            `json:"health_check_path,omitempty"`
+}
+
+// MarshalJSON encodes the topology using the versioned schema described by
+// TopologySchemaVersion. Nodes are written in the order they are walked.
+func (t *Topology) MarshalJSON() ([]byte, error) {
+	out := jsonTopology{
+		Version:                   TopologySchemaVersion,
+		NetworkShape:              string(t.NetworkShape),
+		LinkMode:                  string(t.LinkMode),
+		NodeMode:                  string(t.NodeMode),
+		PeeringMode:               string(t.PeeringMode),
+		Networks:                  []jsonNetwork{},
+		Clusters:                  []jsonCluster{},
+		Nodes:                     []jsonNode{},
+		AdditionalPrimaryGateways: t.additionalPrimaryGateways,
+		PrometheusIP:              t.prometheusIP,
+		VaultIP:                   t.vaultIP,
+	}
+
+	for _, n := range t.Networks() {
+		out.Networks = append(out.Networks, jsonNetwork{Name: n.Name, CIDR: n.CIDR})
+	}
+	for _, c := range t.clusters {
+		out.Clusters = append(out.Clusters, jsonCluster{
+			Name:                c.Name,
+			Primary:             c.Primary,
+			Index:               c.Index,
+			Servers:             c.Servers,
+			Clients:             c.Clients,
+			MeshGateways:        c.MeshGateways,
+			IngressGateways:     c.IngressGateways,
+			TerminatingGateways: c.TerminatingGateways,
+			ReadReplicas:        c.ReadReplicas,
+			Subnet:              prefixString(c.Subnet),
+			WANSubnet:           prefixString(c.WANSubnet),
+		})
+	}
+	for _, p := range t.peerings {
+		out.Peerings = append(out.Peerings, jsonPeering{Acceptor: p.Acceptor, Dialer: p.Dialer})
+	}
+	t.WalkSilent(func(n *Node) {
+		out.Nodes = append(out.Nodes, nodeToJSON(n))
+	})
+
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a topology written by MarshalJSON, replacing the
+// contents of t. It fails if the schema version is not one that it knows
+// how to read.
+func (t *Topology) UnmarshalJSON(data []byte) error {
+	var in jsonTopology
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.Version != TopologySchemaVersion {
+		return fmt.Errorf("unsupported topology schema version %d: expected %d", in.Version, TopologySchemaVersion)
+	}
+
+	out := Topology{
+		NetworkShape:              NetworkShape(in.NetworkShape),
+		LinkMode:                  ClusterLinkMode(in.LinkMode),
+		NodeMode:                  NodeMode(in.NodeMode),
+		PeeringMode:               PeeringMode(in.PeeringMode),
+		additionalPrimaryGateways: in.AdditionalPrimaryGateways,
+		prometheusIP:              in.PrometheusIP,
+		vaultIP:                   in.VaultIP,
+	}
+
+	for _, n := range in.Networks {
+		out.AddNetwork(&Network{Name: n.Name, CIDR: n.CIDR})
+	}
+	for _, c := range in.Clusters {
+		subnet, err := parsePrefix(c.Subnet)
+		if err != nil {
+			return fmt.Errorf("cluster %q has an invalid subnet: %w", c.Name, err)
+		}
+		wanSubnet, err := parsePrefix(c.WANSubnet)
+		if err != nil {
+			return fmt.Errorf("cluster %q has an invalid wan_subnet: %w", c.Name, err)
+		}
+		out.clusters = append(out.clusters, &Cluster{
+			Name:                c.Name,
+			Primary:             c.Primary,
+			Index:               c.Index,
+			Servers:             c.Servers,
+			Clients:             c.Clients,
+			MeshGateways:        c.MeshGateways,
+			IngressGateways:     c.IngressGateways,
+			TerminatingGateways: c.TerminatingGateways,
+			ReadReplicas:        c.ReadReplicas,
+			Subnet:              subnet,
+			WANSubnet:           wanSubnet,
+		})
+	}
+	for _, p := range in.Peerings {
+		out.peerings = append(out.peerings, Peering{Acceptor: p.Acceptor, Dialer: p.Dialer})
+	}
+	for _, n := range in.Nodes {
+		if n.Kind == "" {
+			return fmt.Errorf("node %q is missing a kind", n.Name)
+		}
+		out.AddNode(nodeFromJSON(n))
+	}
+
+	*t = out
+	return nil
+}
+
+// SaveTopology writes the topology to a file as indented JSON.
+func SaveTopology(filename string, t *Topology) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = safeio.WriteToFile(bytes.NewReader(data), filename, 0644)
+	return err
+}
+
+// LoadTopology reads a topology written by SaveTopology, such as the
+// cache/topology.json file written each time everything is brought up.
+func LoadTopology(filename string) (*Topology, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var t Topology
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("could not decode topology from %q: %w", filename, err)
+	}
+	return &t, nil
+}
+
+func nodeToJSON(n *Node) jsonNode {
+	out := jsonNode{
+		Kind:                        string(n.Kind),
+		Cluster:                     n.Cluster,
+		Name:                        n.Name,
+		Segment:                     n.Segment,
+		Partition:                   n.Partition,
+		Index:                       n.Index,
+		Canary:                      n.Canary,
+		MeshGateway:                 n.MeshGateway,
+		IngressGateway:              n.IngressGateway,
+		TerminatingGateway:          n.TerminatingGateway,
+		UseBuiltinProxy:             n.UseBuiltinProxy,
+		AgentExtraHCL:               n.AgentExtraHCL,
+		ReadReplica:                 n.ReadReplica,
+		Zone:                        n.Zone,
+		MeshGatewayUseDNSWANAddress: n.MeshGatewayUseDNSWANAddress,
+		Addresses:                   []jsonAddress{},
+	}
+	for _, a := range n.Addresses {
+		out.Addresses = append(out.Addresses, jsonAddress{
+			Network:   a.Network,
+			IPAddress: a.IPAddress,
+			Public:    a.Public,
+		})
+	}
+	for _, svc := range n.Services {
+		js := jsonService{
+			ID:                      identifierToJSON(svc.ID),
+			Image:                   svc.Image,
+			Command:                 svc.Command,
+			Env:                     svc.Env,
+			Port:                    svc.Port,
+			HealthCheckPath:         svc.HealthCheckPath,
+			UpstreamExtraHCL:        svc.UpstreamExtraHCL,
+			Meta:                    svc.Meta,
+			EnvoyAdminPort:          svc.EnvoyAdminPort,
+			EnvoyPublicListenerPort: svc.EnvoyPublicListenerPort,
+			EnvoyPrometheusPort:     svc.EnvoyPrometheusPort,
+		}
+		for _, up := range svc.Upstreams {
+			js.Upstreams = append(js.Upstreams, jsonUpstream{
+				ID:              identifierToJSON(up.ID),
+				Type:            up.Type,
+				Peer:            up.Peer,
+				Datacenter:      up.Datacenter,
+				LocalPort:       up.LocalPort,
+				MeshGatewayMode: up.MeshGatewayMode,
+				Config:          up.Config,
+			})
+		}
+		out.Services = append(out.Services, js)
+	}
+	for _, l := range n.IngressListeners {
+		out.IngressListeners = append(out.IngressListeners, jsonIngressListener{
+			Service:  identifierToJSON(l.Service),
+			Port:     l.Port,
+			HostPort: l.HostPort,
+		})
+	}
+	for _, svc := range n.ExternalServices {
+		out.ExternalServices = append(out.ExternalServices, jsonExternalService{
+			ID:              identifierToJSON(svc.ID),
+			Image:           svc.Image,
+			Command:         svc.Command,
+			Env:             svc.Env,
+			Port:            svc.Port,
+			HealthCheckPath: svc.HealthCheckPath,
+		})
+	}
+	return out
+}
+
+func nodeFromJSON(in jsonNode) *Node {
+	n := &Node{
+		Kind:                        NodeKind(in.Kind),
+		Cluster:                     in.Cluster,
+		Name:                        in.Name,
+		Segment:                     in.Segment,
+		Partition:                   in.Partition,
+		Index:                       in.Index,
+		Canary:                      in.Canary,
+		MeshGateway:                 in.MeshGateway,
+		IngressGateway:              in.IngressGateway,
+		TerminatingGateway:          in.TerminatingGateway,
+		UseBuiltinProxy:             in.UseBuiltinProxy,
+		AgentExtraHCL:               in.AgentExtraHCL,
+		ReadReplica:                 in.ReadReplica,
+		Zone:                        in.Zone,
+		MeshGatewayUseDNSWANAddress: in.MeshGatewayUseDNSWANAddress,
+	}
+	for _, a := range in.Addresses {
+		n.Addresses = append(n.Addresses, Address{
+			Network:   a.Network,
+			IPAddress: a.IPAddress,
+			Public:    a.Public,
+		})
+	}
+	for _, js := range in.Services {
+		svc := &Service{
+			ID:                      identifierFromJSON(js.ID),
+			Image:                   js.Image,
+			Command:                 js.Command,
+			Env:                     js.Env,
+			Port:                    js.Port,
+			HealthCheckPath:         js.HealthCheckPath,
+			UpstreamExtraHCL:        js.UpstreamExtraHCL,
+			Meta:                    js.Meta,
+			EnvoyAdminPort:          js.EnvoyAdminPort,
+			EnvoyPublicListenerPort: js.EnvoyPublicListenerPort,
+			EnvoyPrometheusPort:     js.EnvoyPrometheusPort,
+		}
+		if svc.Meta == nil {
+			// Compiled services always have one, even if it is empty.
+			svc.Meta = make(map[string]string)
+		}
+		for _, up := range js.Upstreams {
+			svc.Upstreams = append(svc.Upstreams, &Upstream{
+				ID:              identifierFromJSON(up.ID),
+				Type:            up.Type,
+				Peer:            up.Peer,
+				Datacenter:      up.Datacenter,
+				LocalPort:       up.LocalPort,
+				MeshGatewayMode: up.MeshGatewayMode,
+				Config:          up.Config,
+			})
+		}
+		n.Services = append(n.Services, svc)
+	}
+	for _, l := range in.IngressListeners {
+		n.IngressListeners = append(n.IngressListeners, &IngressListener{
+			Service:  identifierFromJSON(l.Service),
+			Port:     l.Port,
+			HostPort: l.HostPort,
+		})
+	}
+	for _, svc := range in.ExternalServices {
+		n.ExternalServices = append(n.ExternalServices, &ExternalService{
+			ID:              identifierFromJSON(svc.ID),
+			Image:           svc.Image,
+			Command:         svc.Command,
+			Env:             svc.Env,
+			Port:            svc.Port,
+			HealthCheckPath: svc.HealthCheckPath,
+		})
+	}
+	return n
+}
+
+func identifierToJSON(id util.Identifier) jsonIdentifier {
+	return jsonIdentifier{
+		Name:      id.Name,
+		Namespace: id.Namespace,
+		Partition: id.Partition,
+	}
+}
+
+func identifierFromJSON(id jsonIdentifier) util.Identifier {
+	return util.Identifier{
+		Name:      id.Name,
+		Namespace: id.Namespace,
+		Partition: id.Partition,
+	}
+}
+
+func prefixString(p netip.Prefix) string {
+	if !p.IsValid() {
+		return ""
+	}
+	return p.String()
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if s == "" {
+		return netip.Prefix{}, nil
+	}
+	return netip.ParsePrefix(s)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -24,6 +25,7 @@ var allCommands = []command{
 	{"down", (*app.App).RunBringDown, []string{"destroy", "rm"}}, // porcelain
 	{"restart", (*app.App).RunRestart, nil},                      // porcelain
 	{"config", (*app.App).RunConfigDump, nil},                    // porcelain
+	{"export", (*app.App).RunExport, nil},                        // porcelain
 	// ================ special scenarios
 	{"force-docker", (*app.App).RunForceDocker, []string{"docker"}},
 	{"primary", (*app.App).RunBringUpPrimary, []string{"up-primary", "up-pri"}},
@@ -56,22 +58,53 @@ func main() {
 	os.Args[0] = app.ProgramName
 
 	var (
-		resetOnce bool
-		timeout   time.Duration
+		resetOnce  bool
+		timeout    time.Duration
+		configFile = envOrDefault("DEVCONSUL_CONFIG", app.DefaultConfigFile)
+		profile    = os.Getenv("DEVCONSUL_ACTIVE")
+		vars       = make(varFlag)
 	)
-	flag.BoolVar(&resetOnce, "force", false, "force one time operations to run again")
-	flag.DurationVar(&timeout, "timeout", 1*time.Minute, "[check-mesh] total runtime")
-	flag.Parse()
+	// addConfigFlags registers the flags that pick the config. The current
+	// values are the defaults, so a subcommand that parses its own flags
+	// after the common ones keeps anything that was already set.
+	addConfigFlags := func(fs *flag.FlagSet) {
+		fs.StringVar(&configFile, "config", configFile, "path to the config file; may also be set with DEVCONSUL_CONFIG")
+		fs.StringVar(&profile, "profile", profile, "name of the config block to use instead of 'active'; may also be set with DEVCONSUL_ACTIVE")
+		fs.Var(vars, "var", "set a config variable as name=value; may be repeated")
+	}
 
-	if timeout < 0 {
-		timeout = 0
+	opts := func() app.Options {
+		return app.Options{
+			ConfigFile: configFile,
+			Profile:    profile,
+			Vars:       vars,
+		}
 	}
 
-	if resetOnce {
-		if err := app.ResetRunOnceMemory(); err != nil {
+	// This runs without creating the app, and has its own flags.
+	if subcommand == "topology" {
+		fs := flag.NewFlagSet(app.ProgramName+" topology", flag.ExitOnError)
+		addConfigFlags(fs)
+		format := fs.String("format", "table", "output format: dot, mermaid, json, or table")
+		if err := fs.Parse(os.Args[1:]); err != nil {
 			logger.Error(err.Error())
 			os.Exit(1)
 		}
+
+		if err := app.ExportTopology(os.Stdout, opts(), *format); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	flag.BoolVar(&resetOnce, "force", false, "force one time operations to run again")
+	flag.DurationVar(&timeout, "timeout", 1*time.Minute, "[check-mesh] total runtime")
+	addConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	if timeout < 0 {
+		timeout = 0
 	}
 
 	if subcommand == "help" {
@@ -79,18 +112,65 @@ func main() {
 		for _, cmd := range allCommands {
 			keys = append(keys, cmd.Name)
 		}
+		// This one runs without creating the app, so it isn't in allCommands.
+		keys = append(keys, "topology")
 
 		logger.Info("available commands: [" + strings.Join(keys, ", ") + "]")
 		os.Exit(0)
 	}
 
-	core, err := app.New(logger)
+	// These have to happen before the app is created, since creating it
+	// stops at the first problem with the config.
+	if subcommand == "config" && (flag.Arg(0) == "validate" || flag.Arg(0) == "migrate") {
+		action := flag.Arg(0)
+
+		// Allow flags after the action as well.
+		fs := flag.NewFlagSet(app.ProgramName+" config "+action, flag.ExitOnError)
+		addConfigFlags(fs)
+		var format *string
+		if action == "validate" {
+			format = fs.String("format", "text", "output format: text or json")
+		}
+		if err := fs.Parse(flag.Args()[1:]); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		if action == "migrate" {
+			if err := app.Migrate(os.Stdout, opts()); err != nil {
+				logger.Error(err.Error())
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		valid, err := app.Validate(os.Stdout, opts(), *format)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		if !valid {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	core, err := app.New(logger, opts())
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 	core.SetTimeout(timeout)
 
+	// This has to wait until after the app has moved into the directory
+	// containing the config file.
+	if resetOnce {
+		if err := app.ResetRunOnceMemory(); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
 	commandMap := make(map[string]func(core *app.App) error)
 	for _, cmd := range allCommands {
 		commandMap[cmd.Name] = cmd.Func
@@ -113,3 +193,26 @@ func main() {
 
 	os.Exit(0)
 }
+
+// varFlag collects repeated -var name=value flags.
+type varFlag map[string]string
+
+func (f varFlag) String() string {
+	return ""
+}
+
+func (f varFlag) Set(v string) error {
+	name, val, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+	f[name] = val
+	return nil
+}
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -1,3 +0,0 @@
-provider "docker" {
-  host = "unix:///var/run/docker.sock"
-}
@@ -2,6 +2,7 @@
 
 set -euo pipefail
 
+readonly gateway="${SBOOT_GATEWAY:-mesh}"
 readonly mode="${SBOOT_MODE:-}"
 readonly agent_tls="${SBOOT_AGENT_TLS:-}"
 readonly agent_grpc_tls="${SBOOT_AGENT_GRPC_TLS:-}"
@@ -72,9 +73,9 @@ if [[ "${mode}" != "insecure" ]]; then
     done
 fi
 
-echo "Launching mesh-gateway proxy..."
+echo "Launching ${gateway}-gateway proxy..."
 exec consul connect envoy \
     -register \
-    -mesh-gateway \
+    -gateway "${gateway}" \
     "${grpc_args[@]}" "${api_args[@]}" \
     "$@"
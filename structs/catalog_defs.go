@@ -49,8 +49,9 @@ type CatalogService struct {
 	Address   string            `json:",omitempty"`
 	Namespace string            `json:",omitempty"`
 	//
-	CheckID  string `json:",omitempty"`
-	TCPCheck string `json:",omitempty"`
+	CheckID   string `json:",omitempty"`
+	TCPCheck  string `json:",omitempty"`
+	HTTPCheck string `json:",omitempty"`
 }
 
 func (s *CatalogService) NodeID() util.Identifier2 {
@@ -80,7 +81,8 @@ func (s *CatalogService) ToAPI(enterprise bool) *api.CatalogRegistration {
 			Status:    "passing", //  TODO
 			ServiceID: s.Service,
 			Definition: api.HealthCheckDefinition{
-				TCP: s.TCPCheck,
+				TCP:  s.TCPCheck,
+				HTTP: s.HTTPCheck,
 			},
 			Output: "",
 		},
@@ -97,36 +99,63 @@ func (s *CatalogService) ToAPI(enterprise bool) *api.CatalogRegistration {
 
 type CatalogProxy struct {
 	CatalogService
+	Kind                        string                  `json:",omitempty"` // empty means a sidecar proxy
+	GatewayWANAddress           string                  `json:",omitempty"`
+	GatewayWANPort              int                     `json:",omitempty"`
 	ProxyDestinationServiceName string                  `json:",omitempty"`
 	ProxyLocalServicePort       int                     `json:",omitempty"`
 	ProxyUpstreams              []*CatalogProxyUpstream `json:",omitempty"`
+	ProxyConfig                 map[string]any          `json:",omitempty"`
 }
 
 type CatalogProxyUpstream struct {
-	DestinationPartition string `json:",omitempty"`
-	DestinationNamespace string `json:",omitempty"`
-	DestinationPeer      string `json:",omitempty"`
-	DestinationName      string `json:",omitempty"`
-	Datacenter           string `json:",omitempty"`
-	LocalBindPort        int    `json:",omitempty"`
+	DestinationType      string            `json:",omitempty"`
+	DestinationPartition string            `json:",omitempty"`
+	DestinationNamespace string            `json:",omitempty"`
+	DestinationPeer      string            `json:",omitempty"`
+	DestinationName      string            `json:",omitempty"`
+	Datacenter           string            `json:",omitempty"`
+	LocalBindPort        int               `json:",omitempty"`
+	MeshGatewayMode      string            `json:",omitempty"`
+	Config               map[string]string `json:",omitempty"`
 }
 
 func (p *CatalogProxy) ToAPI(enterprise bool) *api.CatalogRegistration {
 	r := p.CatalogService.ToAPI(enterprise)
 	r.Service.Kind = api.ServiceKindConnectProxy
+	if p.Kind != "" {
+		r.Service.Kind = api.ServiceKind(p.Kind)
+	}
+	if p.GatewayWANAddress != "" {
+		r.Service.TaggedAddresses = map[string]api.ServiceAddress{
+			"lan": {Address: p.Address, Port: p.Port},
+			"wan": {Address: p.GatewayWANAddress, Port: p.GatewayWANPort},
+		}
+	}
 	r.Service.Proxy = &api.AgentServiceConnectProxyConfig{
 		DestinationServiceName: p.ProxyDestinationServiceName,
 		DestinationServiceID:   p.ProxyDestinationServiceName,
 		LocalServicePort:       p.ProxyLocalServicePort,
+		Config:                 p.ProxyConfig,
 	}
 	for _, u := range p.ProxyUpstreams {
 		newU := api.Upstream{
+			DestinationType: api.UpstreamDestType(u.DestinationType),
 			DestinationName: u.DestinationName,
 			DestinationPeer: u.DestinationPeer,
 			LocalBindPort:   u.LocalBindPort,
 			Datacenter:      u.Datacenter,
+			MeshGateway: api.MeshGatewayConfig{
+				Mode: api.MeshGatewayMode(u.MeshGatewayMode),
+			},
+		}
+		if len(u.Config) > 0 {
+			newU.Config = make(map[string]any, len(u.Config))
+			for k, v := range u.Config {
+				newU.Config[k] = v
+			}
 		}
-		if enterprise {
+		if enterprise && u.DestinationType != string(api.UpstreamDestTypePreparedQuery) {
 			newU.DestinationNamespace = u.DestinationNamespace
 			newU.DestinationPartition = u.DestinationPartition
 		}
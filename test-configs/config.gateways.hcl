@@ -0,0 +1,43 @@
+active = "gateways"
+
+config "gateways" {
+  consul_image = "consul-dev:latest"
+
+  security {
+    initial_master_token = "root"
+    encryption {
+      tls    = true
+      gossip = true
+    }
+  }
+
+  kubernetes {
+    enabled = false
+  }
+
+  envoy {
+    log_level = "debug"
+  }
+
+  topology {
+    network_shape = "flat"
+
+    cluster "dc1" {
+      servers              = 1
+      clients              = 2
+      ingress_gateways     = 1
+      terminating_gateways = 1
+    }
+
+    external_service "legacy" {
+      port        = 9999
+      healthcheck = "/"
+    }
+
+    node "dc1-client1" {
+      upstream {
+        name = "legacy"
+      }
+    }
+  }
+}
@@ -38,14 +38,11 @@ config "prepared-query" {
         version = "v1" // ping
       }
 
-      // this is hacky, we "append" to the list with this weird use of curly braces
-      upstream_extra_hcl = <<EOF
-          },
-          {
-            destination_type = "prepared_query"
-            destination_name = "pong-query"
-            local_bind_port  = 9191
-EOF
+      upstream {
+        destination_type = "prepared_query"
+        name             = "pong-query"
+        local_port       = 9191
+      }
     }
   }
 }
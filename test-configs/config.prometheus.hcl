@@ -25,64 +25,6 @@ config "prometheus" {
     log_level = "info"
   }
 
-  config_entries = [
-    <<EOF
-{
-    "Kind": "proxy-defaults",
-    "Name": "global",
-    "Config": {
-        "protocol": "http"
-    },
-    "MeshGateway": {
-        "Mode": "local"
-    }
-}
-EOF
-    ,
-    # <<EOF
-    # {
-    #   "Kind": "service-resolver",
-    #   "Name": "pong",
-    #   "Redirect": {
-    #       "Datacenter": "dc2"
-    #   }
-    # }
-    # EOF
-    # ,
-    # <<EOF
-    # {
-    #   "Kind": "service-resolver",
-    #   "Name": "ping",
-    #   "Subsets": {
-    #       "v1": {
-    #           "Filter": "Service.Meta.version == v1"
-    #       },
-    #       "v2": {
-    #           "Filter": "Service.Meta.version == v2"
-    #       }
-    #   }
-    # }
-    # EOF
-    # ,
-    # <<EOF
-    # {
-    #   "Kind": "service-splitter",
-    #   "Name": "ping",
-    #   "Splits": [
-    #       {
-    #           "Weight": 50,
-    #           "ServiceSubset": "v1"
-    #       },
-    #       {
-    #           "Weight": 50,
-    #           "ServiceSubset": "v2"
-    #       }
-    #   ]
-    # }
-    # EOF
-    # ,
-  ]
-
   topology {
     network_shape = "flat"
 
@@ -104,11 +46,12 @@ EOF
         version = "v1" // ping
       }
 
-      upstream_extra_hcl = <<EOF
-          config {
-              protocol = "grpc"
-          }
-EOF
+      upstream {
+        name = "pong"
+        config = {
+          protocol = "grpc"
+        }
+      }
     }
 
     node "dc1-client2" {
@@ -153,4 +96,64 @@ EOF
       }
     }
   }
+
+  cluster_config "dc1" {
+    config_entries = [
+      <<EOF
+{
+    "Kind": "proxy-defaults",
+    "Name": "global",
+    "Config": {
+        "protocol": "http"
+    },
+    "MeshGateway": {
+        "Mode": "local"
+    }
+}
+EOF
+      ,
+      # <<EOF
+      # {
+      #   "Kind": "service-resolver",
+      #   "Name": "pong",
+      #   "Redirect": {
+      #       "Datacenter": "dc2"
+      #   }
+      # }
+      # EOF
+      # ,
+      # <<EOF
+      # {
+      #   "Kind": "service-resolver",
+      #   "Name": "ping",
+      #   "Subsets": {
+      #       "v1": {
+      #           "Filter": "Service.Meta.version == v1"
+      #       },
+      #       "v2": {
+      #           "Filter": "Service.Meta.version == v2"
+      #       }
+      #   }
+      # }
+      # EOF
+      # ,
+      # <<EOF
+      # {
+      #   "Kind": "service-splitter",
+      #   "Name": "ping",
+      #   "Splits": [
+      #       {
+      #           "Weight": 50,
+      #           "ServiceSubset": "v1"
+      #       },
+      #       {
+      #           "Weight": 50,
+      #           "ServiceSubset": "v2"
+      #       }
+      #   ]
+      # }
+      # EOF
+      # ,
+    ]
+  }
 }
@@ -80,23 +80,6 @@ config "simple-peering" { # TODO finish
   EOF
       ,
       <<EOF
-{
-  "Kind": "exported-services",
-  "Name": "default",
-  "Services": [
-    {
-      "Name": "ping",
-      "Consumers": [ { "Peer": "peer-dc2" } ]
-    },
-    {
-      "Name": "pong",
-      "Consumers": [ { "Peer": "peer-dc2" } ]
-    }
-  ]
-}
-  EOF
-      ,
-      <<EOF
 {
   "Kind": "service-intentions",
   "Name": "ping",
@@ -153,23 +136,6 @@ config "simple-peering" { # TODO finish
   EOF
       ,
       <<EOF
-{
-  "Kind": "exported-services",
-  "Name": "default",
-  "Services": [
-    {
-      "Name": "ping",
-      "Consumers": [ { "Peer": "peer-dc1" } ]
-    },
-    {
-      "Name": "pong",
-      "Consumers": [ { "Peer": "peer-dc1" } ]
-    }
-  ]
-}
-  EOF
-      ,
-      <<EOF
 {
   "Kind": "service-intentions",
   "Name": "ping",
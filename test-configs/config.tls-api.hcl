@@ -26,22 +26,6 @@ config "tls-api" {
     enabled = false
   }
 
-  # "MeshGateway": {
-  #     "Mode":"local"
-  # },
-  config_entries = [
-    <<EOF
-  {
-    "Kind": "proxy-defaults",
-    "Name": "global",
-    "Config": {
-        "protocol": "http"
-    }
-  }
-  EOF
-    ,
-  ]
-
   topology {
     network_shape = "flat"
 
@@ -110,4 +94,22 @@ config "tls-api" {
       }
     }
   }
+
+  cluster_config "dc1" {
+    # "MeshGateway": {
+    #     "Mode":"local"
+    # },
+    config_entries = [
+      <<EOF
+  {
+    "Kind": "proxy-defaults",
+    "Name": "global",
+    "Config": {
+        "protocol": "http"
+    }
+  }
+  EOF
+      ,
+    ]
+  }
 }
@@ -25,27 +25,10 @@ config "wanfed-mgw" {
     enabled = false
   }
 
-  config_entries = [
-    <<EOF
-  {
-    "Kind": "proxy-defaults",
-    "Name": "global",
-    "MeshGateway": {
-        "Mode":"local"
-    },
-    "Config": {
-        "protocol": "http"
-    }
-  }
-EOF
-    ,
-  ]
-
   topology {
     # network_shape = "flat"
     network_shape = "islands"
 
-
     cluster "dc1" {
       servers = 3
       clients = 8
@@ -111,4 +94,22 @@ EOF
       }
     }
   }
+
+  cluster_config "dc1" {
+    config_entries = [
+      <<EOF
+  {
+    "Kind": "proxy-defaults",
+    "Name": "global",
+    "MeshGateway": {
+        "Mode":"local"
+    },
+    "Config": {
+        "protocol": "http"
+    }
+  }
+EOF
+      ,
+    ]
+  }
 }
@@ -4,40 +4,34 @@ set -euo pipefail
 
 unset CDPATH
 
-cd "$(dirname "$0")"
+# Run from the top of the repository so that devconsul finds its Dockerfiles
+# and boot scripts. Every config in here shares the cache, terraform state, and
+# docker.tf in this directory, so the cases run one at a time and each one is
+# torn down before the next.
+cd "$(dirname "$0")/.."
 
 single_file=""
 if [[ $# -gt 0 ]]; then
     single_file="$1"
 fi
 
-if [[ -f config.hcl ]]; then
+# Any config will do to tear down whatever a prior run left behind, since
+# 'down' removes whatever is in the state no matter which config is used.
+configs=(test-configs/config.*.hcl)
+if [[ -f test-configs/terraform.tfstate ]]; then
     # try to tear down prior run first
-    devconsul down &>/dev/null || true
+    DEVCONSUL_CONFIG="${configs[0]}" devconsul down &>/dev/null || true
 fi
 
-rm -f config.hcl
-
-mkdir -p bin
-cp -f ../bin/clustertool ./bin
-cp -f ../Dockerfile-envoy .
-cp -f ../Dockerfile-cdp .
-cp -f ../Dockerfile-tool .
-cp -f ../versions.tf .
-cp -f ../mesh-gateway-sidecar-boot.sh .
-cp -f ../sidecar-boot.sh .
-cp -f ../dataplane-boot.sh .
-
-terraform init
-
 failed=""
-for fn in config.*.hcl; do
+for path in "${configs[@]}"; do
+    fn="$(basename "${path}")"
     if [[ -n "${single_file}" ]]; then
         if [[ "${fn}" != "${single_file}" ]]; then
             continue # skip
         fi
     fi
-    cp -f $fn config.hcl
+    export DEVCONSUL_CONFIG="${path}"
     echo "==== CASE: $fn ===="
     if [[ "config.wanfed-mgw.hcl" = "${fn}" ]]; then
         devconsul primary || {
@@ -62,16 +56,11 @@ for fn in config.*.hcl; do
     }
 done
 
-rm -f \
-    config.hcl \
-    Dockerfile-envoy \
-    Dockerfile-cdp \
-    Dockerfile-tool \
-    versions.tf \
-    mesh-gateway-sidecar-boot.sh \
-    sidecar-boot.sh \
-    dataplane-boot.sh \
-    bin/clustertool
+rm -rf \
+    test-configs/cache \
+    test-configs/docker.tf \
+    test-configs/terraform.tfstate \
+    test-configs/terraform.tfstate.backup
 
 echo "========================="
 if [[ -n "${failed}" ]]; then